@@ -1,26 +1,162 @@
 package main
 
 import (
+	"flag"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"sensor-api/internal/api"
+	"sensor-api/internal/auth"
+	"sensor-api/internal/events"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/geofence"
+	"sensor-api/internal/ratelimit"
 	"sensor-api/internal/store"
+	"sensor-api/internal/webhook"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
+	distance := flag.String("distance", "haversine", "distance function for spatial queries: haversine or vincenty")
+	index := flag.String("index", "rtree", "spatial index for sensor locations: rtree or quadtree")
+	backend := flag.String("store", "memory", "sensor store backend: memory, or file or bolt to persist sensors to -data-dir")
+	dataDir := flag.String("data-dir", "data", "directory holding the file store's log and snapshot, or the bolt store's database")
+	eventBuffer := flag.Int("event-buffer", events.DefaultBufferSize, "number of recent changes kept for change feed clients to resume from")
+	snapshotInterval := flag.Int("snapshot-interval", store.DefaultSnapshotInterval, "number of logged changes between file store snapshots")
+	authConfig := flag.String("auth-config", "", "JSON file of API keys and JWT keys to authenticate requests with; requests are not authenticated if unset")
+	rateLimitConfig := flag.String("rate-limit-config", "", "JSON file of per-client rate limits and daily quotas, reloaded on SIGHUP; requests are not limited if unset")
+	logFormat := flag.String("log-format", "text", "format of the application log: text or json; the access log is always JSON")
+	flag.Parse()
+
 	log.SetLevel(log.DebugLevel)
+	switch *logFormat {
+	case "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.Fatal("Unknown log format: ", *logFormat)
+	}
+	// the access log has a line per request, written to standard output apart from the application log
+	accessLog := log.New()
+	accessLog.SetOutput(os.Stdout)
+	accessLog.SetFormatter(&log.JSONFormatter{})
+
+	var distanceFunc geo.DistanceFunc
+	switch *distance {
+	case "haversine":
+		distanceFunc = geo.HaversineDistance
+	case "vincenty":
+		distanceFunc = geo.VincentyDistance
+	default:
+		log.Fatal("Unknown distance function: ", *distance)
+	}
+	opts := []store.Option{store.WithDistanceFunc(distanceFunc)}
+	switch *index {
+	case "rtree":
+		opts = append(opts, store.WithSpatialIndex(store.NewRTreeIndex()))
+	case "quadtree":
+		opts = append(opts, store.WithSpatialIndex(store.NewQuadtreeIndex()))
+	default:
+		log.Fatal("Unknown spatial index: ", *index)
+	}
 
-	sensorStore := store.NewInMemorySensorStore()
-	sensorAPI := api.NewSensorAPI(sensorStore)
+	var sensorStore store.SensorStore
+	switch *backend {
+	case "memory":
+		sensorStore = store.NewInMemorySensorStore(opts...)
+	case "file":
+		fileStore, err := store.NewFileSensorStore(*dataDir, *snapshotInterval, opts...)
+		if err != nil {
+			log.Fatal("Failed to open file store: ", err)
+		}
+		sensorStore = fileStore
+	case "bolt":
+		if err := os.MkdirAll(*dataDir, 0o755); err != nil {
+			log.Fatal("Failed to create data directory: ", err)
+		}
+		boltStore, err := store.NewBoltSensorStore(filepath.Join(*dataDir, "sensors.db"), distanceFunc)
+		if err != nil {
+			log.Fatal("Failed to open bolt store: ", err)
+		}
+		sensorStore = boltStore
+	default:
+		log.Fatal("Unknown store backend: ", *backend)
+	}
+	apiOpts := []api.Option{api.WithDistanceFunc(distanceFunc)}
+	if source, ok := sensorStore.(store.EventSource); ok {
+		broker := events.NewBroker(*eventBuffer, events.DefaultSubscriberBuffer)
+		// the monitor passes the store's events on to the broker, each update followed by its geofence alerts
+		monitor := geofence.NewMonitor(broker, distanceFunc, 0)
+		source.SetEventSink(monitor)
+		dispatcher := webhook.NewDispatcher(broker, webhook.DefaultOptions)
+		dispatcher.Start()
+		apiOpts = append(apiOpts, api.WithEvents(broker), api.WithWebhooks(dispatcher), api.WithGeofences(monitor))
+	}
+	sensorAPI := api.NewSensorAPI(sensorStore, apiOpts...)
+	var authenticator *auth.Authenticator
+	if *authConfig != "" {
+		var err error
+		authenticator, err = auth.LoadConfig(*authConfig)
+		if err != nil {
+			log.Fatal("Failed to load auth config: ", err)
+		}
+	} else {
+		log.Warn("No -auth-config given, requests are not authenticated")
+	}
+	var limiter *ratelimit.Limiter
+	if *rateLimitConfig != "" {
+		config, err := ratelimit.LoadConfig(*rateLimitConfig)
+		if err != nil {
+			log.Fatal("Failed to load rate limit config: ", err)
+		}
+		limiter = ratelimit.NewLimiter(config)
+		go reloadRateLimits(limiter, *rateLimitConfig)
+	}
+	// handle registers a handler for a route, logging its requests, authenticating them and limiting
+	// their rate by policy
+	handle := func(route string, policy auth.Policy, h http.Handler) {
+		http.Handle(route, api.AccessLogMiddleware(accessLog, route, api.AuthMiddleware(authenticator, limiter, policy, api.RateLimitMiddleware(limiter, policy, h))))
+	}
 	timeout := 5 * time.Second
-	http.Handle("/sensors", api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.SensorsHandler)))
-	http.Handle("/sensors/", api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.SensorHandler)))
-	http.Handle("/sensors/nearest", api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.NearestSensorHandler)))
-	http.Handle("/sensors/tags", api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.TagsHandler)))
-	http.Handle("/sensors/locations", api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.LocationsHandler)))
+	handle("/sensors", auth.ReadWrite, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.SensorsHandler)))
+	handle("/sensors/", auth.ReadWrite, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.SensorHandler)))
+	handle("/sensors/nearest", auth.ReadOnly, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.NearestSensorHandler)))
+	handle("/sensors/within", auth.ReadOnly, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.SensorsWithinHandler)))
+	handle("/sensors/near", auth.ReadOnly, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.SensorsNearHandler)))
+	handle("/sensors/search/polygon", auth.ReadOnly, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.PolygonSearchHandler)))
+	handle("/sensors/aggregate", auth.ReadOnly, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.AggregateHandler)))
+	handle("/sensors/tags", auth.ReadOnly, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.TagsHandler)))
+	handle("/sensors/locations", auth.ReadOnly, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.LocationsHandler)))
+	handle("/sensors/import", auth.ReadWrite, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.ImportHandler)))
+	handle("/sensors/export", auth.ReadOnly, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.ExportHandler)))
+	handle("/webhooks", auth.AdminOnly, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.WebhooksHandler)))
+	handle("/webhooks/", auth.AdminOnly, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.WebhookHandler)))
+	handle("/geofences", auth.ReadAdmin, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.GeofencesHandler)))
+	handle("/geofences/", auth.ReadAdmin, api.TimeoutMiddleware(timeout, http.HandlerFunc(sensorAPI.GeofenceHandler)))
+	// the change feed and live queries stream for as long as the client stays connected, so they have no timeout
+	handle("/sensors/events", auth.ReadOnly, http.HandlerFunc(sensorAPI.EventsHandler))
+	handle("/sensors/live", auth.ReadOnly, http.HandlerFunc(sensorAPI.LiveHandler))
 
 	log.Info("Listening on port 8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
+
+// reloadRateLimits reloads the rate limit config at path into limiter whenever the process receives
+// SIGHUP, keeping the current limits if the config is invalid.
+func reloadRateLimits(limiter *ratelimit.Limiter, path string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		config, err := ratelimit.LoadConfig(path)
+		if err != nil {
+			log.Error("Failed to reload rate limit config: ", err)
+			continue
+		}
+		limiter.SetConfig(config)
+		log.Info("Reloaded rate limit config from ", path)
+	}
+}
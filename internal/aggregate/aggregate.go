@@ -0,0 +1,155 @@
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"sensor-api/internal/model"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxBuckets limits the number of buckets a single aggregation can produce.
+const MaxBuckets = 10000
+
+// Bucket holds the aggregated values of the readings in [Start, Start+window).
+// Values is empty when the bucket has no readings.
+type Bucket struct {
+	Start  time.Time          `json:"start"`
+	Count  int                `json:"count"`
+	Values map[string]float64 `json:"values,omitempty"`
+}
+
+// Func is an aggregate function over the values in a bucket.
+type Func struct {
+	name string
+	// apply is called with the values of a non-empty bucket in ascending order
+	apply func(sorted []float64) float64
+}
+
+func (f Func) String() string {
+	return f.name
+}
+
+var funcs = map[string]func(sorted []float64) float64{
+	"count": func(sorted []float64) float64 { return float64(len(sorted)) },
+	"min":   func(sorted []float64) float64 { return sorted[0] },
+	"max":   func(sorted []float64) float64 { return sorted[len(sorted)-1] },
+	"sum":   sum,
+	"avg":   func(sorted []float64) float64 { return sum(sorted) / float64(len(sorted)) },
+}
+
+// ParseFuncs parses a comma separated list of aggregate functions: count, min, max, sum, avg, or a
+// percentile from p0 to p100 such as p95 or p99.9.
+func ParseFuncs(s string) ([]Func, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, fmt.Errorf("no functions given")
+	}
+
+	var result []Func
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if apply, ok := funcs[name]; ok {
+			result = append(result, Func{name: name, apply: apply})
+			continue
+		}
+
+		p, err := strconv.ParseFloat(strings.TrimPrefix(name, "p"), 64)
+		if !strings.HasPrefix(name, "p") || err != nil || !(p >= 0 && p <= 100) {
+			return nil, fmt.Errorf("unknown function %q", name)
+		}
+		result = append(result, Func{name: name, apply: func(sorted []float64) float64 {
+			return percentile(sorted, p)
+		}})
+	}
+	return result, nil
+}
+
+// Aggregate groups readings into buckets of the given window and applies each function to the values
+// in every bucket. Buckets are aligned to multiples of the window since the zero time, so that the
+// buckets of different queries line up, and are contiguous from the bucket holding from to the one
+// holding the end of to. A zero from or to is taken from the earliest or latest reading.
+// The readings need not be sorted.
+func Aggregate(readings []model.Reading, window time.Duration, from, to time.Time, fns []Func) ([]Bucket, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("window must be positive")
+	}
+	if len(readings) == 0 && (from.IsZero() || to.IsZero()) {
+		return []Bucket{}, nil
+	}
+
+	if from.IsZero() || to.IsZero() {
+		first, last := readings[0].Timestamp, readings[0].Timestamp
+		for _, reading := range readings[1:] {
+			if reading.Timestamp.Before(first) {
+				first = reading.Timestamp
+			}
+			if reading.Timestamp.After(last) {
+				last = reading.Timestamp
+			}
+		}
+		if from.IsZero() {
+			from = first
+		}
+		if to.IsZero() {
+			// to is exclusive, so step past the last reading
+			to = last.Add(1)
+		}
+	}
+	if !to.After(from) {
+		return []Bucket{}, nil
+	}
+
+	start := from.Truncate(window)
+	// index of the bucket holding the instant just before to, as to is exclusive
+	n := int(to.Add(-1).Sub(start)/window) + 1
+	if n > MaxBuckets {
+		return nil, fmt.Errorf("window is too small: %d buckets exceeds the limit of %d", n, MaxBuckets)
+	}
+
+	values := make([][]float64, n)
+	for _, reading := range readings {
+		if reading.Timestamp.Before(from) || !reading.Timestamp.Before(to) {
+			continue
+		}
+		i := int(reading.Timestamp.Sub(start) / window)
+		values[i] = append(values[i], reading.Value)
+	}
+
+	buckets := make([]Bucket, n)
+	for i := range buckets {
+		buckets[i] = Bucket{
+			Start: start.Add(time.Duration(i) * window),
+			Count: len(values[i]),
+		}
+		if len(values[i]) == 0 {
+			continue
+		}
+		sort.Float64s(values[i])
+		buckets[i].Values = make(map[string]float64, len(fns))
+		for _, fn := range fns {
+			buckets[i].Values[fn.name] = fn.apply(values[i])
+		}
+	}
+	return buckets, nil
+}
+
+func sum(values []float64) float64 {
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+// percentile interpolates linearly between the two closest ranks of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	fraction := rank - float64(lower)
+	return sorted[lower] + fraction*(sorted[lower+1]-sorted[lower])
+}
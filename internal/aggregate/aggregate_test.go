@@ -0,0 +1,84 @@
+package aggregate
+
+import (
+	"sensor-api/internal/model"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFuncs(t *testing.T) {
+	fns, err := ParseFuncs("avg, MAX,p95,p99.9,count")
+	assert.NoError(t, err)
+	names := make([]string, len(fns))
+	for i, fn := range fns {
+		names[i] = fn.String()
+	}
+	assert.Equal(t, []string{"avg", "max", "p95", "p99.9", "count"}, names)
+
+	for _, input := range []string{"", "median", "p101", "p-1", "pNaN", "avg,,max"} {
+		_, err := ParseFuncs(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes, seconds int) time.Time {
+		return start.Add(time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second)
+	}
+	// readings out of order, with a gap between 10 and 15 minutes
+	readings := []model.Reading{
+		{Metric: "temperature", Value: 4, Timestamp: at(3, 0)},
+		{Metric: "temperature", Value: 1, Timestamp: at(1, 30)},
+		{Metric: "temperature", Value: 10, Timestamp: at(16, 0)},
+		{Metric: "temperature", Value: 2, Timestamp: at(2, 0)},
+		{Metric: "temperature", Value: 3, Timestamp: at(4, 59)},
+		{Metric: "temperature", Value: 6, Timestamp: at(5, 0)},
+	}
+	fns, err := ParseFuncs("min,max,avg,sum,count,p50,p100")
+	assert.NoError(t, err)
+
+	// Test buckets are aligned to the window and span the readings when no range is given
+	buckets, err := Aggregate(readings, 5*time.Minute, time.Time{}, time.Time{}, fns)
+	assert.NoError(t, err)
+	assert.Equal(t, []Bucket{
+		{Start: at(0, 0), Count: 4, Values: map[string]float64{"min": 1, "max": 4, "avg": 2.5, "sum": 10, "count": 4, "p50": 2.5, "p100": 4}},
+		{Start: at(5, 0), Count: 1, Values: map[string]float64{"min": 6, "max": 6, "avg": 6, "sum": 6, "count": 1, "p50": 6, "p100": 6}},
+		{Start: at(10, 0), Count: 0},
+		{Start: at(15, 0), Count: 1, Values: map[string]float64{"min": 10, "max": 10, "avg": 10, "sum": 10, "count": 1, "p50": 10, "p100": 10}},
+	}, buckets)
+
+	// Test a range keeps only the readings inside it, with from inclusive and to exclusive, and fills
+	// the range with buckets even where there are no readings
+	buckets, err = Aggregate(readings, 10*time.Minute, at(2, 0), at(25, 0), fns[:1])
+	assert.NoError(t, err)
+	assert.Equal(t, []Bucket{
+		{Start: at(0, 0), Count: 4, Values: map[string]float64{"min": 2}},
+		{Start: at(10, 0), Count: 1, Values: map[string]float64{"min": 10}},
+		{Start: at(20, 0), Count: 0},
+	}, buckets)
+
+	buckets, err = Aggregate(readings, 5*time.Minute, at(0, 0), at(5, 0), fns[:1])
+	assert.NoError(t, err)
+	assert.Len(t, buckets, 1)
+
+	// Test percentiles interpolate between ranks
+	fns, err = ParseFuncs("p25,p90")
+	assert.NoError(t, err)
+	buckets, err = Aggregate(readings[:5], time.Hour, time.Time{}, time.Time{}, fns)
+	assert.NoError(t, err)
+	assert.Len(t, buckets, 1)
+	assert.Equal(t, 2.0, buckets[0].Values["p25"])
+	assert.InDelta(t, 7.6, buckets[0].Values["p90"], 1e-9)
+
+	// Test empty input and invalid windows
+	buckets, err = Aggregate(nil, time.Minute, time.Time{}, time.Time{}, fns)
+	assert.NoError(t, err)
+	assert.Empty(t, buckets)
+	_, err = Aggregate(readings, 0, time.Time{}, time.Time{}, fns)
+	assert.Error(t, err)
+	_, err = Aggregate(readings, time.Millisecond, time.Time{}, time.Time{}, fns)
+	assert.Error(t, err)
+}
@@ -0,0 +1,432 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sensor-api/internal/geojson"
+	"sensor-api/internal/model"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sensors are imported and exported in bulk as NDJSON, one sensor object per line; as CSV, with the
+// columns name, lat, lon and tags, the tags separated by semicolons; or as a GeoJSON FeatureCollection
+// of Point features with name and tags properties.
+
+const (
+	formatNDJSON  = "ndjson"
+	formatCSV     = "csv"
+	formatGeoJSON = "geojson"
+
+	// importBatchSize is the number of sensors added to the store at a time, locking it once for each
+	// batch. An atomic import is added as a single batch.
+	importBatchSize = 1000
+	// maxImportLine is the longest NDJSON line an import accepts.
+	maxImportLine = 1 << 20
+	// tagSeparator separates the tags in the tags column of a CSV file.
+	tagSeparator = ";"
+)
+
+// formatTypes maps each bulk format to its media type.
+var formatTypes = map[string]string{
+	formatNDJSON:  "application/x-ndjson",
+	formatCSV:     "text/csv",
+	formatGeoJSON: mediaTypeGeoJSON,
+}
+
+// csvHeader is the header row of an exported CSV file.
+var csvHeader = []string{"name", "lat", "lon", "tags"}
+
+// importResult is the outcome of importing one sensor.
+type importResult struct {
+	// Row numbers the sensors of the import from 1, not counting a CSV header.
+	Row    int    `json:"row"`
+	Name   string `json:"name,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// importReport is the response to an import, with a result for every sensor in it.
+type importReport struct {
+	Added   int            `json:"added"`
+	Failed  int            `json:"failed"`
+	Results []importResult `json:"results"`
+}
+
+// rowError is the error reading a single sensor of an import, which fails only that sensor.
+type rowError struct {
+	err error
+}
+
+func (e rowError) Error() string {
+	return e.err.Error()
+}
+
+// sensorReader reads the sensors of an import in order. Read returns io.EOF after the last sensor,
+// a rowError if a sensor cannot be read but later ones can, and any other error if the import
+// cannot be read further.
+type sensorReader interface {
+	Read() (model.Sensor, error)
+}
+
+// ndjsonReader reads sensors from NDJSON, skipping blank lines.
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+}
+
+func newNDJSONReader(r io.Reader) *ndjsonReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxImportLine)
+	return &ndjsonReader{scanner: scanner}
+}
+
+func (r *ndjsonReader) Read() (model.Sensor, error) {
+	for r.scanner.Scan() {
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var sensor model.Sensor
+		if err := json.Unmarshal(line, &sensor); err != nil {
+			return model.Sensor{}, rowError{err}
+		}
+		return sensor, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return model.Sensor{}, err
+	}
+	return model.Sensor{}, io.EOF
+}
+
+// csvReader reads sensors from CSV, skipping a header row starting with "name".
+type csvReader struct {
+	reader *csv.Reader
+	first  bool
+}
+
+func newCSVReader(r io.Reader) *csvReader {
+	reader := csv.NewReader(r)
+	// rows may leave out the tags column
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	return &csvReader{reader: reader, first: true}
+}
+
+func (r *csvReader) Read() (model.Sensor, error) {
+	record, err := r.reader.Read()
+	if r.first && err == nil && len(record) > 0 && strings.EqualFold(record[0], csvHeader[0]) {
+		record, err = r.reader.Read()
+	}
+	r.first = false
+
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return model.Sensor{}, rowError{err}
+	}
+	if err != nil {
+		return model.Sensor{}, err
+	}
+
+	if len(record) < 3 || len(record) > 4 {
+		return model.Sensor{}, rowError{fmt.Errorf("expected 3 or 4 columns, got %d", len(record))}
+	}
+	sensor := model.Sensor{Name: record[0]}
+	if sensor.Location.Latitude, err = strconv.ParseFloat(record[1], 64); err != nil {
+		return sensor, rowError{fmt.Errorf("invalid latitude %q", record[1])}
+	}
+	if sensor.Location.Longitude, err = strconv.ParseFloat(record[2], 64); err != nil {
+		return sensor, rowError{fmt.Errorf("invalid longitude %q", record[2])}
+	}
+	if len(record) == 4 && record[3] != "" {
+		sensor.Tags = strings.Split(record[3], tagSeparator)
+	}
+	return sensor, nil
+}
+
+// geojsonReader reads sensors from the features of a GeoJSON FeatureCollection.
+type geojsonReader struct {
+	features []json.RawMessage
+}
+
+func newGeoJSONReader(r io.Reader) (*geojsonReader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	features, err := geojson.DecodeFeatureCollection(data)
+	if err != nil {
+		return nil, err
+	}
+	return &geojsonReader{features: features}, nil
+}
+
+func (r *geojsonReader) Read() (model.Sensor, error) {
+	if len(r.features) == 0 {
+		return model.Sensor{}, io.EOF
+	}
+	feature := r.features[0]
+	r.features = r.features[1:]
+	sensor, err := geojson.DecodeSensorFeature(feature)
+	if err != nil {
+		return sensor, rowError{err}
+	}
+	return sensor, nil
+}
+
+// importFormat returns the format of an import, given by the format query parameter or else by the
+// Content-Type header. An unknown format parameter is a bad request, and an unknown Content-Type an
+// unsupported media type.
+func importFormat(r *http.Request) (string, int, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := formatTypes[format]; !ok {
+			return "", http.StatusBadRequest, fmt.Errorf("unsupported format %q", format)
+		}
+		return format, http.StatusOK, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", http.StatusUnsupportedMediaType, fmt.Errorf("missing format: set the format parameter or the Content-Type header")
+	}
+	for format, formatType := range formatTypes {
+		if mediaType == formatType {
+			return format, http.StatusOK, nil
+		}
+	}
+	return "", http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", mediaType)
+}
+
+// newSensorReader returns a reader for an import in the given format.
+func newSensorReader(format string, r io.Reader) (sensorReader, error) {
+	switch format {
+	case formatNDJSON:
+		return newNDJSONReader(r), nil
+	case formatCSV:
+		return newCSVReader(r), nil
+	case formatGeoJSON:
+		return newGeoJSONReader(r)
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+// ImportHandler handles requests to /sensors/import.
+func (api *SensorAPI) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		format, code, err := importFormat(r)
+		if err != nil {
+			logger(r).Error("Failed to get import format: ", err)
+			http.Error(w, fmt.Sprint("Invalid import: ", err), code)
+			return
+		}
+		atomic := false
+		if value := r.URL.Query().Get("atomic"); value != "" {
+			if atomic, err = strconv.ParseBool(value); err != nil {
+				logger(r).Error("Failed to parse atomic from URL: ", err)
+				http.Error(w, "Invalid request: invalid atomic", http.StatusBadRequest)
+				return
+			}
+		}
+		reader, err := newSensorReader(format, r.Body)
+		if err != nil {
+			logger(r).Error("Failed to read import: ", err)
+			http.Error(w, fmt.Sprint("Invalid import: ", err), http.StatusBadRequest)
+			return
+		}
+
+		code, report, err := api.importSensors(r, reader, atomic)
+		if err != nil {
+			logger(r).Error("Failed to import sensors: ", err)
+			http.Error(w, fmt.Sprint("Failed to import sensors: ", err), code)
+			return
+		}
+
+		logger(r).Info("Imported ", report.Added, " sensors, ", report.Failed, " failed")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(report)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// importSensors adds the sensors read from an import to the store in batches, returning the status
+// code and the report to respond with, or an error if the import cannot be read or the store fails.
+// An atomic import that fails adds nothing and responds 400 Bad Request.
+func (api *SensorAPI) importSensors(r *http.Request, reader sensorReader, atomic bool) (int, importReport, error) {
+	report := importReport{Results: []importResult{}}
+	var batch []model.Sensor
+	// rows holds the index in the report of each sensor in the batch
+	var rows []int
+
+	flush := func() (int, error) {
+		results, code, err := api.storeFor(r).AddSensors(batch, atomic)
+		if results == nil && err != nil {
+			return code, err
+		}
+		for i, result := range results {
+			row := &report.Results[rows[i]]
+			row.Status = result.Code
+			if result.Err != nil {
+				row.Error = result.Err.Error()
+			}
+		}
+		batch, rows = batch[:0], rows[:0]
+		return code, nil
+	}
+
+	failed := false
+	for {
+		sensor, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var rowErr rowError
+		if err != nil && !errors.As(err, &rowErr) {
+			return http.StatusBadRequest, report, err
+		}
+
+		result := importResult{Row: len(report.Results) + 1, Name: sensor.Name}
+		if err != nil {
+			result.Status = http.StatusBadRequest
+			result.Error = err.Error()
+			failed = true
+		} else {
+			batch = append(batch, sensor)
+			rows = append(rows, len(report.Results))
+		}
+		report.Results = append(report.Results, result)
+
+		if !atomic && len(batch) == importBatchSize {
+			if code, err := flush(); err != nil {
+				return code, report, err
+			}
+		}
+	}
+
+	code := http.StatusOK
+	if atomic && failed {
+		// a sensor that could not be read fails the whole import without touching the store
+		for _, i := range rows {
+			report.Results[i].Status = http.StatusFailedDependency
+			report.Results[i].Error = "sensor not added: another sensor in the batch failed"
+		}
+		code = http.StatusBadRequest
+	} else if len(batch) > 0 {
+		var err error
+		if code, err = flush(); err != nil {
+			return code, report, err
+		}
+	}
+
+	for _, result := range report.Results {
+		if result.Status == http.StatusCreated {
+			report.Added++
+		} else {
+			report.Failed++
+		}
+	}
+	return code, report, nil
+}
+
+// ExportHandler handles requests to /sensors/export.
+func (api *SensorAPI) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = formatNDJSON
+		}
+		formatType, ok := formatTypes[format]
+		if !ok {
+			logger(r).Error("Unsupported export format: ", format)
+			http.Error(w, fmt.Sprintf("Invalid request: unsupported format %q", format), http.StatusBadRequest)
+			return
+		}
+
+		// if tags is nil, GetSensorsByTags will return all sensors
+		sensors, code, err := api.storeFor(r).GetSensorsByTags(nil)
+		if err != nil && code != http.StatusNotFound {
+			logger(r).Error("Failed to get sensors: ", err)
+			http.Error(w, "Failed to get sensors", code)
+			return
+		}
+		sort.Slice(sensors, func(i, j int) bool { return sensors[i].Name < sensors[j].Name })
+
+		w.Header().Set("Content-Type", formatType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="sensors.%s"`, format))
+		w.WriteHeader(http.StatusOK)
+		if err := writeExport(w, format, sensors); err != nil {
+			logger(r).Error("Failed to write export: ", err)
+		}
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeExport writes sensors in the given format one at a time, so an export is streamed to the
+// client rather than built in memory.
+func writeExport(w io.Writer, format string, sensors []model.Sensor) error {
+	switch format {
+	case formatNDJSON:
+		encoder := json.NewEncoder(w)
+		for _, sensor := range sensors {
+			if err := encoder.Encode(sensor); err != nil {
+				return err
+			}
+		}
+		return nil
+	case formatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write(csvHeader)
+		for _, sensor := range sensors {
+			writer.Write([]string{
+				sensor.Name,
+				strconv.FormatFloat(sensor.Location.Latitude, 'g', -1, 64),
+				strconv.FormatFloat(sensor.Location.Longitude, 'g', -1, 64),
+				strings.Join(sensor.Tags, tagSeparator),
+			})
+		}
+		writer.Flush()
+		return writer.Error()
+	case formatGeoJSON:
+		if _, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`); err != nil {
+			return err
+		}
+		for i, sensor := range sensors {
+			feature, err := json.Marshal(geojson.NewSensorFeature(sensor))
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				feature = append([]byte(","), feature...)
+			}
+			if _, err := w.Write(feature); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, "]}\n")
+		return err
+	}
+	return fmt.Errorf("unsupported format %q", format)
+}
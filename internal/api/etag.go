@@ -0,0 +1,120 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A single sensor's ETag is its version, which the store changes whenever the sensor changes, so
+// PUT and DELETE with If-Match only succeed if the sensor is unchanged since the client read it.
+// Collections are tagged with a weak ETag hashed from the response body, which lets clients poll
+// them with If-None-Match.
+
+// sensorETag returns the strong ETag of a sensor version.
+func sensorETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// geoSensorETag returns the strong ETag of the GeoJSON representation of a sensor version, which is a
+// different entity from its JSON representation.
+func geoSensorETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `-geo"`
+}
+
+// bodyETag returns a weak ETag for a response body.
+func bodyETag(body []byte) string {
+	h := fnv.New64a()
+	h.Write(body)
+	return fmt.Sprintf(`W/"%016x"`, h.Sum64())
+}
+
+// etagList splits an If-Match or If-None-Match header into its entity tags.
+func etagList(header string) []string {
+	var etags []string
+	for _, etag := range strings.Split(header, ",") {
+		if etag = strings.TrimSpace(etag); etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+	return etags
+}
+
+// ifMatch reports whether the If-Match header allows changing a sensor at the given version, in
+// either representation. The comparison is strong, so weak ETags never match. A missing header allows
+// any change.
+func ifMatch(r *http.Request, version uint64) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, etag := range etagList(header) {
+		if etag == "*" || etag == sensorETag(version) || etag == geoSensorETag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// ifNoneMatch reports whether the If-None-Match header lists the ETag, meaning the client's copy is
+// current. The comparison is weak, ignoring the W/ prefix.
+func ifNoneMatch(r *http.Request, etag string) bool {
+	for _, candidate := range etagList(r.Header.Get("If-None-Match")) {
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified tells the client its copy, tagged etag, is current.
+func writeNotModified(w http.ResponseWriter, etag string) {
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// writeTagged writes body as JSON of the given media type, tagged with a weak ETag hashed from it, or
+// 304 Not Modified if the client's copy is current.
+func writeTagged(w http.ResponseWriter, r *http.Request, code int, mediaType string, body interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		logger(r).Error("Failed to encode response: ", err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	etag := bodyETag(buf.Bytes())
+	if ifNoneMatch(r, etag) {
+		writeNotModified(w, etag)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
+
+// matchVersion checks the If-Match header of a request to change the named sensor, returning the
+// version the change must be conditional on, or 0 if there is no header. If the sensor has already
+// changed it writes 412 Precondition Failed and returns false.
+func (api *SensorAPI) matchVersion(w http.ResponseWriter, r *http.Request, name string) (uint64, bool) {
+	if r.Header.Get("If-Match") == "" {
+		return 0, true
+	}
+
+	_, version, code, err := api.storeFor(r).GetSensorVersion(name)
+	if err != nil && code != http.StatusNotFound {
+		logger(r).Error("Failed to get sensor version: ", err)
+		http.Error(w, "Failed to get sensor", code)
+		return 0, false
+	}
+	if err != nil || !ifMatch(r, version) {
+		logger(r).Error("Precondition failed for sensor: ", name)
+		http.Error(w, "Sensor has been modified", http.StatusPreconditionFailed)
+		return 0, false
+	}
+	return version, true
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sensor-api/internal/events"
+	"sensor-api/internal/model"
+	"sensor-api/internal/tagexpr"
+	"strconv"
+	"time"
+)
+
+// The change feed streams the events the store publishes as Server-Sent Events.
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+// Each event carries its ID, so a client that reconnects with the Last-Event-ID header resumes where it
+// left off, for as long as the events it missed are still buffered by the broker. When they are not,
+// the stream starts with a reset event telling the client to reload the sensors.
+
+// heartbeatInterval is how often an idle stream is written to, so that proxies keep it open and a
+// client that has gone away is noticed.
+var heartbeatInterval = 15 * time.Second
+
+// eventFilter selects the events a client is sent: those whose sensor, before or after the change,
+// matches the tag filter and lies inside the bounding box.
+type eventFilter struct {
+	tags tagexpr.Expr
+	// box is nil if the events are not filtered by location
+	box *model.BoundingBox
+}
+
+// parseEventFilter reads the tags and tag_expr query parameters, and a bounding box given by min_lat,
+// max_lat, min_lng and max_lng if any of them is present.
+func parseEventFilter(query url.Values) (eventFilter, error) {
+	var (
+		filter eventFilter
+		err    error
+	)
+	filter.tags, err = parseTagFilter(query)
+	if err != nil {
+		return eventFilter{}, fmt.Errorf("invalid tag_expr: %w", err)
+	}
+	for _, key := range []string{"min_lat", "max_lat", "min_lng", "max_lng"} {
+		if query.Has(key) {
+			box, err := parseBoundingBox(query)
+			if err != nil {
+				return eventFilter{}, err
+			}
+			filter.box = &box
+			break
+		}
+	}
+	return filter, nil
+}
+
+// match reports whether the event is about a sensor the client is interested in.
+func (filter eventFilter) match(event events.Event) bool {
+	return filter.matchSensor(event.Sensor) || filter.matchSensor(event.Previous)
+}
+
+func (filter eventFilter) matchSensor(sensor *model.Sensor) bool {
+	if sensor == nil {
+		return false
+	}
+	if filter.box != nil && !filter.box.Contains(sensor.Location) {
+		return false
+	}
+	return tagexpr.Match(filter.tags, sensor.Tags)
+}
+
+// eventStream writes events to a client.
+type eventStream struct {
+	w      io.Writer
+	filter eventFilter
+	// seen is the ID of the last event considered for the client, and sent the last one written
+	seen, sent uint64
+}
+
+// send writes the event if it matches the client's filter.
+func (stream *eventStream) send(event events.Event) error {
+	stream.seen = event.ID
+	if !stream.filter.match(event) {
+		return nil
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	stream.sent = event.ID
+	_, err = fmt.Fprintf(stream.w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// reset tells the client that events have been missed.
+func (stream *eventStream) reset() error {
+	_, err := fmt.Fprint(stream.w, "event: reset\ndata: events have been missed, reload the sensors\n\n")
+	return err
+}
+
+// heartbeat keeps the stream open. If events have been filtered out since the last one sent, it moves
+// the client's last event ID past them without dispatching an event, so a reconnecting client does not
+// resume from before them.
+func (stream *eventStream) heartbeat() error {
+	if stream.seen > stream.sent {
+		stream.sent = stream.seen
+		_, err := fmt.Fprintf(stream.w, "id: %d\n\n", stream.seen)
+		return err
+	}
+	_, err := fmt.Fprint(stream.w, ": heartbeat\n\n")
+	return err
+}
+
+// EventsHandler handles requests to /sensors/events.
+func (api *SensorAPI) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if api.events == nil {
+			logger(r).Error("Change feed is not enabled")
+			http.Error(w, "Change feed is not enabled", http.StatusNotImplemented)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			logger(r).Error("Response writer does not support streaming")
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		filter, err := parseEventFilter(r.URL.Query())
+		if err != nil {
+			logger(r).Error("Failed to parse event filter from URL: ", err)
+			http.Error(w, fmt.Sprint("Invalid filter: ", err), http.StatusBadRequest)
+			return
+		}
+
+		// browsers cannot set Last-Event-ID on the first connection, so it may also be a query parameter
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("last_event_id")
+		}
+		var (
+			sub     *events.Subscription
+			backlog []events.Event
+			missed  bool
+		)
+		if lastEventID == "" {
+			sub = api.events.Subscribe()
+		} else {
+			lastID, err := strconv.ParseUint(lastEventID, 10, 64)
+			if err != nil {
+				logger(r).Error("Failed to parse Last-Event-ID: ", err)
+				http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+			sub, backlog, missed = api.events.Resume(lastID)
+		}
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		stream := &eventStream{w: w, filter: filter}
+		if missed {
+			if err := stream.reset(); err != nil {
+				return
+			}
+		}
+		for _, event := range backlog {
+			if err := stream.send(event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			var err error
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-sub.Events:
+				if !ok {
+					// the client fell too far behind and was dropped; it resumes from the buffer when it reconnects
+					logger(r).Info("Closing change feed for slow client ", r.RemoteAddr)
+					return
+				}
+				err = stream.send(event)
+			case <-ticker.C:
+				err = stream.heartbeat()
+			}
+			if err != nil {
+				logger(r).Debug("Failed to write event: ", err)
+				return
+			}
+			flusher.Flush()
+		}
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sensor-api/internal/geofence"
+	"strconv"
+	"strings"
+)
+
+// WithGeofences manages geofences and their alerts through monitor, which the store should publish its
+// changes to.
+func WithGeofences(monitor *geofence.Monitor) Option {
+	return func(api *SensorAPI) {
+		api.geofences = monitor
+	}
+}
+
+// geofencesEnabled writes 501 Not Implemented if geofences are not enabled.
+func (api *SensorAPI) geofencesEnabled(w http.ResponseWriter, r *http.Request) bool {
+	if api.geofences == nil {
+		logger(r).Error("Geofences are not enabled")
+		http.Error(w, "Geofences are not enabled", http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+// decodeFence decodes a geofence from a request body, rejecting unknown fields.
+func decodeFence(r *http.Request) (geofence.Fence, error) {
+	var fence geofence.Fence
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&fence)
+	return fence, err
+}
+
+// GeofencesHandler handles requests to /geofences.
+func (api *SensorAPI) GeofencesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if !api.geofencesEnabled(w, r) {
+			return
+		}
+		fences, code, err := api.geofences.GetFences()
+		if err != nil {
+			logger(r).Error("Failed to get geofences: ", err)
+			http.Error(w, fmt.Sprint("Failed to get geofences: ", err), code)
+			return
+		}
+
+		writeJSON(w, code, mediaTypeJSON, fences)
+	case http.MethodPost:
+		if !api.geofencesEnabled(w, r) {
+			return
+		}
+		fence, err := decodeFence(r)
+		if err != nil {
+			logger(r).Error("Failed to decode geofence: ", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		fence, code, err := api.geofences.AddFence(fence)
+		if err != nil {
+			logger(r).Error("Failed to add geofence: ", err)
+			http.Error(w, fmt.Sprint("Failed to add geofence: ", err), code)
+			return
+		}
+
+		w.Header().Set("Location", "/geofences/"+fence.ID)
+		writeJSON(w, code, mediaTypeJSON, fence)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// GeofenceHandler handles requests to /geofences/{id}.
+func (api *SensorAPI) GeofenceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/geofences/alerts" {
+		api.GeofenceAlertsHandler(w, r)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/geofences/")
+	switch r.Method {
+	case http.MethodGet:
+		if !api.geofencesEnabled(w, r) {
+			return
+		}
+		fence, code, err := api.geofences.GetFence(id)
+		if err != nil {
+			logger(r).Error("Failed to get geofence: ", err)
+			http.Error(w, fmt.Sprint("Failed to get geofence: ", err), code)
+			return
+		}
+
+		writeJSON(w, code, mediaTypeJSON, fence)
+	case http.MethodPut:
+		if !api.geofencesEnabled(w, r) {
+			return
+		}
+		fence, err := decodeFence(r)
+		if err != nil {
+			logger(r).Error("Failed to decode geofence: ", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		fence, code, err := api.geofences.UpdateFence(id, fence)
+		if err != nil {
+			logger(r).Error("Failed to update geofence: ", err)
+			http.Error(w, fmt.Sprint("Failed to update geofence: ", err), code)
+			return
+		}
+
+		writeJSON(w, code, mediaTypeJSON, fence)
+	case http.MethodDelete:
+		if !api.geofencesEnabled(w, r) {
+			return
+		}
+		code, err := api.geofences.RemoveFence(id)
+		if err != nil {
+			logger(r).Error("Failed to remove geofence: ", err)
+			http.Error(w, fmt.Sprint("Failed to remove geofence: ", err), code)
+			return
+		}
+
+		w.WriteHeader(code)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, PUT, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// GeofenceAlertsHandler handles requests to /geofences/alerts, optionally filtered by the geofence and
+// sensor query parameters, and by after to return only the alerts since the alert with that ID.
+func (api *SensorAPI) GeofenceAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if !api.geofencesEnabled(w, r) {
+			return
+		}
+		q := geofence.AlertQuery{
+			Geofence: r.URL.Query().Get("geofence"),
+			Sensor:   r.URL.Query().Get("sensor"),
+		}
+		if after := r.URL.Query().Get("after"); after != "" {
+			id, err := strconv.ParseUint(after, 10, 64)
+			if err != nil {
+				logger(r).Error("Invalid after parameter: ", err)
+				http.Error(w, "Invalid after parameter", http.StatusBadRequest)
+				return
+			}
+			q.After = id
+		}
+
+		alerts, code, err := api.geofences.GetAlerts(q)
+		if err != nil {
+			logger(r).Error("Failed to get geofence alerts: ", err)
+			http.Error(w, fmt.Sprint("Failed to get geofence alerts: ", err), code)
+			return
+		}
+
+		writeJSON(w, code, mediaTypeJSON, alerts)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
@@ -3,93 +3,407 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"sensor-api/internal/aggregate"
+	"sensor-api/internal/events"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/geofence"
+	"sensor-api/internal/geojson"
 	"sensor-api/internal/model"
+	"sensor-api/internal/query"
 	"sensor-api/internal/store"
+	"sensor-api/internal/tagexpr"
+	"sensor-api/internal/webhook"
 	"strconv"
 	"strings"
-
-	log "github.com/sirupsen/logrus"
+	"time"
 )
 
 type SensorAPI struct {
 	store store.SensorStore
+	// events feeds the change feed, which is disabled if it is nil
+	events *events.Broker
+	// webhooks delivers changes to webhooks, which are disabled if it is nil
+	webhooks *webhook.Dispatcher
+	// geofences checks updates against geofences, which are disabled if it is nil
+	geofences *geofence.Monitor
+	// distance measures distances for listings sorted by distance, as the store measures them
+	distance geo.DistanceFunc
+}
+
+// Option configures a SensorAPI.
+type Option func(*SensorAPI)
+
+// WithEvents serves the change feed from broker, which the store should publish its changes to.
+func WithEvents(broker *events.Broker) Option {
+	return func(api *SensorAPI) {
+		api.events = broker
+	}
+}
+
+// WithDistanceFunc sorts listings by distance with the function the store measures distances with.
+// The default is geo.HaversineDistance, as for the stores.
+func WithDistanceFunc(distance geo.DistanceFunc) Option {
+	return func(api *SensorAPI) {
+		api.distance = distance
+	}
 }
 
 // NewSensorAPI creates a new SensorAPI.
-func NewSensorAPI(store store.SensorStore) *SensorAPI {
-	return &SensorAPI{
-		store: store,
+func NewSensorAPI(store store.SensorStore, opts ...Option) *SensorAPI {
+	api := &SensorAPI{
+		store:    store,
+		distance: geo.HaversineDistance,
+	}
+	for _, opt := range opts {
+		opt(api)
 	}
+	return api
+}
+
+// storeFor returns the store, logging with the logger of r so that the store's failures carry its
+// request ID.
+func (api *SensorAPI) storeFor(r *http.Request) store.SensorStore {
+	return store.WithLogger(api.store, logger(r))
+}
+
+// Sub-resources of a sensor, at /sensors/{name}/{resource}.
+const (
+	resourceReadings  = "readings"
+	resourceAggregate = "readings/aggregate"
+)
+
+// sensorPath splits the path of a request to /sensors/{name}[/{resource}] into the sensor name and
+// sub-resource, if any. It splits the escaped path, so a name that ends like a sub-resource, such as
+// "floor/readings", is reached by escaping its slashes as %2F; other names may leave them unescaped.
+func sensorPath(r *http.Request) (name, resource string, err error) {
+	escaped := strings.TrimPrefix(r.URL.EscapedPath(), "/sensors/")
+	for _, sub := range []string{resourceAggregate, resourceReadings} {
+		if strings.HasSuffix(escaped, "/"+sub) {
+			escaped, resource = strings.TrimSuffix(escaped, "/"+sub), sub
+			break
+		}
+	}
+	name, err = url.PathUnescape(escaped)
+	return name, resource, err
 }
 
 // SensorHandler handles requests to /sensors/{name}.
 func (api *SensorAPI) SensorHandler(w http.ResponseWriter, r *http.Request) {
+	name, resource, err := sensorPath(r)
+	if err != nil {
+		logger(r).Error("Failed to parse sensor name from URL: ", err)
+		http.Error(w, fmt.Sprint("Invalid sensor name: ", err), http.StatusBadRequest)
+		return
+	}
+	switch resource {
+	case resourceAggregate:
+		api.ReadingsAggregateHandler(w, r)
+		return
+	case resourceReadings:
+		api.ReadingsHandler(w, r)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
-		path := r.URL.Path
-		name := strings.TrimPrefix(path, "/sensors/")
-		sensor, code, err := api.store.GetSensor(name)
+		sensor, version, code, err := api.storeFor(r).GetSensorVersion(name)
 		if err != nil {
-			log.Error("Failed to get sensor: ", err)
+			logger(r).Error("Failed to get sensor: ", err)
 			http.Error(w, "Failed to get sensor", code)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(code)
-		json.NewEncoder(w).Encode(sensor)
+		etag := sensorETag(version)
+		if wantsGeoJSON(r) {
+			etag = geoSensorETag(version)
+		}
+		varyAccept(w)
+		if ifNoneMatch(r, etag) {
+			writeNotModified(w, etag)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		writeSensor(w, r, code, sensor)
 	case http.MethodPut:
-		path := r.URL.Path
-		name := strings.TrimPrefix(path, "/sensors/")
-		var updatedSensor model.Sensor
-		err := json.NewDecoder(r.Body).Decode(&updatedSensor)
+		updatedSensor, err := decodeSensor(r)
 		if err != nil {
-			log.Error("Failed to decode request body: ", err)
+			logger(r).Error("Failed to decode request body: ", err)
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		code, err := api.store.UpdateSensor(name, &updatedSensor)
+		version, ok := api.matchVersion(w, r, name)
+		if !ok {
+			return
+		}
+		code, err := api.storeFor(r).UpdateSensorIfMatch(name, &updatedSensor, version)
 		if err != nil {
-			log.Error("Failed to update sensor: ", err)
+			logger(r).Error("Failed to update sensor: ", err)
 			http.Error(w, fmt.Sprint("Failed to update sensor: ", err), code)
 			return
 		}
-		log.Info("Updated sensor: ", updatedSensor)
+		logger(r).Info("Updated sensor: ", updatedSensor)
+		w.WriteHeader(code)
+	case http.MethodPatch:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger(r).Error("Failed to read request body: ", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		patch, code, err := parsePatch(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			logger(r).Error("Failed to parse patch: ", err)
+			w.Header().Set("Accept-Patch", acceptPatch)
+			http.Error(w, fmt.Sprint("Invalid patch: ", err), code)
+			return
+		}
+
+		version, ok := api.matchVersion(w, r, name)
+		if !ok {
+			return
+		}
+		code, err = api.storeFor(r).PatchSensor(name, sensorPatch(patch), version)
+		if err != nil {
+			logger(r).Error("Failed to patch sensor: ", err)
+			http.Error(w, fmt.Sprint("Failed to patch sensor: ", err), code)
+			return
+		}
+		logger(r).Info("Patched sensor: ", name)
 		w.WriteHeader(code)
 	case http.MethodDelete:
-		path := r.URL.Path
-		name := strings.TrimPrefix(path, "/sensors/")
-		code, err := api.store.RemoveSensor(name)
+		version, ok := api.matchVersion(w, r, name)
+		if !ok {
+			return
+		}
+		code, err := api.storeFor(r).RemoveSensorIfMatch(name, version)
 		if err != nil {
-			log.Error("Failed to remove sensor: ", err)
+			logger(r).Error("Failed to remove sensor: ", err)
 			http.Error(w, fmt.Sprint("Failed to remove sensor: ", err), code)
 			return
 		}
 
 		w.WriteHeader(code)
 	case http.MethodOptions:
-		w.Header().Set("Allow", "GET, PUT, DELETE, OPTIONS")
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Accept-Patch", acceptPatch)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// ReadingsHandler handles requests to /sensors/{name}/readings.
+func (api *SensorAPI) ReadingsHandler(w http.ResponseWriter, r *http.Request) {
+	readingStore, ok := api.storeFor(r).(store.ReadingStore)
+	if !ok {
+		logger(r).Error("Store does not support readings")
+		http.Error(w, "Readings are not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	name, _, err := sensorPath(r)
+	if err != nil {
+		logger(r).Error("Failed to parse sensor name from URL: ", err)
+		http.Error(w, fmt.Sprint("Invalid sensor name: ", err), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		from, to, err := parseTimeRange(r.URL.Query())
+		if err != nil {
+			logger(r).Error("Failed to parse time range from URL: ", err)
+			http.Error(w, fmt.Sprint("Invalid time range: ", err), http.StatusBadRequest)
+			return
+		}
+
+		readings, code, err := readingStore.GetReadings(name, from, to, r.URL.Query().Get("metric"))
+		if err != nil {
+			logger(r).Error("Failed to get readings: ", err)
+			http.Error(w, fmt.Sprint("Failed to get readings: ", err), code)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(readings)
+	case http.MethodPost:
+		// the body is either a single reading or an array of readings
+		var body json.RawMessage
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			logger(r).Error("Failed to decode request body: ", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var readings []model.Reading
+		if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+			err = json.Unmarshal(body, &readings)
+		} else {
+			readings = make([]model.Reading, 1)
+			err = json.Unmarshal(body, &readings[0])
+		}
+		if err != nil {
+			logger(r).Error("Failed to decode readings: ", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		code, err := readingStore.AddReadings(name, readings)
+		if err != nil {
+			logger(r).Error("Failed to add readings: ", err)
+			http.Error(w, fmt.Sprint("Failed to add readings: ", err), code)
+			return
+		}
+
+		logger(r).Debug("Added ", len(readings), " readings to sensor: ", name)
+		w.WriteHeader(code)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// ReadingsAggregateHandler handles requests to /sensors/{name}/readings/aggregate.
+func (api *SensorAPI) ReadingsAggregateHandler(w http.ResponseWriter, r *http.Request) {
+	readingStore, ok := api.storeFor(r).(store.ReadingStore)
+	if !ok {
+		logger(r).Error("Store does not support readings")
+		http.Error(w, "Readings are not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	name, _, err := sensorPath(r)
+	if err != nil {
+		logger(r).Error("Failed to parse sensor name from URL: ", err)
+		http.Error(w, fmt.Sprint("Invalid sensor name: ", err), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		agg, err := parseAggregation(r.URL.Query())
+		if err != nil {
+			logger(r).Error("Failed to parse aggregation from URL: ", err)
+			http.Error(w, fmt.Sprint("Invalid aggregation: ", err), http.StatusBadRequest)
+			return
+		}
+
+		readings, code, err := readingStore.GetReadings(name, agg.from, agg.to, agg.metric)
+		if err != nil {
+			logger(r).Error("Failed to get readings: ", err)
+			http.Error(w, fmt.Sprint("Failed to get readings: ", err), code)
+			return
+		}
+
+		api.writeAggregation(w, r, readings, agg)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// AggregateHandler handles requests to /sensors/aggregate, aggregating the readings of every sensor
+// matching q, or tags and tag_expr.
+func (api *SensorAPI) AggregateHandler(w http.ResponseWriter, r *http.Request) {
+	readingStore, ok := api.storeFor(r).(store.ReadingStore)
+	if !ok {
+		logger(r).Error("Store does not support readings")
+		http.Error(w, "Readings are not supported by this store", http.StatusNotImplemented)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		agg, err := parseAggregation(r.URL.Query())
+		if err != nil {
+			logger(r).Error("Failed to parse aggregation from URL: ", err)
+			http.Error(w, fmt.Sprint("Invalid aggregation: ", err), http.StatusBadRequest)
+			return
+		}
+
+		var q query.Expr
+		if r.URL.Query().Has("q") {
+			if r.URL.Query().Has("tags") || r.URL.Query().Has("tag_expr") {
+				logger(r).Error("Query combined with tags or tag_expr")
+				http.Error(w, "q cannot be combined with tags or tag_expr", http.StatusBadRequest)
+				return
+			}
+			q, err = query.Parse(r.URL.Query().Get("q"))
+			if err != nil {
+				logger(r).Error("Failed to parse query from URL: ", err)
+				http.Error(w, fmt.Sprint("Invalid q: ", err), http.StatusBadRequest)
+				return
+			}
+		} else {
+			filter, err := parseTagFilter(r.URL.Query())
+			if err != nil {
+				logger(r).Error("Failed to parse tag expression from URL: ", err)
+				http.Error(w, fmt.Sprint("Invalid tag_expr: ", err), http.StatusBadRequest)
+				return
+			}
+			// the tags pick sensors through the tag index, just as they would in a query
+			q = query.FromTagExpr(filter)
+		}
+
+		readings, code, err := readingStore.QueryReadings(q, agg.from, agg.to, agg.metric)
+		if err != nil {
+			logger(r).Error("Failed to get readings: ", err)
+			http.Error(w, fmt.Sprint("Failed to get readings: ", err), code)
+			return
+		}
+
+		api.writeAggregation(w, r, readings, agg)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
 		w.WriteHeader(http.StatusOK)
 	case http.MethodHead:
 		w.WriteHeader(http.StatusOK)
 	default:
-		log.Error("Invalid HTTP request method: ", r.Method)
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 	}
 }
 
+// writeAggregation writes the readings aggregated into buckets.
+func (api *SensorAPI) writeAggregation(w http.ResponseWriter, r *http.Request, readings []model.Reading, agg aggregation) {
+	buckets, err := aggregate.Aggregate(readings, agg.window, agg.from, agg.to, agg.fns)
+	if err != nil {
+		logger(r).Error("Failed to aggregate readings: ", err)
+		http.Error(w, fmt.Sprint("Invalid aggregation: ", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(buckets)
+}
+
 // SensorHandler handles requests to /sensors/{name}.
 func (api *SensorAPI) SensorsHandler(w http.ResponseWriter, r *http.Request) {
-	log.Debug("request URI: ", r.RequestURI)
+	logger(r).Debug("request URI: ", r.RequestURI)
 	switch r.Method {
 	case http.MethodGet:
 		if r.URL.Query().Get("count") == "true" {
 			// an optional parameter to get the number of sensors
-			count, code, err := api.store.GetSensorCount()
+			count, code, err := api.storeFor(r).GetSensorCount()
 			if err != nil {
-				log.Error("Failed to get sensor count: ", err)
+				logger(r).Error("Failed to get sensor count: ", err)
 				http.Error(w, "Failed to get sensor count", code)
 				return
 			}
@@ -100,35 +414,77 @@ func (api *SensorAPI) SensorsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		tags := r.URL.Query()["tags"]
-		// if tags is nil, GetSensorsByTags will return all sensors
-		sensor, code, err := api.store.GetSensorsByTags(tags)
+		l, err := parseListing(r.URL.Query(), api.distance, sortName, sortNameDesc, sortDistance)
 		if err != nil {
-			log.Error("Failed to get sensor: ", err)
+			logger(r).Error("Failed to parse listing from URL: ", err)
+			http.Error(w, fmt.Sprint("Invalid request: ", err), http.StatusBadRequest)
+			return
+		}
+
+		var (
+			sensor []model.Sensor
+			code   int
+		)
+		if r.URL.Query().Has("q") {
+			if r.URL.Query().Has("tags") || r.URL.Query().Has("tag_expr") {
+				logger(r).Error("Query combined with tags or tag_expr")
+				http.Error(w, "q cannot be combined with tags or tag_expr", http.StatusBadRequest)
+				return
+			}
+			var q query.Expr
+			q, err = query.Parse(r.URL.Query().Get("q"))
+			if err != nil {
+				logger(r).Error("Failed to parse query from URL: ", err)
+				http.Error(w, fmt.Sprint("Invalid q: ", err), http.StatusBadRequest)
+				return
+			}
+			sensor, code, err = api.storeFor(r).QuerySensors(q)
+		} else if r.URL.Query().Has("tag_expr") {
+			var filter tagexpr.Expr
+			filter, err = parseTagFilter(r.URL.Query())
+			if err != nil {
+				logger(r).Error("Failed to parse tag expression from URL: ", err)
+				http.Error(w, fmt.Sprint("Invalid tag_expr: ", err), http.StatusBadRequest)
+				return
+			}
+			sensor, code, err = api.storeFor(r).GetSensorsByTagExpr(filter)
+		} else {
+			tags := r.URL.Query()["tags"]
+			// if tags is nil, GetSensorsByTags will return all sensors
+			sensor, code, err = api.storeFor(r).GetSensorsByTags(tags)
+		}
+		if err != nil {
+			logger(r).Error("Failed to get sensor: ", err)
 			http.Error(w, "Failed to get sensor", code)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(code)
-		json.NewEncoder(w).Encode(sensor)
+		keys := make([]pageKey, len(sensor))
+		for i := range sensor {
+			keys[i] = l.sensorKey(sensor[i])
+		}
+		indexes, next := l.page(keys)
+		sensors := make([]model.Sensor, len(indexes))
+		for i, index := range indexes {
+			sensors[i] = sensor[index]
+		}
+		writeSensorListing(w, r, l, code, sensors, next)
 	case http.MethodPost:
-		var sensor model.Sensor
-		err := json.NewDecoder(r.Body).Decode(&sensor)
+		sensor, err := decodeSensor(r)
 		if err != nil {
-			log.Error("Failed to decode request body: ", err)
+			logger(r).Error("Failed to decode request body: ", err)
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		code, err := api.store.AddSensor(sensor)
+		code, err := api.storeFor(r).AddSensor(sensor)
 		if err != nil {
-			log.Error("Failed to add sensor: ", err)
+			logger(r).Error("Failed to add sensor: ", err)
 			http.Error(w, fmt.Sprint("Failed to add sensor: ", err), code)
 			return
 		}
 
-		log.Info("Added sensor: ", sensor)
+		logger(r).Info("Added sensor: ", sensor)
 		w.WriteHeader(code)
 	case http.MethodOptions:
 		w.Header().Set("Allow", "GET, POST, OPTIONS")
@@ -136,7 +492,7 @@ func (api *SensorAPI) SensorsHandler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodHead:
 		w.WriteHeader(http.StatusOK)
 	default:
-		log.Error("Invalid HTTP request method: ", r.Method)
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 	}
 }
@@ -147,14 +503,14 @@ func (api *SensorAPI) NearestSensorHandler(w http.ResponseWriter, r *http.Reques
 	case http.MethodGet:
 		lat, err := strconv.ParseFloat(r.URL.Query().Get("latitude"), 64)
 		if err != nil {
-			log.Error("Failed to parse latitude from URL: ", err)
+			logger(r).Error("Failed to parse latitude from URL: ", err)
 			http.Error(w, "Invalid latitude", http.StatusBadRequest)
 			return
 		}
 
 		lon, err := strconv.ParseFloat(r.URL.Query().Get("longitude"), 64)
 		if err != nil {
-			log.Error("Failed to parse longitude from URL: ", err)
+			logger(r).Error("Failed to parse longitude from URL: ", err)
 			http.Error(w, "Invalid longitude", http.StatusBadRequest)
 			return
 		}
@@ -163,72 +519,422 @@ func (api *SensorAPI) NearestSensorHandler(w http.ResponseWriter, r *http.Reques
 			Longitude: lon,
 		}
 
-		log.Debug("nearest sensor endpoint")
-		log.Debug("location: ", location)
+		logger(r).Debug("nearest sensor endpoint")
+		logger(r).Debug("location: ", location)
+		if r.URL.Query().Has("k") || r.URL.Query().Has("max_distance") || r.URL.Query().Has("tag_expr") {
+			filter, err := parseTagFilter(r.URL.Query())
+			if err != nil {
+				logger(r).Error("Failed to parse tag expression from URL: ", err)
+				http.Error(w, fmt.Sprint("Invalid tag_expr: ", err), http.StatusBadRequest)
+				return
+			}
+			api.nearestSensors(w, r, location, filter)
+			return
+		}
 		tags := r.URL.Query()["tags"]
 		// if tags is nil, GetNearestSensorByTag will return the nearest sensor regardless of tags
-		nearestSensor, code, err := api.store.GetNearestSensorByTag(location, tags)
+		nearestSensor, code, err := api.storeFor(r).GetNearestSensorByTag(location, tags)
 		if err != nil {
-			log.Error("Failed to get nearest sensor: ", err)
+			logger(r).Error("Failed to get nearest sensor: ", err)
 			http.Error(w, "Failed to get nearest sensor", code)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(code)
-		json.NewEncoder(w).Encode(nearestSensor)
+		writeSensor(w, r, code, *nearestSensor)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// nearestSensors writes the k sensors nearest to location, with their distance and bearing.
+// Without k or max_distance it writes the single nearest sensor, as GetNearestSensorByTag does.
+func (api *SensorAPI) nearestSensors(w http.ResponseWriter, r *http.Request, location model.Location, filter tagexpr.Expr) {
+	single := !r.URL.Query().Has("k") && !r.URL.Query().Has("max_distance")
+	k := 1
+	if r.URL.Query().Has("k") {
+		var err error
+		k, err = strconv.Atoi(r.URL.Query().Get("k"))
+		if err != nil || k <= 0 {
+			logger(r).Error("Failed to parse k from URL: ", r.URL.Query().Get("k"))
+			http.Error(w, "Invalid k", http.StatusBadRequest)
+			return
+		}
+	}
+
+	unit, err := parseUnit(r.URL.Query().Get("unit"))
+	if err != nil {
+		logger(r).Error("Failed to parse unit from URL: ", err)
+		http.Error(w, "Invalid unit", http.StatusBadRequest)
+		return
+	}
+
+	var maxDistance float64
+	if r.URL.Query().Has("max_distance") {
+		maxDistance, err = strconv.ParseFloat(r.URL.Query().Get("max_distance"), 64)
+		if err != nil || maxDistance <= 0 {
+			logger(r).Error("Failed to parse max distance from URL: ", r.URL.Query().Get("max_distance"))
+			http.Error(w, "Invalid max distance", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sensors, code, err := api.storeFor(r).GetNearestSensors(location, k, maxDistance*unit, filter)
+	if err != nil {
+		logger(r).Error("Failed to get nearest sensors: ", err)
+		http.Error(w, fmt.Sprint("Failed to get nearest sensors: ", err), code)
+		return
+	}
+	if single {
+		if len(sensors) == 0 {
+			logger(r).Error("Failed to get nearest sensor: no sensors match tag_expr")
+			http.Error(w, "Failed to get nearest sensor", http.StatusNotFound)
+			return
+		}
+		writeSensor(w, r, code, sensors[0].Sensor)
+		return
+	}
+	for i := range sensors {
+		sensors[i].Distance /= unit
+	}
+
+	writeSensorDistances(w, r, code, sensors)
+}
+
+// SensorsWithinHandler handles requests to /sensors/within.
+func (api *SensorAPI) SensorsWithinHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		box, err := parseBoundingBox(r.URL.Query())
+		if err != nil {
+			logger(r).Error("Failed to parse bounding box from URL: ", err)
+			http.Error(w, fmt.Sprint("Invalid bounding box: ", err), http.StatusBadRequest)
+			return
+		}
+
+		filter, err := parseTagFilter(r.URL.Query())
+		if err != nil {
+			logger(r).Error("Failed to parse tag expression from URL: ", err)
+			http.Error(w, fmt.Sprint("Invalid tag_expr: ", err), http.StatusBadRequest)
+			return
+		}
+		// if filter is nil, every sensor inside the bounding box is returned
+		sensors, code, err := api.storeFor(r).GetSensorsByTagWithinBoundingBox(filter, box.Min.Latitude, box.Min.Longitude, box.Max.Latitude, box.Max.Longitude)
+		if err != nil {
+			logger(r).Error("Failed to get sensors within bounding box: ", err)
+			http.Error(w, fmt.Sprint("Failed to get sensors within bounding box: ", err), code)
+			return
+		}
+
+		writeSensors(w, r, code, sensors)
 	case http.MethodOptions:
 		w.Header().Set("Allow", "GET, OPTIONS")
 		w.WriteHeader(http.StatusOK)
 	case http.MethodHead:
 		w.WriteHeader(http.StatusOK)
 	default:
-		log.Error("Invalid HTTP request method: ", r.Method)
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 	}
 }
 
+// SensorsNearHandler handles requests to /sensors/near.
+func (api *SensorAPI) SensorsNearHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		lat, err := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+		if err != nil {
+			logger(r).Error("Failed to parse latitude from URL: ", err)
+			http.Error(w, "Invalid latitude", http.StatusBadRequest)
+			return
+		}
+
+		lon, err := strconv.ParseFloat(r.URL.Query().Get("lng"), 64)
+		if err != nil {
+			logger(r).Error("Failed to parse longitude from URL: ", err)
+			http.Error(w, "Invalid longitude", http.StatusBadRequest)
+			return
+		}
+
+		radius, err := strconv.ParseFloat(r.URL.Query().Get("radius"), 64)
+		if err != nil {
+			logger(r).Error("Failed to parse radius from URL: ", err)
+			http.Error(w, "Invalid radius", http.StatusBadRequest)
+			return
+		}
+
+		unit, err := parseUnit(r.URL.Query().Get("unit"))
+		if err != nil {
+			logger(r).Error("Failed to parse unit from URL: ", err)
+			http.Error(w, "Invalid unit", http.StatusBadRequest)
+			return
+		}
+
+		location := model.Location{
+			Latitude:  lat,
+			Longitude: lon,
+		}
+		filter, err := parseTagFilter(r.URL.Query())
+		if err != nil {
+			logger(r).Error("Failed to parse tag expression from URL: ", err)
+			http.Error(w, fmt.Sprint("Invalid tag_expr: ", err), http.StatusBadRequest)
+			return
+		}
+		// the store works in meters, so scale the radius in and the distances back out
+		sensors, code, err := api.storeFor(r).GetSensorsByTagWithinRadius(filter, location, radius*unit)
+		if err != nil {
+			logger(r).Error("Failed to get sensors within radius: ", err)
+			http.Error(w, fmt.Sprint("Failed to get sensors within radius: ", err), code)
+			return
+		}
+		for i := range sensors {
+			sensors[i].Distance /= unit
+		}
+
+		writeSensorDistances(w, r, code, sensors)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// PolygonSearchHandler handles requests to /sensors/search/polygon.
+func (api *SensorAPI) PolygonSearchHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger(r).Error("Failed to read request body: ", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		polygon, err := geojson.DecodeMultiPolygon(body)
+		if err != nil {
+			logger(r).Error("Failed to decode polygon: ", err)
+			http.Error(w, fmt.Sprint("Invalid polygon: ", err), http.StatusBadRequest)
+			return
+		}
+
+		filter, err := parseTagFilter(r.URL.Query())
+		if err != nil {
+			logger(r).Error("Failed to parse tag expression from URL: ", err)
+			http.Error(w, fmt.Sprint("Invalid tag_expr: ", err), http.StatusBadRequest)
+			return
+		}
+		// if filter is nil, every sensor inside the polygon is returned
+		sensors, code, err := api.storeFor(r).GetSensorsByTagWithinPolygon(filter, polygon)
+		if err != nil {
+			logger(r).Error("Failed to get sensors within polygon: ", err)
+			http.Error(w, fmt.Sprint("Failed to get sensors within polygon: ", err), code)
+			return
+		}
+
+		writeSensors(w, r, code, sensors)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// TagsHandler handles requests to /sensors/tags, listing every tag in use in name order.
 func (api *SensorAPI) TagsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		tags, code, err := api.store.GetUniqueTags()
+		l, err := parseListing(r.URL.Query(), api.distance, sortName, sortNameDesc)
 		if err != nil {
-			log.Error("Failed to get tags: ", err)
+			logger(r).Error("Failed to parse listing from URL: ", err)
+			http.Error(w, fmt.Sprint("Invalid request: ", err), http.StatusBadRequest)
+			return
+		}
+		tags, code, err := api.storeFor(r).GetUniqueTags()
+		if err != nil {
+			logger(r).Error("Failed to get tags: ", err)
 			http.Error(w, "Failed to get tags", code)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(code)
-		json.NewEncoder(w).Encode(tags)
+
+		keys := make([]pageKey, len(tags))
+		for i, tag := range tags {
+			keys[i] = pageKey{Name: tag}
+		}
+		indexes, next := l.page(keys)
+		page := make([]string, len(indexes))
+		for i, index := range indexes {
+			page[i] = tags[index]
+		}
+		writeListing(w, r, l, code, page, next)
 	case http.MethodOptions:
 		w.Header().Set("Allow", "GET, OPTIONS")
 		w.WriteHeader(http.StatusOK)
 	case http.MethodHead:
 		w.WriteHeader(http.StatusOK)
 	default:
-		log.Error("Invalid HTTP request method: ", r.Method)
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 	}
 }
 
+// LocationsHandler handles requests to /sensors/locations, listing every distinct sensor location
+// ordered by latitude, then longitude.
 func (api *SensorAPI) LocationsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		locations, code, err := api.store.GetUniqueLocations()
+		l, err := parseListing(r.URL.Query(), api.distance, sortLocation, sortDistance)
 		if err != nil {
-			log.Error("Failed to get locations: ", err)
+			logger(r).Error("Failed to parse listing from URL: ", err)
+			http.Error(w, fmt.Sprint("Invalid request: ", err), http.StatusBadRequest)
+			return
+		}
+		locations, code, err := api.storeFor(r).GetUniqueLocations()
+		if err != nil {
+			logger(r).Error("Failed to get locations: ", err)
 			http.Error(w, "Failed to get locations", code)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(code)
-		json.NewEncoder(w).Encode(locations)
+
+		keys := make([]pageKey, len(locations))
+		for i, location := range locations {
+			keys[i] = l.locationKey(location)
+		}
+		indexes, next := l.page(keys)
+		page := make([]model.Location, len(indexes))
+		for i, index := range indexes {
+			page[i] = locations[index]
+		}
+		writeListing(w, r, l, code, page, next)
 	case http.MethodOptions:
 		w.Header().Set("Allow", "GET, OPTIONS")
 		w.WriteHeader(http.StatusOK)
 	case http.MethodHead:
 		w.WriteHeader(http.StatusOK)
 	default:
-		log.Error("Invalid HTTP request method: ", r.Method)
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 	}
 }
+
+// parseBoundingBox reads the min_lat, max_lat, min_lng and max_lng query parameters.
+func parseBoundingBox(query url.Values) (model.BoundingBox, error) {
+	var (
+		box    model.BoundingBox
+		fields = []struct {
+			key   string
+			value *float64
+		}{
+			{"min_lat", &box.Min.Latitude},
+			{"max_lat", &box.Max.Latitude},
+			{"min_lng", &box.Min.Longitude},
+			{"max_lng", &box.Max.Longitude},
+		}
+	)
+	for _, field := range fields {
+		value, err := strconv.ParseFloat(query.Get(field.key), 64)
+		if err != nil {
+			return model.BoundingBox{}, fmt.Errorf("invalid %s", field.key)
+		}
+		*field.value = value
+	}
+	if !box.IsValid() {
+		return model.BoundingBox{}, fmt.Errorf("corners must be valid locations with min_lat <= max_lat and min_lng <= max_lng")
+	}
+	return box, nil
+}
+
+// parseTagFilter combines the tags and tag_expr query parameters into a single filter.
+// Sensors must have every one of the tags and match the expression. The filter is nil if neither is given.
+func parseTagFilter(query url.Values) (tagexpr.Expr, error) {
+	filter := tagexpr.AllOf(query["tags"])
+	if !query.Has("tag_expr") {
+		return filter, nil
+	}
+	expr, err := tagexpr.Parse(query.Get("tag_expr"))
+	if err != nil {
+		return nil, err
+	}
+	return tagexpr.Both(filter, expr), nil
+}
+
+// aggregation holds the query parameters of an aggregate request.
+type aggregation struct {
+	window   time.Duration
+	from, to time.Time
+	metric   string
+	fns      []aggregate.Func
+}
+
+// parseAggregation reads the window, fn, metric, from and to query parameters. The window and metric
+// are required, and fn defaults to avg.
+func parseAggregation(query url.Values) (aggregation, error) {
+	var (
+		agg aggregation
+		err error
+	)
+	agg.window, err = time.ParseDuration(query.Get("window"))
+	if err != nil || agg.window <= 0 {
+		return aggregation{}, fmt.Errorf("window must be a positive duration such as 5m")
+	}
+
+	agg.metric = query.Get("metric")
+	if agg.metric == "" {
+		return aggregation{}, fmt.Errorf("metric is required")
+	}
+
+	fn := query.Get("fn")
+	if fn == "" {
+		fn = "avg"
+	}
+	if agg.fns, err = aggregate.ParseFuncs(fn); err != nil {
+		return aggregation{}, err
+	}
+
+	if agg.from, agg.to, err = parseTimeRange(query); err != nil {
+		return aggregation{}, err
+	}
+	return agg, nil
+}
+
+// parseTimeRange reads the optional from and to query parameters as RFC 3339 timestamps.
+func parseTimeRange(query url.Values) (from, to time.Time, err error) {
+	if query.Get("from") != "" {
+		if from, err = time.Parse(time.RFC3339Nano, query.Get("from")); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from: expected an RFC 3339 timestamp")
+		}
+	}
+	if query.Get("to") != "" {
+		if to, err = time.Parse(time.RFC3339Nano, query.Get("to")); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to: expected an RFC 3339 timestamp")
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("to is before from")
+	}
+	return from, to, nil
+}
+
+// parseUnit returns the number of meters in the given distance unit, defaulting to meters.
+func parseUnit(unit string) (float64, error) {
+	switch unit {
+	case "", "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "mi":
+		return 1609.344, nil
+	}
+	return 0, fmt.Errorf("unknown unit %q", unit)
+}
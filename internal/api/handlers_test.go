@@ -1,14 +1,28 @@
 package api
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sensor-api/internal/aggregate"
+	"sensor-api/internal/auth"
+	"sensor-api/internal/events"
+	"sensor-api/internal/geofence"
+	"sensor-api/internal/logging"
 	"sensor-api/internal/model"
+	"sensor-api/internal/ratelimit"
 	"sensor-api/internal/store"
+	"sensor-api/internal/webhook"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -356,7 +370,7 @@ func TestSensorHandlerOptions(t *testing.T) {
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
 	// Check the Allow header is what we expect
-	assert.Equal(t, "GET, PUT, DELETE, OPTIONS", recorder.Header().Get("Allow"))
+	assert.Equal(t, "GET, PUT, PATCH, DELETE, OPTIONS", recorder.Header().Get("Allow"))
 }
 
 func TestSensorHandlerHead(t *testing.T) {
@@ -573,3 +587,1800 @@ func TestTagsHandler(t *testing.T) {
 	expectedBody := fmt.Sprintln(`["tag1","tag2","tag3"]`)
 	assert.Equal(t, expectedBody, recorder.Body.String())
 }
+
+func TestSensorsWithinHandler(t *testing.T) {
+	// Create a new in-memory store and add sensors to it
+	store := store.NewInMemorySensorStore()
+	sensor1 := model.Sensor{
+		Name: "Sensor1",
+		Location: model.Location{
+			Latitude:  37.7749,
+			Longitude: -122.4194,
+		},
+		Tags: []string{"tag1"},
+	}
+	code, err := store.AddSensor(sensor1)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, code)
+
+	sensor2 := model.Sensor{
+		Name: "Sensor2",
+		Location: model.Location{
+			Latitude:  39.0921,
+			Longitude: -123.5222,
+		},
+		Tags: []string{"tag1"},
+	}
+	code, err = store.AddSensor(sensor2)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, code)
+
+	// Create a new request to get the sensors within a bounding box
+	req, err := http.NewRequest("GET", "/sensors/within?min_lat=37.7&max_lat=37.8&min_lng=-122.5&max_lng=-122.3&tags=tag1", nil)
+	assert.NoError(t, err)
+
+	// Create a new recorder to capture the response
+	recorder := httptest.NewRecorder()
+
+	// Call the SensorsWithin handler with the request and recorder
+	handler := http.HandlerFunc(NewSensorAPI(store).SensorsWithinHandler)
+	handler.ServeHTTP(recorder, req)
+
+	// Check the status code is what we expect
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Check the response body is what we expect
+	expectedBody := fmt.Sprintln(`[{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"tags":["tag1"]}]`)
+	assert.Equal(t, expectedBody, recorder.Body.String())
+}
+
+func TestSensorsWithinHandlerInvalidBoundingBox(t *testing.T) {
+	// Create a new in-memory store
+	store := store.NewInMemorySensorStore()
+
+	handler := http.HandlerFunc(NewSensorAPI(store).SensorsWithinHandler)
+	for _, query := range []string{
+		"min_lat=invalid&max_lat=37.8&min_lng=-122.5&max_lng=-122.3",
+		"max_lat=37.8&min_lng=-122.5&max_lng=-122.3",
+		"min_lat=37.8&max_lat=37.7&min_lng=-122.5&max_lng=-122.3",
+		"min_lat=37.7&max_lat=37.8&min_lng=-122.5&max_lng=-181",
+	} {
+		req, err := http.NewRequest("GET", "/sensors/within?"+query, nil)
+		assert.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		// Check the status code is what we expect
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, query)
+	}
+}
+
+func TestSensorsWithinHandlerOptions(t *testing.T) {
+	// Create a new in-memory store
+	store := store.NewInMemorySensorStore()
+
+	req, err := http.NewRequest("OPTIONS", "/sensors/within", nil)
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(NewSensorAPI(store).SensorsWithinHandler)
+	handler.ServeHTTP(recorder, req)
+
+	// Check the status code and Allow header are what we expect
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "GET, OPTIONS", recorder.Header().Get("Allow"))
+}
+
+func TestSensorsNearHandler(t *testing.T) {
+	// Create a new in-memory store and add sensors to it
+	store := store.NewInMemorySensorStore()
+	for _, sensor := range []model.Sensor{
+		{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"tag1"}},
+		{Name: "Sensor2", Location: model.Location{Latitude: 37.7833, Longitude: -122.4167}},
+		{Name: "Sensor3", Location: model.Location{Latitude: 39.0921, Longitude: -123.5222}},
+	} {
+		code, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, code)
+	}
+
+	// Create a new request to get the sensors within 5 kilometers
+	req, err := http.NewRequest("GET", "/sensors/near?lat=37.775&lng=-122.42&radius=5&unit=km", nil)
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(NewSensorAPI(store).SensorsNearHandler)
+	handler.ServeHTTP(recorder, req)
+
+	// Check the status code is what we expect
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Check the response body holds the two closest sensors, closest first, with distances in kilometers
+	var sensors []model.SensorDistance
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&sensors))
+	assert.Len(t, sensors, 2)
+	assert.Equal(t, "Sensor1", sensors[0].Name)
+	assert.Equal(t, "Sensor2", sensors[1].Name)
+	assert.InDelta(t, 1, sensors[1].Distance, 0.05)
+
+	// Create a new request filtering by tags
+	req, err = http.NewRequest("GET", "/sensors/near?lat=37.775&lng=-122.42&radius=5000&tags=tag1", nil)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&sensors))
+	assert.Len(t, sensors, 1)
+	assert.Equal(t, "Sensor1", sensors[0].Name)
+}
+
+func TestSensorsNearHandlerInvalidQuery(t *testing.T) {
+	// Create a new in-memory store
+	store := store.NewInMemorySensorStore()
+
+	handler := http.HandlerFunc(NewSensorAPI(store).SensorsNearHandler)
+	for _, query := range []string{
+		"lat=invalid&lng=-122.42&radius=5",
+		"lat=37.775&lng=invalid&radius=5",
+		"lat=37.775&lng=-122.42",
+		"lat=37.775&lng=-122.42&radius=5&unit=furlong",
+		"lat=37.775&lng=-122.42&radius=-5",
+	} {
+		req, err := http.NewRequest("GET", "/sensors/near?"+query, nil)
+		assert.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		// Check the status code is what we expect
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, query)
+	}
+}
+
+func TestNearestSensorHandlerK(t *testing.T) {
+	// Create a new in-memory store and add sensors to it
+	store := store.NewInMemorySensorStore()
+	for _, sensor := range []model.Sensor{
+		{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}},
+		{Name: "Sensor2", Location: model.Location{Latitude: 37.7833, Longitude: -122.4167}},
+		{Name: "Sensor3", Location: model.Location{Latitude: 39.0921, Longitude: -123.5222}},
+	} {
+		code, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, code)
+	}
+
+	// Create a new request to get the two nearest sensors
+	req, err := http.NewRequest("GET", "/sensors/nearest?latitude=37.775&longitude=-122.42&k=2&unit=km", nil)
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(NewSensorAPI(store).NearestSensorHandler)
+	handler.ServeHTTP(recorder, req)
+
+	// Check the status code is what we expect
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Check the response body holds the two nearest sensors with distances in kilometers
+	var sensors []model.SensorDistance
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&sensors))
+	assert.Len(t, sensors, 2)
+	assert.Equal(t, "Sensor1", sensors[0].Name)
+	assert.Equal(t, "Sensor2", sensors[1].Name)
+	assert.InDelta(t, 1, sensors[1].Distance, 0.05)
+
+	// Create a new request capped by max distance
+	req, err = http.NewRequest("GET", "/sensors/nearest?latitude=37.775&longitude=-122.42&k=5&max_distance=500", nil)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&sensors))
+	assert.Len(t, sensors, 1)
+	assert.Equal(t, "Sensor1", sensors[0].Name)
+
+	// Check invalid parameters are rejected
+	for _, query := range []string{"k=0", "k=invalid", "k=2&max_distance=-1", "k=2&unit=furlong"} {
+		req, err = http.NewRequest("GET", "/sensors/nearest?latitude=37.775&longitude=-122.42&"+query, nil)
+		assert.NoError(t, err)
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, query)
+	}
+}
+
+func TestPolygonSearchHandler(t *testing.T) {
+	// Create a new in-memory store and add sensors to it
+	store := store.NewInMemorySensorStore()
+	for _, sensor := range []model.Sensor{
+		{Name: "Sensor1", Location: model.Location{Latitude: 37.72, Longitude: -122.42}, Tags: []string{"tag1"}},
+		{Name: "Sensor2", Location: model.Location{Latitude: 37.755, Longitude: -122.42}, Tags: []string{"tag1"}},
+		{Name: "Sensor3", Location: model.Location{Latitude: 37.78, Longitude: -122.35}},
+	} {
+		code, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, code)
+	}
+
+	// Create a new request with a polygon holding a hole around Sensor2
+	body := `{
+		"type": "Polygon",
+		"coordinates": [
+			[[-122.5, 37.7], [-122.3, 37.7], [-122.3, 37.8], [-122.5, 37.8], [-122.5, 37.7]],
+			[[-122.45, 37.75], [-122.4, 37.75], [-122.4, 37.76], [-122.45, 37.76], [-122.45, 37.75]]
+		]
+	}`
+	req, err := http.NewRequest("POST", "/sensors/search/polygon?tags=tag1", strings.NewReader(body))
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(NewSensorAPI(store).PolygonSearchHandler)
+	handler.ServeHTTP(recorder, req)
+
+	// Check the status code is what we expect
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Check the response body is what we expect
+	expectedBody := fmt.Sprintln(`[{"name":"Sensor1","location":{"latitude":37.72,"longitude":-122.42},"tags":["tag1"]}]`)
+	assert.Equal(t, expectedBody, recorder.Body.String())
+}
+
+func TestPolygonSearchHandlerInvalidBody(t *testing.T) {
+	// Create a new in-memory store
+	store := store.NewInMemorySensorStore()
+
+	handler := http.HandlerFunc(NewSensorAPI(store).PolygonSearchHandler)
+	for _, body := range []string{
+		`{"type": "Polygon", "coordinates": [[[-122.5, 37.7], [-122.3, 37.7]`,
+		`{"type": "Point", "coordinates": [-122.5, 37.7]}`,
+		`{"type": "Polygon", "coordinates": [[[-122.5, 37.7], [-122.3, 37.7], [-122.3, 37.8], [-122.5, 37.8]]]}`,
+	} {
+		req, err := http.NewRequest("POST", "/sensors/search/polygon", strings.NewReader(body))
+		assert.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		// Check the status code is what we expect
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, body)
+	}
+}
+
+func TestPolygonSearchHandlerInvalidMethod(t *testing.T) {
+	// Create a new in-memory store
+	store := store.NewInMemorySensorStore()
+
+	req, err := http.NewRequest("GET", "/sensors/search/polygon", nil)
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(NewSensorAPI(store).PolygonSearchHandler)
+	handler.ServeHTTP(recorder, req)
+
+	// Check the status code is what we expect
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
+
+func TestTagExpr(t *testing.T) {
+	// Create a new in-memory store and add sensors to it
+	store := store.NewInMemorySensorStore()
+	for _, sensor := range []model.Sensor{
+		{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"temperature", "decommissioned"}},
+		{Name: "Sensor2", Location: model.Location{Latitude: 37.7833, Longitude: -122.4167}, Tags: []string{"humidity"}},
+		{Name: "Sensor3", Location: model.Location{Latitude: 39.0921, Longitude: -123.5222}, Tags: []string{"temperature", "outdoor"}},
+	} {
+		code, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, code)
+	}
+	api := NewSensorAPI(store)
+	expr := url.QueryEscape("(temperature OR humidity) AND NOT decommissioned")
+
+	// Create a new request to list the sensors matching the expression
+	req, err := http.NewRequest("GET", "/sensors?tag_expr="+expr, nil)
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(api.SensorsHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var sensors []model.Sensor
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&sensors))
+	assert.Len(t, sensors, 2)
+	assert.ElementsMatch(t, []string{"Sensor2", "Sensor3"}, []string{sensors[0].Name, sensors[1].Name})
+
+	// Check the tags parameter is combined with the expression
+	req, err = http.NewRequest("GET", "/sensors?tags=outdoor&tag_expr="+expr, nil)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	http.HandlerFunc(api.SensorsHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&sensors))
+	assert.Len(t, sensors, 1)
+	assert.Equal(t, "Sensor3", sensors[0].Name)
+
+	// Check the nearest sensor skips the decommissioned one
+	req, err = http.NewRequest("GET", "/sensors/nearest?latitude=37.775&longitude=-122.42&tag_expr="+expr, nil)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	http.HandlerFunc(api.NearestSensorHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var nearest model.Sensor
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&nearest))
+	assert.Equal(t, "Sensor2", nearest.Name)
+
+	// Check an expression nothing matches gives not found
+	req, err = http.NewRequest("GET", "/sensors/nearest?latitude=37.775&longitude=-122.42&tag_expr=pressure", nil)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	http.HandlerFunc(api.NearestSensorHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	// Check the spatial endpoints accept the expression
+	req, err = http.NewRequest("GET", "/sensors/within?min_lat=37&max_lat=38&min_lng=-123&max_lng=-122&tag_expr="+expr, nil)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	http.HandlerFunc(api.SensorsWithinHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&sensors))
+	assert.Len(t, sensors, 1)
+	assert.Equal(t, "Sensor2", sensors[0].Name)
+
+	req, err = http.NewRequest("GET", "/sensors/near?lat=37.775&lng=-122.42&radius=5&unit=km&tag_expr=NOT+humidity", nil)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	http.HandlerFunc(api.SensorsNearHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var near []model.SensorDistance
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&near))
+	assert.Len(t, near, 1)
+	assert.Equal(t, "Sensor1", near[0].Name)
+}
+
+func TestTagExprSyntaxError(t *testing.T) {
+	api := NewSensorAPI(store.NewInMemorySensorStore())
+
+	// Check every endpoint taking tag_expr reports the position of the syntax error
+	for _, test := range []struct {
+		handler http.HandlerFunc
+		target  string
+	}{
+		{api.SensorsHandler, "/sensors"},
+		{api.NearestSensorHandler, "/sensors/nearest?latitude=37.775&longitude=-122.42"},
+		{api.SensorsWithinHandler, "/sensors/within?min_lat=37&max_lat=38&min_lng=-123&max_lng=-122"},
+		{api.SensorsNearHandler, "/sensors/near?lat=37.775&lng=-122.42&radius=5"},
+	} {
+		separator := "?"
+		if strings.Contains(test.target, "?") {
+			separator = "&"
+		}
+		req, err := http.NewRequest("GET", test.target+separator+"tag_expr="+url.QueryEscape("temperature AND (humidity OR"), nil)
+		assert.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		test.handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, test.target)
+		assert.Equal(t, "Invalid tag_expr: syntax error at position 28: expected tag, found end of expression\n", recorder.Body.String(), test.target)
+	}
+}
+
+func TestSensorsHandlerQuery(t *testing.T) {
+	// Create a new in-memory store and add sensors to it
+	store := store.NewInMemorySensorStore()
+	for _, sensor := range []model.Sensor{
+		{Name: "bldg-1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor"}},
+		{Name: "bldg-2", Location: model.Location{Latitude: 37.7833, Longitude: -122.4167}, Tags: []string{"outdoor"}},
+		{Name: "site-1", Location: model.Location{Latitude: 37.7833, Longitude: -122.4167}, Tags: []string{"indoor"}},
+		{Name: "bldg-3", Location: model.Location{Latitude: 39.0921, Longitude: -123.5222}, Tags: []string{"indoor"}},
+	} {
+		code, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, code)
+	}
+	handler := http.HandlerFunc(NewSensorAPI(store).SensorsHandler)
+
+	// Create a new request combining tag, location and name terms
+	q := url.QueryEscape(`tag:indoor AND within(37.7,-122.5,37.8,-122.3) AND name~"^bldg-"`)
+	req, err := http.NewRequest("GET", "/sensors?q="+q, nil)
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var sensors []model.Sensor
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&sensors))
+	assert.Len(t, sensors, 1)
+	assert.Equal(t, "bldg-1", sensors[0].Name)
+
+	// Check a malformed query reports the position of the error
+	req, err = http.NewRequest("GET", "/sensors?q="+url.QueryEscape("tag:indoor AND within(37.7,-122.5)"), nil)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Invalid q: syntax error at position 33: within takes 4 arguments, found 2\n", recorder.Body.String())
+
+	// Check q cannot be mixed with the tag parameters
+	req, err = http.NewRequest("GET", "/sensors?q=tag:indoor&tags=outdoor", nil)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestSensorsHandlerPagination(t *testing.T) {
+	// Create a new in-memory store and add sensors to it
+	store := store.NewInMemorySensorStore()
+	for i, name := range []string{"Sensor3", "Sensor1", "Sensor5", "Sensor2", "Sensor4"} {
+		code, err := store.AddSensor(model.Sensor{Name: name, Location: model.Location{Latitude: 37 + float64(i)/10, Longitude: -122}})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, code)
+	}
+	handler := http.HandlerFunc(NewSensorAPI(store).SensorsHandler)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", target, nil)
+		assert.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	var page struct {
+		Items []model.Sensor `json:"items"`
+		Next  string         `json:"next"`
+	}
+	getPage := func(target string) []string {
+		recorder := get(target)
+		assert.Equal(t, http.StatusOK, recorder.Code, target)
+		page.Items, page.Next = nil, ""
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&page))
+		names := []string{}
+		for _, sensor := range page.Items {
+			names = append(names, sensor.Name)
+		}
+		return names
+	}
+
+	// Check sensors are listed in name order without an envelope when no page is asked for
+	recorder := get("/sensors")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var sensors []model.Sensor
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&sensors))
+	assert.Len(t, sensors, 5)
+	for i, sensor := range sensors {
+		assert.Equal(t, fmt.Sprint("Sensor", i+1), sensor.Name)
+	}
+
+	// Test following next links, while sensors are added before and after the cursor and removed
+	assert.Equal(t, []string{"Sensor1", "Sensor2"}, getPage("/sensors?limit=2"))
+	assert.NotEmpty(t, page.Next)
+	_, err := store.AddSensor(model.Sensor{Name: "Sensor0", Location: model.Location{Latitude: 38, Longitude: -122}})
+	assert.NoError(t, err)
+	_, err = store.AddSensor(model.Sensor{Name: "Sensor6", Location: model.Location{Latitude: 38, Longitude: -122}})
+	assert.NoError(t, err)
+	_, err = store.RemoveSensor("Sensor3")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Sensor4", "Sensor5"}, getPage(page.Next))
+	assert.Contains(t, page.Next, "limit=2")
+	assert.Equal(t, []string{"Sensor6"}, getPage(page.Next))
+	assert.Empty(t, page.Next)
+
+	// Test sorting in reverse and by distance, keeping the filters in the next link
+	assert.Equal(t, []string{"Sensor6", "Sensor5", "Sensor4"}, getPage("/sensors?sort=-name&limit=3"))
+	assert.Equal(t, []string{"Sensor2", "Sensor1", "Sensor0"}, getPage(page.Next))
+	assert.Equal(t, []string{"Sensor4", "Sensor2"}, getPage("/sensors?sort=distance(37.42,-122)&limit=2"))
+	assert.Equal(t, []string{"Sensor5", "Sensor1"}, getPage(page.Next))
+	assert.Equal(t, []string{"Sensor0", "Sensor6"}, getPage(page.Next))
+	assert.Empty(t, page.Next)
+
+	// Test invalid parameters
+	for _, target := range []string{
+		"/sensors?limit=0",
+		"/sensors?limit=1001",
+		"/sensors?limit=ten",
+		"/sensors?sort=size",
+		"/sensors?sort=distance",
+		"/sensors?sort=distance(91,0)",
+		"/sensors?cursor=not-a-cursor",
+	} {
+		recorder = get(target)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, target)
+	}
+
+	// Check a cursor cannot be used with a different sort
+	getPage("/sensors?limit=1")
+	next, err := url.Parse(page.Next)
+	assert.NoError(t, err)
+	recorder = get("/sensors?sort=-name&cursor=" + next.Query().Get("cursor"))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// Test sorting by distance measures with the configured distance function, here the degrees south
+	// of the north pole
+	handler = http.HandlerFunc(NewSensorAPI(store, WithDistanceFunc(func(_, _, lat, _ float64) float64 { return 90 - lat })).SensorsHandler)
+	assert.Equal(t, []string{"Sensor0", "Sensor6", "Sensor4"}, getPage("/sensors?sort=distance(37.42,-122)&limit=3"))
+}
+
+func TestTagsAndLocationsPagination(t *testing.T) {
+	// Create a new in-memory store and add sensors to it
+	store := store.NewInMemorySensorStore()
+	for i, tag := range []string{"c", "a", "d", "b"} {
+		code, err := store.AddSensor(model.Sensor{
+			Name:     fmt.Sprint("Sensor", i),
+			Location: model.Location{Latitude: 40 - float64(i), Longitude: -122},
+			Tags:     []string{tag},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, code)
+	}
+	api := NewSensorAPI(store)
+
+	get := func(handler http.HandlerFunc, target string, v interface{}) {
+		req, err := http.NewRequest("GET", target, nil)
+		assert.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code, target)
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(v))
+	}
+
+	// Test tags are paged in name order
+	var tags struct {
+		Items []string `json:"items"`
+		Next  string   `json:"next"`
+	}
+	get(api.TagsHandler, "/sensors/tags?limit=3", &tags)
+	assert.Equal(t, []string{"a", "b", "c"}, tags.Items)
+	get(api.TagsHandler, tags.Next, &tags)
+	assert.Equal(t, []string{"d"}, tags.Items)
+	tags.Next = ""
+	get(api.TagsHandler, "/sensors/tags?sort=-name&limit=2", &tags)
+	assert.Equal(t, []string{"d", "c"}, tags.Items)
+
+	// Test locations are paged by latitude, or by distance
+	var locations struct {
+		Items []model.Location `json:"items"`
+		Next  string           `json:"next"`
+	}
+	get(api.LocationsHandler, "/sensors/locations?limit=2", &locations)
+	assert.Equal(t, []model.Location{{Latitude: 37, Longitude: -122}, {Latitude: 38, Longitude: -122}}, locations.Items)
+	get(api.LocationsHandler, locations.Next, &locations)
+	assert.Equal(t, []model.Location{{Latitude: 39, Longitude: -122}, {Latitude: 40, Longitude: -122}}, locations.Items)
+	get(api.LocationsHandler, "/sensors/locations?sort=distance(38.9,-122)&limit=2", &locations)
+	assert.Equal(t, []model.Location{{Latitude: 39, Longitude: -122}, {Latitude: 38, Longitude: -122}}, locations.Items)
+
+	// Check sorts that make no sense for the listing are rejected
+	req, err := http.NewRequest("GET", "/sensors/locations?sort=name", nil)
+	assert.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	api.LocationsHandler(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestSensorHandlerETags(t *testing.T) {
+	// Create a new in-memory store and add a sensor to it
+	store := store.NewInMemorySensorStore()
+	_, err := store.AddSensor(model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}})
+	assert.NoError(t, err)
+	handler := http.HandlerFunc(NewSensorAPI(store).SensorHandler)
+
+	send := func(method, etagHeader, etag, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "/sensors/Sensor1", strings.NewReader(body))
+		assert.NoError(t, err)
+		if etag != "" {
+			req.Header.Set(etagHeader, etag)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	update := `{"name":"Sensor1","location":{"latitude":37.8,"longitude":-122.4}}`
+
+	// Check GET returns the sensor's version as its ETag
+	recorder := send("GET", "", "", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	etag := recorder.Header().Get("ETag")
+	assert.Regexp(t, `^"\d+"$`, etag)
+
+	// Test If-None-Match with the current ETag returns 304 with no body
+	recorder = send("GET", "If-None-Match", etag, "")
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Equal(t, etag, recorder.Header().Get("ETag"))
+	assert.Empty(t, recorder.Body.String())
+
+	// Test updating with the current ETag succeeds and changes the ETag
+	recorder = send("PUT", "If-Match", etag, update)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	recorder = send("GET", "If-None-Match", etag, "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	current := recorder.Header().Get("ETag")
+	assert.NotEqual(t, etag, current)
+
+	// Test updating and removing with the stale ETag fail without changing the sensor
+	recorder = send("PUT", "If-Match", etag, update)
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	recorder = send("DELETE", "If-Match", etag, "")
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	recorder = send("DELETE", "If-Match", `W/`+current, "")
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	recorder = send("GET", "", "", "")
+	assert.Equal(t, current, recorder.Header().Get("ETag"))
+
+	// Test removing with the current ETag succeeds, after which any ETag fails
+	recorder = send("DELETE", "If-Match", `"0", `+current, "")
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	recorder = send("DELETE", "If-Match", "*", "")
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	recorder = send("DELETE", "", "", "")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestPatchSensorHandler(t *testing.T) {
+	// Create a new in-memory store and add sensors to it
+	store := store.NewInMemorySensorStore()
+	_, err := store.AddSensor(model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor"}})
+	assert.NoError(t, err)
+	_, err = store.AddSensor(model.Sensor{Name: "Sensor2", Location: model.Location{Latitude: 37.8044, Longitude: -122.2712}})
+	assert.NoError(t, err)
+	handler := http.HandlerFunc(NewSensorAPI(store).SensorHandler)
+
+	patch := func(name, contentType, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PATCH", "/sensors/"+name, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	get := func(name string) model.Sensor {
+		sensor, _, err := store.GetSensor(name)
+		assert.NoError(t, err)
+		return sensor
+	}
+
+	// Test adding a tag with JSON Patch, including to a sensor without tags
+	recorder := patch("Sensor1", "application/json-patch+json", `[{"op":"add","path":"/tags/-","value":"temperature"}]`)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, []string{"indoor", "temperature"}, get("Sensor1").Tags)
+	recorder = patch("Sensor2", "application/json-patch+json", `[{"op":"add","path":"/tags/-","value":"outdoor"}]`)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, []string{"outdoor"}, get("Sensor2").Tags)
+
+	// Test moving a sensor with JSON Merge Patch, which keeps the spatial and tag indexes in sync
+	recorder = patch("Sensor1", "application/merge-patch+json; charset=utf-8", `{"location":{"latitude":37.3382,"longitude":-121.8863},"tags":["outdoor"]}`)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.3382, Longitude: -121.8863}, Tags: []string{"outdoor"}}, get("Sensor1"))
+	sensors, _, err := store.GetSensorsWithinBoundingBox(37.3, -121.9, 37.4, -121.8)
+	assert.NoError(t, err)
+	assert.Len(t, sensors, 1)
+	sensors, _, err = store.GetSensorsByTags([]string{"indoor"})
+	assert.NoError(t, err)
+	assert.Empty(t, sensors)
+
+	// Test a failed test operation, a patch making the sensor invalid and malformed patches
+	recorder = patch("Sensor1", "application/json-patch+json", `[{"op":"test","path":"/tags/0","value":"indoor"},{"op":"remove","path":"/tags"}]`)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	recorder = patch("Sensor1", "application/merge-patch+json", `{"location":{"latitude":95}}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder = patch("Sensor1", "application/merge-patch+json", `{"colour":"red"}`)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	recorder = patch("Sensor1", "application/json-patch+json", `[{"op":"add","path":"/tags/-"}]`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.3382, Longitude: -121.8863}, Tags: []string{"outdoor"}}, get("Sensor1"))
+
+	// Check other content types are rejected with the accepted formats, and missing sensors are not found
+	recorder = patch("Sensor1", "application/json", `{"tags":[]}`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, recorder.Code)
+	assert.Equal(t, "application/merge-patch+json, application/json-patch+json", recorder.Header().Get("Accept-Patch"))
+	recorder = patch("Sensor3", "application/merge-patch+json", `{"tags":[]}`)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	// Test a patch conditional on a stale ETag fails
+	_, version, _, err := store.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+	req, err := http.NewRequest("PATCH", "/sensors/Sensor1", strings.NewReader(`{"tags":null}`))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("If-Match", sensorETag(version-1))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+}
+
+func TestSensorsHandlerETag(t *testing.T) {
+	// Create a new in-memory store and add a sensor to it
+	store := store.NewInMemorySensorStore()
+	_, err := store.AddSensor(model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}})
+	assert.NoError(t, err)
+	handler := http.HandlerFunc(NewSensorAPI(store).SensorsHandler)
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/sensors", nil)
+		assert.NoError(t, err)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// Check the listing has a weak ETag, and If-None-Match with it returns 304
+	recorder := get("")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	etag := recorder.Header().Get("ETag")
+	assert.True(t, strings.HasPrefix(etag, `W/"`), etag)
+	recorder = get(etag)
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Empty(t, recorder.Body.String())
+
+	// Check the ETag changes when the listing does
+	_, err = store.AddSensor(model.Sensor{Name: "Sensor2", Location: model.Location{Latitude: 37.8, Longitude: -122.4}})
+	assert.NoError(t, err)
+	recorder = get(etag)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotEqual(t, etag, recorder.Header().Get("ETag"))
+}
+
+func TestReadingsHandler(t *testing.T) {
+	// Create a new in-memory store and add a sensor to it
+	store := store.NewInMemorySensorStore()
+	_, err := store.AddSensor(model.Sensor{Name: "sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}})
+	assert.NoError(t, err)
+	handler := http.HandlerFunc(NewSensorAPI(store).SensorHandler)
+
+	// Create a new request to add a single reading
+	req, err := http.NewRequest("POST", "/sensors/sensor1/readings", strings.NewReader(`{"metric": "temperature", "value": 21.5, "timestamp": "2024-01-01T00:05:00Z"}`))
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	// Create a new request to add a batch of readings
+	req, err = http.NewRequest("POST", "/sensors/sensor1/readings", strings.NewReader(`[
+		{"metric": "temperature", "value": 20, "timestamp": "2024-01-01T00:00:00Z"},
+		{"metric": "humidity", "value": 40, "timestamp": "2024-01-01T00:00:00Z"},
+		{"metric": "temperature", "value": 23, "timestamp": "2024-01-01T00:10:00Z"}
+	]`))
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	// Create a new request to get the temperature readings in a time range
+	req, err = http.NewRequest("GET", "/sensors/sensor1/readings?metric=temperature&from=2024-01-01T00:00:00Z&to=2024-01-01T00:10:00Z", nil)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var readings []model.Reading
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&readings))
+	assert.Len(t, readings, 2)
+	assert.Equal(t, 20.0, readings[0].Value)
+	assert.Equal(t, 21.5, readings[1].Value)
+
+	// Check invalid requests are rejected
+	for _, test := range []struct {
+		method string
+		target string
+		body   string
+		code   int
+	}{
+		{"POST", "/sensors/sensor1/readings", `{"metric": "temperature", "value": 21.5}`, http.StatusBadRequest},
+		{"POST", "/sensors/sensor1/readings", `[{"metric": "temperature"`, http.StatusBadRequest},
+		{"POST", "/sensors/sensor2/readings", `{"metric": "temperature", "value": 21.5, "timestamp": "2024-01-01T00:05:00Z"}`, http.StatusNotFound},
+		{"GET", "/sensors/sensor1/readings?from=yesterday", "", http.StatusBadRequest},
+		{"GET", "/sensors/sensor1/readings?from=2024-01-02T00:00:00Z&to=2024-01-01T00:00:00Z", "", http.StatusBadRequest},
+		{"GET", "/sensors/sensor2/readings", "", http.StatusNotFound},
+		{"PUT", "/sensors/sensor1/readings", "", http.StatusMethodNotAllowed},
+	} {
+		req, err = http.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		assert.NoError(t, err)
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, test.code, recorder.Code, "%s %s", test.method, test.target)
+	}
+}
+
+func TestSensorHandlerSubResourceNames(t *testing.T) {
+	store := store.NewInMemorySensorStore()
+	for _, name := range []string{"floor/readings", "floor/readings/aggregate", "floor/1"} {
+		_, err := store.AddSensor(model.Sensor{Name: name, Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}})
+		assert.NoError(t, err)
+	}
+	handler := http.HandlerFunc(NewSensorAPI(store).SensorHandler)
+	get := func(target string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", target, nil)
+		assert.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// Test sensors named like a sub-resource are reached by escaping their slashes
+	for target, name := range map[string]string{
+		"/sensors/floor%2Freadings":             "floor/readings",
+		"/sensors/floor%2Freadings%2Faggregate": "floor/readings/aggregate",
+		"/sensors/floor/1":                      "floor/1",
+		"/sensors/floor%2F1":                    "floor/1",
+	} {
+		recorder := get(target)
+		assert.Equal(t, http.StatusOK, recorder.Code, target)
+		var sensor model.Sensor
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&sensor), target)
+		assert.Equal(t, name, sensor.Name, target)
+	}
+
+	// Check their readings are reached the same way, and unescaped slashes still mean a sub-resource
+	_, err := store.AddReadings("floor/readings", []model.Reading{{Metric: "temperature", Value: 21.5, Timestamp: time.Now()}})
+	assert.NoError(t, err)
+	recorder := get("/sensors/floor%2Freadings/readings")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var readings []model.Reading
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&readings))
+	assert.Len(t, readings, 1)
+	assert.Equal(t, http.StatusOK, get("/sensors/floor%2Freadings/readings/aggregate?metric=temperature&window=5m").Code)
+	assert.Equal(t, http.StatusNotFound, get("/sensors/floor/readings").Code)
+}
+
+func TestAggregateHandlers(t *testing.T) {
+	// Create a new in-memory store and add sensors with readings to it
+	store := store.NewInMemorySensorStore()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, sensor := range []model.Sensor{
+		{Name: "sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor"}},
+		{Name: "sensor2", Location: model.Location{Latitude: 37.7833, Longitude: -122.4167}, Tags: []string{"indoor"}},
+		{Name: "sensor3", Location: model.Location{Latitude: 39.0921, Longitude: -123.5222}, Tags: []string{"outdoor"}},
+	} {
+		_, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+		for minute := 0; minute < 10; minute++ {
+			_, err = store.AddReadings(sensor.Name, []model.Reading{
+				{Metric: "temperature", Value: float64(10*i + minute), Timestamp: start.Add(time.Duration(minute) * time.Minute)},
+			})
+			assert.NoError(t, err)
+		}
+	}
+	api := NewSensorAPI(store)
+
+	// Create a new request to aggregate one sensor's readings into 5 minute buckets
+	req, err := http.NewRequest("GET", "/sensors/sensor1/readings/aggregate?metric=temperature&window=5m&fn=min,avg,max", nil)
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(api.SensorHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var buckets []aggregate.Bucket
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&buckets))
+	assert.Equal(t, []aggregate.Bucket{
+		{Start: start, Count: 5, Values: map[string]float64{"min": 0, "avg": 2, "max": 4}},
+		{Start: start.Add(5 * time.Minute), Count: 5, Values: map[string]float64{"min": 5, "avg": 7, "max": 9}},
+	}, buckets)
+
+	// Create a new request to aggregate the readings of every indoor sensor
+	req, err = http.NewRequest("GET", "/sensors/aggregate?tags=indoor&metric=temperature&window=10m&fn=count,max&from=2024-01-01T00:00:00Z&to=2024-01-01T00:20:00Z", nil)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	http.HandlerFunc(api.AggregateHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	buckets = nil
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&buckets))
+	assert.Equal(t, []aggregate.Bucket{
+		{Start: start, Count: 20, Values: map[string]float64{"count": 20, "max": 19}},
+		{Start: start.Add(10 * time.Minute), Count: 0},
+	}, buckets)
+
+	// Create a new request to aggregate the readings of the sensors matching a spatial query
+	req, err = http.NewRequest("GET", "/sensors/aggregate?metric=temperature&window=1h&q="+url.QueryEscape("within(39, -124, 40, -123)"), nil)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	http.HandlerFunc(api.AggregateHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	buckets = nil
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&buckets))
+	assert.Equal(t, []aggregate.Bucket{
+		{Start: start, Count: 10, Values: map[string]float64{"avg": 24.5}},
+	}, buckets)
+
+	// Check invalid requests are rejected
+	for _, test := range []struct {
+		handler http.HandlerFunc
+		target  string
+		code    int
+	}{
+		{api.SensorHandler, "/sensors/sensor1/readings/aggregate?metric=temperature", http.StatusBadRequest},
+		{api.SensorHandler, "/sensors/sensor1/readings/aggregate?metric=temperature&window=-5m", http.StatusBadRequest},
+		{api.SensorHandler, "/sensors/sensor1/readings/aggregate?window=5m", http.StatusBadRequest},
+		{api.SensorHandler, "/sensors/sensor1/readings/aggregate?metric=temperature&window=5m&fn=median", http.StatusBadRequest},
+		{api.SensorHandler, "/sensors/sensor1/readings/aggregate?metric=temperature&window=1ns", http.StatusBadRequest},
+		{api.SensorHandler, "/sensors/sensor4/readings/aggregate?metric=temperature&window=5m", http.StatusNotFound},
+		{api.AggregateHandler, "/sensors/aggregate?metric=temperature&window=5m&q=tag", http.StatusBadRequest},
+		{api.AggregateHandler, "/sensors/aggregate?metric=temperature&window=5m&q=tag:indoor&tags=indoor", http.StatusBadRequest},
+		{api.AggregateHandler, "/sensors/aggregate?metric=temperature&window=5m&tag_expr=(indoor", http.StatusBadRequest},
+	} {
+		req, err = http.NewRequest("GET", test.target, nil)
+		assert.NoError(t, err)
+
+		recorder = httptest.NewRecorder()
+		test.handler.ServeHTTP(recorder, req)
+		assert.Equal(t, test.code, recorder.Code, test.target)
+	}
+}
+
+func TestImportHandler(t *testing.T) {
+	// Create a new in-memory store and add a sensor to it
+	store := store.NewInMemorySensorStore()
+	_, err := store.AddSensor(model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}})
+	assert.NoError(t, err)
+	handler := http.HandlerFunc(NewSensorAPI(store).ImportHandler)
+
+	post := func(target, contentType, body string) (*httptest.ResponseRecorder, importReport) {
+		req, err := http.NewRequest("POST", target, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		var report importReport
+		if recorder.Header().Get("Content-Type") == "application/json" {
+			assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+		}
+		return recorder, report
+	}
+	statuses := func(report importReport) []int {
+		statuses := []int{}
+		for _, result := range report.Results {
+			statuses = append(statuses, result.Status)
+		}
+		return statuses
+	}
+
+	// Test an atomic CSV import with a bad row adds nothing
+	csvBody := "name,lat,lon,tags\nSensor2,37.8044,-122.2712,indoor;temperature\nSensor3,north,-122\nSensor1,37.3382,-121.8863\n"
+	recorder, report := post("/sensors/import?atomic=true", "text/csv", csvBody)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, []int{424, 400, 424}, statuses(report))
+	assert.Equal(t, importReport{Added: 0, Failed: 3}, importReport{Added: report.Added, Failed: report.Failed})
+	count, _, err := store.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Test the same import without atomic reports each row, numbered without the header
+	recorder, report = post("/sensors/import", "text/csv; charset=utf-8", csvBody)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []int{201, 400, 400}, statuses(report))
+	assert.Equal(t, importResult{Row: 3, Name: "Sensor1", Status: 400, Error: "sensor already exists"}, report.Results[2])
+	assert.Equal(t, 1, report.Added)
+	assert.Equal(t, 2, report.Failed)
+	sensor, _, err := store.GetSensor("Sensor2")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Sensor{Name: "Sensor2", Location: model.Location{Latitude: 37.8044, Longitude: -122.2712}, Tags: []string{"indoor", "temperature"}}, sensor)
+
+	// Test NDJSON and GeoJSON imports, with the format given by the query or the content type
+	recorder, report = post("/sensors/import?format=ndjson", "text/plain", `{"name":"Sensor3","location":{"latitude":37.3382,"longitude":-121.8863},"tags":["outdoor"]}`+"\n\n{\"name\":\n")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []int{201, 400}, statuses(report))
+	recorder, report = post("/sensors/import?atomic=true", "application/geo+json", `{"type":"FeatureCollection","features":[
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[-121.9,37.4]},"properties":{"name":"Sensor4"}},
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[-122.0,37.5]},"properties":{"name":"Sensor5","tags":["indoor"]}}
+	]}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []int{201, 201}, statuses(report))
+	sensor, _, err = store.GetSensor("Sensor4")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Location{Latitude: 37.4, Longitude: -121.9}, sensor.Location)
+	count, _, err = store.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	// Check unknown content types are unsupported, unknown format parameters bad requests, and
+	// unreadable imports are rejected
+	recorder, _ = post("/sensors/import", "application/json", `[]`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, recorder.Code)
+	recorder, _ = post("/sensors/import", "", "")
+	assert.Equal(t, http.StatusUnsupportedMediaType, recorder.Code)
+	recorder, _ = post("/sensors/import?format=xml", "text/csv", "")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder, _ = post("/sensors/import", "application/geo+json", `{"type":"Feature"}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder, _ = post("/sensors/import?atomic=maybe", "text/csv", "")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestImportHandlerBatches(t *testing.T) {
+	// Create a new in-memory store
+	store := store.NewInMemorySensorStore()
+	handler := http.HandlerFunc(NewSensorAPI(store).ImportHandler)
+
+	// Test an import larger than a batch, with a sensor repeated across batches
+	var body strings.Builder
+	for i := 0; i < importBatchSize+10; i++ {
+		fmt.Fprintf(&body, "Sensor%d,%f,-122\n", i%(importBatchSize+5), 30+float64(i)/1000)
+	}
+	req, err := http.NewRequest("POST", "/sensors/import", strings.NewReader(body.String()))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "text/csv")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var report importReport
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&report))
+	assert.Equal(t, importBatchSize+5, report.Added)
+	assert.Equal(t, 5, report.Failed)
+	assert.Len(t, report.Results, importBatchSize+10)
+	assert.Equal(t, 400, report.Results[importBatchSize+5].Status)
+	count, _, err := store.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, importBatchSize+5, count)
+}
+
+func TestExportHandler(t *testing.T) {
+	// Create a new in-memory store and add sensors to it
+	sensorStore := store.NewInMemorySensorStore()
+	sensors := []model.Sensor{
+		{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor", "temperature"}},
+		{Name: "Sensor2", Location: model.Location{Latitude: 37.8044, Longitude: -122.2712}},
+	}
+	handler := http.HandlerFunc(NewSensorAPI(sensorStore).ExportHandler)
+	get := func(target string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", target, nil)
+		assert.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// Check an empty store exports nothing rather than failing
+	recorder := get("/sensors/export")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Empty(t, recorder.Body.String())
+
+	for _, sensor := range []model.Sensor{sensors[1], sensors[0]} {
+		_, err := sensorStore.AddSensor(sensor)
+		assert.NoError(t, err)
+	}
+
+	// Check each format, in name order
+	recorder = get("/sensors/export")
+	assert.Equal(t, "application/x-ndjson", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"tags":["indoor","temperature"]}`+"\n"+
+		`{"name":"Sensor2","location":{"latitude":37.8044,"longitude":-122.2712},"tags":null}`+"\n", recorder.Body.String())
+
+	recorder = get("/sensors/export?format=csv")
+	assert.Equal(t, "text/csv", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="sensors.csv"`, recorder.Header().Get("Content-Disposition"))
+	assert.Equal(t, "name,lat,lon,tags\nSensor1,37.7749,-122.4194,indoor;temperature\nSensor2,37.8044,-122.2712,\n", recorder.Body.String())
+
+	recorder = get("/sensors/export?format=geojson")
+	assert.Equal(t, "application/geo+json", recorder.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"FeatureCollection","features":[
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[-122.4194,37.7749]},"properties":{"name":"Sensor1","tags":["indoor","temperature"]}},
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[-122.2712,37.8044]},"properties":{"name":"Sensor2","tags":[]}}
+	]}`, recorder.Body.String())
+
+	recorder = get("/sensors/export?format=xml")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// Test each export imports into an empty store as the same sensors
+	for _, format := range []string{"ndjson", "csv", "geojson"} {
+		imported := store.NewInMemorySensorStore()
+		req, err := http.NewRequest("POST", "/sensors/import?atomic=true&format="+format, get("/sensors/export?format="+format).Body)
+		assert.NoError(t, err)
+		recorder = httptest.NewRecorder()
+		NewSensorAPI(imported).ImportHandler(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code, format)
+		for _, sensor := range sensors {
+			retrieved, _, err := imported.GetSensor(sensor.Name)
+			assert.NoError(t, err, format)
+			assert.Equal(t, sensor.Location, retrieved.Location, format)
+			assert.ElementsMatch(t, sensor.Tags, retrieved.Tags, format)
+		}
+	}
+}
+
+func TestGeoJSONNegotiation(t *testing.T) {
+	// Create a new in-memory store and add sensors to it
+	store := store.NewInMemorySensorStore()
+	_, err := store.AddSensor(model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor"}})
+	assert.NoError(t, err)
+	_, err = store.AddSensor(model.Sensor{Name: "Sensor2", Location: model.Location{Latitude: 37.8044, Longitude: -122.2712}})
+	assert.NoError(t, err)
+	api := NewSensorAPI(store)
+
+	type feature struct {
+		Type     string `json:"type"`
+		Geometry struct {
+			Type        string    `json:"type"`
+			Coordinates []float64 `json:"coordinates"`
+		} `json:"geometry"`
+		Properties struct {
+			Name     string   `json:"name"`
+			Tags     []string `json:"tags"`
+			Distance *float64 `json:"distance"`
+		} `json:"properties"`
+	}
+	var collection struct {
+		Type     string    `json:"type"`
+		Features []feature `json:"features"`
+		Next     string    `json:"next"`
+	}
+	get := func(handler http.HandlerFunc, target, accept string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", target, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept", accept)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code, target)
+		assert.Equal(t, "Accept", recorder.Header().Get("Vary"), target)
+		return recorder
+	}
+	getCollection := func(handler http.HandlerFunc, target string) []string {
+		recorder := get(handler, target, "application/geo+json")
+		assert.Equal(t, "application/geo+json", recorder.Header().Get("Content-Type"), target)
+		collection.Features, collection.Next = nil, ""
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&collection), target)
+		assert.Equal(t, "FeatureCollection", collection.Type, target)
+		names := []string{}
+		for _, feature := range collection.Features {
+			assert.Equal(t, "Feature", feature.Type)
+			assert.Equal(t, "Point", feature.Geometry.Type)
+			names = append(names, feature.Properties.Name)
+		}
+		return names
+	}
+
+	// Test a single sensor is a Feature with [lon, lat] coordinates and its own ETag
+	recorder := get(api.SensorHandler, "/sensors/Sensor1", "application/geo+json")
+	assert.Equal(t, "application/geo+json", recorder.Header().Get("Content-Type"))
+	var single feature
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&single))
+	assert.Equal(t, "Feature", single.Type)
+	assert.Equal(t, []float64{-122.4194, 37.7749}, single.Geometry.Coordinates)
+	assert.Equal(t, "Sensor1", single.Properties.Name)
+	assert.Equal(t, []string{"indoor"}, single.Properties.Tags)
+	geoETag := recorder.Header().Get("ETag")
+	jsonETag := get(api.SensorHandler, "/sensors/Sensor1", "application/json").Header().Get("ETag")
+	assert.NotEqual(t, jsonETag, geoETag)
+
+	// Check JSON is kept when it is preferred, equally acceptable, or GeoJSON is not acceptable
+	for _, accept := range []string{"", "*/*", "application/json", "application/*", "application/geo+json;q=0.5, application/json", "text/html"} {
+		recorder = get(api.SensorHandler, "/sensors/Sensor1", accept)
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"), accept)
+	}
+	recorder = get(api.SensorHandler, "/sensors/Sensor1", "application/json;q=0.5, application/geo+json")
+	assert.Equal(t, "application/geo+json", recorder.Header().Get("Content-Type"))
+
+	// Test the list, nearest and spatial endpoints return FeatureCollections
+	assert.Equal(t, []string{"Sensor1", "Sensor2"}, getCollection(api.SensorsHandler, "/sensors"))
+	assert.Equal(t, []string{"Sensor1"}, getCollection(api.SensorsHandler, "/sensors?limit=1"))
+	assert.NotEmpty(t, collection.Next)
+	assert.Equal(t, []string{"Sensor2"}, getCollection(api.SensorsHandler, collection.Next))
+	assert.Empty(t, collection.Next)
+	assert.Equal(t, []string{"Sensor2", "Sensor1"}, getCollection(api.NearestSensorHandler, "/sensors/nearest?latitude=37.8&longitude=-122.27&k=2"))
+	assert.NotNil(t, collection.Features[0].Properties.Distance)
+	assert.Equal(t, []string{"Sensor1"}, getCollection(api.SensorsWithinHandler, "/sensors/within?min_lat=37.7&max_lat=37.78&min_lng=-122.5&max_lng=-122.3"))
+	assert.Equal(t, []string{"Sensor1"}, getCollection(api.SensorsNearHandler, "/sensors/near?lat=37.775&lng=-122.42&radius=1&unit=km"))
+	recorder = get(api.NearestSensorHandler, "/sensors/nearest?latitude=37.8&longitude=-122.27", "application/geo+json")
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&single))
+	assert.Equal(t, "Sensor2", single.Properties.Name)
+
+	req, err := http.NewRequest("POST", "/sensors/search/polygon", strings.NewReader(`{"type": "Polygon", "coordinates": [[[-122.5, 37.7], [-122.3, 37.7], [-122.3, 37.8], [-122.5, 37.8], [-122.5, 37.7]]]}`))
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "application/geo+json")
+	recorder = httptest.NewRecorder()
+	api.PolygonSearchHandler(recorder, req)
+	assert.Equal(t, "application/geo+json", recorder.Header().Get("Content-Type"))
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&collection))
+	assert.Len(t, collection.Features, 1)
+
+	// Test POST and PUT accept a Feature
+	send := func(method, target, body string) int {
+		req, err := http.NewRequest(method, target, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/geo+json")
+		recorder := httptest.NewRecorder()
+		if method == "POST" {
+			api.SensorsHandler(recorder, req)
+		} else {
+			api.SensorHandler(recorder, req)
+		}
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusCreated, send("POST", "/sensors", `{"type": "Feature", "geometry": {"type": "Point", "coordinates": [-121.8863, 37.3382]}, "properties": {"name": "Sensor3", "tags": ["outdoor"]}}`))
+	sensor, _, err := store.GetSensor("Sensor3")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Sensor{Name: "Sensor3", Location: model.Location{Latitude: 37.3382, Longitude: -121.8863}, Tags: []string{"outdoor"}}, sensor)
+	assert.Equal(t, http.StatusNoContent, send("PUT", "/sensors/Sensor3", `{"type": "Feature", "geometry": {"type": "Point", "coordinates": [-121.9, 37.4]}, "properties": {"name": "Sensor3"}}`))
+	sensor, _, err = store.GetSensor("Sensor3")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Location{Latitude: 37.4, Longitude: -121.9}, sensor.Location)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/sensors", `{"name": "Sensor4", "location": {"latitude": 37, "longitude": -122}}`))
+	assert.Equal(t, http.StatusBadRequest, send("PUT", "/sensors/Sensor3", `{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": []}}`))
+}
+
+// readEvent reads the fields of the next event or ID update from a Server-Sent Events stream, skipping
+// comments.
+func readEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	t.Helper()
+	fields := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return fields
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(fields) > 0 {
+				return fields
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		fields[field] = value
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	// Test the change feed is unavailable without a broker
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/sensors/events", nil)
+	assert.NoError(t, err)
+	NewSensorAPI(store.NewInMemorySensorStore()).EventsHandler(recorder, req)
+	assert.Equal(t, http.StatusNotImplemented, recorder.Code)
+
+	// Create a store publishing to a broker that buffers the last two events
+	defer func(interval time.Duration) { heartbeatInterval = interval }(heartbeatInterval)
+	heartbeatInterval = 10 * time.Millisecond
+	sensorStore := store.NewInMemorySensorStore()
+	broker := events.NewBroker(2, 10)
+	sensorStore.SetEventSink(broker)
+	sensorAPI := NewSensorAPI(sensorStore, WithEvents(broker))
+	server := httptest.NewServer(http.HandlerFunc(sensorAPI.EventsHandler))
+	defer server.Close()
+	stream := func(query string, lastEventID string) (*http.Response, *bufio.Reader) {
+		req, err := http.NewRequest("GET", server.URL+"?"+query, nil)
+		assert.NoError(t, err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	// Test a client filtering by tag is only sent changes to sensors with the tag before or after
+	resp, reader := stream("tags=outdoor", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	sensorStore.AddSensor(model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor"}})
+	sensorStore.AddSensor(model.Sensor{Name: "Sensor2", Location: model.Location{Latitude: 37.8044, Longitude: -122.2712}, Tags: []string{"outdoor"}})
+	sensorStore.UpdateSensor("Sensor2", &model.Sensor{Name: "Sensor2", Location: model.Location{Latitude: 37.8044, Longitude: -122.2712}})
+	event := readEvent(t, reader)
+	assert.Equal(t, "2", event["id"])
+	assert.Equal(t, "created", event["event"])
+	var data events.Event
+	assert.NoError(t, json.Unmarshal([]byte(event["data"]), &data))
+	assert.Equal(t, "Sensor2", data.Name)
+	assert.Equal(t, []string{"outdoor"}, data.Sensor.Tags)
+	event = readEvent(t, reader)
+	assert.Equal(t, "3", event["id"])
+	assert.Equal(t, "updated", event["event"])
+	assert.NoError(t, json.Unmarshal([]byte(event["data"]), &data))
+	assert.Equal(t, []string{"outdoor"}, data.Previous.Tags)
+	assert.Empty(t, data.Sensor.Tags)
+	resp.Body.Close()
+
+	// Check a client filtering by location has its last event ID moved past the events filtered out
+	resp, reader = stream("min_lat=37.7&max_lat=37.9&min_lng=-122.3&max_lng=-122.2", "")
+	sensorStore.RemoveSensor("Sensor1")
+	assert.Equal(t, map[string]string{"id": "4"}, readEvent(t, reader))
+	resp.Body.Close()
+
+	// Test a client resuming from a buffered event is sent the events after it
+	resp, reader = stream("", "2")
+	event = readEvent(t, reader)
+	assert.Equal(t, "3", event["id"])
+	event = readEvent(t, reader)
+	assert.Equal(t, "4", event["id"])
+	assert.Equal(t, "deleted", event["event"])
+	resp.Body.Close()
+
+	// Test a client resuming from an event no longer buffered is told to reset first
+	resp, reader = stream("", "1")
+	event = readEvent(t, reader)
+	assert.Equal(t, "reset", event["event"])
+	assert.Equal(t, "3", readEvent(t, reader)["id"])
+	resp.Body.Close()
+
+	// Check invalid filters and event IDs are rejected
+	for _, test := range []struct {
+		query, lastEventID string
+	}{
+		{"tag_expr=(", ""},
+		{"min_lat=37", ""},
+		{"min_lat=38&max_lat=37&min_lng=-122&max_lng=-121", ""},
+		{"", "abc"},
+		{"last_event_id=-1", ""},
+	} {
+		resp, _ := stream(test.query, test.lastEventID)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, test)
+		resp.Body.Close()
+	}
+}
+
+func TestLiveHandler(t *testing.T) {
+	// Test live queries are unavailable without a broker
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/sensors/live", nil)
+	assert.NoError(t, err)
+	NewSensorAPI(store.NewInMemorySensorStore()).LiveHandler(recorder, req)
+	assert.Equal(t, http.StatusNotImplemented, recorder.Code)
+
+	// Create a store publishing to a broker, with one sensor inside the viewport and one outside
+	sensorStore := store.NewInMemorySensorStore()
+	broker := events.NewBroker(0, 0)
+	sensorStore.SetEventSink(broker)
+	sanFrancisco := model.Location{Latitude: 37.7749, Longitude: -122.4194}
+	oakland := model.Location{Latitude: 37.8044, Longitude: -122.2712}
+	sanJose := model.Location{Latitude: 37.3382, Longitude: -121.8863}
+	sensorStore.AddSensor(model.Sensor{Name: "Sensor1", Location: sanFrancisco, Tags: []string{"outdoor"}})
+	sensorStore.AddSensor(model.Sensor{Name: "Sensor2", Location: sanJose, Tags: []string{"outdoor"}})
+	server := httptest.NewServer(http.HandlerFunc(NewSensorAPI(sensorStore, WithEvents(broker)).LiveHandler))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	read := func() map[string]interface{} {
+		t.Helper()
+		var msg map[string]interface{}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		assert.NoError(t, conn.ReadJSON(&msg))
+		return msg
+	}
+
+	// Test subscribing to a viewport sends the sensors inside it
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "viewport", "bbox": {"min": {"latitude": 37.7, "longitude": -122.5}, "max": {"latitude": 37.9, "longitude": -122.2}}, "tags": ["outdoor"]}`)))
+	msg := read()
+	assert.Equal(t, "snapshot", msg["type"])
+	assert.Len(t, msg["sensors"], 1)
+	assert.Equal(t, "Sensor1", msg["sensors"].([]interface{})[0].(map[string]interface{})["name"])
+
+	// Test sensors entering, changing inside and leaving the viewport are reported
+	sensorStore.UpdateSensor("Sensor2", &model.Sensor{Name: "Sensor2", Location: oakland, Tags: []string{"outdoor"}})
+	msg = read()
+	assert.Equal(t, "enter", msg["type"])
+	assert.Equal(t, "Sensor2", msg["name"])
+	sensorStore.UpdateSensor("Sensor1", &model.Sensor{Name: "Sensor3", Location: sanFrancisco, Tags: []string{"outdoor"}})
+	msg = read()
+	assert.Equal(t, "update", msg["type"])
+	assert.Equal(t, "Sensor1", msg["name"])
+	assert.Equal(t, "Sensor3", msg["sensor"].(map[string]interface{})["name"])
+	sensorStore.UpdateSensor("Sensor3", &model.Sensor{Name: "Sensor3", Location: sanFrancisco, Tags: []string{"indoor"}})
+	assert.Equal(t, map[string]interface{}{"type": "leave", "name": "Sensor3"}, read())
+	sensorStore.AddSensor(model.Sensor{Name: "Sensor4", Location: sanJose})
+	sensorStore.RemoveSensor("Sensor2")
+	assert.Equal(t, map[string]interface{}{"type": "leave", "name": "Sensor2"}, read())
+
+	// Test an invalid viewport is reported, and the viewport left unchanged
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "viewport"}`)))
+	msg = read()
+	assert.Equal(t, "error", msg["type"])
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`not json`)))
+	msg = read()
+	assert.Equal(t, "error", msg["type"])
+
+	// Test moving the viewport sends the sensors entering and leaving it
+	sensorStore.AddSensor(model.Sensor{Name: "Sensor5", Location: oakland, Tags: []string{"outdoor"}})
+	assert.Equal(t, "Sensor5", read()["name"])
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "viewport", "bbox": {"min": {"latitude": 37.3, "longitude": -122}, "max": {"latitude": 37.4, "longitude": -121.8}}}`)))
+	assert.Equal(t, map[string]interface{}{"type": "leave", "name": "Sensor5"}, read())
+	msg = read()
+	assert.Equal(t, "enter", msg["type"])
+	assert.Equal(t, "Sensor4", msg["name"])
+}
+
+func TestWebhookHandlers(t *testing.T) {
+	// Test webhooks are unavailable without a dispatcher
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/webhooks", nil)
+	assert.NoError(t, err)
+	NewSensorAPI(store.NewInMemorySensorStore()).WebhooksHandler(recorder, req)
+	assert.Equal(t, http.StatusNotImplemented, recorder.Code)
+
+	// Create a receiver that takes longer to respond than requests to the API may take
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+	sensorStore := store.NewInMemorySensorStore()
+	broker := events.NewBroker(0, 0)
+	sensorStore.SetEventSink(broker)
+	dispatcher := webhook.NewDispatcher(broker, webhook.Options{Backoff: time.Millisecond})
+	dispatcher.Start()
+	defer dispatcher.Close()
+	sensorAPI := NewSensorAPI(sensorStore, WithEvents(broker), WithWebhooks(dispatcher))
+	serve := func(handler http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		assert.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder
+	}
+
+	// Test adding a webhook returns its ID and secret
+	recorder = serve(sensorAPI.WebhooksHandler, "POST", "/webhooks", fmt.Sprintf(`{"url": %q, "events": ["created"], "secret": "s3cret"}`, receiver.URL))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var hook webhook.Webhook
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &hook))
+	assert.Equal(t, "s3cret", hook.Secret)
+	assert.Equal(t, "/webhooks/"+hook.ID, recorder.Header().Get("Location"))
+	assert.Equal(t, http.StatusBadRequest, serve(sensorAPI.WebhooksHandler, "POST", "/webhooks", `{"url": "ftp://example.com"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(sensorAPI.WebhooksHandler, "POST", "/webhooks", `{"url": "http://example.com", "unknown": 1}`).Code)
+
+	// Check webhooks are listed and retrieved without their secrets
+	recorder = serve(sensorAPI.WebhooksHandler, "GET", "/webhooks", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "s3cret")
+	assert.Contains(t, recorder.Body.String(), hook.ID)
+	recorder = serve(sensorAPI.WebhookHandler, "GET", "/webhooks/"+hook.ID, "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "s3cret")
+	assert.Equal(t, http.StatusNotFound, serve(sensorAPI.WebhookHandler, "GET", "/webhooks/missing", "").Code)
+
+	// Test a change is delivered and signed after the request that made it has timed out
+	handler := TimeoutMiddleware(10*time.Millisecond, http.HandlerFunc(sensorAPI.SensorsHandler))
+	recorder = serve(handler.ServeHTTP, "POST", "/sensors", `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194}}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	select {
+	case req := <-received:
+		body := <-bodies
+		assert.Equal(t, "created", req.Header.Get(webhook.HeaderEvent))
+		assert.Equal(t, webhook.Sign("s3cret", body), req.Header.Get(webhook.HeaderSignature))
+		assert.Contains(t, string(body), `"name":"Sensor1"`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the delivery")
+	}
+
+	// Check the dead letters are listed, and replaying a missing one fails
+	recorder = serve(sensorAPI.WebhookHandler, "GET", "/webhooks/dead-letters", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "[]\n", recorder.Body.String())
+	assert.Equal(t, http.StatusNotFound, serve(sensorAPI.WebhookHandler, "POST", "/webhooks/dead-letters/missing/replay", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(sensorAPI.WebhookHandler, "GET", "/webhooks/dead-letters/missing/replay", "").Code)
+
+	// Test removing a webhook
+	assert.Equal(t, http.StatusNoContent, serve(sensorAPI.WebhookHandler, "DELETE", "/webhooks/"+hook.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(sensorAPI.WebhookHandler, "DELETE", "/webhooks/"+hook.ID, "").Code)
+}
+
+func TestGeofenceHandlers(t *testing.T) {
+	// Test geofences are unavailable without a monitor
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/geofences", nil)
+	assert.NoError(t, err)
+	NewSensorAPI(store.NewInMemorySensorStore()).GeofencesHandler(recorder, req)
+	assert.Equal(t, http.StatusNotImplemented, recorder.Code)
+
+	sensorStore := store.NewInMemorySensorStore()
+	broker := events.NewBroker(0, 0)
+	monitor := geofence.NewMonitor(broker, nil, 0)
+	sensorStore.SetEventSink(monitor)
+	sensorAPI := NewSensorAPI(sensorStore, WithEvents(broker), WithGeofences(monitor))
+	serve := func(handler http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		assert.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder
+	}
+
+	// Test adding a circle and a polygon geofence
+	recorder = serve(sensorAPI.GeofencesHandler, "POST", "/geofences", `{"name": "Downtown", "circle": {"center": {"latitude": 37.7749, "longitude": -122.4194}, "radius": 2000}}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var circle geofence.Fence
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &circle))
+	assert.Equal(t, "/geofences/"+circle.ID, recorder.Header().Get("Location"))
+	recorder = serve(sensorAPI.GeofencesHandler, "POST", "/geofences", `{"name": "San Jose", "tags": ["mobile"], "polygon": {"type": "Polygon", "coordinates": [[[-122, 37.2], [-121.8, 37.2], [-121.8, 37.4], [-122, 37.4], [-122, 37.2]]]}}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var polygon geofence.Fence
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &polygon))
+
+	// Check invalid geofences are rejected
+	assert.Equal(t, http.StatusBadRequest, serve(sensorAPI.GeofencesHandler, "POST", "/geofences", `{"name": "Nowhere"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(sensorAPI.GeofencesHandler, "POST", "/geofences", `{"circle": {"center": {"latitude": 0, "longitude": 0}, "radius": -1}}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(sensorAPI.GeofencesHandler, "POST", "/geofences", `{"unknown": 1}`).Code)
+
+	// Check geofences are listed and retrieved
+	recorder = serve(sensorAPI.GeofencesHandler, "GET", "/geofences", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var fences []geofence.Fence
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &fences))
+	assert.Len(t, fences, 2)
+	recorder = serve(sensorAPI.GeofenceHandler, "GET", "/geofences/"+circle.ID, "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"name":"Downtown"`)
+	assert.Equal(t, http.StatusNotFound, serve(sensorAPI.GeofenceHandler, "GET", "/geofences/missing", "").Code)
+
+	// Test moving a sensor into the circle and then the polygon alerts on each, after its update
+	sub := broker.Subscribe()
+	defer sub.Close()
+	assert.Equal(t, http.StatusCreated, serve(sensorAPI.SensorsHandler, "POST", "/sensors", `{"name":"Sensor1","location":{"latitude":37.8044,"longitude":-122.2712},"tags":["mobile"]}`).Code)
+	assert.Equal(t, http.StatusNoContent, serve(sensorAPI.SensorHandler, "PUT", "/sensors/Sensor1", `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"tags":["mobile"]}`).Code)
+	assert.Equal(t, http.StatusNoContent, serve(sensorAPI.SensorHandler, "PUT", "/sensors/Sensor1", `{"name":"Sensor1","location":{"latitude":37.3382,"longitude":-121.8863},"tags":["mobile"]}`).Code)
+	var types []string
+	for i := 0; i < 6; i++ {
+		event := <-sub.Events
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []string{"created", "updated", "geofence.enter", "updated", "geofence.exit", "geofence.enter"}, types)
+
+	// Check the alerts are queryable by geofence, sensor and after an alert
+	recorder = serve(sensorAPI.GeofenceHandler, "GET", "/geofences/alerts", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var alerts []geofence.Alert
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &alerts))
+	assert.Len(t, alerts, 3)
+	recorder = serve(sensorAPI.GeofenceHandler, "GET", "/geofences/alerts?geofence="+polygon.ID, "")
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &alerts))
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, geofence.AlertEnter, alerts[0].Type)
+	recorder = serve(sensorAPI.GeofenceHandler, "GET", "/geofences/alerts?sensor=Sensor1&after=2", "")
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &alerts))
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, uint64(3), alerts[0].ID)
+	assert.Equal(t, http.StatusBadRequest, serve(sensorAPI.GeofenceHandler, "GET", "/geofences/alerts?after=-1", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(sensorAPI.GeofenceHandler, "POST", "/geofences/alerts", "").Code)
+
+	// Test updating and removing a geofence
+	recorder = serve(sensorAPI.GeofenceHandler, "PUT", "/geofences/"+circle.ID, `{"name": "Midtown", "circle": {"center": {"latitude": 37.7549, "longitude": -122.4194}, "radius": 1000}}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"name":"Midtown"`)
+	assert.Equal(t, http.StatusNotFound, serve(sensorAPI.GeofenceHandler, "PUT", "/geofences/missing", `{"circle": {"center": {"latitude": 37.7549, "longitude": -122.4194}, "radius": 1}}`).Code)
+	assert.Equal(t, http.StatusNoContent, serve(sensorAPI.GeofenceHandler, "DELETE", "/geofences/"+circle.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(sensorAPI.GeofenceHandler, "DELETE", "/geofences/"+circle.ID, "").Code)
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	sensorAPI := NewSensorAPI(store.NewInMemorySensorStore())
+	authenticator, err := auth.NewAuthenticator(auth.Config{APIKeys: []auth.APIKey{
+		{Name: "dashboard", Key: "read-key", Scopes: []string{auth.ScopeRead}},
+		{Name: "ingest", Key: "write-key", Scopes: []string{auth.ScopeWrite}},
+	}}, "")
+	assert.NoError(t, err)
+	handler := AuthMiddleware(authenticator, nil, auth.ReadWrite, http.HandlerFunc(sensorAPI.SensorsHandler))
+	serve := func(method, key, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "/sensors", strings.NewReader(body))
+		assert.NoError(t, err)
+		if key != "" {
+			req.Header.Set(auth.HeaderAPIKey, key)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	sensor := `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194}}`
+
+	// Test requests without credentials are challenged, except preflight requests
+	recorder := serve("GET", "", "")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, `Bearer realm="sensor-api", scope="sensors:read"`, recorder.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusOK, serve("OPTIONS", "", "").Code)
+
+	// Test invalid credentials are rejected as an invalid token
+	recorder = serve("GET", "wrong-key", "")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+
+	// Test a write key can write, and read
+	assert.Equal(t, http.StatusCreated, serve("POST", "write-key", sensor).Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "write-key", "").Code)
+
+	// Test a read key can read but not write
+	assert.Equal(t, http.StatusOK, serve("GET", "read-key", "").Code)
+	recorder = serve("POST", "read-key", sensor)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, `Bearer realm="sensor-api", error="insufficient_scope", scope="sensors:write"`, recorder.Header().Get("WWW-Authenticate"))
+
+	// Check the principal is passed to the handler
+	var principal auth.Principal
+	handler = AuthMiddleware(authenticator, nil, auth.ReadOnly, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = auth.FromContext(r.Context())
+	}))
+	serve("GET", "read-key", "")
+	assert.Equal(t, "dashboard", principal.Subject)
+
+	// Check requests are not authenticated without an authenticator
+	handler = AuthMiddleware(nil, nil, auth.AdminOnly, http.HandlerFunc(sensorAPI.SensorsHandler))
+	assert.Equal(t, http.StatusOK, serve("GET", "", "").Code)
+
+	// Test requests without the scope are charged to their principal
+	limiter := ratelimit.NewLimiter(ratelimit.Config{
+		Limits: ratelimit.Limits{Read: ratelimit.Limit{Rate: 0.001, Burst: 2}, Write: ratelimit.Limit{Rate: 0.001, Burst: 1}},
+	})
+	handler = AuthMiddleware(authenticator, limiter, auth.ReadWrite, http.HandlerFunc(sensorAPI.SensorsHandler))
+	assert.Equal(t, http.StatusForbidden, serve("POST", "read-key", sensor).Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve("POST", "read-key", sensor).Code)
+
+	// Test repeated bad credentials are limited by client address, before they are checked
+	assert.Equal(t, http.StatusOK, serve("GET", "read-key", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "wrong-key", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "", "").Code)
+	recorder = serve("GET", "wrong-key", "")
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "1000", recorder.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("GET", "read-key", "").Code)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	sensorAPI := NewSensorAPI(store.NewInMemorySensorStore())
+	limiter := ratelimit.NewLimiter(ratelimit.Config{
+		Limits: ratelimit.Limits{Read: ratelimit.Limit{Rate: 0.001, Burst: 2}, Write: ratelimit.Limit{Rate: 0.001, Burst: 1}},
+	})
+	handler := RateLimitMiddleware(limiter, auth.ReadWrite, http.HandlerFunc(sensorAPI.SensorsHandler))
+	serve := func(method, remoteAddr, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "/sensors", strings.NewReader(body))
+		assert.NoError(t, err)
+		req.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// Test limited responses carry the rate limit headers
+	recorder := serve("POST", "10.0.0.1:1234", `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194}}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "1", recorder.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", recorder.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1000", recorder.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "1;w=1000", recorder.Header().Get("RateLimit-Policy"))
+
+	// Test a client over its write limit is refused with Retry-After, but can still read
+	recorder = serve("POST", "10.0.0.1:1234", `{"name":"Sensor2","location":{"latitude":37.7749,"longitude":-122.4194}}`)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "1000", recorder.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, serve("GET", "10.0.0.1:1234", "").Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "10.0.0.1:5678", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve("GET", "10.0.0.1:1234", "").Code)
+
+	// Test clients are told apart by address, and by principal when authenticated
+	assert.Equal(t, http.StatusOK, serve("GET", "10.0.0.2:1234", "").Code)
+	req, err := http.NewRequest("GET", "/sensors", nil)
+	assert.NoError(t, err)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req = req.WithContext(auth.WithPrincipal(req.Context(), auth.Principal{Subject: "dashboard"}))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Check a principal without a subject is limited by address, not in a bucket shared by all of them
+	req = req.WithContext(auth.WithPrincipal(req.Context(), auth.Principal{}))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	req.RemoteAddr = "10.0.0.3:1234"
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Check requests are not limited without a limiter
+	handler = RateLimitMiddleware(nil, auth.ReadWrite, http.HandlerFunc(sensorAPI.SensorsHandler))
+	recorder = serve("GET", "10.0.0.1:1234", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("RateLimit-Limit"))
+}
+
+// lineWriter sends each line logged to it on the channel.
+type lineWriter chan []byte
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	output := make(lineWriter, 10)
+	accessLog := log.New()
+	accessLog.SetOutput(output)
+	accessLog.SetFormatter(&log.JSONFormatter{})
+	sensorStore := store.NewInMemorySensorStore()
+	sensorStore.AddSensor(model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}})
+	sensorAPI := NewSensorAPI(sensorStore)
+	readLine := func() map[string]interface{} {
+		t.Helper()
+		var line map[string]interface{}
+		select {
+		case data := <-output:
+			assert.NoError(t, json.Unmarshal(data, &line))
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the access log")
+		}
+		return line
+	}
+
+	// Test a request gets an ID, returned in the response and logged with the request
+	handler := AccessLogMiddleware(accessLog, "/sensors/", http.HandlerFunc(sensorAPI.SensorHandler))
+	req, err := http.NewRequest("GET", "/sensors/Sensor1", nil)
+	assert.NoError(t, err)
+	req.RemoteAddr = "10.0.0.1:1234"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	id := recorder.Header().Get(HeaderRequestID)
+	assert.Len(t, id, 32)
+	line := readLine()
+	assert.Equal(t, id, line[logging.FieldRequestID])
+	assert.Equal(t, "GET", line["method"])
+	assert.Equal(t, "/sensors/", line["route"])
+	assert.Equal(t, "/sensors/Sensor1", line["path"])
+	assert.Equal(t, float64(http.StatusOK), line["status"])
+	assert.Equal(t, float64(recorder.Body.Len()), line["bytes"])
+	assert.Equal(t, "10.0.0.1", line["client"])
+	assert.Contains(t, line, "latency_ms")
+
+	// Test a valid request ID is propagated, and an invalid one replaced
+	req.Header.Set(HeaderRequestID, "5d7e6c0a-1b2c-4d3e-8f9a-0b1c2d3e4f5a")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, "5d7e6c0a-1b2c-4d3e-8f9a-0b1c2d3e4f5a", recorder.Header().Get(HeaderRequestID))
+	assert.Equal(t, "5d7e6c0a-1b2c-4d3e-8f9a-0b1c2d3e4f5a", readLine()[logging.FieldRequestID])
+	req.Header.Set(HeaderRequestID, "forged\nline")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Len(t, recorder.Header().Get(HeaderRequestID), 32)
+	readLine()
+
+	// Check errors are logged with their status, and handlers get an entry carrying the ID
+	req, err = http.NewRequest("GET", "/sensors/Missing", nil)
+	assert.NoError(t, err)
+	req.Header.Set(HeaderRequestID, "req-1")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, float64(http.StatusNotFound), readLine()["status"])
+	var entry *log.Entry
+	handler = AccessLogMiddleware(accessLog, "/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry = logger(r)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "req-1", entry.Data[logging.FieldRequestID])
+	readLine()
+
+	// Test live queries can still upgrade the connection, logged as switching protocols
+	broker := events.NewBroker(0, 0)
+	sensorStore.SetEventSink(broker)
+	server := httptest.NewServer(AccessLogMiddleware(accessLog, "/sensors/live", http.HandlerFunc(NewSensorAPI(sensorStore, WithEvents(broker)).LiveHandler)))
+	defer server.Close()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NoError(t, err)
+	assert.Len(t, resp.Header.Get(HeaderRequestID), 32)
+	conn.Close()
+	assert.Equal(t, float64(http.StatusSwitchingProtocols), readLine()["status"])
+}
@@ -0,0 +1,324 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sensor-api/internal/events"
+	"sensor-api/internal/model"
+	"sensor-api/internal/store"
+	"sensor-api/internal/tagexpr"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Live queries keep a client's view of the sensors inside a viewport up to date over a WebSocket. The
+// client sends a viewport message, and is sent a snapshot of the sensors inside it. From then on it is
+// sent a message whenever a sensor enters the viewport, changes inside it or leaves it, whether because
+// the sensor changed or because the client sent a new viewport.
+//
+// The client's view is rebuilt from the change feed, so the broker's backpressure applies: a client
+// that falls too far behind is resynchronized by querying the store again, rather than disconnected.
+
+// Live message types
+const (
+	liveViewport = "viewport"
+	liveSnapshot = "snapshot"
+	liveEnter    = "enter"
+	liveUpdate   = "update"
+	liveLeave    = "leave"
+	liveError    = "error"
+)
+
+const (
+	// liveWriteWait is how long a message may take to write before the client is disconnected.
+	liveWriteWait = 10 * time.Second
+	// livePongWait is how long the client may go without answering a ping.
+	livePongWait = 60 * time.Second
+	// livePingInterval is how often the client is pinged, within livePongWait.
+	livePingInterval = livePongWait * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{
+	// live maps are served from other origins
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// viewportMessage is sent by the client to set its viewport: a bounding box, and optionally the tags
+// and tag expression sensors must match as in the tags and tag_expr query parameters.
+type viewportMessage struct {
+	Type    string            `json:"type"`
+	Box     model.BoundingBox `json:"bbox"`
+	Tags    []string          `json:"tags,omitempty"`
+	TagExpr string            `json:"tag_expr,omitempty"`
+}
+
+// parseViewport parses a viewport message, returning the filter selecting the sensors inside it.
+func parseViewport(data []byte) (eventFilter, error) {
+	var msg viewportMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return eventFilter{}, fmt.Errorf("invalid message: %w", err)
+	}
+	if msg.Type != liveViewport {
+		return eventFilter{}, fmt.Errorf("unknown message type %q", msg.Type)
+	}
+	if !msg.Box.IsValid() {
+		return eventFilter{}, fmt.Errorf("invalid bbox: corners must be valid locations with min south-west of max")
+	}
+	filter := eventFilter{tags: tagexpr.AllOf(msg.Tags), box: &msg.Box}
+	if msg.TagExpr != "" {
+		expr, err := tagexpr.Parse(msg.TagExpr)
+		if err != nil {
+			return eventFilter{}, fmt.Errorf("invalid tag_expr: %w", err)
+		}
+		filter.tags = tagexpr.Both(filter.tags, expr)
+	}
+	return filter, nil
+}
+
+// snapshotMessage holds every sensor inside a new client's viewport.
+type snapshotMessage struct {
+	Type    string         `json:"type"`
+	Sensors []model.Sensor `json:"sensors"`
+}
+
+// changeMessage reports a sensor entering, changing inside or leaving the viewport. Name is the name the
+// client knows the sensor by, which differs from the sensor's if it has been renamed.
+type changeMessage struct {
+	Type   string        `json:"type"`
+	Name   string        `json:"name"`
+	Sensor *model.Sensor `json:"sensor,omitempty"`
+}
+
+// errorMessage reports a message from the client that could not be handled.
+type errorMessage struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+// liveSession is the state of a live query: the client's viewport, and the sensors it has been sent.
+type liveSession struct {
+	api    *SensorAPI
+	conn   *websocket.Conn
+	sub    *events.Subscription
+	logger *log.Entry
+	// filter is the client's viewport, valid once the subscription has started
+	filter eventFilter
+	// visible holds the sensors inside the viewport as last sent to the client, by name
+	visible map[string]model.Sensor
+}
+
+// LiveHandler handles requests to /sensors/live.
+func (api *SensorAPI) LiveHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if api.events == nil {
+			logger(r).Error("Change feed is not enabled")
+			http.Error(w, "Change feed is not enabled", http.StatusNotImplemented)
+			return
+		}
+		// the upgrader writes its own response, so the headers set by middleware, such as the request ID,
+		// are passed to it
+		conn, err := upgrader.Upgrade(w, r, w.Header())
+		if err != nil {
+			logger(r).Error("Failed to upgrade connection: ", err)
+			return
+		}
+		defer conn.Close()
+
+		session := &liveSession{api: api, conn: conn, logger: logger(r), visible: make(map[string]model.Sensor)}
+		defer func() {
+			if session.sub != nil {
+				session.sub.Close()
+			}
+		}()
+		if err := session.run(); err != nil {
+			logger(r).Debug("Closing live query: ", err)
+		}
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// run serves the session until the client disconnects or a message cannot be written.
+func (session *liveSession) run() error {
+	messages := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	// gorilla allows one reader and one writer at a time, so messages are read here and written by the loop
+	session.conn.SetReadDeadline(time.Now().Add(livePongWait))
+	session.conn.SetPongHandler(func(string) error {
+		return session.conn.SetReadDeadline(time.Now().Add(livePongWait))
+	})
+	go func() {
+		for {
+			_, msg, err := session.conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+	for {
+		// no events are received until the client has sent a viewport
+		var changes <-chan events.Event
+		if session.sub != nil {
+			changes = session.sub.Events
+		}
+
+		select {
+		case err := <-readErr:
+			if _, ok := err.(*websocket.CloseError); ok {
+				return nil
+			}
+			return err
+		case data := <-messages:
+			filter, err := parseViewport(data)
+			if err != nil {
+				session.logger.Error("Invalid viewport: ", err)
+				if err := session.write(errorMessage{Type: liveError, Error: err.Error()}); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := session.setViewport(filter); err != nil {
+				return err
+			}
+		case event, ok := <-changes:
+			if !ok {
+				// the client fell too far behind the change feed, so it is brought up to date from the store
+				session.logger.Info("Resynchronizing slow live query")
+				session.sub = session.api.events.Subscribe()
+				if err := session.setViewport(session.filter); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := session.apply(event); err != nil {
+				return err
+			}
+		case <-ping.C:
+			if err := session.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteWait)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// setViewport queries the store for the sensors inside a viewport, and sends the client the snapshot if
+// it is the first, or else the sensors entering, changing inside and leaving its view.
+func (session *liveSession) setViewport(filter eventFilter) error {
+	// subscribing before the query means no change is lost between them; changes the query already
+	// includes are recognized and skipped by apply
+	first := session.sub == nil
+	if first {
+		session.sub = session.api.events.Subscribe()
+	}
+	session.filter = filter
+
+	box := filter.box
+	sensors, code, err := store.WithLogger(session.api.store, session.logger).GetSensorsByTagWithinBoundingBox(filter.tags, box.Min.Latitude, box.Min.Longitude, box.Max.Latitude, box.Max.Longitude)
+	if err != nil && code != http.StatusNotFound {
+		session.logger.Error("Failed to get sensors in viewport: ", err)
+		return session.write(errorMessage{Type: liveError, Error: fmt.Sprint("Failed to get sensors in viewport: ", err)})
+	}
+	sort.Slice(sensors, func(i, j int) bool { return sensors[i].Name < sensors[j].Name })
+
+	if first {
+		for _, sensor := range sensors {
+			session.visible[sensor.Name] = sensor
+		}
+		if sensors == nil {
+			sensors = []model.Sensor{}
+		}
+		return session.write(snapshotMessage{Type: liveSnapshot, Sensors: sensors})
+	}
+
+	inside := make(map[string]bool, len(sensors))
+	for _, sensor := range sensors {
+		inside[sensor.Name] = true
+	}
+	var left []string
+	for name := range session.visible {
+		if !inside[name] {
+			left = append(left, name)
+		}
+	}
+	sort.Strings(left)
+	for _, name := range left {
+		delete(session.visible, name)
+		if err := session.write(changeMessage{Type: liveLeave, Name: name}); err != nil {
+			return err
+		}
+	}
+	for i := range sensors {
+		if err := session.show(sensors[i].Name, sensors[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply brings the client's view up to date with a change.
+func (session *liveSession) apply(event events.Event) error {
+	if event.Type != events.TypeCreated && event.Type != events.TypeUpdated && event.Type != events.TypeDeleted {
+		// geofence alerts follow the update they are about, which has already been applied
+		return nil
+	}
+	if event.Sensor != nil && session.filter.matchSensor(event.Sensor) {
+		return session.show(event.Name, *event.Sensor)
+	}
+	if _, ok := session.visible[event.Name]; ok {
+		delete(session.visible, event.Name)
+		return session.write(changeMessage{Type: liveLeave, Name: event.Name})
+	}
+	return nil
+}
+
+// show sends a sensor inside the viewport to the client, known to it by name if it was visible, unless
+// the client already has it as it is.
+func (session *liveSession) show(name string, sensor model.Sensor) error {
+	visible, ok := session.visible[name]
+	if !ok {
+		// a change the viewport's query already included may still arrive under the new name
+		name = sensor.Name
+		visible, ok = session.visible[name]
+	}
+	if ok && reflect.DeepEqual(visible, sensor) {
+		return nil
+	}
+
+	delete(session.visible, name)
+	session.visible[sensor.Name] = sensor
+	msg := changeMessage{Type: liveUpdate, Name: name, Sensor: &sensor}
+	if !ok {
+		msg.Type = liveEnter
+	}
+	return session.write(msg)
+}
+
+// write sends a message to the client.
+func (session *liveSession) write(msg interface{}) error {
+	session.conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+	return session.conn.WriteJSON(msg)
+}
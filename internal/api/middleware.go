@@ -1,9 +1,21 @@
 package api
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"sensor-api/internal/auth"
+	"sensor-api/internal/logging"
+	"sensor-api/internal/ratelimit"
+	"strconv"
+	"sync"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // Middleware used for CORS, authentication, logging, etc.
@@ -29,3 +41,266 @@ func TimeoutMiddleware(timeout time.Duration, h http.Handler) http.Handler {
 		}
 	})
 }
+
+// realm is the protection space named in WWW-Authenticate challenges.
+const realm = "sensor-api"
+
+// AuthMiddleware authenticates requests with authenticator and rejects those without the scope policy
+// requires for their method: with 401 Unauthorized if they have no valid credentials, and 403 Forbidden
+// if their credentials lack the scope. Both carry a bearer WWW-Authenticate challenge, as in RFC 6750.
+// The principal is added to the context of the requests let through. Requests are not authenticated if
+// authenticator is nil.
+//
+// Rejected requests are charged to limiter, if it is not nil, as RateLimitMiddleware would charge them:
+// a 401 as a read by the client address, and a 403 to the principal. A client address that has used up
+// its reads is refused with 429 Too Many Requests before its credentials are checked, so guessing keys
+// or sending forged tokens is limited like any other request.
+func AuthMiddleware(authenticator *auth.Authenticator, limiter *ratelimit.Limiter, policy auth.Policy, h http.Handler) http.Handler {
+	if authenticator == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := policy.Scope(r.Method)
+		if scope == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		address := clientAddress(r)
+		if limiter != nil && !limiter.Check(address, false).Allowed {
+			limit(w, r, limiter, address, false)
+			return
+		}
+		principal, err := authenticator.Authenticate(r)
+		if err != nil && limiter != nil && !limit(w, r, limiter, address, false) {
+			return
+		}
+		if errors.Is(err, auth.ErrNoCredentials) {
+			logger(r).Error("Unauthenticated request to ", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q, scope=%q`, realm, scope))
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			logger(r).Error("Failed to authenticate: ", err)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q, error="invalid_token", error_description=%q`, realm, err.Error()))
+			http.Error(w, fmt.Sprint("Failed to authenticate: ", err), http.StatusUnauthorized)
+			return
+		}
+		if !principal.HasScope(scope) {
+			if limiter != nil && !limit(w, r, limiter, clientName(r, principal), isWrite(policy, r.Method)) {
+				return
+			}
+			logger(r).Error("Forbidden request to ", r.URL.Path, " by ", principal.Subject, ": missing scope ", scope)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q, error="insufficient_scope", scope=%q`, realm, scope))
+			http.Error(w, fmt.Sprint("Missing scope ", scope), http.StatusForbidden)
+			return
+		}
+
+		logger(r).Debug("Authenticated ", principal.Subject, " for ", r.Method, " ", r.URL.Path)
+		h.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// RateLimitMiddleware limits the requests of each client with limiter, refusing those over their limit
+// with 429 Too Many Requests and a Retry-After header. Requests needing a scope above sensors:read by
+// policy are writes, and the rest reads. Clients are the principal added by AuthMiddleware, or the
+// client address without one. Limited responses carry the RateLimit-Limit, RateLimit-Remaining,
+// RateLimit-Reset and RateLimit-Policy headers of the IETF RateLimit header fields draft. Requests are
+// not limited if limiter is nil.
+func RateLimitMiddleware(limiter *ratelimit.Limiter, policy auth.Policy, h http.Handler) http.Handler {
+	if limiter == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := auth.FromContext(r.Context())
+		if !limit(w, r, limiter, clientName(r, principal), isWrite(policy, r.Method)) {
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// limit charges a read or a write by client to limiter and writes the rate limit headers, refusing the
+// request with 429 Too Many Requests if it is over the client's limit. It reports whether the request
+// is allowed.
+func limit(w http.ResponseWriter, r *http.Request, limiter *ratelimit.Limiter, client string, write bool) bool {
+	decision := limiter.Allow(client, write)
+	if decision.Limit > 0 {
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(decision.Reset)))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", decision.Limit, seconds(decision.Window)))
+	}
+	if decision.Allowed {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds(decision.RetryAfter)))
+	if decision.QuotaExceeded {
+		logger(r).Error("Daily quota exceeded by ", client)
+		http.Error(w, "Daily quota exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	logger(r).Error("Rate limit exceeded by ", client)
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	return false
+}
+
+// isWrite reports whether policy needs a scope above sensors:read for a request method.
+func isWrite(policy auth.Policy, method string) bool {
+	scope := policy.Scope(method)
+	return scope == auth.ScopeWrite || scope == auth.ScopeAdmin
+}
+
+// clientName returns the name a request is limited under: the subject of its principal, or its client
+// address if it has no principal or the principal has no subject, so that tokens without a subject do
+// not share one bucket.
+func clientName(r *http.Request, principal auth.Principal) string {
+	if principal.Subject == "" {
+		return clientAddress(r)
+	}
+	return principal.Subject
+}
+
+// clientAddress returns the IP address a request came from.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// seconds rounds a duration up to whole seconds, at least one.
+func seconds(d time.Duration) int {
+	return int(math.Max(1, math.Ceil(d.Seconds())))
+}
+
+// HeaderRequestID is the header a request ID is taken from, and returned in.
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestIDLength is the length of the longest request ID taken from a client.
+const maxRequestIDLength = 128
+
+// logger returns the logrus entry of a request, carrying its request ID.
+func logger(r *http.Request) *log.Entry {
+	return logging.FromContext(r.Context())
+}
+
+// AccessLogMiddleware gives each request an ID, taken from its X-Request-ID header if it has a valid
+// one so that it can be correlated with the client's and proxies' logs, and returns it in the
+// X-Request-ID response header. The handler logs through an entry carrying the ID, passed in the
+// request context. Once the request has been served, one line is logged to accessLog with the ID,
+// method, route, path, status, latency, response bytes and client address.
+func AccessLogMiddleware(accessLog *log.Logger, route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(HeaderRequestID)
+		if !validRequestID(id) {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set(HeaderRequestID, id)
+
+		recorder := &accessRecorder{ResponseWriter: w}
+		entry := log.WithField(logging.FieldRequestID, id)
+		h.ServeHTTP(recorder, r.WithContext(logging.WithEntry(r.Context(), entry)))
+
+		status, bytes := recorder.result()
+		accessLog.WithFields(log.Fields{
+			logging.FieldRequestID: id,
+			"method":               r.Method,
+			"route":                route,
+			"path":                 r.URL.Path,
+			"status":               status,
+			"latency_ms":           float64(time.Since(start).Microseconds()) / 1000,
+			"bytes":                bytes,
+			"client":               clientAddress(r),
+		}).Info("request")
+	})
+}
+
+// validRequestID reports whether a request ID from a client is safe to log and return: not too long,
+// and made of letters, digits and the punctuation found in UUIDs and trace IDs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// accessRecorder records the status and size of a response. It is safe for concurrent use, as
+// TimeoutMiddleware may write a response while the handler it timed out is still writing.
+type accessRecorder struct {
+	http.ResponseWriter
+	mu     sync.Mutex
+	status int
+	bytes  int64
+}
+
+func (rec *accessRecorder) WriteHeader(code int) {
+	rec.mu.Lock()
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.mu.Unlock()
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *accessRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.mu.Lock()
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.bytes += int64(n)
+	rec.mu.Unlock()
+	return n, err
+}
+
+// Flush flushes the response, for the change feed.
+func (rec *accessRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack takes over the connection, for live queries. The response is then written by the caller, so
+// it is recorded as switching protocols.
+func (rec *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		rec.mu.Lock()
+		if rec.status == 0 {
+			rec.status = http.StatusSwitchingProtocols
+		}
+		rec.mu.Unlock()
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the underlying response, for http.ResponseController.
+func (rec *accessRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// result returns the status and size of the response, 200 OK if the handler wrote nothing.
+func (rec *accessRecorder) result() (int, int64) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.status == 0 {
+		return http.StatusOK, rec.bytes
+	}
+	return rec.status, rec.bytes
+}
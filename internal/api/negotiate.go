@@ -0,0 +1,160 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sensor-api/internal/geojson"
+	"sensor-api/internal/model"
+	"strconv"
+	"strings"
+)
+
+// Sensors are written as JSON unless the Accept header prefers GeoJSON, when a sensor is written as a
+// Feature and a list of sensors as a FeatureCollection. Sensors are read as GeoJSON Features when the
+// Content-Type is GeoJSON.
+
+const (
+	mediaTypeJSON    = "application/json"
+	mediaTypeGeoJSON = "application/geo+json"
+)
+
+// negotiate returns the offered media type the Accept header gives the highest quality, or the first
+// offered if none is preferred.
+func negotiate(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	best, bestQuality := offers[0], 0.0
+	if accept == "" {
+		return best
+	}
+	for _, offer := range offers {
+		if quality := acceptQuality(accept, offer); quality > bestQuality {
+			best, bestQuality = offer, quality
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality an Accept header gives a media type, from the most specific media
+// range matching it, or 0 if none does.
+func acceptQuality(accept, mediaType string) float64 {
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		s := -1
+		switch {
+		case mediaRange == mediaType:
+			s = 2
+		case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+			s = 1
+		case mediaRange == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, quality = s, 1
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			quality = q
+		}
+	}
+	return quality
+}
+
+// wantsGeoJSON reports whether the client prefers GeoJSON to JSON.
+func wantsGeoJSON(r *http.Request) bool {
+	return negotiate(r, mediaTypeJSON, mediaTypeGeoJSON) == mediaTypeGeoJSON
+}
+
+// varyAccept records for caches that the response depends on the Accept header.
+func varyAccept(w http.ResponseWriter) {
+	w.Header().Set("Vary", "Accept")
+}
+
+// writeSensor writes a sensor as JSON, or as a GeoJSON Feature if the client prefers it.
+func writeSensor(w http.ResponseWriter, r *http.Request, code int, sensor model.Sensor) {
+	varyAccept(w)
+	if wantsGeoJSON(r) {
+		writeJSON(w, code, mediaTypeGeoJSON, geojson.NewSensorFeature(sensor))
+		return
+	}
+	writeJSON(w, code, mediaTypeJSON, sensor)
+}
+
+// writeSensors writes sensors as JSON, or as a GeoJSON FeatureCollection if the client prefers it.
+func writeSensors(w http.ResponseWriter, r *http.Request, code int, sensors []model.Sensor) {
+	varyAccept(w)
+	if wantsGeoJSON(r) {
+		writeJSON(w, code, mediaTypeGeoJSON, geojson.NewSensorFeatureCollection(sensors))
+		return
+	}
+	writeJSON(w, code, mediaTypeJSON, sensors)
+}
+
+// writeSensorDistances writes sensors found by distance as JSON, or as a GeoJSON FeatureCollection
+// with their distance and bearing as properties if the client prefers it.
+func writeSensorDistances(w http.ResponseWriter, r *http.Request, code int, sensors []model.SensorDistance) {
+	varyAccept(w)
+	if wantsGeoJSON(r) {
+		writeJSON(w, code, mediaTypeGeoJSON, geojson.NewSensorDistanceFeatureCollection(sensors))
+		return
+	}
+	writeJSON(w, code, mediaTypeJSON, sensors)
+}
+
+// featurePage is a page of a sensor listing as a GeoJSON FeatureCollection, with the link to the next
+// page as a foreign member.
+type featurePage struct {
+	geojson.SensorFeatureCollection
+	Next string `json:"next,omitempty"`
+}
+
+// writeSensorListing writes a listing of sensors as writeListing does, or as a GeoJSON
+// FeatureCollection if the client prefers it.
+func writeSensorListing(w http.ResponseWriter, r *http.Request, l listing, code int, sensors []model.Sensor, next *pageKey) {
+	varyAccept(w)
+	if !wantsGeoJSON(r) {
+		writeListing(w, r, l, code, sensors, next)
+		return
+	}
+	link, err := l.nextLink(r, next)
+	if err != nil {
+		logger(r).Error("Failed to encode cursor: ", err)
+		http.Error(w, "Failed to encode cursor", http.StatusInternalServerError)
+		return
+	}
+	writeTagged(w, r, code, mediaTypeGeoJSON, featurePage{geojson.NewSensorFeatureCollection(sensors), link})
+}
+
+// writeJSON writes body as JSON of the given media type.
+func writeJSON(w http.ResponseWriter, code int, mediaType string, body interface{}) {
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// decodeSensor reads a sensor from a request body: a GeoJSON Feature if the Content-Type is GeoJSON,
+// and otherwise JSON.
+func decodeSensor(r *http.Request) (model.Sensor, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mediaTypeGeoJSON {
+		var sensor model.Sensor
+		err := json.NewDecoder(r.Body).Decode(&sensor)
+		return sensor, err
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return model.Sensor{}, err
+	}
+	sensor, err := geojson.DecodeSensorFeature(body)
+	if err != nil {
+		return model.Sensor{}, fmt.Errorf("invalid feature: %w", err)
+	}
+	return sensor, nil
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/model"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Listings are always returned in a stable order, given by the sort query parameter. With limit or
+// cursor they are also split into pages, written as an envelope holding the items and a link to the
+// next page:
+//
+//	{"items": [...], "next": "/sensors?cursor=...&limit=10"}
+//
+// A cursor holds the sort key of the last item on its page, and the next page starts after that key
+// rather than at an offset, so adding or removing sensors between requests never repeats or skips the
+// items that remain.
+
+const (
+	// DefaultPageLimit is the page size when a cursor is given without a limit.
+	DefaultPageLimit = 100
+	// MaxPageLimit is the largest page size allowed.
+	MaxPageLimit = 1000
+
+	sortName     = "name"
+	sortNameDesc = "-name"
+	sortDistance = "distance"
+	// sortLocation orders locations by latitude, then longitude.
+	sortLocation = "location"
+)
+
+// pageKey is the position of an item in a listing. Keys are compared by Distance, then Name, then
+// Latitude and Longitude; fields not used by a sort are left zero.
+type pageKey struct {
+	Distance  float64 `json:"d,omitempty"`
+	Name      string  `json:"n,omitempty"`
+	Latitude  float64 `json:"lat,omitempty"`
+	Longitude float64 `json:"lng,omitempty"`
+}
+
+func (k pageKey) less(other pageKey) bool {
+	if k.Distance != other.Distance {
+		return k.Distance < other.Distance
+	}
+	if k.Name != other.Name {
+		return k.Name < other.Name
+	}
+	if k.Latitude != other.Latitude {
+		return k.Latitude < other.Latitude
+	}
+	return k.Longitude < other.Longitude
+}
+
+// cursor is the decoded form of a cursor token.
+type cursor struct {
+	// Sort is the sort the cursor was issued for, which later pages must keep.
+	Sort  string  `json:"s"`
+	After pageKey `json:"k"`
+}
+
+// listing holds the sort, limit and cursor query parameters of a listing.
+type listing struct {
+	// sort is the normalized sort parameter, such as "-name" or "distance(37.7749,-122.4194)".
+	sort string
+	kind string
+	// origin is the location distances are measured from when sorting by distance, with measure.
+	origin  model.Location
+	measure geo.DistanceFunc
+	// limit is the page size, or 0 if the listing is not paged.
+	limit int
+	// after is the key of the last item on the previous page, if there is one.
+	after *pageKey
+}
+
+// parseListing reads the sort, limit and cursor query parameters, allowing the given sorts. The first
+// is the default. Distances are measured with distance.
+func parseListing(query url.Values, distance geo.DistanceFunc, sorts ...string) (listing, error) {
+	l := listing{sort: sorts[0], kind: sorts[0], measure: distance}
+
+	if query.Has("sort") {
+		l.sort = query.Get("sort")
+		l.kind = l.sort
+		if strings.HasPrefix(l.sort, sortDistance+"(") && strings.HasSuffix(l.sort, ")") {
+			l.kind = sortDistance
+			args := strings.Split(strings.TrimSuffix(strings.TrimPrefix(l.sort, sortDistance+"("), ")"), ",")
+			if len(args) != 2 {
+				return l, fmt.Errorf("invalid sort %q: distance takes a latitude and longitude", l.sort)
+			}
+			lat, latErr := strconv.ParseFloat(strings.TrimSpace(args[0]), 64)
+			lon, lonErr := strconv.ParseFloat(strings.TrimSpace(args[1]), 64)
+			l.origin = model.Location{Latitude: lat, Longitude: lon}
+			if latErr != nil || lonErr != nil || !l.origin.IsValid() {
+				return l, fmt.Errorf("invalid sort %q: invalid location", l.sort)
+			}
+			l.sort = fmt.Sprintf("%s(%s,%s)", sortDistance, strconv.FormatFloat(lat, 'g', -1, 64), strconv.FormatFloat(lon, 'g', -1, 64))
+		}
+		if l.sort == sortDistance {
+			return l, fmt.Errorf("invalid sort %q: distance takes a latitude and longitude", l.sort)
+		}
+		allowed := false
+		for _, s := range sorts {
+			allowed = allowed || s == l.kind
+		}
+		if !allowed {
+			return l, fmt.Errorf("invalid sort %q", query.Get("sort"))
+		}
+	}
+
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > MaxPageLimit {
+			return l, fmt.Errorf("invalid limit %q: must be between 1 and %d", query.Get("limit"), MaxPageLimit)
+		}
+		l.limit = limit
+	}
+
+	if query.Has("cursor") {
+		token, err := base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+		var c cursor
+		if err != nil || json.Unmarshal(token, &c) != nil {
+			return l, fmt.Errorf("invalid cursor")
+		}
+		if c.Sort != l.sort {
+			return l, fmt.Errorf("invalid cursor: issued for sort %q", c.Sort)
+		}
+		l.after = &c.After
+		if l.limit == 0 {
+			l.limit = DefaultPageLimit
+		}
+	}
+
+	return l, nil
+}
+
+// sensorKey returns the position of a sensor in the listing.
+func (l listing) sensorKey(sensor model.Sensor) pageKey {
+	if l.kind == sortDistance {
+		return pageKey{Distance: l.distance(sensor.Location), Name: sensor.Name}
+	}
+	return pageKey{Name: sensor.Name}
+}
+
+// locationKey returns the position of a location in the listing.
+func (l listing) locationKey(location model.Location) pageKey {
+	key := pageKey{Latitude: location.Latitude, Longitude: location.Longitude}
+	if l.kind == sortDistance {
+		key.Distance = l.distance(location)
+	}
+	return key
+}
+
+// distance returns the distance in meters from the sort's origin.
+func (l listing) distance(location model.Location) float64 {
+	return l.measure(l.origin.Latitude, l.origin.Longitude, location.Latitude, location.Longitude)
+}
+
+// page sorts items by their keys and returns the indexes of the items on the requested page, in order,
+// and the cursor for the next page, or nil if this is the last.
+func (l listing) page(keys []pageKey) ([]int, *pageKey) {
+	less := func(a, b pageKey) bool { return a.less(b) }
+	if l.kind == sortNameDesc {
+		less = func(a, b pageKey) bool { return b.less(a) }
+	}
+
+	indexes := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if l.after == nil || less(*l.after, key) {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return less(keys[indexes[i]], keys[indexes[j]]) })
+
+	if l.limit == 0 || len(indexes) <= l.limit {
+		return indexes, nil
+	}
+	indexes = indexes[:l.limit]
+	return indexes, &keys[indexes[len(indexes)-1]]
+}
+
+// paged reports whether the listing is written as pages.
+func (l listing) paged() bool {
+	return l.limit > 0
+}
+
+// pageEnvelope is a page of a listing.
+type pageEnvelope struct {
+	Items interface{} `json:"items"`
+	// Next is the URL of the next page, or empty if this is the last.
+	Next string `json:"next,omitempty"`
+}
+
+// nextLink returns the URL of the page starting after next, or an empty string if next is nil.
+func (l listing) nextLink(r *http.Request, next *pageKey) (string, error) {
+	if next == nil {
+		return "", nil
+	}
+	token, err := json.Marshal(cursor{Sort: l.sort, After: *next})
+	if err != nil {
+		return "", err
+	}
+	u := *r.URL
+	query := u.Query()
+	query.Set("cursor", base64.RawURLEncoding.EncodeToString(token))
+	u.RawQuery = query.Encode()
+	return u.RequestURI(), nil
+}
+
+// writeListing writes items, sorted and paged by the listing, as JSON tagged with a weak ETag. Paged
+// listings are wrapped in an envelope linking to the next page.
+func writeListing(w http.ResponseWriter, r *http.Request, l listing, code int, items interface{}, next *pageKey) {
+	var body interface{} = items
+	if l.paged() {
+		link, err := l.nextLink(r, next)
+		if err != nil {
+			logger(r).Error("Failed to encode cursor: ", err)
+			http.Error(w, "Failed to encode cursor", http.StatusInternalServerError)
+			return
+		}
+		body = pageEnvelope{Items: items, Next: link}
+	}
+	writeTagged(w, r, code, mediaTypeJSON, body)
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sensor-api/internal/jsonpatch"
+	"sensor-api/internal/model"
+	"sensor-api/internal/store"
+)
+
+// acceptPatch lists the patch formats PATCH /sensors/{name} accepts, for the Accept-Patch header.
+var acceptPatch = jsonpatch.MediaTypeMergePatch + ", " + jsonpatch.MediaTypeJSONPatch
+
+// parsePatch parses a patch document of the given content type, returning the status code to fail
+// with if it cannot: 415 Unsupported Media Type for other formats and 400 Bad Request for malformed
+// documents.
+func parsePatch(contentType string, body []byte) (jsonpatch.Patch, int, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("invalid content type %q", contentType)
+	}
+
+	switch mediaType {
+	case jsonpatch.MediaTypeMergePatch:
+		patch, err := jsonpatch.ParseMergePatch(body)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return patch, http.StatusOK, nil
+	case jsonpatch.MediaTypeJSONPatch:
+		patch, err := jsonpatch.ParseJSONPatch(body)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return patch, http.StatusOK, nil
+	}
+	return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", mediaType)
+}
+
+// sensorPatch returns a store.Patch applying a patch document to the JSON form of a sensor. The
+// patched document must still decode to a sensor, without unknown members.
+func sensorPatch(patch jsonpatch.Patch) store.Patch {
+	return func(sensor model.Sensor) (model.Sensor, error) {
+		// patches see an empty list rather than null, so tags can be added to a sensor without any
+		if sensor.Tags == nil {
+			sensor.Tags = []string{}
+		}
+		doc, err := json.Marshal(sensor)
+		if err != nil {
+			return model.Sensor{}, err
+		}
+		doc, err = patch.Apply(doc)
+		if err != nil {
+			return model.Sensor{}, err
+		}
+
+		var patched model.Sensor
+		decoder := json.NewDecoder(bytes.NewReader(doc))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&patched); err != nil {
+			return model.Sensor{}, fmt.Errorf("patched sensor is invalid: %w", err)
+		}
+		if len(patched.Tags) == 0 {
+			patched.Tags = nil
+		}
+		return patched, nil
+	}
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sensor-api/internal/webhook"
+	"strings"
+)
+
+// WithWebhooks manages webhooks through dispatcher.
+func WithWebhooks(dispatcher *webhook.Dispatcher) Option {
+	return func(api *SensorAPI) {
+		api.webhooks = dispatcher
+	}
+}
+
+// webhooksEnabled writes 501 Not Implemented if webhooks are not enabled.
+func (api *SensorAPI) webhooksEnabled(w http.ResponseWriter, r *http.Request) bool {
+	if api.webhooks == nil {
+		logger(r).Error("Webhooks are not enabled")
+		http.Error(w, "Webhooks are not enabled", http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+// WebhooksHandler handles requests to /webhooks.
+func (api *SensorAPI) WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if !api.webhooksEnabled(w, r) {
+			return
+		}
+		hooks, code, err := api.webhooks.GetWebhooks()
+		if err != nil {
+			logger(r).Error("Failed to get webhooks: ", err)
+			http.Error(w, fmt.Sprint("Failed to get webhooks: ", err), code)
+			return
+		}
+
+		writeJSON(w, code, mediaTypeJSON, hooks)
+	case http.MethodPost:
+		if !api.webhooksEnabled(w, r) {
+			return
+		}
+		var hook webhook.Webhook
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&hook); err != nil {
+			logger(r).Error("Failed to decode webhook: ", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		hook, code, err := api.webhooks.AddWebhook(hook)
+		if err != nil {
+			logger(r).Error("Failed to add webhook: ", err)
+			http.Error(w, fmt.Sprint("Failed to add webhook: ", err), code)
+			return
+		}
+
+		w.Header().Set("Location", "/webhooks/"+hook.ID)
+		writeJSON(w, code, mediaTypeJSON, hook)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// WebhookHandler handles requests to /webhooks/{id}.
+func (api *SensorAPI) WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/webhooks/dead-letters") {
+		api.DeadLettersHandler(w, r)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/webhooks/")
+	switch r.Method {
+	case http.MethodGet:
+		if !api.webhooksEnabled(w, r) {
+			return
+		}
+		hook, code, err := api.webhooks.GetWebhook(id)
+		if err != nil {
+			logger(r).Error("Failed to get webhook: ", err)
+			http.Error(w, fmt.Sprint("Failed to get webhook: ", err), code)
+			return
+		}
+
+		writeJSON(w, code, mediaTypeJSON, hook)
+	case http.MethodDelete:
+		if !api.webhooksEnabled(w, r) {
+			return
+		}
+		code, err := api.webhooks.RemoveWebhook(id)
+		if err != nil {
+			logger(r).Error("Failed to remove webhook: ", err)
+			http.Error(w, fmt.Sprint("Failed to remove webhook: ", err), code)
+			return
+		}
+
+		w.WriteHeader(code)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// DeadLettersHandler handles requests to /webhooks/dead-letters and /webhooks/dead-letters/{id}/replay.
+func (api *SensorAPI) DeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/webhooks/dead-letters" {
+		api.replayHandler(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !api.webhooksEnabled(w, r) {
+			return
+		}
+		deliveries, code, err := api.webhooks.GetDeadLetters()
+		if err != nil {
+			logger(r).Error("Failed to get dead letters: ", err)
+			http.Error(w, fmt.Sprint("Failed to get dead letters: ", err), code)
+			return
+		}
+
+		writeJSON(w, code, mediaTypeJSON, deliveries)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// replayHandler handles requests to /webhooks/dead-letters/{id}/replay.
+func (api *SensorAPI) replayHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/webhooks/dead-letters/")
+	if !strings.HasSuffix(id, "/replay") {
+		http.NotFound(w, r)
+		return
+	}
+	id = strings.TrimSuffix(id, "/replay")
+
+	switch r.Method {
+	case http.MethodPost:
+		if !api.webhooksEnabled(w, r) {
+			return
+		}
+		code, err := api.webhooks.ReplayDeadLetter(id)
+		if err != nil {
+			logger(r).Error("Failed to replay dead letter: ", err)
+			http.Error(w, fmt.Sprint("Failed to replay dead letter: ", err), code)
+			return
+		}
+
+		w.WriteHeader(code)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	default:
+		logger(r).Error("Invalid HTTP request method: ", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,522 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// An Authenticator identifies the client making a request, from a static API key or a JWT, and the
+// scopes it was granted. API keys are sent in the X-API-Key header or as a bearer token, and JWTs as a
+// bearer token in the Authorization header. Browsers cannot set headers on EventSource and WebSocket
+// requests, so either may also be sent in the access_token query parameter.
+//
+// JWTs must be signed with HS256 or RS256 by one of the configured keys, which come from the config file
+// or a JWKS file. A token naming a key with "kid" is only checked against that key, and a key is only
+// used for its own algorithm, so an RSA public key can never be used as an HMAC secret. Tokens are
+// rejected once expired or before their "nbf", allowing Leeway for clock skew, and when an issuer or
+// audience is configured, unless they carry it. Their scopes are read from the space-separated "scope"
+// claim or the "scp" claim.
+//
+// Scopes are hierarchical: sensors:admin grants sensors:write, which grants sensors:read.
+
+// Scopes
+const (
+	ScopeRead  = "sensors:read"
+	ScopeWrite = "sensors:write"
+	ScopeAdmin = "sensors:admin"
+)
+
+// Signing algorithms
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+)
+
+// Policy maps request methods to the scope they require. The scope for "" applies to the methods not
+// listed, and an empty scope lets requests through without credentials.
+type Policy map[string]string
+
+// Policies for the endpoints. Preflight OPTIONS requests never carry credentials, so are let through.
+var (
+	// ReadOnly requires sensors:read for every method.
+	ReadOnly = Policy{http.MethodOptions: "", "": ScopeRead}
+	// ReadWrite requires sensors:read to read and sensors:write for everything else.
+	ReadWrite = Policy{http.MethodGet: ScopeRead, http.MethodHead: ScopeRead, http.MethodOptions: "", "": ScopeWrite}
+	// ReadAdmin requires sensors:read to read and sensors:admin for everything else.
+	ReadAdmin = Policy{http.MethodGet: ScopeRead, http.MethodHead: ScopeRead, http.MethodOptions: "", "": ScopeAdmin}
+	// AdminOnly requires sensors:admin for every method.
+	AdminOnly = Policy{http.MethodOptions: "", "": ScopeAdmin}
+)
+
+// Scope returns the scope a request with method requires, or "" if it requires none.
+func (p Policy) Scope(method string) string {
+	if scope, ok := p[method]; ok {
+		return scope
+	}
+	return p[""]
+}
+
+// HeaderAPIKey is the header API keys are sent in.
+const HeaderAPIKey = "X-API-Key"
+
+// Leeway is the clock skew allowed when checking the times in a JWT.
+const Leeway = time.Minute
+
+var (
+	// ErrNoCredentials is returned for a request without an API key or token.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned for a request with an unknown API key, or a token that could not
+	// be verified.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// implied holds the scopes each scope grants beyond itself.
+var implied = map[string][]string{
+	ScopeAdmin: {ScopeWrite, ScopeRead},
+	ScopeWrite: {ScopeRead},
+}
+
+// Principal is an authenticated client.
+type Principal struct {
+	// Subject is the name of the API key, or the "sub" claim of the token.
+	Subject string
+	Scopes  []string
+}
+
+// HasScope reports whether the principal was granted scope, directly or by a scope implying it.
+func (p Principal) HasScope(scope string) bool {
+	for _, granted := range p.Scopes {
+		if granted == scope {
+			return true
+		}
+		for _, s := range implied[granted] {
+			if s == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the principal.
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal carried by ctx, if any.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// APIKey is a static API key.
+type APIKey struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Scopes []string `json:"scopes"`
+}
+
+// Key is a key JWTs are verified with: an HS256 secret, or an RS256 public key in a PEM file.
+type Key struct {
+	ID        string `json:"kid,omitempty"`
+	Algorithm string `json:"alg"`
+	Secret    string `json:"secret,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+}
+
+// Config is the configuration of an Authenticator, read from a JSON file. Relative file paths are
+// resolved from the directory of the config file.
+type Config struct {
+	APIKeys []APIKey `json:"api_keys,omitempty"`
+	Keys    []Key    `json:"keys,omitempty"`
+	// JWKSFile is a JSON Web Key Set file of further keys.
+	JWKSFile string `json:"jwks_file,omitempty"`
+	// Issuer and Audience, if set, must be the "iss" claim and one of the "aud" claim of every token.
+	Issuer   string `json:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty"`
+}
+
+// apiKey is an API key, held by its hash so that keys are compared in constant time.
+type apiKey struct {
+	hash   [sha256.Size]byte
+	name   string
+	scopes []string
+}
+
+// verifier is a key JWTs are verified with.
+type verifier struct {
+	id        string
+	algorithm string
+	secret    []byte
+	public    *rsa.PublicKey
+}
+
+// Authenticator authenticates requests.
+type Authenticator struct {
+	apiKeys   []apiKey
+	verifiers []verifier
+	issuer    string
+	audience  string
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// LoadConfig reads the config file at path and creates an Authenticator from it.
+func LoadConfig(path string) (*Authenticator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config Config
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid auth config: %w", err)
+	}
+	return NewAuthenticator(config, filepath.Dir(path))
+}
+
+// NewAuthenticator creates an Authenticator from config, resolving relative file paths from dir.
+func NewAuthenticator(config Config, dir string) (*Authenticator, error) {
+	a := &Authenticator{issuer: config.Issuer, audience: config.Audience, now: time.Now}
+	for i, key := range config.APIKeys {
+		if key.Key == "" {
+			return nil, fmt.Errorf("api key %d has no key", i)
+		}
+		if err := checkScopes(key.Scopes); err != nil {
+			return nil, fmt.Errorf("api key %q: %w", key.Name, err)
+		}
+		a.apiKeys = append(a.apiKeys, apiKey{hash: sha256.Sum256([]byte(key.Key)), name: key.Name, scopes: key.Scopes})
+	}
+	for _, key := range config.Keys {
+		v := verifier{id: key.ID, algorithm: key.Algorithm}
+		switch key.Algorithm {
+		case HS256:
+			if key.Secret == "" {
+				return nil, fmt.Errorf("key %q has no secret", key.ID)
+			}
+			v.secret = []byte(key.Secret)
+		case RS256:
+			public, err := readPublicKey(resolve(dir, key.PublicKey))
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", key.ID, err)
+			}
+			v.public = public
+		default:
+			return nil, fmt.Errorf("key %q has unsupported algorithm %q", key.ID, key.Algorithm)
+		}
+		a.verifiers = append(a.verifiers, v)
+	}
+	if config.JWKSFile != "" {
+		verifiers, err := readJWKS(resolve(dir, config.JWKSFile))
+		if err != nil {
+			return nil, fmt.Errorf("jwks file: %w", err)
+		}
+		a.verifiers = append(a.verifiers, verifiers...)
+	}
+	return a, nil
+}
+
+// checkScopes returns an error if any of scopes is unknown.
+func checkScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if scope != ScopeRead && scope != ScopeWrite && scope != ScopeAdmin {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+// resolve returns path resolved from dir if it is relative.
+func resolve(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// readPublicKey reads an RSA public key from a PEM file, as a PKIX public key or a certificate.
+func readPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in %s", path)
+	}
+	var public interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		public = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		public, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := public.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold an RSA public key", path)
+	}
+	return rsaKey, nil
+}
+
+// jwk is a JSON Web Key, of which RSA and symmetric keys are read.
+type jwk struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	K         string `json:"k"`
+}
+
+// readJWKS reads the keys of a JWKS file, skipping encryption keys and key types other than RSA and
+// symmetric keys.
+func readJWKS(path string) ([]verifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	var verifiers []verifier
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		switch key.KeyType {
+		case "RSA":
+			if key.Algorithm != "" && key.Algorithm != RS256 {
+				continue
+			}
+			n, err := base64.RawURLEncoding.DecodeString(key.N)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: invalid modulus: %w", key.ID, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(key.E)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: invalid exponent: %w", key.ID, err)
+			}
+			exponent := new(big.Int).SetBytes(e)
+			if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+				return nil, fmt.Errorf("key %q: invalid RSA key", key.ID)
+			}
+			public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+			verifiers = append(verifiers, verifier{id: key.ID, algorithm: RS256, public: public})
+		case "oct":
+			if key.Algorithm != "" && key.Algorithm != HS256 {
+				continue
+			}
+			secret, err := base64.RawURLEncoding.DecodeString(key.K)
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("key %q: invalid secret", key.ID)
+			}
+			verifiers = append(verifiers, verifier{id: key.ID, algorithm: HS256, secret: secret})
+		default:
+			log.Debug("Skipping JWKS key ", key.ID, " of unsupported type ", key.KeyType)
+		}
+	}
+	return verifiers, nil
+}
+
+// Authenticate returns the principal making a request. It returns ErrNoCredentials if the request has
+// no credentials, and an error wrapping ErrInvalidCredentials if they are not valid.
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	credential := r.Header.Get(HeaderAPIKey)
+	if credential == "" {
+		if header := r.Header.Get("Authorization"); header != "" {
+			scheme, token, ok := strings.Cut(header, " ")
+			if !ok || !strings.EqualFold(scheme, "Bearer") {
+				return Principal{}, fmt.Errorf("%w: unsupported authorization scheme", ErrInvalidCredentials)
+			}
+			credential = strings.TrimSpace(token)
+		} else {
+			credential = r.URL.Query().Get("access_token")
+		}
+	}
+	if credential == "" {
+		return Principal{}, ErrNoCredentials
+	}
+
+	if p, ok := a.lookupAPIKey(credential); ok {
+		return p, nil
+	}
+	if strings.Count(credential, ".") != 2 {
+		return Principal{}, fmt.Errorf("%w: unknown api key", ErrInvalidCredentials)
+	}
+	p, err := a.verify(credential)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return p, nil
+}
+
+// lookupAPIKey returns the principal of an API key, comparing it against every key in constant time.
+func (a *Authenticator) lookupAPIKey(key string) (Principal, bool) {
+	hash := sha256.Sum256([]byte(key))
+	var found *apiKey
+	for i := range a.apiKeys {
+		if subtle.ConstantTimeCompare(hash[:], a.apiKeys[i].hash[:]) == 1 {
+			found = &a.apiKeys[i]
+		}
+	}
+	if found == nil {
+		return Principal{}, false
+	}
+	return Principal{Subject: found.name, Scopes: found.scopes}, true
+}
+
+// header is the header of a JWT.
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// claims are the claims of a JWT that are checked.
+type claims struct {
+	Subject   string       `json:"sub"`
+	Issuer    string       `json:"iss"`
+	Audience  claimStrings `json:"aud"`
+	ExpiresAt *float64     `json:"exp"`
+	NotBefore *float64     `json:"nbf"`
+	Scope     string       `json:"scope"`
+	Scp       claimStrings `json:"scp"`
+}
+
+// claimStrings is a claim holding an array of strings, or a string of them separated by spaces.
+type claimStrings []string
+
+func (cs *claimStrings) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*cs = strings.Fields(s)
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return errors.New("must be a string or an array of strings")
+	}
+	*cs = values
+	return nil
+}
+
+// verify verifies a JWT and returns its principal.
+func (a *Authenticator) verify(token string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return Principal{}, fmt.Errorf("invalid header: %w", err)
+	}
+	if h.Algorithm != HS256 && h.Algorithm != RS256 {
+		return Principal{}, fmt.Errorf("unsupported algorithm %q", h.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, errors.New("invalid signature encoding")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, v := range a.verifiers {
+		if v.algorithm != h.Algorithm || (h.KeyID != "" && v.id != h.KeyID) {
+			continue
+		}
+		if v.check(signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return Principal{}, errors.New("signature not verified")
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return Principal{}, fmt.Errorf("invalid claims: %w", err)
+	}
+	now := a.now()
+	if c.ExpiresAt != nil && now.After(unixTime(*c.ExpiresAt).Add(Leeway)) {
+		return Principal{}, errors.New("token is expired")
+	}
+	if c.NotBefore != nil && now.Add(Leeway).Before(unixTime(*c.NotBefore)) {
+		return Principal{}, errors.New("token is not valid yet")
+	}
+	if a.issuer != "" && c.Issuer != a.issuer {
+		return Principal{}, fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	if a.audience != "" && !contains(c.Audience, a.audience) {
+		return Principal{}, errors.New("token is not for this audience")
+	}
+
+	scopes := append(strings.Fields(c.Scope), c.Scp...)
+	return Principal{Subject: c.Subject, Scopes: scopes}, nil
+}
+
+// check reports whether signature is a valid signature of signed.
+func (v verifier) check(signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	if v.algorithm == HS256 {
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+	return rsa.VerifyPKCS1v15(v.public, crypto.SHA256, digest[:], signature) == nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a JWT.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// unixTime converts a NumericDate claim to a time.
+func unixTime(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sign creates a JWT with the header and claims, signed with an HMAC secret or an RSA private key.
+func sign(t *testing.T, header, claims map[string]interface{}, key interface{}) string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		assert.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// request creates a request carrying a credential in the header.
+func request(t *testing.T, header, credential string) *http.Request {
+	req, err := http.NewRequest("GET", "/sensors", nil)
+	assert.NoError(t, err)
+	if header != "" {
+		req.Header.Set(header, credential)
+	}
+	return req
+}
+
+func TestAPIKeys(t *testing.T) {
+	a, err := NewAuthenticator(Config{APIKeys: []APIKey{
+		{Name: "ingest", Key: "ingest-key", Scopes: []string{ScopeWrite}},
+		{Name: "dashboard", Key: "dashboard-key", Scopes: []string{ScopeRead}},
+	}}, "")
+	assert.NoError(t, err)
+
+	// Test API keys are accepted in the X-API-Key header, as a bearer token and in the query
+	p, err := a.Authenticate(request(t, HeaderAPIKey, "ingest-key"))
+	assert.NoError(t, err)
+	assert.Equal(t, Principal{Subject: "ingest", Scopes: []string{ScopeWrite}}, p)
+	p, err = a.Authenticate(request(t, "Authorization", "Bearer dashboard-key"))
+	assert.NoError(t, err)
+	assert.Equal(t, "dashboard", p.Subject)
+	req, err := http.NewRequest("GET", "/sensors/events?access_token=dashboard-key", nil)
+	assert.NoError(t, err)
+	p, err = a.Authenticate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "dashboard", p.Subject)
+
+	// Check missing, unknown and unsupported credentials are told apart
+	_, err = a.Authenticate(request(t, "", ""))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+	_, err = a.Authenticate(request(t, HeaderAPIKey, "wrong-key"))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = a.Authenticate(request(t, "Authorization", "Basic dXNlcjpwYXNz"))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	// Check keys with unknown scopes are rejected
+	_, err = NewAuthenticator(Config{APIKeys: []APIKey{{Name: "typo", Key: "k", Scopes: []string{"sensor:read"}}}}, "")
+	assert.Error(t, err)
+	_, err = NewAuthenticator(Config{APIKeys: []APIKey{{Name: "empty"}}}, "")
+	assert.Error(t, err)
+}
+
+func TestScopes(t *testing.T) {
+	// Test scopes imply the scopes below them
+	admin := Principal{Scopes: []string{ScopeAdmin}}
+	writer := Principal{Scopes: []string{ScopeWrite}}
+	reader := Principal{Scopes: []string{ScopeRead}}
+	assert.True(t, admin.HasScope(ScopeRead))
+	assert.True(t, admin.HasScope(ScopeWrite))
+	assert.True(t, writer.HasScope(ScopeRead))
+	assert.False(t, writer.HasScope(ScopeAdmin))
+	assert.False(t, reader.HasScope(ScopeWrite))
+	assert.False(t, Principal{}.HasScope(ScopeRead))
+
+	// Check policies choose the scope by method
+	assert.Equal(t, ScopeRead, ReadWrite.Scope(http.MethodGet))
+	assert.Equal(t, ScopeWrite, ReadWrite.Scope(http.MethodDelete))
+	assert.Equal(t, "", ReadWrite.Scope(http.MethodOptions))
+	assert.Equal(t, ScopeRead, ReadOnly.Scope(http.MethodPost))
+	assert.Equal(t, ScopeAdmin, ReadAdmin.Scope(http.MethodPut))
+	assert.Equal(t, ScopeAdmin, AdminOnly.Scope(http.MethodGet))
+}
+
+func TestHS256(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	a, err := NewAuthenticator(Config{
+		Keys:     []Key{{ID: "primary", Algorithm: HS256, Secret: string(secret)}},
+		Issuer:   "https://auth.example.com",
+		Audience: "sensor-api",
+	}, "")
+	assert.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return now }
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "alice", "iss": "https://auth.example.com", "aud": "sensor-api", "exp": now.Unix() + 60, "scope": "sensors:read sensors:write"}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	header := map[string]interface{}{"alg": "HS256", "typ": "JWT", "kid": "primary"}
+
+	// Test a valid token is accepted, with its subject and scopes
+	p, err := a.Authenticate(request(t, "Authorization", "Bearer "+sign(t, header, claims(nil), secret)))
+	assert.NoError(t, err)
+	assert.Equal(t, Principal{Subject: "alice", Scopes: []string{ScopeRead, ScopeWrite}}, p)
+
+	// Check scopes are also read from the scp claim, and the audience from an array
+	p, err = a.Authenticate(request(t, "Authorization", "Bearer "+sign(t, header, claims(map[string]interface{}{"scope": nil, "scp": []string{ScopeAdmin}, "aud": []string{"other", "sensor-api"}}), secret)))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ScopeAdmin}, p.Scopes)
+
+	// Check tokens are rejected when tampered with, signed with another secret, or for another key
+	token := sign(t, header, claims(nil), secret)
+	tampered := sign(t, header, claims(map[string]interface{}{"scope": ScopeAdmin}), secret)
+	tampered = tampered[:len(tampered)-43] + token[len(token)-43:]
+	for name, token := range map[string]string{
+		"tampered":       tampered,
+		"wrong secret":   sign(t, header, claims(nil), []byte("another secret")),
+		"unknown key":    sign(t, map[string]interface{}{"alg": "HS256", "kid": "other"}, claims(nil), secret),
+		"none algorithm": sign(t, map[string]interface{}{"alg": "none"}, claims(nil), nil),
+		"expired":        sign(t, header, claims(map[string]interface{}{"exp": now.Unix() - 120}), secret),
+		"not yet valid":  sign(t, header, claims(map[string]interface{}{"nbf": now.Unix() + 120}), secret),
+		"wrong issuer":   sign(t, header, claims(map[string]interface{}{"iss": "https://evil.example.com"}), secret),
+		"wrong audience": sign(t, header, claims(map[string]interface{}{"aud": "other"}), secret),
+		"not a token":    "a.b.c",
+	} {
+		_, err := a.Authenticate(request(t, "Authorization", "Bearer "+token))
+		assert.ErrorIs(t, err, ErrInvalidCredentials, name)
+	}
+
+	// Check a token within the leeway of its expiry is still accepted
+	_, err = a.Authenticate(request(t, "Authorization", "Bearer "+sign(t, header, claims(map[string]interface{}{"exp": now.Unix() - 30}), secret)))
+	assert.NoError(t, err)
+}
+
+func TestRS256(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	// Write the public key to a PEM file and the other to a JWKS file, next to a config file
+	dir := t.TempDir()
+	der, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "jwks", "alg": "RS256", "use": "sig", "n": base64.RawURLEncoding.EncodeToString(other.N.Bytes()), "e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(other.E)).Bytes())},
+		{"kty": "EC", "kid": "skipped", "crv": "P-256"},
+	}})
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "jwks.json"), jwks, 0o600))
+	config := `{"keys": [{"kid": "pem", "alg": "RS256", "public_key": "key.pem"}], "jwks_file": "jwks.json"}`
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "auth.json"), []byte(config), 0o600))
+	a, err := LoadConfig(filepath.Join(dir, "auth.json"))
+	assert.NoError(t, err)
+	claims := map[string]interface{}{"sub": "bob", "scope": ScopeRead}
+
+	// Test tokens signed by the PEM key and the JWKS key are accepted, with or without a kid
+	p, err := a.Authenticate(request(t, "Authorization", "Bearer "+sign(t, map[string]interface{}{"alg": "RS256", "kid": "pem"}, claims, private)))
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", p.Subject)
+	_, err = a.Authenticate(request(t, "Authorization", "Bearer "+sign(t, map[string]interface{}{"alg": "RS256"}, claims, other)))
+	assert.NoError(t, err)
+
+	// Check a token is only checked against the key it names
+	_, err = a.Authenticate(request(t, "Authorization", "Bearer "+sign(t, map[string]interface{}{"alg": "RS256", "kid": "jwks"}, claims, private)))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	// Check the public key cannot be used as an HMAC secret
+	_, err = a.Authenticate(request(t, "Authorization", "Bearer "+sign(t, map[string]interface{}{"alg": "HS256", "kid": "pem"}, claims, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	// Check invalid configs are rejected
+	for _, config := range []string{
+		`{"keys": [{"kid": "pem", "alg": "RS256", "public_key": "missing.pem"}]}`,
+		`{"keys": [{"kid": "ec", "alg": "ES256"}]}`,
+		`{"keys": [{"kid": "hmac", "alg": "HS256"}]}`,
+		`{"unknown": true}`,
+	} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "auth.json"), []byte(config), 0o600))
+		_, err := LoadConfig(filepath.Join(dir, "auth.json"))
+		assert.Error(t, err, config)
+	}
+	_, err = LoadConfig(filepath.Join(dir, "missing.json"))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
@@ -0,0 +1,294 @@
+package boolexpr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Tag expressions and queries share one syntax for combining their terms:
+//
+//	or      = and { "OR" and }
+//	and     = unary { "AND" unary }
+//	unary   = "NOT" unary | primary
+//	primary = term | "(" or ")"
+//
+// NOT binds tighter than AND, which binds tighter than OR, and keywords are case-insensitive. This
+// package lexes and parses that syntax, leaving each language to parse its own terms from the tokens.
+
+// SyntaxError describes a malformed expression.
+type SyntaxError struct {
+	// Pos is the byte offset of the error in the expression.
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+// Kind is the kind of a token.
+type Kind int
+
+const (
+	EOF Kind = iota
+	// Word is a run of characters other than spaces, parentheses, quotes and the language's symbols.
+	Word
+	// String is a quoted string, holding its unquoted value.
+	String
+	And
+	Or
+	Not
+	LeftParen
+	RightParen
+	// Symbol is one of the language's symbols.
+	Symbol
+	// Error is a malformed token, holding the error.
+	Error
+)
+
+// Token is a token of an expression.
+type Token struct {
+	Kind Kind
+	// Pos is the byte offset of the token in the expression.
+	Pos   int
+	Value string
+	// lang describes the token in errors
+	lang *Language
+}
+
+// Is reports whether the token is the symbol.
+func (t Token) Is(symbol string) bool {
+	return t.Kind == Symbol && t.Value == symbol
+}
+
+func (t Token) String() string {
+	switch t.Kind {
+	case EOF:
+		return "end of " + t.lang.Name
+	case Word:
+		if t.lang.WordName == "" {
+			return fmt.Sprintf("%q", t.Value)
+		}
+		return fmt.Sprintf("%s %q", t.lang.WordName, t.Value)
+	case String:
+		return fmt.Sprintf("%s %q", t.lang.StringName, t.Value)
+	case And, Or, Not:
+		return strings.ToUpper(t.Value)
+	}
+	return fmt.Sprintf("%q", t.Value)
+}
+
+// IsKeyword reports whether a word would be read as AND, OR or NOT, and so must be quoted to be read
+// as a word.
+func IsKeyword(word string) bool {
+	switch strings.ToUpper(word) {
+	case "AND", "OR", "NOT":
+		return true
+	}
+	return false
+}
+
+// Language describes the tokens of a language built on the syntax.
+type Language struct {
+	// Name is what an expression is called in errors, such as "expression".
+	Name string
+	// Symbols are the characters read as Symbol tokens, which separate words without needing spaces.
+	Symbols string
+	// Quotes are the characters strings can be quoted with: '"', which allows Go escapes, and '`'.
+	Quotes string
+	// WordName and StringName describe words and strings in errors, such as "tag". Words without a
+	// name are shown as just their quoted value.
+	WordName   string
+	StringName string
+}
+
+// Parser parses an expression, building its operators with the functions it is given. Terms are
+// parsed by the language, through the methods reading the tokens.
+type Parser[E any] struct {
+	// Term parses the term starting at the current token, which may be any token other than NOT, a
+	// parenthesis or an error.
+	Term func(p *Parser[E]) (E, error)
+	And  func(operands []E) E
+	Or   func(operands []E) E
+	Not  func(operand E) E
+
+	lang  *Language
+	input string
+	pos   int
+	tok   Token
+}
+
+// Parse parses s. Errors are of type *SyntaxError.
+func (p *Parser[E]) Parse(lang *Language, s string) (E, error) {
+	var zero E
+	p.lang, p.input, p.pos = lang, s, 0
+	p.Next()
+	x, err := p.parseOr()
+	if err != nil {
+		return zero, err
+	}
+	switch p.tok.Kind {
+	case EOF:
+		return x, nil
+	case Error:
+		return zero, p.Errorf("%s", p.tok.Value)
+	}
+	return zero, p.Errorf("expected AND, OR or end of %s, found %s", lang.Name, p.tok)
+}
+
+// Tok returns the current token.
+func (p *Parser[E]) Tok() Token {
+	return p.tok
+}
+
+// Next moves on to the next token.
+func (p *Parser[E]) Next() {
+	p.tok = p.lex()
+	p.tok.lang = p.lang
+}
+
+// Errorf returns a syntax error at the current token.
+func (p *Parser[E]) Errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Pos: p.tok.Pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *Parser[E]) lex() Token {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.input) {
+		return Token{Kind: EOF, Pos: start}
+	}
+
+	switch c := p.input[p.pos]; {
+	case c == '(':
+		p.pos++
+		return Token{Kind: LeftParen, Pos: start, Value: "("}
+	case c == ')':
+		p.pos++
+		return Token{Kind: RightParen, Pos: start, Value: ")"}
+	case strings.IndexByte(p.lang.Symbols, c) >= 0:
+		p.pos++
+		return Token{Kind: Symbol, Pos: start, Value: string(c)}
+	case strings.IndexByte(p.lang.Quotes, c) >= 0:
+		// find the closing quote, skipping escaped characters in double quoted strings
+		end := p.pos + 1
+		for ; end < len(p.input) && p.input[end] != c; end++ {
+			if c == '"' && p.input[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(p.input) {
+			p.pos = len(p.input)
+			return Token{Kind: Error, Pos: start, Value: "unterminated quoted " + p.lang.StringName}
+		}
+		value, err := strconv.Unquote(p.input[p.pos : end+1])
+		p.pos = end + 1
+		if err != nil {
+			return Token{Kind: Error, Pos: start, Value: "invalid quoted " + p.lang.StringName}
+		}
+		return Token{Kind: String, Pos: start, Value: value}
+	}
+
+	for p.pos < len(p.input) && !p.separates(p.input[p.pos]) {
+		p.pos++
+	}
+	word := p.input[start:p.pos]
+	switch strings.ToUpper(word) {
+	case "AND":
+		return Token{Kind: And, Pos: start, Value: word}
+	case "OR":
+		return Token{Kind: Or, Pos: start, Value: word}
+	case "NOT":
+		return Token{Kind: Not, Pos: start, Value: word}
+	}
+	return Token{Kind: Word, Pos: start, Value: word}
+}
+
+// separates reports whether a character ends a word.
+func (p *Parser[E]) separates(c byte) bool {
+	return unicode.IsSpace(rune(c)) || c == '(' || c == ')' ||
+		strings.IndexByte(p.lang.Symbols, c) >= 0 || strings.IndexByte(p.lang.Quotes, c) >= 0
+}
+
+func (p *Parser[E]) parseOr() (E, error) {
+	var zero E
+	x, err := p.parseAnd()
+	if err != nil {
+		return zero, err
+	}
+	or := []E{x}
+	for p.tok.Kind == Or {
+		p.Next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return zero, err
+		}
+		or = append(or, y)
+	}
+	if len(or) == 1 {
+		return x, nil
+	}
+	return p.Or(or), nil
+}
+
+func (p *Parser[E]) parseAnd() (E, error) {
+	var zero E
+	x, err := p.parseUnary()
+	if err != nil {
+		return zero, err
+	}
+	and := []E{x}
+	for p.tok.Kind == And {
+		p.Next()
+		y, err := p.parseUnary()
+		if err != nil {
+			return zero, err
+		}
+		and = append(and, y)
+	}
+	if len(and) == 1 {
+		return x, nil
+	}
+	return p.And(and), nil
+}
+
+func (p *Parser[E]) parseUnary() (E, error) {
+	if p.tok.Kind == Not {
+		p.Next()
+		x, err := p.parseUnary()
+		if err != nil {
+			var zero E
+			return zero, err
+		}
+		return p.Not(x), nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *Parser[E]) parsePrimary() (E, error) {
+	var zero E
+	switch p.tok.Kind {
+	case LeftParen:
+		open := p.tok
+		p.Next()
+		x, err := p.parseOr()
+		if err != nil {
+			return zero, err
+		}
+		if p.tok.Kind != RightParen {
+			if p.tok.Kind == EOF {
+				return zero, &SyntaxError{Pos: open.Pos, Msg: `unclosed "("`}
+			}
+			return zero, p.Errorf(`expected ")", found %s`, p.tok)
+		}
+		p.Next()
+		return x, nil
+	case Error:
+		return zero, p.Errorf("%s", p.tok.Value)
+	}
+	return p.Term(p)
+}
@@ -0,0 +1,80 @@
+package boolexpr
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// parse parses a language of words and symbols into a prefix notation, checking the parser is driven
+// only through its exported methods.
+func parse(s string) (string, error) {
+	lang := &Language{Name: "test", Symbols: ":", Quotes: "\"`", StringName: "string"}
+	join := func(op string, operands []string) string {
+		return "(" + op + " " + strings.Join(operands, " ") + ")"
+	}
+	p := &Parser[string]{
+		Term: func(p *Parser[string]) (string, error) {
+			tok := p.Tok()
+			if tok.Kind != Word && tok.Kind != String {
+				return "", p.Errorf("expected term, found %s", tok)
+			}
+			p.Next()
+			if p.Tok().Is(":") {
+				p.Next()
+				value := p.Tok()
+				p.Next()
+				return tok.Value + ":" + value.Value, nil
+			}
+			return tok.Value, nil
+		},
+		And: func(operands []string) string { return join("and", operands) },
+		Or:  func(operands []string) string { return join("or", operands) },
+		Not: func(operand string) string { return join("not", []string{operand}) },
+	}
+	return p.Parse(lang, s)
+}
+
+func TestParse(t *testing.T) {
+	for input, expected := range map[string]string{
+		"a":                  "a",
+		"a or b and not c":   "(or a (and b (not c)))",
+		"(a OR b) AND c":     "(and (or a b) c)",
+		`"a b" AND ` + "`c`": "(and a b c)",
+		"k:v AND k:\"x y\"":  "(and k:v k:x y)",
+		"NOT NOT a":          "(not (not a))",
+		"  ( ( a ) )  ":      "a",
+		`"and" OR "\u0041"`:  "(or and A)",
+		"a AND b OR c AND d": "(or (and a b) (and c d))",
+	} {
+		x, err := parse(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, x, input)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for input, expected := range map[string]SyntaxError{
+		"":          {Pos: 0, Msg: "expected term, found end of test"},
+		"a b":       {Pos: 2, Msg: `expected AND, OR or end of test, found "b"`},
+		"(a OR b":   {Pos: 0, Msg: `unclosed "("`},
+		"(a b)":     {Pos: 3, Msg: `expected ")", found "b"`},
+		"a AND":     {Pos: 5, Msg: "expected term, found end of test"},
+		`a OR "b`:   {Pos: 5, Msg: "unterminated quoted string"},
+		`a OR "\q"`: {Pos: 5, Msg: "invalid quoted string"},
+		"NOT )":     {Pos: 4, Msg: `expected term, found ")"`},
+		"a:b:c":     {Pos: 3, Msg: `expected AND, OR or end of test, found ":"`},
+	} {
+		_, err := parse(input)
+		syntaxErr, ok := err.(*SyntaxError)
+		if assert.True(t, ok, input) {
+			assert.Equal(t, expected, *syntaxErr, input)
+		}
+	}
+
+	// Check keywords are recognised in any case
+	assert.True(t, IsKeyword("and"))
+	assert.True(t, IsKeyword("Not"))
+	assert.False(t, IsKeyword("android"))
+}
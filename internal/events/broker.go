@@ -0,0 +1,204 @@
+package events
+
+import (
+	"sensor-api/internal/model"
+	"sync"
+	"time"
+)
+
+// A Broker fans the changes a store makes out to subscribers, such as the clients of the change feed.
+// It keeps the most recent events in a bounded buffer so that a client which reconnects can resume
+// from the last event it saw.
+//
+// Stores publish while holding their own locks, so Publish never blocks: a subscriber that falls so
+// far behind that its channel is full is dropped, and its channel closed. It can resume from the
+// buffer by subscribing again.
+
+// Event types
+const (
+	TypeCreated = "created"
+	TypeUpdated = "updated"
+	TypeDeleted = "deleted"
+	// TypeGeofenceEnter and TypeGeofenceExit report an update moving a sensor into or out of a geofence.
+	TypeGeofenceEnter = "geofence.enter"
+	TypeGeofenceExit  = "geofence.exit"
+)
+
+const (
+	// DefaultBufferSize is the number of recent events a broker keeps for resuming subscribers.
+	DefaultBufferSize = 1024
+	// DefaultSubscriberBuffer is the number of events a subscriber may fall behind before it is dropped.
+	DefaultSubscriberBuffer = 256
+)
+
+// Event is a change made to a sensor.
+type Event struct {
+	// ID increases with every event published by a broker, starting from 1.
+	ID   uint64    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Name is the name of the sensor changed, before the change.
+	Name string `json:"name"`
+	// Sensor is the sensor after the change, nil if it was deleted.
+	Sensor *model.Sensor `json:"sensor,omitempty"`
+	// Previous is the sensor before the change, nil if it was created.
+	Previous *model.Sensor `json:"previous,omitempty"`
+	// Geofence is the ID of the geofence entered or exited.
+	Geofence string `json:"geofence,omitempty"`
+}
+
+// Created returns the event for a sensor added to a store.
+func Created(sensor model.Sensor) Event {
+	return Event{Type: TypeCreated, Name: sensor.Name, Sensor: &sensor}
+}
+
+// Updated returns the event for a sensor replaced in a store.
+func Updated(previous, sensor model.Sensor) Event {
+	return Event{Type: TypeUpdated, Name: previous.Name, Sensor: &sensor, Previous: &previous}
+}
+
+// Deleted returns the event for a sensor removed from a store.
+func Deleted(previous model.Sensor) Event {
+	return Event{Type: TypeDeleted, Name: previous.Name, Previous: &previous}
+}
+
+// Broker publishes events to its subscribers.
+type Broker struct {
+	mu sync.Mutex
+	// lastID is the ID of the last event published
+	lastID uint64
+	// buffer holds the most recent events, oldest first once start is taken into account
+	buffer []Event
+	// start is the index in buffer of the oldest event once the buffer is full
+	start            int
+	bufferSize       int
+	subscriberBuffer int
+	subscribers      map[*Subscription]struct{}
+}
+
+// NewBroker creates a Broker keeping the last bufferSize events, whose subscribers are dropped when
+// they fall subscriberBuffer events behind. Sizes that are not positive are replaced by the defaults.
+func NewBroker(bufferSize, subscriberBuffer int) *Broker {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	if subscriberBuffer <= 0 {
+		subscriberBuffer = DefaultSubscriberBuffer
+	}
+	return &Broker{
+		bufferSize:       bufferSize,
+		subscriberBuffer: subscriberBuffer,
+		subscribers:      make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish gives the event the next ID, and the current time if it has none, buffers it and sends it to
+// every subscriber. It never blocks.
+func (b *Broker) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	event.ID = b.lastID
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	if len(b.buffer) < b.bufferSize {
+		b.buffer = append(b.buffer, event)
+	} else {
+		b.buffer[b.start] = event
+		b.start = (b.start + 1) % b.bufferSize
+	}
+
+	for sub := range b.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			// the subscriber is too far behind to keep up, so it is dropped rather than block the store
+			b.drop(sub)
+		}
+	}
+}
+
+// LastID returns the ID of the last event published, or 0 if there has been none.
+func (b *Broker) LastID() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.lastID
+}
+
+// Subscribe subscribes to the events published from now on.
+func (b *Broker) Subscribe() *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.subscribe()
+}
+
+// Resume subscribes to the events published after the event lastID, returning those already buffered
+// and whether any of them are missing because they have left the buffer. An ID the broker has not
+// given out, such as one from before a restart, resumes from the oldest buffered event and reports
+// events missing.
+func (b *Broker) Resume(lastID uint64) (*Subscription, []Event, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	missed := false
+	if lastID > b.lastID {
+		lastID, missed = 0, true
+	}
+	buffered := b.buffered()
+	if len(buffered) > 0 && buffered[0].ID > lastID+1 {
+		missed = true
+	}
+	var backlog []Event
+	for _, event := range buffered {
+		if event.ID > lastID {
+			backlog = append(backlog, event)
+		}
+	}
+	return b.subscribe(), backlog, missed
+}
+
+// subscribe adds a subscriber. The caller must hold b.mu.
+func (b *Broker) subscribe() *Subscription {
+	events := make(chan Event, b.subscriberBuffer)
+	sub := &Subscription{Events: events, events: events, broker: b}
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// buffered returns the buffered events, oldest first. The caller must hold b.mu.
+func (b *Broker) buffered() []Event {
+	events := make([]Event, 0, len(b.buffer))
+	events = append(events, b.buffer[b.start:]...)
+	return append(events, b.buffer[:b.start]...)
+}
+
+// drop removes a subscriber and closes its channel. The caller must hold b.mu.
+func (b *Broker) drop(sub *Subscription) {
+	if _, ok := b.subscribers[sub]; !ok {
+		return
+	}
+	delete(b.subscribers, sub)
+	close(sub.events)
+}
+
+// Subscription receives the events published by a broker.
+type Subscription struct {
+	// Events receives the events in the order they were published. It is closed when the subscriber
+	// is dropped for falling behind, or when the subscription is closed.
+	Events <-chan Event
+	events chan Event
+	broker *Broker
+}
+
+// Close ends the subscription. It may be called more than once.
+func (sub *Subscription) Close() {
+	sub.broker.mu.Lock()
+	defer sub.broker.mu.Unlock()
+
+	sub.broker.drop(sub)
+}
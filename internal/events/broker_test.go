@@ -0,0 +1,124 @@
+package events
+
+import (
+	"sensor-api/internal/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sensor(name string) model.Sensor {
+	return model.Sensor{Name: name, Location: model.Location{Latitude: 1, Longitude: 1}}
+}
+
+func TestPublish(t *testing.T) {
+	broker := NewBroker(10, 10)
+	sub := broker.Subscribe()
+	defer sub.Close()
+
+	broker.Publish(Created(sensor("a")))
+	broker.Publish(Updated(sensor("a"), sensor("b")))
+	broker.Publish(Deleted(sensor("b")))
+	assert.Equal(t, uint64(3), broker.LastID())
+
+	// events arrive in order with increasing IDs and a time
+	for i, want := range []string{TypeCreated, TypeUpdated, TypeDeleted} {
+		event := <-sub.Events
+		assert.Equal(t, uint64(i+1), event.ID)
+		assert.Equal(t, want, event.Type)
+		assert.False(t, event.Time.IsZero())
+	}
+
+	// Check the events carry the sensor before and after the change
+	updated := Updated(sensor("a"), sensor("b"))
+	assert.Equal(t, "a", updated.Name)
+	assert.Equal(t, "a", updated.Previous.Name)
+	assert.Equal(t, "b", updated.Sensor.Name)
+	assert.Nil(t, Created(sensor("a")).Previous)
+	assert.Nil(t, Deleted(sensor("a")).Sensor)
+}
+
+func TestResume(t *testing.T) {
+	broker := NewBroker(3, 10)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		broker.Publish(Created(sensor(name)))
+	}
+
+	// resuming inside the buffer returns the events after the last one seen
+	sub, backlog, missed := broker.Resume(3)
+	sub.Close()
+	assert.False(t, missed)
+	assert.Len(t, backlog, 2)
+	assert.Equal(t, uint64(4), backlog[0].ID)
+	assert.Equal(t, uint64(5), backlog[1].ID)
+
+	// resuming from the event before the oldest buffered misses nothing
+	sub, backlog, missed = broker.Resume(2)
+	sub.Close()
+	assert.False(t, missed)
+	assert.Len(t, backlog, 3)
+
+	// events that have left the buffer are reported missing
+	sub, backlog, missed = broker.Resume(1)
+	sub.Close()
+	assert.True(t, missed)
+	assert.Len(t, backlog, 3)
+
+	// resuming from the last event returns nothing
+	sub, backlog, missed = broker.Resume(5)
+	sub.Close()
+	assert.False(t, missed)
+	assert.Empty(t, backlog)
+
+	// an ID from before a restart resumes from the oldest buffered event
+	sub, backlog, missed = broker.Resume(100)
+	sub.Close()
+	assert.True(t, missed)
+	assert.Len(t, backlog, 3)
+	assert.Equal(t, uint64(3), backlog[0].ID)
+
+	// an empty broker has nothing to resume
+	sub, backlog, missed = NewBroker(3, 10).Resume(0)
+	sub.Close()
+	assert.False(t, missed)
+	assert.Empty(t, backlog)
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	broker := NewBroker(10, 2)
+	slow := broker.Subscribe()
+	fast := broker.Subscribe()
+	defer fast.Close()
+
+	// publishing never blocks, and the subscriber that stops reading is dropped once its buffer is full
+	for i := 0; i < 5; i++ {
+		broker.Publish(Created(sensor("a")))
+		<-fast.Events
+	}
+	var received []uint64
+	for event := range slow.Events {
+		received = append(received, event.ID)
+	}
+	assert.Equal(t, []uint64{1, 2}, received)
+
+	// the dropped subscriber can resume from the buffer
+	sub, backlog, missed := broker.Resume(2)
+	defer sub.Close()
+	assert.False(t, missed)
+	assert.Len(t, backlog, 3)
+
+	// closing a dropped subscription is harmless
+	slow.Close()
+}
+
+func TestClose(t *testing.T) {
+	broker := NewBroker(10, 10)
+	sub := broker.Subscribe()
+	sub.Close()
+	sub.Close()
+
+	// a closed subscription receives nothing more
+	broker.Publish(Created(sensor("a")))
+	_, ok := <-sub.Events
+	assert.False(t, ok)
+}
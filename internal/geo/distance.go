@@ -0,0 +1,206 @@
+package geo
+
+import (
+	"math"
+	"sensor-api/internal/model"
+)
+
+// EarthRadius is the mean radius of the Earth in meters.
+const EarthRadius = 6371008.8
+
+// WGS84 ellipsoid parameters used by VincentyDistance.
+const (
+	wgs84SemiMajorAxis = 6378137.0
+	wgs84Flattening    = 1 / 298.257223563
+	wgs84SemiMinorAxis = wgs84SemiMajorAxis * (1 - wgs84Flattening)
+)
+
+// EllipsoidLowerBound scales a spherical distance so that it never exceeds the WGS84 ellipsoidal distance
+// between the same points. The two differ by less than 0.6% anywhere on Earth.
+const EllipsoidLowerBound = 0.99
+
+// DistanceFunc returns the distance in meters between two points given in degrees.
+type DistanceFunc func(lat1, lon1, lat2, lon2 float64) float64
+
+// HaversineDistance calculates the distance in meters between two points on Earth using the Haversine formula.
+// https://en.wikipedia.org/wiki/Haversine_formula
+// Good for short distances, less accurate for larger distances.
+func HaversineDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	// Convert degrees to radians
+	lat1Rad := toRadians(lat1)
+	lat2Rad := toRadians(lat2)
+
+	latDiff := lat2Rad - lat1Rad
+	lonDiff := toRadians(lon2 - lon1)
+
+	a := math.Pow(math.Sin(latDiff/2), 2) + math.Cos(lat1Rad)*math.Cos(lat2Rad)*math.Pow(math.Sin(lonDiff/2), 2)
+	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+
+	return EarthRadius * c
+}
+
+// VincentyDistance calculates the distance in meters between two points on the WGS84 ellipsoid using
+// Vincenty's inverse formula. It is accurate to within a millimetre, at the cost of an iterative solution.
+// Nearly antipodal points where the iteration fails to converge fall back to HaversineDistance.
+// https://en.wikipedia.org/wiki/Vincenty%27s_formulae
+func VincentyDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	const (
+		maxIterations = 200
+		tolerance     = 1e-12
+	)
+
+	l := toRadians(lon2 - lon1)
+	u1 := math.Atan((1 - wgs84Flattening) * math.Tan(toRadians(lat1)))
+	u2 := math.Atan((1 - wgs84Flattening) * math.Tan(toRadians(lat2)))
+	sinU1, cosU1 := math.Sincos(u1)
+	sinU2, cosU2 := math.Sincos(u2)
+
+	lambda := l
+	for i := 0; i < maxIterations; i++ {
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma := math.Sqrt(math.Pow(cosU2*sinLambda, 2) + math.Pow(cosU1*sinU2-sinU1*cosU2*cosLambda, 2))
+		if sinSigma == 0 {
+			// coincident points
+			return 0
+		}
+		cosSigma := sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma := math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha := 1 - sinAlpha*sinAlpha
+		cos2SigmaM := 0.0
+		if cosSqAlpha != 0 {
+			// points on the equator have no cos2SigmaM term
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+		c := wgs84Flattening / 16 * cosSqAlpha * (4 + wgs84Flattening*(4-3*cosSqAlpha))
+		previous := lambda
+		lambda = l + (1-c)*wgs84Flattening*sinAlpha*
+			(sigma+c*sinSigma*(cos2SigmaM+c*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+
+		if math.Abs(lambda-previous) < tolerance {
+			uSq := cosSqAlpha * (wgs84SemiMajorAxis*wgs84SemiMajorAxis - wgs84SemiMinorAxis*wgs84SemiMinorAxis) /
+				(wgs84SemiMinorAxis * wgs84SemiMinorAxis)
+			a := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+			b := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+			deltaSigma := b * sinSigma * (cos2SigmaM + b/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+				b/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+			return wgs84SemiMinorAxis * a * (sigma - deltaSigma)
+		}
+	}
+
+	return HaversineDistance(lat1, lon1, lat2, lon2)
+}
+
+// BoxDistance returns the shortest great-circle distance in meters from a point to a latitude/longitude
+// aligned box, or zero if the point is inside it. Longitudes wrap at ±180 degrees, so a point just east
+// of the antimeridian is close to a box just west of it.
+func BoxDistance(lat, lon, minLat, minLon, maxLat, maxLon float64) float64 {
+	if lon >= minLon && lon <= maxLon {
+		// the point shares a meridian with the box, so the closest point is straight north or south
+		switch {
+		case lat < minLat:
+			return EarthRadius * toRadians(minLat-lat)
+		case lat > maxLat:
+			return EarthRadius * toRadians(lat-maxLat)
+		}
+		return 0
+	}
+
+	// moving along a parallel towards the point always gets closer, so the closest point of the box
+	// lies on its western or eastern edge
+	return math.Min(
+		meridianDistance(lat, lon, minLon, minLat, maxLat),
+		meridianDistance(lat, lon, maxLon, minLat, maxLat),
+	)
+}
+
+// meridianDistance returns the shortest great-circle distance in meters from a point to the segment
+// of the meridian at longitude lon between minLat and maxLat.
+func meridianDistance(lat, lon, meridian, minLat, maxLat float64) float64 {
+	distance := math.Min(
+		HaversineDistance(lat, lon, minLat, meridian),
+		HaversineDistance(lat, lon, maxLat, meridian),
+	)
+
+	lonDiff := toRadians(meridian - lon)
+	if math.Cos(lonDiff) > 0 {
+		// the distance along the meridian has a single minimum at this latitude; on the far side of
+		// the globe it has a maximum instead and the closest point is one of the segment ends
+		closest := toDegrees(math.Atan(math.Tan(toRadians(lat)) / math.Cos(lonDiff)))
+		if closest > minLat && closest < maxLat {
+			distance = math.Min(distance, HaversineDistance(lat, lon, closest, meridian))
+		}
+	}
+
+	return distance
+}
+
+// InitialBearing returns the initial compass bearing in degrees, in the range [0, 360), of the great-circle
+// path from the first point to the second.
+// https://www.movable-type.co.uk/scripts/latlong.html#bearing
+func InitialBearing(lat1, lon1, lat2, lon2 float64) float64 {
+	lat1Rad := toRadians(lat1)
+	lat2Rad := toRadians(lat2)
+	lonDiff := toRadians(lon2 - lon1)
+
+	y := math.Sin(lonDiff) * math.Cos(lat2Rad)
+	x := math.Cos(lat1Rad)*math.Sin(lat2Rad) - math.Sin(lat1Rad)*math.Cos(lat2Rad)*math.Cos(lonDiff)
+
+	return math.Mod(toDegrees(math.Atan2(y, x))+360, 360)
+}
+
+// CircleBounds returns the bounding boxes enclosing every point within radius meters of center.
+// A circle crossing the antimeridian is split into one box on each side of it, and a circle
+// reaching over a pole spans every longitude.
+// https://janmatuschek.de/LatitudeLongitudeBoundingCoordinates
+func CircleBounds(center model.Location, radius float64) []model.BoundingBox {
+	angularRadius := radius / EarthRadius
+	if angularRadius >= math.Pi {
+		return []model.BoundingBox{world()}
+	}
+
+	minLat := center.Latitude - toDegrees(angularRadius)
+	maxLat := center.Latitude + toDegrees(angularRadius)
+	if minLat <= -90 || maxLat >= 90 {
+		// the circle contains a pole, so every longitude is in range
+		return []model.BoundingBox{{
+			Min: model.Location{Latitude: math.Max(minLat, -90), Longitude: -180},
+			Max: model.Location{Latitude: math.Min(maxLat, 90), Longitude: 180},
+		}}
+	}
+
+	lonDelta := toDegrees(math.Asin(math.Sin(angularRadius) / math.Cos(toRadians(center.Latitude))))
+	minLon := center.Longitude - lonDelta
+	maxLon := center.Longitude + lonDelta
+	switch {
+	case minLon < -180:
+		return []model.BoundingBox{
+			{Min: model.Location{Latitude: minLat, Longitude: minLon + 360}, Max: model.Location{Latitude: maxLat, Longitude: 180}},
+			{Min: model.Location{Latitude: minLat, Longitude: -180}, Max: model.Location{Latitude: maxLat, Longitude: maxLon}},
+		}
+	case maxLon > 180:
+		return []model.BoundingBox{
+			{Min: model.Location{Latitude: minLat, Longitude: minLon}, Max: model.Location{Latitude: maxLat, Longitude: 180}},
+			{Min: model.Location{Latitude: minLat, Longitude: -180}, Max: model.Location{Latitude: maxLat, Longitude: maxLon - 360}},
+		}
+	}
+	return []model.BoundingBox{{
+		Min: model.Location{Latitude: minLat, Longitude: minLon},
+		Max: model.Location{Latitude: maxLat, Longitude: maxLon},
+	}}
+}
+
+func world() model.BoundingBox {
+	return model.BoundingBox{
+		Min: model.Location{Latitude: -90, Longitude: -180},
+		Max: model.Location{Latitude: 90, Longitude: 180},
+	}
+}
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func toDegrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
@@ -0,0 +1,107 @@
+package geo
+
+import (
+	"sensor-api/internal/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHaversineDistance(t *testing.T) {
+	// San Francisco to Los Angeles is roughly 559km
+	distance := HaversineDistance(37.7749, -122.4194, 34.0522, -118.2437)
+	assert.InDelta(t, 559120, distance, 1000)
+
+	// the same point is zero meters away
+	assert.Equal(t, 0.0, HaversineDistance(37.7749, -122.4194, 37.7749, -122.4194))
+
+	// points either side of the antimeridian are close together
+	distance = HaversineDistance(0, 179.9, 0, -179.9)
+	assert.InDelta(t, 22239, distance, 10)
+}
+
+func TestVincentyDistance(t *testing.T) {
+	// Flinders Peak to Buninyong, the worked example from Vincenty's paper
+	distance := VincentyDistance(-37.95103341666667, 144.42486788888888, -37.65282113888889, 143.92649552777777)
+	assert.InDelta(t, 54972.271, distance, 0.001)
+
+	// the same point is zero meters away
+	assert.Equal(t, 0.0, VincentyDistance(37.7749, -122.4194, 37.7749, -122.4194))
+
+	// one degree of longitude along the equator
+	assert.InDelta(t, 111319.491, VincentyDistance(0, 0, 0, 1), 0.001)
+
+	// nearly antipodal points still return a sensible distance
+	distance = VincentyDistance(0, 0, 0.5, 179.7)
+	assert.InDelta(t, 19936288, distance, 100000)
+}
+
+func TestBoxDistance(t *testing.T) {
+	// inside the box
+	assert.Equal(t, 0.0, BoxDistance(37.775, -122.42, 37.7, -122.5, 37.8, -122.3))
+
+	// straight south of the box
+	assert.InDelta(t, HaversineDistance(37, -122.4, 37.7, -122.4), BoxDistance(37, -122.4, 37.7, -122.5, 37.8, -122.3), 1e-6)
+
+	// east of the box, level with it
+	assert.InDelta(t, HaversineDistance(37.75, -122, 37.75, -122.3), BoxDistance(37.75, -122, 37.7, -122.5, 37.8, -122.3), 1)
+
+	// across the antimeridian
+	assert.InDelta(t, HaversineDistance(0, 179.9, 0, -179.9), BoxDistance(0, 179.9, -1, -179.9, 1, -179), 1e-6)
+
+	// the bound never exceeds the distance to any point inside the box
+	for _, point := range [][2]float64{{89, 0}, {-60, 170}, {10, -10}, {45, 100}} {
+		bound := BoxDistance(point[0], point[1], 20, 30, 60, 80)
+		for lat := 20.0; lat <= 60; lat += 5 {
+			for lon := 30.0; lon <= 80; lon += 5 {
+				assert.LessOrEqual(t, bound, HaversineDistance(point[0], point[1], lat, lon)+1e-6)
+			}
+		}
+	}
+}
+
+func TestInitialBearing(t *testing.T) {
+	assert.InDelta(t, 0, InitialBearing(0, 0, 1, 0), 1e-9)
+	assert.InDelta(t, 90, InitialBearing(0, 0, 0, 1), 1e-9)
+	assert.InDelta(t, 180, InitialBearing(1, 0, 0, 0), 1e-9)
+	assert.InDelta(t, 270, InitialBearing(0, 1, 0, 0), 1e-9)
+
+	// heading east across the antimeridian
+	assert.InDelta(t, 90, InitialBearing(0, 179.9, 0, -179.9), 1e-9)
+}
+
+func TestCircleBounds(t *testing.T) {
+	t.Run("Small circle", func(t *testing.T) {
+		center := model.Location{Latitude: 37.7749, Longitude: -122.4194}
+		boxes := CircleBounds(center, 1000)
+		assert.Len(t, boxes, 1)
+		assert.True(t, boxes[0].Contains(center))
+
+		// every point 1km north, south, east and west must be inside the box
+		assert.True(t, boxes[0].Contains(model.Location{Latitude: center.Latitude + 0.00898, Longitude: center.Longitude}))
+		assert.True(t, boxes[0].Contains(model.Location{Latitude: center.Latitude - 0.00898, Longitude: center.Longitude}))
+		assert.True(t, boxes[0].Contains(model.Location{Latitude: center.Latitude, Longitude: center.Longitude + 0.0113}))
+		assert.True(t, boxes[0].Contains(model.Location{Latitude: center.Latitude, Longitude: center.Longitude - 0.0113}))
+	})
+
+	t.Run("Antimeridian", func(t *testing.T) {
+		boxes := CircleBounds(model.Location{Latitude: 10, Longitude: 179.99}, 10000)
+		assert.Len(t, boxes, 2)
+		assert.Equal(t, 180.0, boxes[0].Max.Longitude)
+		assert.Equal(t, -180.0, boxes[1].Min.Longitude)
+		assert.True(t, boxes[1].Contains(model.Location{Latitude: 10, Longitude: -179.95}))
+	})
+
+	t.Run("Pole", func(t *testing.T) {
+		boxes := CircleBounds(model.Location{Latitude: 89.99, Longitude: 10}, 10000)
+		assert.Len(t, boxes, 1)
+		assert.Equal(t, 90.0, boxes[0].Max.Latitude)
+		assert.Equal(t, -180.0, boxes[0].Min.Longitude)
+		assert.Equal(t, 180.0, boxes[0].Max.Longitude)
+	})
+
+	t.Run("Whole world", func(t *testing.T) {
+		boxes := CircleBounds(model.Location{Latitude: 10, Longitude: 10}, 50000000)
+		assert.Equal(t, []model.BoundingBox{world()}, boxes)
+	})
+}
@@ -0,0 +1,148 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+	"sensor-api/internal/model"
+)
+
+// Polygon is a list of linear rings. The first ring is the exterior boundary and any others are holes.
+// Each ring is closed, its first and last locations being equal. Edges are straight lines in
+// latitude/longitude space, as in GeoJSON.
+type Polygon [][]model.Location
+
+// MultiPolygon is a set of polygons; a location is inside it if it is inside any of them.
+type MultiPolygon []Polygon
+
+// Validate reports whether every ring has at least four valid locations and is closed.
+func (p Polygon) Validate() error {
+	if len(p) == 0 {
+		return fmt.Errorf("polygon has no rings")
+	}
+	for i, ring := range p {
+		if len(ring) < 4 {
+			return fmt.Errorf("ring %d has fewer than four positions", i)
+		}
+		if ring[0] != ring[len(ring)-1] {
+			return fmt.Errorf("ring %d is not closed", i)
+		}
+		for _, location := range ring {
+			if !inRange(location) {
+				return fmt.Errorf("ring %d has an invalid position %v", i, location)
+			}
+		}
+	}
+	return nil
+}
+
+// Contains reports whether the location is inside the exterior ring and outside every hole.
+// Locations on an edge are inside.
+func (p Polygon) Contains(location model.Location) bool {
+	if len(p) == 0 || !ringContains(p[0], location) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if ringContains(hole, location) && !onBoundary(hole, location) {
+			return false
+		}
+	}
+	return true
+}
+
+// Bounds returns the smallest bounding box enclosing the exterior ring.
+func (p Polygon) Bounds() model.BoundingBox {
+	if len(p) == 0 || len(p[0]) == 0 {
+		return model.BoundingBox{}
+	}
+	box := model.BoundingBox{Min: p[0][0], Max: p[0][0]}
+	for _, location := range p[0] {
+		box.Min.Latitude = math.Min(box.Min.Latitude, location.Latitude)
+		box.Min.Longitude = math.Min(box.Min.Longitude, location.Longitude)
+		box.Max.Latitude = math.Max(box.Max.Latitude, location.Latitude)
+		box.Max.Longitude = math.Max(box.Max.Longitude, location.Longitude)
+	}
+	return box
+}
+
+// Validate reports whether the multipolygon has at least one polygon and every polygon is valid.
+func (mp MultiPolygon) Validate() error {
+	if len(mp) == 0 {
+		return fmt.Errorf("multipolygon has no polygons")
+	}
+	for i, polygon := range mp {
+		if err := polygon.Validate(); err != nil {
+			return fmt.Errorf("polygon %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Contains reports whether the location is inside any of the polygons.
+func (mp MultiPolygon) Contains(location model.Location) bool {
+	for _, polygon := range mp {
+		if polygon.Contains(location) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bounds returns the smallest bounding box enclosing every polygon.
+func (mp MultiPolygon) Bounds() model.BoundingBox {
+	var box model.BoundingBox
+	for i, polygon := range mp {
+		bounds := polygon.Bounds()
+		if i == 0 {
+			box = bounds
+			continue
+		}
+		box.Min.Latitude = math.Min(box.Min.Latitude, bounds.Min.Latitude)
+		box.Min.Longitude = math.Min(box.Min.Longitude, bounds.Min.Longitude)
+		box.Max.Latitude = math.Max(box.Max.Latitude, bounds.Max.Latitude)
+		box.Max.Longitude = math.Max(box.Max.Longitude, bounds.Max.Longitude)
+	}
+	return box
+}
+
+// ringContains reports whether the location is inside or on a closed ring, using the even-odd rule.
+// https://wrf.ecse.rpi.edu/Research/Short_Notes/pnpoly.html
+func ringContains(ring []model.Location, location model.Location) bool {
+	if onBoundary(ring, location) {
+		return true
+	}
+
+	inside := false
+	x, y := location.Longitude, location.Latitude
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i].Longitude, ring[i].Latitude
+		xj, yj := ring[j].Longitude, ring[j].Latitude
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// onBoundary reports whether the location lies on one of the ring's edges.
+func onBoundary(ring []model.Location, location model.Location) bool {
+	x, y := location.Longitude, location.Latitude
+	for i := 1; i < len(ring); i++ {
+		x1, y1 := ring[i-1].Longitude, ring[i-1].Latitude
+		x2, y2 := ring[i].Longitude, ring[i].Latitude
+		cross := (x2-x1)*(y-y1) - (y2-y1)*(x-x1)
+		if math.Abs(cross) > 1e-12 {
+			continue
+		}
+		if x >= math.Min(x1, x2) && x <= math.Max(x1, x2) && y >= math.Min(y1, y2) && y <= math.Max(y1, y2) {
+			return true
+		}
+	}
+	return false
+}
+
+// inRange reports whether a location lies within the valid latitude and longitude ranges.
+// Unlike model.Location.IsValid it allows the origin, which is a common polygon vertex.
+func inRange(location model.Location) bool {
+	return location.Latitude >= -90 && location.Latitude <= 90 &&
+		location.Longitude >= -180 && location.Longitude <= 180
+}
@@ -0,0 +1,65 @@
+package geo
+
+import (
+	"sensor-api/internal/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// square returns a closed ring around the given corners.
+func square(minLat, minLon, maxLat, maxLon float64) []model.Location {
+	return []model.Location{
+		{Latitude: minLat, Longitude: minLon},
+		{Latitude: minLat, Longitude: maxLon},
+		{Latitude: maxLat, Longitude: maxLon},
+		{Latitude: maxLat, Longitude: minLon},
+		{Latitude: minLat, Longitude: minLon},
+	}
+}
+
+func TestPolygonContains(t *testing.T) {
+	polygon := Polygon{square(0, 0, 10, 10), square(4, 4, 6, 6)}
+	assert.NoError(t, polygon.Validate())
+
+	assert.True(t, polygon.Contains(model.Location{Latitude: 2, Longitude: 2}), "Expected location inside polygon")
+	assert.False(t, polygon.Contains(model.Location{Latitude: 5, Longitude: 5}), "Expected location inside hole to be outside")
+	assert.False(t, polygon.Contains(model.Location{Latitude: 11, Longitude: 5}), "Expected location outside polygon")
+
+	// edges of the exterior and of holes are inside
+	assert.True(t, polygon.Contains(model.Location{Latitude: 0, Longitude: 5}), "Expected exterior edge to be inside")
+	assert.True(t, polygon.Contains(model.Location{Latitude: 4, Longitude: 5}), "Expected hole edge to be inside")
+
+	// a concave polygon
+	concave := Polygon{{
+		{Latitude: 0, Longitude: 0},
+		{Latitude: 0, Longitude: 10},
+		{Latitude: 10, Longitude: 10},
+		{Latitude: 5, Longitude: 5},
+		{Latitude: 10, Longitude: 0},
+		{Latitude: 0, Longitude: 0},
+	}}
+	assert.True(t, concave.Contains(model.Location{Latitude: 4, Longitude: 5}), "Expected location below notch inside")
+	assert.False(t, concave.Contains(model.Location{Latitude: 8, Longitude: 5}), "Expected location in notch outside")
+
+	assert.Equal(t, model.BoundingBox{Min: model.Location{}, Max: model.Location{Latitude: 10, Longitude: 10}}, polygon.Bounds())
+}
+
+func TestMultiPolygon(t *testing.T) {
+	multiPolygon := MultiPolygon{{square(0, 0, 1, 1)}, {square(10, 10, 11, 11)}}
+	assert.NoError(t, multiPolygon.Validate())
+
+	assert.True(t, multiPolygon.Contains(model.Location{Latitude: 0.5, Longitude: 0.5}))
+	assert.True(t, multiPolygon.Contains(model.Location{Latitude: 10.5, Longitude: 10.5}))
+	assert.False(t, multiPolygon.Contains(model.Location{Latitude: 5, Longitude: 5}))
+
+	assert.Equal(t, model.BoundingBox{Min: model.Location{}, Max: model.Location{Latitude: 11, Longitude: 11}}, multiPolygon.Bounds())
+}
+
+func TestPolygonValidate(t *testing.T) {
+	assert.Error(t, Polygon{}.Validate())
+	assert.Error(t, Polygon{square(0, 0, 1, 1)[:3]}.Validate(), "Expected too few positions to be invalid")
+	assert.Error(t, Polygon{square(0, 0, 1, 1)[:4]}.Validate(), "Expected open ring to be invalid")
+	assert.Error(t, Polygon{square(0, 0, 91, 1)}.Validate(), "Expected out of range position to be invalid")
+	assert.Error(t, MultiPolygon{}.Validate())
+}
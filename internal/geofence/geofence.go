@@ -0,0 +1,352 @@
+package geofence
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sensor-api/internal/events"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/geojson"
+	"sensor-api/internal/ids"
+	"sensor-api/internal/model"
+	"sensor-api/internal/store"
+	"sensor-api/internal/tagexpr"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/rtree"
+)
+
+// A Monitor sits between a store and its event sink, watching the updates the store publishes for
+// sensors moving into or out of geofences. Every event is passed on to the sink, followed by an enter
+// or exit event for each geofence the update moved the sensor into or out of. The alerts are also
+// recorded, the most recent kept to be queried.
+//
+// Geofences are held in an R-tree of their bounding boxes, so an update is only checked against the
+// geofences whose boxes hold the sensor's old or new location. Whether a sensor is inside a geofence is
+// worked out from those two locations rather than remembered, so the monitor keeps no state per
+// sensor; the geofences and alert history themselves are not persisted, and must be added again after
+// a restart.
+
+// Alert types
+const (
+	AlertEnter = "enter"
+	AlertExit  = "exit"
+)
+
+// DefaultMaxAlerts is the number of alerts a monitor keeps.
+const DefaultMaxAlerts = 10000
+
+// Circle is a circular geofence: every point within Radius meters of Center.
+type Circle struct {
+	Center model.Location `json:"center"`
+	Radius float64        `json:"radius"`
+}
+
+// Fence is a geofence: a circle, or a GeoJSON Polygon or MultiPolygon geometry. Tags and TagExpr scope
+// it to the sensors matching them, as the tags and tag_expr query parameters do; other sensors never
+// enter or exit it.
+type Fence struct {
+	ID      string          `json:"id"`
+	Name    string          `json:"name,omitempty"`
+	Circle  *Circle         `json:"circle,omitempty"`
+	Polygon json.RawMessage `json:"polygon,omitempty"`
+	Tags    []string        `json:"tags,omitempty"`
+	TagExpr string          `json:"tag_expr,omitempty"`
+
+	polygon geo.MultiPolygon
+	filter  tagexpr.Expr
+	bounds  []model.BoundingBox
+}
+
+// Alert records a sensor entering or exiting a geofence.
+type Alert struct {
+	// ID increases with every alert, starting from 1.
+	ID       uint64         `json:"id"`
+	Type     string         `json:"type"`
+	Geofence string         `json:"geofence"`
+	Sensor   string         `json:"sensor"`
+	Location model.Location `json:"location"`
+	Time     time.Time      `json:"time"`
+}
+
+// AlertQuery selects alerts: those after the alert After, of a geofence and of a sensor. Empty fields
+// match every alert.
+type AlertQuery struct {
+	After    uint64
+	Geofence string
+	Sensor   string
+}
+
+// Monitor checks sensor updates against geofences.
+type Monitor struct {
+	mu sync.Mutex
+	// sink receives the store's events and the alerts, if set
+	sink     store.EventSink
+	distance geo.DistanceFunc
+	fences   map[string]*Fence
+	// index holds the bounding boxes of the fences, a circle crossing the antimeridian having two
+	index rtree.RTreeG[string]
+	// alerts holds the most recent alerts, oldest first
+	alerts    []Alert
+	lastAlert uint64
+	maxAlerts int
+}
+
+// NewMonitor creates a Monitor passing events on to sink, measuring distances to the centers of circles
+// with distance, or geo.HaversineDistance if it is nil, and keeping the last maxAlerts alerts, or
+// DefaultMaxAlerts if it is not positive.
+func NewMonitor(sink store.EventSink, distance geo.DistanceFunc, maxAlerts int) *Monitor {
+	if distance == nil {
+		distance = geo.HaversineDistance
+	}
+	if maxAlerts <= 0 {
+		maxAlerts = DefaultMaxAlerts
+	}
+	return &Monitor{
+		sink:      sink,
+		distance:  distance,
+		fences:    make(map[string]*Fence),
+		maxAlerts: maxAlerts,
+	}
+}
+
+// Publish passes an event on to the sink and, for an update, alerts on the geofences it moved the sensor
+// into or out of. Stores call it while holding their locks, so the alerts follow the update in order.
+func (m *Monitor) Publish(event events.Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sink != nil {
+		m.sink.Publish(event)
+	}
+	if event.Type != events.TypeUpdated {
+		return
+	}
+
+	// the fences exited are alerted before those entered, so a sensor leaves one zone before entering the next
+	previous, sensor := *event.Previous, *event.Sensor
+	var exited, entered []*Fence
+	for _, fence := range m.candidates(previous.Location, sensor.Location) {
+		before, after := m.contains(fence, previous), m.contains(fence, sensor)
+		switch {
+		case before && !after:
+			exited = append(exited, fence)
+		case after && !before:
+			entered = append(entered, fence)
+		}
+	}
+	for _, fence := range exited {
+		m.alert(event, AlertExit, events.TypeGeofenceExit, fence)
+	}
+	for _, fence := range entered {
+		m.alert(event, AlertEnter, events.TypeGeofenceEnter, fence)
+	}
+}
+
+// alert records an alert for the update event moving a sensor into or out of a fence, and publishes it to
+// the sink. The caller must hold m.mu.
+func (m *Monitor) alert(event events.Event, alertType, eventType string, fence *Fence) {
+	alert := Alert{Type: alertType, Geofence: fence.ID, Sensor: event.Sensor.Name, Location: event.Sensor.Location, Time: time.Now().UTC()}
+	m.record(alert)
+	if m.sink != nil {
+		m.sink.Publish(events.Event{Type: eventType, Time: alert.Time, Name: event.Name, Sensor: event.Sensor, Previous: event.Previous, Geofence: fence.ID})
+	}
+}
+
+// candidates returns the fences whose bounding boxes hold either location, in ID order. The caller must
+// hold m.mu.
+func (m *Monitor) candidates(locations ...model.Location) []*Fence {
+	found := make(map[string]bool)
+	for _, location := range locations {
+		point := [2]float64{location.Latitude, location.Longitude}
+		m.index.Search(point, point, func(min, max [2]float64, id string) bool {
+			found[id] = true
+			return true
+		})
+	}
+	fences := make([]*Fence, 0, len(found))
+	for id := range found {
+		fences = append(fences, m.fences[id])
+	}
+	sort.Slice(fences, func(i, j int) bool { return fences[i].ID < fences[j].ID })
+	return fences
+}
+
+// contains reports whether a sensor is in scope of a fence and inside it.
+func (m *Monitor) contains(fence *Fence, sensor model.Sensor) bool {
+	if !tagexpr.Match(fence.filter, sensor.Tags) {
+		return false
+	}
+	if fence.Circle != nil {
+		center := fence.Circle.Center
+		return m.distance(center.Latitude, center.Longitude, sensor.Location.Latitude, sensor.Location.Longitude) <= fence.Circle.Radius
+	}
+	return fence.polygon.Contains(sensor.Location)
+}
+
+// record keeps an alert, dropping the oldest beyond maxAlerts. The caller must hold m.mu.
+func (m *Monitor) record(alert Alert) {
+	m.lastAlert++
+	alert.ID = m.lastAlert
+	log.Info("Sensor ", alert.Sensor, " ", alert.Type, " geofence ", alert.Geofence)
+	m.alerts = append(m.alerts, alert)
+	if len(m.alerts) > m.maxAlerts {
+		m.alerts = append([]Alert(nil), m.alerts[len(m.alerts)-m.maxAlerts:]...)
+	}
+}
+
+// GetAlerts returns the alerts matching a query, oldest first.
+func (m *Monitor) GetAlerts(q AlertQuery) ([]Alert, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	alerts := []Alert{}
+	for _, alert := range m.alerts {
+		if alert.ID > q.After && (q.Geofence == "" || alert.Geofence == q.Geofence) && (q.Sensor == "" || alert.Sensor == q.Sensor) {
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts, http.StatusOK, nil
+}
+
+// parse validates a fence, parsing its geometry and tag filter.
+func parse(fence Fence) (Fence, int, error) {
+	switch {
+	case fence.Circle != nil && fence.Polygon != nil:
+		log.Error("Geofence has both a circle and a polygon")
+		return Fence{}, http.StatusBadRequest, fmt.Errorf("geofence must have a circle or a polygon, not both")
+	case fence.Circle != nil:
+		if !fence.Circle.Center.IsValid() {
+			log.Error("Invalid geofence center: ", fence.Circle.Center)
+			return Fence{}, http.StatusBadRequest, fmt.Errorf("invalid circle center")
+		}
+		if !(fence.Circle.Radius > 0) || math.IsInf(fence.Circle.Radius, 0) {
+			log.Error("Invalid geofence radius: ", fence.Circle.Radius)
+			return Fence{}, http.StatusBadRequest, fmt.Errorf("circle radius must be a positive number of meters")
+		}
+		// the bounds must hold every location a circle's distance function puts inside it
+		fence.bounds = geo.CircleBounds(fence.Circle.Center, fence.Circle.Radius/geo.EllipsoidLowerBound)
+	case fence.Polygon != nil:
+		polygon, err := geojson.DecodeMultiPolygon(fence.Polygon)
+		if err != nil {
+			log.Error("Invalid geofence polygon: ", err)
+			return Fence{}, http.StatusBadRequest, fmt.Errorf("invalid polygon: %w", err)
+		}
+		fence.polygon = polygon
+		fence.bounds = []model.BoundingBox{polygon.Bounds()}
+	default:
+		log.Error("Geofence has no geometry")
+		return Fence{}, http.StatusBadRequest, fmt.Errorf("geofence must have a circle or a polygon")
+	}
+
+	fence.filter = tagexpr.AllOf(fence.Tags)
+	if fence.TagExpr != "" {
+		expr, err := tagexpr.Parse(fence.TagExpr)
+		if err != nil {
+			log.Error("Invalid geofence tag expression: ", err)
+			return Fence{}, http.StatusBadRequest, fmt.Errorf("invalid tag_expr: %w", err)
+		}
+		fence.filter = tagexpr.Both(fence.filter, expr)
+	}
+	return fence, http.StatusOK, nil
+}
+
+// AddFence validates and adds a geofence, giving it an ID.
+func (m *Monitor) AddFence(fence Fence) (Fence, int, error) {
+	fence, code, err := parse(fence)
+	if err != nil {
+		return Fence{}, code, err
+	}
+	fence.ID = ids.New()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.insert(&fence)
+	log.Info("Added geofence ", fence.ID)
+	return fence, http.StatusCreated, nil
+}
+
+// UpdateFence replaces a geofence, keeping its ID. Sensors that the change moves into or out of the
+// geofence are not alerted on until they are next updated.
+func (m *Monitor) UpdateFence(id string, fence Fence) (Fence, int, error) {
+	fence, code, err := parse(fence)
+	if err != nil {
+		return Fence{}, code, err
+	}
+	fence.ID = id
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.fences[id]
+	if !ok {
+		log.Error("Geofence not found: ", id)
+		return Fence{}, http.StatusNotFound, fmt.Errorf("geofence not found")
+	}
+	m.delete(old)
+	m.insert(&fence)
+	log.Info("Updated geofence ", id)
+	return fence, http.StatusOK, nil
+}
+
+// GetFence returns a geofence.
+func (m *Monitor) GetFence(id string) (Fence, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fence, ok := m.fences[id]
+	if !ok {
+		log.Error("Geofence not found: ", id)
+		return Fence{}, http.StatusNotFound, fmt.Errorf("geofence not found")
+	}
+	return *fence, http.StatusOK, nil
+}
+
+// GetFences returns every geofence in ID order.
+func (m *Monitor) GetFences() ([]Fence, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fences := make([]Fence, 0, len(m.fences))
+	for _, fence := range m.fences {
+		fences = append(fences, *fence)
+	}
+	sort.Slice(fences, func(i, j int) bool { return fences[i].ID < fences[j].ID })
+	return fences, http.StatusOK, nil
+}
+
+// RemoveFence removes a geofence. Its alerts are kept.
+func (m *Monitor) RemoveFence(id string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fence, ok := m.fences[id]
+	if !ok {
+		log.Error("Geofence not found: ", id)
+		return http.StatusNotFound, fmt.Errorf("geofence not found")
+	}
+	m.delete(fence)
+	log.Info("Removed geofence ", id)
+	return http.StatusNoContent, nil
+}
+
+// insert adds a fence and its bounds to the index. The caller must hold m.mu.
+func (m *Monitor) insert(fence *Fence) {
+	m.fences[fence.ID] = fence
+	for _, box := range fence.bounds {
+		m.index.Insert([2]float64{box.Min.Latitude, box.Min.Longitude}, [2]float64{box.Max.Latitude, box.Max.Longitude}, fence.ID)
+	}
+}
+
+// delete removes a fence and its bounds from the index. The caller must hold m.mu.
+func (m *Monitor) delete(fence *Fence) {
+	delete(m.fences, fence.ID)
+	for _, box := range fence.bounds {
+		m.index.Delete([2]float64{box.Min.Latitude, box.Min.Longitude}, [2]float64{box.Max.Latitude, box.Max.Longitude}, fence.ID)
+	}
+}
@@ -0,0 +1,175 @@
+package geofence
+
+import (
+	"encoding/json"
+	"net/http"
+	"sensor-api/internal/events"
+	"sensor-api/internal/model"
+	"sensor-api/internal/store"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	sanFrancisco = model.Location{Latitude: 37.7749, Longitude: -122.4194}
+	oakland      = model.Location{Latitude: 37.8044, Longitude: -122.2712}
+	sanJose      = model.Location{Latitude: 37.3382, Longitude: -121.8863}
+	// a square around San Jose
+	square = json.RawMessage(`{"type": "Polygon", "coordinates": [[[-122, 37.2], [-121.8, 37.2], [-121.8, 37.4], [-122, 37.4], [-122, 37.2]]]}`)
+)
+
+// recorder is an event sink recording the events it is sent.
+type recorder struct {
+	events []events.Event
+}
+
+func (r *recorder) Publish(event events.Event) {
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) types() []string {
+	var types []string
+	for _, event := range r.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestMonitor(t *testing.T) {
+	sink := &recorder{}
+	monitor := NewMonitor(sink, nil, 0)
+	s := store.NewInMemorySensorStore()
+	s.SetEventSink(monitor)
+	circle, _, err := monitor.AddFence(Fence{Name: "San Francisco", Circle: &Circle{Center: sanFrancisco, Radius: 5000}})
+	assert.NoError(t, err)
+	polygon, _, err := monitor.AddFence(Fence{Name: "San Jose", Polygon: square, Tags: []string{"mobile"}})
+	assert.NoError(t, err)
+
+	// Test moving a sensor into and out of a circle alerts after the update
+	_, err = s.AddSensor(model.Sensor{Name: "Sensor1", Location: oakland, Tags: []string{"mobile"}})
+	assert.NoError(t, err)
+	_, err = s.UpdateSensor("Sensor1", &model.Sensor{Name: "Sensor1", Location: sanFrancisco, Tags: []string{"mobile"}})
+	assert.NoError(t, err)
+	_, err = s.UpdateSensor("Sensor1", &model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.78, Longitude: -122.41}, Tags: []string{"mobile"}})
+	assert.NoError(t, err)
+	_, err = s.UpdateSensor("Sensor1", &model.Sensor{Name: "Sensor1", Location: sanJose, Tags: []string{"mobile"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		events.TypeCreated,
+		events.TypeUpdated, events.TypeGeofenceEnter,
+		events.TypeUpdated,
+		events.TypeUpdated, events.TypeGeofenceExit, events.TypeGeofenceEnter,
+	}, sink.types()[:1+2+1+3])
+	assert.Equal(t, circle.ID, sink.events[2].Geofence)
+	assert.Equal(t, sanFrancisco, sink.events[2].Sensor.Location)
+
+	// Check the exit and enter of the same update are both alerted, and in the right geofences
+	exit, enter := sink.events[5], sink.events[6]
+	assert.Equal(t, circle.ID, exit.Geofence)
+	assert.Equal(t, polygon.ID, enter.Geofence)
+
+	// Test a polygon is scoped to its tags, so losing the tag exits it
+	_, err = s.UpdateSensor("Sensor1", &model.Sensor{Name: "Sensor1", Location: sanJose})
+	assert.NoError(t, err)
+	assert.Equal(t, events.TypeGeofenceExit, sink.events[len(sink.events)-1].Type)
+	_, err = s.AddSensor(model.Sensor{Name: "Sensor2", Location: oakland})
+	assert.NoError(t, err)
+	_, err = s.UpdateSensor("Sensor2", &model.Sensor{Name: "Sensor2", Location: sanJose})
+	assert.NoError(t, err)
+	assert.Equal(t, events.TypeUpdated, sink.events[len(sink.events)-1].Type)
+
+	// Test alerts are recorded and can be queried by geofence, sensor and ID
+	alerts, code, err := monitor.GetAlerts(AlertQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, alerts, 4)
+	assert.Equal(t, Alert{ID: 1, Type: AlertEnter, Geofence: circle.ID, Sensor: "Sensor1", Location: sanFrancisco, Time: alerts[0].Time}, alerts[0])
+	alerts, _, _ = monitor.GetAlerts(AlertQuery{Geofence: polygon.ID})
+	assert.Len(t, alerts, 2)
+	alerts, _, _ = monitor.GetAlerts(AlertQuery{After: 3})
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, uint64(4), alerts[0].ID)
+	alerts, _, _ = monitor.GetAlerts(AlertQuery{Sensor: "Sensor2"})
+	assert.Empty(t, alerts)
+
+	// Check only the most recent alerts are kept
+	monitor.maxAlerts = 2
+	_, err = s.UpdateSensor("Sensor2", &model.Sensor{Name: "Sensor2", Location: sanFrancisco})
+	assert.NoError(t, err)
+	alerts, _, _ = monitor.GetAlerts(AlertQuery{})
+	assert.Len(t, alerts, 2)
+	assert.Equal(t, uint64(5), alerts[1].ID)
+}
+
+func TestFences(t *testing.T) {
+	monitor := NewMonitor(nil, nil, 0)
+
+	// Test invalid geofences are rejected
+	for _, fence := range []Fence{
+		{},
+		{Circle: &Circle{Center: sanFrancisco, Radius: 100}, Polygon: square},
+		{Circle: &Circle{Center: sanFrancisco}},
+		{Circle: &Circle{Center: model.Location{Latitude: 95}, Radius: 100}},
+		{Polygon: json.RawMessage(`{"type": "Point", "coordinates": [1, 1]}`)},
+		{Polygon: json.RawMessage(`{"type": "Polygon", "coordinates": [[[0, 0], [1, 1], [0, 0]]]}`)},
+		{Circle: &Circle{Center: sanFrancisco, Radius: 100}, TagExpr: "("},
+	} {
+		_, code, err := monitor.AddFence(fence)
+		assert.Error(t, err, fence)
+		assert.Equal(t, http.StatusBadRequest, code)
+	}
+
+	// Test geofences are added, retrieved, listed, updated and removed
+	fence, code, err := monitor.AddFence(Fence{Name: "Depot", Circle: &Circle{Center: sanFrancisco, Radius: 100}})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.NotEmpty(t, fence.ID)
+	retrieved, _, err := monitor.GetFence(fence.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Depot", retrieved.Name)
+	_, code, err = monitor.GetFence("missing")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	updated, code, err := monitor.UpdateFence(fence.ID, Fence{Name: "Yard", Polygon: square})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, fence.ID, updated.ID)
+	_, code, err = monitor.UpdateFence("missing", Fence{Polygon: square})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// the index follows the update, so only the new geometry is a candidate
+	assert.Empty(t, monitor.candidates(sanFrancisco))
+	assert.Len(t, monitor.candidates(sanJose), 1)
+
+	fences, _, err := monitor.GetFences()
+	assert.NoError(t, err)
+	assert.Len(t, fences, 1)
+	assert.Equal(t, "Yard", fences[0].Name)
+
+	code, err = monitor.RemoveFence(fence.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, code)
+	code, err = monitor.RemoveFence(fence.ID)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Empty(t, monitor.candidates(sanJose))
+}
+
+func TestAntimeridianCircle(t *testing.T) {
+	sink := &recorder{}
+	monitor := NewMonitor(sink, nil, 0)
+	fence, _, err := monitor.AddFence(Fence{Circle: &Circle{Center: model.Location{Latitude: 10, Longitude: 179.99}, Radius: 10000}})
+	assert.NoError(t, err)
+
+	// a circle crossing the antimeridian is found from either side of it
+	assert.Len(t, monitor.candidates(model.Location{Latitude: 10, Longitude: -179.99}), 1)
+	monitor.Publish(events.Updated(
+		model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 20, Longitude: 20}},
+		model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 10, Longitude: -179.99}},
+	))
+	assert.Equal(t, []string{events.TypeUpdated, events.TypeGeofenceEnter}, sink.types())
+	assert.Equal(t, fence.ID, sink.events[1].Geofence)
+}
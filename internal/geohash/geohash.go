@@ -0,0 +1,126 @@
+package geohash
+
+import (
+	"math"
+	"sensor-api/internal/model"
+	"strings"
+)
+
+// A geohash names a cell of a grid over the globe. Each character adds five bits, alternately halving
+// the cell's longitude and latitude range, so nearby locations share long prefixes and the cells
+// covering an area can be found by scanning a handful of key prefixes.
+
+// MaxPrecision is the longest geohash supported, giving cells a few centimeters across.
+const MaxPrecision = 12
+
+const alphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Encode returns the geohash of the given precision holding the location.
+func Encode(location model.Location, precision int) string {
+	latIndex, lonIndex := cell(location.Latitude, location.Longitude, precision)
+	return encode(latIndex, lonIndex, precision)
+}
+
+// Bounds returns the box covered by a geohash. ok is false if the hash is empty, too long or not a geohash.
+func Bounds(hash string) (box model.BoundingBox, ok bool) {
+	if hash == "" || len(hash) > MaxPrecision {
+		return model.BoundingBox{}, false
+	}
+
+	var latIndex, lonIndex uint64
+	for i := 0; i < len(hash); i++ {
+		value := strings.IndexByte(alphabet, hash[i])
+		if value < 0 {
+			return model.BoundingBox{}, false
+		}
+		for bit := 4; bit >= 0; bit-- {
+			b := uint64(value>>bit) & 1
+			if (i*5+4-bit)%2 == 0 {
+				lonIndex = lonIndex<<1 | b
+			} else {
+				latIndex = latIndex<<1 | b
+			}
+		}
+	}
+
+	latSize, lonSize := cellSize(len(hash))
+	return model.BoundingBox{
+		Min: model.Location{Latitude: -90 + float64(latIndex)*latSize, Longitude: -180 + float64(lonIndex)*lonSize},
+		Max: model.Location{Latitude: -90 + float64(latIndex+1)*latSize, Longitude: -180 + float64(lonIndex+1)*lonSize},
+	}, true
+}
+
+// Cover returns geohashes whose cells together cover the box, using the longest precision that needs
+// at most maxCells of them. At least 32 cells are always allowed, which covers the globe.
+func Cover(box model.BoundingBox, maxCells int) []string {
+	precision := MaxPrecision
+	for ; precision > 1; precision-- {
+		minLat, minLon := cell(box.Min.Latitude, box.Min.Longitude, precision)
+		maxLat, maxLon := cell(box.Max.Latitude, box.Max.Longitude, precision)
+		if (maxLat-minLat+1)*(maxLon-minLon+1) <= uint64(maxCells) {
+			break
+		}
+	}
+
+	minLat, minLon := cell(box.Min.Latitude, box.Min.Longitude, precision)
+	maxLat, maxLon := cell(box.Max.Latitude, box.Max.Longitude, precision)
+	var hashes []string
+	for lat := minLat; lat <= maxLat; lat++ {
+		for lon := minLon; lon <= maxLon; lon++ {
+			hashes = append(hashes, encode(lat, lon, precision))
+		}
+	}
+	return hashes
+}
+
+// bits returns how many of a geohash's bits index latitude and longitude. Longitude takes the first
+// bit, so it has the extra one when the total is odd.
+func bits(precision int) (latBits, lonBits uint) {
+	total := uint(precision * 5)
+	return total / 2, total - total/2
+}
+
+// cellSize returns the height and width in degrees of a cell.
+func cellSize(precision int) (latSize, lonSize float64) {
+	latBits, lonBits := bits(precision)
+	return 180 / float64(uint64(1)<<latBits), 360 / float64(uint64(1)<<lonBits)
+}
+
+// cell returns the row and column of the cell holding a location, counting from the south west.
+func cell(lat, lon float64, precision int) (latIndex, lonIndex uint64) {
+	latBits, lonBits := bits(precision)
+	return index((lat+90)/180, latBits), index((lon+180)/360, lonBits)
+}
+
+// index scales a fraction in [0, 1] to one of 2^bits cells, keeping the far edge in the last cell.
+func index(fraction float64, bits uint) uint64 {
+	n := uint64(1) << bits
+	i := math.Floor(fraction * float64(n))
+	if i < 0 {
+		return 0
+	}
+	if i >= float64(n) {
+		return n - 1
+	}
+	return uint64(i)
+}
+
+// encode interleaves the cell's row and column into a geohash, longitude bit first.
+func encode(latIndex, lonIndex uint64, precision int) string {
+	latBits, lonBits := bits(precision)
+	var hash uint64
+	for i := uint(0); i < latBits+lonBits; i++ {
+		if i%2 == 0 {
+			hash = hash<<1 | (lonIndex>>(lonBits-1-i/2))&1
+		} else {
+			hash = hash<<1 | (latIndex>>(latBits-1-i/2))&1
+		}
+	}
+
+	b := make([]byte, precision)
+	for i := precision - 1; i >= 0; i-- {
+		b[i] = alphabet[hash&31]
+		hash >>= 5
+	}
+	return string(b)
+}
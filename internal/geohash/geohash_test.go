@@ -0,0 +1,80 @@
+package geohash
+
+import (
+	"math/rand"
+	"sensor-api/internal/model"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncode(t *testing.T) {
+	// well known geohashes
+	assert.Equal(t, "9q8yyk8ytp", Encode(model.Location{Latitude: 37.7749, Longitude: -122.4194}, 10))
+	assert.Equal(t, "u4pruydqqvj", Encode(model.Location{Latitude: 57.64911, Longitude: 10.40744}, 11))
+	assert.Equal(t, "s0000", Encode(model.Location{Latitude: 0, Longitude: 0}, 5))
+
+	// the far edges of the globe fall in the last cells
+	assert.Equal(t, "zzzz", Encode(model.Location{Latitude: 90, Longitude: 180}, 4))
+	assert.Equal(t, "0000", Encode(model.Location{Latitude: -90, Longitude: -180}, 4))
+}
+
+func TestBounds(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		location := model.Location{Latitude: rng.Float64()*180 - 90, Longitude: rng.Float64()*360 - 180}
+		for precision := 1; precision <= MaxPrecision; precision++ {
+			hash := Encode(location, precision)
+			box, ok := Bounds(hash)
+			assert.True(t, ok)
+			assert.True(t, box.Contains(location), "%s %v %v", hash, box, location)
+		}
+	}
+
+	box, ok := Bounds("9q8y")
+	assert.True(t, ok)
+	assert.InDelta(t, 37.6171875, box.Min.Latitude, 1e-9)
+	assert.InDelta(t, 37.79296875, box.Max.Latitude, 1e-9)
+	assert.InDelta(t, -122.6953125, box.Min.Longitude, 1e-9)
+	assert.InDelta(t, -122.34375, box.Max.Longitude, 1e-9)
+
+	for _, hash := range []string{"", "9q8a", strings.Repeat("0", MaxPrecision+1)} {
+		_, ok := Bounds(hash)
+		assert.False(t, ok, hash)
+	}
+}
+
+func TestCover(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		lat, lon := rng.Float64()*170-85, rng.Float64()*350-175
+		size := rng.Float64() * 5
+		box := model.BoundingBox{
+			Min: model.Location{Latitude: lat, Longitude: lon},
+			Max: model.Location{Latitude: lat + size, Longitude: lon + size},
+		}
+
+		hashes := Cover(box, 16)
+		assert.NotEmpty(t, hashes)
+		assert.LessOrEqual(t, len(hashes), 16)
+
+		// every location in the box has a geohash starting with one of the cells
+		for j := 0; j < 20; j++ {
+			location := model.Location{
+				Latitude:  box.Min.Latitude + rng.Float64()*size,
+				Longitude: box.Min.Longitude + rng.Float64()*size,
+			}
+			hash := Encode(location, MaxPrecision)
+			covered := false
+			for _, prefix := range hashes {
+				covered = covered || strings.HasPrefix(hash, prefix)
+			}
+			assert.True(t, covered, "%v %v", location, hashes)
+		}
+	}
+
+	// the whole globe needs the 32 one character cells
+	world := model.BoundingBox{Min: model.Location{Latitude: -90, Longitude: -180}, Max: model.Location{Latitude: 90, Longitude: 180}}
+	assert.Len(t, Cover(world, 1), 32)
+}
@@ -0,0 +1,213 @@
+package geojson
+
+import (
+	"encoding/json"
+	"fmt"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/model"
+)
+
+// GeoJSON support for the API, as described by RFC 7946.
+// https://datatracker.ietf.org/doc/html/rfc7946
+// Positions are [longitude, latitude] pairs, the reverse of the order used everywhere else in this API.
+
+// Geometry types
+const (
+	TypePoint        = "Point"
+	TypePolygon      = "Polygon"
+	TypeMultiPolygon = "MultiPolygon"
+	TypeFeature      = "Feature"
+
+	TypeFeatureCollection = "FeatureCollection"
+)
+
+// Geometry is a GeoJSON geometry object with its coordinates left undecoded until its type is known.
+type Geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// Position is a GeoJSON [longitude, latitude] position. Any altitude is ignored.
+type Position []float64
+
+// Location converts the position to a model.Location.
+func (p Position) Location() (model.Location, error) {
+	if len(p) < 2 {
+		return model.Location{}, fmt.Errorf("position must have a longitude and a latitude")
+	}
+	return model.Location{Latitude: p[1], Longitude: p[0]}, nil
+}
+
+// Point is a GeoJSON Point geometry.
+type Point struct {
+	Type        string   `json:"type"`
+	Coordinates Position `json:"coordinates"`
+}
+
+// SensorFeature is a sensor as a GeoJSON Feature: a Point at its location, with its name and tags as
+// properties.
+type SensorFeature struct {
+	Type       string           `json:"type"`
+	Geometry   *Point           `json:"geometry"`
+	Properties SensorProperties `json:"properties"`
+}
+
+// SensorProperties are the properties of a SensorFeature. Distance and Bearing are only set for
+// sensors found by distance from a location.
+type SensorProperties struct {
+	Name     string   `json:"name"`
+	Tags     []string `json:"tags"`
+	Distance *float64 `json:"distance,omitempty"`
+	Bearing  *float64 `json:"bearing,omitempty"`
+}
+
+// SensorFeatureCollection is a GeoJSON FeatureCollection of sensors.
+type SensorFeatureCollection struct {
+	Type     string          `json:"type"`
+	Features []SensorFeature `json:"features"`
+}
+
+// NewSensorFeature returns the Feature for a sensor.
+func NewSensorFeature(sensor model.Sensor) SensorFeature {
+	tags := sensor.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return SensorFeature{
+		Type:       TypeFeature,
+		Geometry:   &Point{Type: TypePoint, Coordinates: Position{sensor.Location.Longitude, sensor.Location.Latitude}},
+		Properties: SensorProperties{Name: sensor.Name, Tags: tags},
+	}
+}
+
+// NewSensorDistanceFeature returns the Feature for a sensor found by distance, with its distance and
+// bearing as properties.
+func NewSensorDistanceFeature(sensor model.SensorDistance) SensorFeature {
+	feature := NewSensorFeature(sensor.Sensor)
+	distance, bearing := sensor.Distance, sensor.Bearing
+	feature.Properties.Distance = &distance
+	feature.Properties.Bearing = &bearing
+	return feature
+}
+
+// NewSensorFeatureCollection returns the FeatureCollection of sensors.
+func NewSensorFeatureCollection(sensors []model.Sensor) SensorFeatureCollection {
+	collection := SensorFeatureCollection{Type: TypeFeatureCollection, Features: make([]SensorFeature, len(sensors))}
+	for i, sensor := range sensors {
+		collection.Features[i] = NewSensorFeature(sensor)
+	}
+	return collection
+}
+
+// NewSensorDistanceFeatureCollection returns the FeatureCollection of sensors found by distance.
+func NewSensorDistanceFeatureCollection(sensors []model.SensorDistance) SensorFeatureCollection {
+	collection := SensorFeatureCollection{Type: TypeFeatureCollection, Features: make([]SensorFeature, len(sensors))}
+	for i, sensor := range sensors {
+		collection.Features[i] = NewSensorDistanceFeature(sensor)
+	}
+	return collection
+}
+
+// DecodeSensorFeature parses a GeoJSON Feature with a Point geometry into a sensor.
+func DecodeSensorFeature(data []byte) (model.Sensor, error) {
+	var feature SensorFeature
+	if err := json.Unmarshal(data, &feature); err != nil {
+		return model.Sensor{}, err
+	}
+	if feature.Type != TypeFeature {
+		return model.Sensor{}, fmt.Errorf("unsupported type %q, expected Feature", feature.Type)
+	}
+	if feature.Geometry == nil || feature.Geometry.Type != TypePoint {
+		return model.Sensor{}, fmt.Errorf("feature geometry must be a Point")
+	}
+	location, err := feature.Geometry.Coordinates.Location()
+	if err != nil {
+		return model.Sensor{}, err
+	}
+	return model.Sensor{Name: feature.Properties.Name, Location: location, Tags: feature.Properties.Tags}, nil
+}
+
+// DecodeFeatureCollection parses a GeoJSON FeatureCollection, leaving its features undecoded so that
+// each can be decoded, and fail, separately.
+func DecodeFeatureCollection(data []byte) ([]json.RawMessage, error) {
+	var collection struct {
+		Type     string            `json:"type"`
+		Features []json.RawMessage `json:"features"`
+	}
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, err
+	}
+	if collection.Type != TypeFeatureCollection {
+		return nil, fmt.Errorf("unsupported type %q, expected FeatureCollection", collection.Type)
+	}
+	return collection.Features, nil
+}
+
+// DecodeMultiPolygon parses a GeoJSON Polygon or MultiPolygon geometry, or a Feature holding one, into a
+// geo.MultiPolygon. A Polygon becomes a MultiPolygon of one.
+func DecodeMultiPolygon(data []byte) (geo.MultiPolygon, error) {
+	var object struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+		Geometry    *Geometry       `json:"geometry"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	geometry := Geometry{Type: object.Type, Coordinates: object.Coordinates}
+	if object.Type == TypeFeature {
+		if object.Geometry == nil {
+			return nil, fmt.Errorf("feature has no geometry")
+		}
+		geometry = *object.Geometry
+	}
+
+	var multiPolygon geo.MultiPolygon
+	switch geometry.Type {
+	case TypePolygon:
+		var coordinates [][]Position
+		if err := json.Unmarshal(geometry.Coordinates, &coordinates); err != nil {
+			return nil, fmt.Errorf("invalid polygon coordinates: %w", err)
+		}
+		polygon, err := decodePolygon(coordinates)
+		if err != nil {
+			return nil, err
+		}
+		multiPolygon = geo.MultiPolygon{polygon}
+	case TypeMultiPolygon:
+		var coordinates [][][]Position
+		if err := json.Unmarshal(geometry.Coordinates, &coordinates); err != nil {
+			return nil, fmt.Errorf("invalid multipolygon coordinates: %w", err)
+		}
+		for _, polygonCoordinates := range coordinates {
+			polygon, err := decodePolygon(polygonCoordinates)
+			if err != nil {
+				return nil, err
+			}
+			multiPolygon = append(multiPolygon, polygon)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported geometry type %q, expected Polygon or MultiPolygon", geometry.Type)
+	}
+
+	if err := multiPolygon.Validate(); err != nil {
+		return nil, err
+	}
+	return multiPolygon, nil
+}
+
+func decodePolygon(coordinates [][]Position) (geo.Polygon, error) {
+	polygon := make(geo.Polygon, len(coordinates))
+	for i, ring := range coordinates {
+		polygon[i] = make([]model.Location, len(ring))
+		for j, position := range ring {
+			location, err := position.Location()
+			if err != nil {
+				return nil, err
+			}
+			polygon[i][j] = location
+		}
+	}
+	return polygon, nil
+}
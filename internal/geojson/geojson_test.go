@@ -0,0 +1,123 @@
+package geojson
+
+import (
+	"encoding/json"
+	"sensor-api/internal/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeMultiPolygon(t *testing.T) {
+	t.Run("Polygon with a hole", func(t *testing.T) {
+		multiPolygon, err := DecodeMultiPolygon([]byte(`{
+			"type": "Polygon",
+			"coordinates": [
+				[[-122.5, 37.7], [-122.3, 37.7], [-122.3, 37.8], [-122.5, 37.8], [-122.5, 37.7]],
+				[[-122.45, 37.75], [-122.4, 37.75], [-122.4, 37.76], [-122.45, 37.76], [-122.45, 37.75]]
+			]
+		}`))
+		assert.NoError(t, err)
+		assert.Len(t, multiPolygon, 1)
+		assert.Len(t, multiPolygon[0], 2)
+
+		// positions are [longitude, latitude]
+		assert.Equal(t, model.Location{Latitude: 37.7, Longitude: -122.5}, multiPolygon[0][0][0])
+		assert.True(t, multiPolygon.Contains(model.Location{Latitude: 37.72, Longitude: -122.42}))
+		assert.False(t, multiPolygon.Contains(model.Location{Latitude: 37.755, Longitude: -122.42}))
+	})
+
+	t.Run("MultiPolygon feature", func(t *testing.T) {
+		multiPolygon, err := DecodeMultiPolygon([]byte(`{
+			"type": "Feature",
+			"properties": {"name": "campus"},
+			"geometry": {
+				"type": "MultiPolygon",
+				"coordinates": [
+					[[[0, 0], [1, 0], [1, 1], [0, 1], [0, 0]]],
+					[[[10, 10], [11, 10], [11, 11], [10, 11], [10, 10]]]
+				]
+			}
+		}`))
+		assert.NoError(t, err)
+		assert.Len(t, multiPolygon, 2)
+		assert.True(t, multiPolygon.Contains(model.Location{Latitude: 10.5, Longitude: 10.5}))
+	})
+
+	t.Run("Invalid input", func(t *testing.T) {
+		for _, body := range []string{
+			`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 0]]`,
+			`{"type": "Point", "coordinates": [0, 0]}`,
+			`{"type": "Feature", "properties": {}}`,
+			`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 1]]]}`,
+			`{"type": "Polygon", "coordinates": [[[0], [1, 0], [1, 1], [0, 0]]]}`,
+			`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 91], [0, 0]]]}`,
+			`{"type": "Polygon", "coordinates": []}`,
+			`{"type": "MultiPolygon", "coordinates": "nope"}`,
+		} {
+			_, err := DecodeMultiPolygon([]byte(body))
+			assert.Error(t, err, body)
+		}
+	})
+}
+
+func TestSensorFeature(t *testing.T) {
+	sensor := model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor"}}
+
+	// positions are [longitude, latitude]
+	data, err := json.Marshal(NewSensorFeature(sensor))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"type": "Feature",
+		"geometry": {"type": "Point", "coordinates": [-122.4194, 37.7749]},
+		"properties": {"name": "Sensor1", "tags": ["indoor"]}
+	}`, string(data))
+
+	decoded, err := DecodeSensorFeature(data)
+	assert.NoError(t, err)
+	assert.Equal(t, sensor, decoded)
+
+	for _, body := range []string{
+		`{"type": "Point", "coordinates": [0, 0]}`,
+		`{"type": "Feature", "properties": {"name": "Sensor1"}}`,
+		`{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": []}}`,
+		`{"type": "Feature", "geometry": {"type": "Point", "coordinates": [1]}}`,
+	} {
+		_, err := DecodeSensorFeature([]byte(body))
+		assert.Error(t, err, body)
+	}
+}
+
+func TestDecodeFeatureCollection(t *testing.T) {
+	features, err := DecodeFeatureCollection([]byte(`{"type": "FeatureCollection", "features": [{"type": "Feature"}, {}]}`))
+	assert.NoError(t, err)
+	assert.Len(t, features, 2)
+
+	_, err = DecodeFeatureCollection([]byte(`{"type": "Feature", "features": []}`))
+	assert.Error(t, err)
+}
+
+func TestSensorFeatureCollection(t *testing.T) {
+	sensor := model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}}
+
+	data, err := json.Marshal(NewSensorFeatureCollection([]model.Sensor{sensor}))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type": "FeatureCollection", "features": [{
+		"type": "Feature",
+		"geometry": {"type": "Point", "coordinates": [-122.4194, 37.7749]},
+		"properties": {"name": "Sensor1", "tags": []}
+	}]}`, string(data))
+
+	// a distance of zero is still written
+	data, err = json.Marshal(NewSensorDistanceFeatureCollection([]model.SensorDistance{{Sensor: sensor, Distance: 0, Bearing: 90}}))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type": "FeatureCollection", "features": [{
+		"type": "Feature",
+		"geometry": {"type": "Point", "coordinates": [-122.4194, 37.7749]},
+		"properties": {"name": "Sensor1", "tags": [], "distance": 0, "bearing": 90}
+	}]}`, string(data))
+
+	data, err = json.Marshal(NewSensorFeatureCollection(nil))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type": "FeatureCollection", "features": []}`, string(data))
+}
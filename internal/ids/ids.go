@@ -0,0 +1,18 @@
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// IDs name the things the API creates at runtime, such as webhooks, geofences and requests. They are
+// random rather than sequential, so they cannot be guessed and do not collide across restarts.
+
+// New returns a random 128-bit ID in hex.
+func New() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
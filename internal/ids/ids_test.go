@@ -0,0 +1,17 @@
+package ids
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	// Test IDs are 128 bits in hex, and differ
+	id := New()
+	assert.Len(t, id, 32)
+	_, err := hex.DecodeString(id)
+	assert.NoError(t, err)
+	assert.NotEqual(t, id, New())
+}
@@ -0,0 +1,371 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Patch documents for partial updates, as described by RFC 6902 (JSON Patch) and RFC 7396 (JSON
+// Merge Patch).
+// https://datatracker.ietf.org/doc/html/rfc6902
+// https://datatracker.ietf.org/doc/html/rfc7396
+// Both are applied to a JSON document and return the patched document. A patch either applies in
+// full or returns an error, leaving the document unchanged.
+
+// Media types
+const (
+	MediaTypeJSONPatch  = "application/json-patch+json"
+	MediaTypeMergePatch = "application/merge-patch+json"
+)
+
+// Patch is a parsed patch document.
+type Patch interface {
+	// Apply returns the document with the patch applied.
+	Apply(doc []byte) ([]byte, error)
+}
+
+// JSON Patch operations
+const (
+	OpAdd     = "add"
+	OpRemove  = "remove"
+	OpReplace = "replace"
+	OpMove    = "move"
+	OpCopy    = "copy"
+	OpTest    = "test"
+)
+
+// Operation is a single JSON Patch operation.
+type Operation struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// From is the source location of move and copy operations.
+	From string `json:"from,omitempty"`
+	// Value is the value added, replaced with or tested for. It is nil when missing, and the JSON
+	// literal null when the value is null.
+	Value json.RawMessage `json:"value,omitempty"`
+
+	path, from pointer
+	value      interface{}
+}
+
+// JSONPatch is a JSON Patch document: operations applied in order.
+type JSONPatch []Operation
+
+// ParseJSONPatch parses a JSON Patch document, checking every operation is well formed.
+func ParseJSONPatch(data []byte) (JSONPatch, error) {
+	var patch JSONPatch
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, fmt.Errorf("invalid JSON Patch: %w", err)
+	}
+
+	for i := range patch {
+		op := &patch[i]
+		var err error
+		if op.path, err = parsePointer(op.Path); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+		switch op.Op {
+		case OpAdd, OpReplace, OpTest:
+			if op.Value == nil {
+				return nil, fmt.Errorf("operation %d: %s requires a value", i, op.Op)
+			}
+			if err := json.Unmarshal(op.Value, &op.value); err != nil {
+				return nil, fmt.Errorf("operation %d: invalid value: %w", i, err)
+			}
+		case OpMove, OpCopy:
+			if op.from, err = parsePointer(op.From); err != nil {
+				return nil, fmt.Errorf("operation %d: from: %w", i, err)
+			}
+			if op.Op == OpMove && op.from.contains(op.path) && len(op.path) > len(op.from) {
+				return nil, fmt.Errorf("operation %d: cannot move %q into itself", i, op.From)
+			}
+		case OpRemove:
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op %q", i, op.Op)
+		}
+	}
+
+	return patch, nil
+}
+
+// Apply returns the document with each operation applied in turn.
+func (patch JSONPatch) Apply(doc []byte) ([]byte, error) {
+	var value interface{}
+	if err := json.Unmarshal(doc, &value); err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+
+	for i, op := range patch {
+		var err error
+		if value, err = op.apply(value); err != nil {
+			return nil, fmt.Errorf("operation %d: %s %s: %w", i, op.Op, op.Path, err)
+		}
+	}
+
+	return json.Marshal(value)
+}
+
+// apply returns the document with the operation applied. The document may be changed in place.
+func (op Operation) apply(doc interface{}) (interface{}, error) {
+	switch op.Op {
+	case OpAdd:
+		return add(doc, op.path, clone(op.value))
+	case OpRemove:
+		doc, _, err := remove(doc, op.path)
+		return doc, err
+	case OpReplace:
+		if len(op.path) == 0 {
+			return clone(op.value), nil
+		}
+		doc, _, err := remove(doc, op.path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, op.path, clone(op.value))
+	case OpMove:
+		doc, value, err := remove(doc, op.from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, op.path, value)
+	case OpCopy:
+		value, err := get(doc, op.from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, op.path, clone(value))
+	case OpTest:
+		value, err := get(doc, op.path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, op.value) {
+			return nil, fmt.Errorf("test failed: value is %s", marshal(value))
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// MergePatch is a JSON Merge Patch document: the members of an object replace those of the document,
+// recursively, with null removing a member.
+type MergePatch struct {
+	value interface{}
+}
+
+// ParseMergePatch parses a JSON Merge Patch document.
+func ParseMergePatch(data []byte) (MergePatch, error) {
+	var patch MergePatch
+	if err := json.Unmarshal(data, &patch.value); err != nil {
+		return patch, fmt.Errorf("invalid JSON Merge Patch: %w", err)
+	}
+	return patch, nil
+}
+
+// Apply returns the document with the patch merged into it.
+func (patch MergePatch) Apply(doc []byte) ([]byte, error) {
+	var value interface{}
+	if err := json.Unmarshal(doc, &value); err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+	return json.Marshal(merge(value, clone(patch.value)))
+}
+
+// merge merges patch into target as described by RFC 7396.
+func merge(target, patch interface{}) interface{} {
+	members, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		object = map[string]interface{}{}
+	}
+	for name, value := range members {
+		if value == nil {
+			delete(object, name)
+		} else {
+			object[name] = merge(object[name], value)
+		}
+	}
+	return object
+}
+
+// pointer is a parsed JSON Pointer (RFC 6901): the reference tokens leading from the root of a
+// document to a value. The empty pointer refers to the whole document.
+type pointer []string
+
+func parsePointer(s string) (pointer, error) {
+	if s == "" {
+		return pointer{}, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("invalid pointer %q: must start with /", s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// contains reports whether other refers to the value p refers to or to a value inside it.
+func (p pointer) contains(other pointer) bool {
+	if len(other) < len(p) {
+		return false
+	}
+	for i := range p {
+		if p[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// get returns the value the pointer refers to.
+func get(doc interface{}, p pointer) (interface{}, error) {
+	for _, token := range p {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node))
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("cannot refer to %q inside %s", token, marshal(node))
+		}
+	}
+	return doc, nil
+}
+
+// add adds value at the pointer: replacing an object member, or inserting into an array before the
+// indexed element, or at the end for the index "-".
+func add(doc interface{}, p pointer, value interface{}) (interface{}, error) {
+	if len(p) == 0 {
+		return value, nil
+	}
+	return modify(doc, p, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i := len(node)
+			if token != "-" {
+				var err error
+				if i, err = arrayIndex(token, len(node)+1); err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("cannot add %q to %s", token, marshal(parent))
+	})
+}
+
+// remove removes the value the pointer refers to, returning the document and the removed value.
+func remove(doc interface{}, p pointer) (interface{}, interface{}, error) {
+	if len(p) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole document")
+	}
+	var removed interface{}
+	doc, err := modify(doc, p, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node))
+			if err != nil {
+				return nil, err
+			}
+			removed = node[i]
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove %q from %s", token, marshal(parent))
+	})
+	return doc, removed, err
+}
+
+// modify replaces the parent of the value the non-empty pointer refers to with the result of fn,
+// called with the parent and the last token of the pointer, and returns the document.
+func modify(doc interface{}, p pointer, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(p) == 1 {
+		return fn(doc, p[0])
+	}
+
+	child, err := get(doc, p[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = modify(child, p[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+
+	// arrays may have been reallocated, so the parent is updated with the new child
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[p[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(p[0], len(node))
+		node[i] = child
+	}
+	return doc, nil
+}
+
+// arrayIndex parses an array index token, which must be less than length.
+func arrayIndex(token string, length int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.TrimLeft(token, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i >= length {
+		return 0, fmt.Errorf("array index %s out of range", token)
+	}
+	return i, nil
+}
+
+// clone returns a deep copy of a decoded JSON value, so that it can be changed without changing the
+// original.
+func clone(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for name, member := range value {
+			object[name] = clone(member)
+		}
+		return object
+	case []interface{}:
+		array := make([]interface{}, len(value))
+		for i, element := range value {
+			array[i] = clone(element)
+		}
+		return array
+	}
+	return value
+}
+
+// marshal returns a value as JSON for error messages.
+func marshal(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
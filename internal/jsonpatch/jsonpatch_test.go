@@ -0,0 +1,101 @@
+package jsonpatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONPatch(t *testing.T) {
+	doc := `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"tags":["indoor","temperature"]}`
+
+	t.Run("Operations", func(t *testing.T) {
+		for _, test := range []struct {
+			patch    string
+			expected string
+		}{
+			// examples adapted from RFC 6902 appendix A
+			{`[{"op":"add","path":"/tags/-","value":"humidity"}]`, `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"tags":["indoor","temperature","humidity"]}`},
+			{`[{"op":"add","path":"/tags/1","value":"outdoor"}]`, `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"tags":["indoor","outdoor","temperature"]}`},
+			{`[{"op":"remove","path":"/tags/0"}]`, `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"tags":["temperature"]}`},
+			{`[{"op":"replace","path":"/location/latitude","value":38}]`, `{"name":"Sensor1","location":{"latitude":38,"longitude":-122.4194},"tags":["indoor","temperature"]}`},
+			{`[{"op":"move","from":"/tags/0","path":"/tags/-"}]`, `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"tags":["temperature","indoor"]}`},
+			{`[{"op":"copy","from":"/name","path":"/tags/0"}]`, `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"tags":["Sensor1","indoor","temperature"]}`},
+			{`[{"op":"test","path":"/tags","value":["indoor","temperature"]},{"op":"replace","path":"/tags","value":[]}]`, `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"tags":[]}`},
+			{`[{"op":"add","path":"/location/a~1b~0c","value":null},{"op":"test","path":"/location/a~1b~0c","value":null}]`, `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194,"a/b~c":null},"tags":["indoor","temperature"]}`},
+			{`[{"op":"replace","path":"","value":{"name":"Sensor2"}}]`, `{"name":"Sensor2"}`},
+			{`[]`, doc},
+		} {
+			patch, err := ParseJSONPatch([]byte(test.patch))
+			if !assert.NoError(t, err, test.patch) {
+				continue
+			}
+			patched, err := patch.Apply([]byte(doc))
+			assert.NoError(t, err, test.patch)
+			assert.JSONEq(t, test.expected, string(patched), test.patch)
+		}
+	})
+
+	t.Run("Failed operations", func(t *testing.T) {
+		for _, body := range []string{
+			`[{"op":"test","path":"/name","value":"Sensor2"}]`,
+			`[{"op":"remove","path":"/missing"}]`,
+			`[{"op":"replace","path":"/tags/2","value":"outdoor"}]`,
+			`[{"op":"add","path":"/tags/3","value":"outdoor"}]`,
+			`[{"op":"add","path":"/tags/01","value":"outdoor"}]`,
+			`[{"op":"add","path":"/missing/member","value":1}]`,
+			`[{"op":"add","path":"/name/member","value":1}]`,
+			`[{"op":"remove","path":""}]`,
+			// the whole patch fails if any operation does
+			`[{"op":"remove","path":"/tags/0"},{"op":"test","path":"/tags/0","value":"indoor"}]`,
+		} {
+			patch, err := ParseJSONPatch([]byte(body))
+			if !assert.NoError(t, err, body) {
+				continue
+			}
+			_, err = patch.Apply([]byte(doc))
+			assert.Error(t, err, body)
+		}
+	})
+
+	t.Run("Invalid patches", func(t *testing.T) {
+		for _, body := range []string{
+			`{"op":"add","path":"/tags/-","value":"humidity"}`,
+			`[{"op":"add","path":"/tags/-"}]`,
+			`[{"op":"add","path":"tags","value":"humidity"}]`,
+			`[{"op":"frobnicate","path":"/tags"}]`,
+			`[{"op":"move","from":"/location","path":"/location/latitude"}]`,
+			`[{"op":"copy","from":"name","path":"/tags/-"}]`,
+			`[{"op":"add","path":"/tags/-","value":"humidity"}`,
+		} {
+			_, err := ParseJSONPatch([]byte(body))
+			assert.Error(t, err, body)
+		}
+	})
+}
+
+func TestMergePatch(t *testing.T) {
+	doc := `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"tags":["indoor"]}`
+
+	for _, test := range []struct {
+		patch    string
+		expected string
+	}{
+		{`{"tags":["outdoor","humidity"]}`, `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"tags":["outdoor","humidity"]}`},
+		{`{"location":{"latitude":38}}`, `{"name":"Sensor1","location":{"latitude":38,"longitude":-122.4194},"tags":["indoor"]}`},
+		{`{"tags":null,"extra":{"a":null,"b":1}}`, `{"name":"Sensor1","location":{"latitude":37.7749,"longitude":-122.4194},"extra":{"b":1}}`},
+		{`{}`, doc},
+		{`["replaced"]`, `["replaced"]`},
+	} {
+		patch, err := ParseMergePatch([]byte(test.patch))
+		if !assert.NoError(t, err, test.patch) {
+			continue
+		}
+		patched, err := patch.Apply([]byte(doc))
+		assert.NoError(t, err, test.patch)
+		assert.JSONEq(t, test.expected, string(patched), test.patch)
+	}
+
+	_, err := ParseMergePatch([]byte(`{"tags":`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,35 @@
+package logging
+
+import (
+	"context"
+	"sensor-api/internal/ids"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Requests are logged with a logrus entry carrying their request ID, so that every line logged while
+// serving a request can be tied to it and to its access log line. The entry is passed through the
+// request context; code without a request logs through the standard logger as before.
+
+// FieldRequestID is the field holding the request ID.
+const FieldRequestID = "request_id"
+
+type entryKey struct{}
+
+// WithEntry returns a copy of ctx carrying entry.
+func WithEntry(ctx context.Context, entry *log.Entry) context.Context {
+	return context.WithValue(ctx, entryKey{}, entry)
+}
+
+// FromContext returns the entry carried by ctx, or an entry of the standard logger if there is none.
+func FromContext(ctx context.Context) *log.Entry {
+	if entry, ok := ctx.Value(entryKey{}).(*log.Entry); ok {
+		return entry
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	return ids.New()
+}
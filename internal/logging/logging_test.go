@@ -0,0 +1,27 @@
+package logging
+
+import (
+	"context"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromContext(t *testing.T) {
+	// Test a context without an entry falls back to the standard logger
+	entry := FromContext(context.Background())
+	assert.Equal(t, log.StandardLogger(), entry.Logger)
+	assert.Empty(t, entry.Data)
+
+	// Test the entry carried by a context is returned
+	ctx := WithEntry(context.Background(), log.WithField(FieldRequestID, "req-1"))
+	assert.Equal(t, "req-1", FromContext(ctx).Data[FieldRequestID])
+}
+
+func TestNewRequestID(t *testing.T) {
+	// Check request IDs are random hex
+	id := NewRequestID()
+	assert.Regexp(t, "^[0-9a-f]{32}$", id)
+	assert.NotEqual(t, id, NewRequestID())
+}
@@ -0,0 +1,20 @@
+package model
+
+// BoundingBox is a latitude/longitude aligned rectangle described by its
+// south-west (Min) and north-east (Max) corners.
+type BoundingBox struct {
+	Min Location `json:"min"`
+	Max Location `json:"max"`
+}
+
+// IsValid reports whether both corners are valid locations and Min lies south-west of Max.
+func (b *BoundingBox) IsValid() bool {
+	return b.Min.IsValid() && b.Max.IsValid() &&
+		b.Min.Latitude <= b.Max.Latitude && b.Min.Longitude <= b.Max.Longitude
+}
+
+// Contains reports whether the location lies inside the box, edges included.
+func (b *BoundingBox) Contains(l Location) bool {
+	return l.Latitude >= b.Min.Latitude && l.Latitude <= b.Max.Latitude &&
+		l.Longitude >= b.Min.Longitude && l.Longitude <= b.Max.Longitude
+}
@@ -1,7 +1,9 @@
 package model
 
 import (
+	"math"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -30,3 +32,38 @@ func TestLocationIsValid(t *testing.T) {
 	assert.False(t, invalidLoc4.IsValid(), "Expected invalidLoc4 to be invalid")
 	assert.False(t, emptyLoc.IsValid(), "Expected emptyLoc to be invalid")
 }
+
+func TestBoundingBoxIsValid(t *testing.T) {
+	validBox := BoundingBox{Min: Location{Latitude: 37.7, Longitude: -122.5}, Max: Location{Latitude: 37.8, Longitude: -122.3}}
+	invertedBox := BoundingBox{Min: Location{Latitude: 37.8, Longitude: -122.3}, Max: Location{Latitude: 37.7, Longitude: -122.5}}
+	outOfRangeBox := BoundingBox{Min: Location{Latitude: -91, Longitude: -122.5}, Max: Location{Latitude: 37.8, Longitude: -122.3}}
+	emptyBox := BoundingBox{}
+
+	assert.True(t, validBox.IsValid(), "Expected validBox to be valid")
+	assert.False(t, invertedBox.IsValid(), "Expected invertedBox to be invalid")
+	assert.False(t, outOfRangeBox.IsValid(), "Expected outOfRangeBox to be invalid")
+	assert.False(t, emptyBox.IsValid(), "Expected emptyBox to be invalid")
+}
+
+func TestBoundingBoxContains(t *testing.T) {
+	box := BoundingBox{Min: Location{Latitude: 37.7, Longitude: -122.5}, Max: Location{Latitude: 37.8, Longitude: -122.3}}
+
+	assert.True(t, box.Contains(Location{Latitude: 37.7749, Longitude: -122.4194}), "Expected location inside box")
+	assert.True(t, box.Contains(Location{Latitude: 37.7, Longitude: -122.5}), "Expected corner to be inside box")
+	assert.False(t, box.Contains(Location{Latitude: 39.0921, Longitude: -123.5222}), "Expected location outside box")
+}
+
+func TestReadingIsValid(t *testing.T) {
+	now := time.Now()
+	validReading := Reading{Metric: "temperature", Value: 21.5, Timestamp: now}
+	noMetric := Reading{Value: 21.5, Timestamp: now}
+	notANumber := Reading{Metric: "temperature", Value: math.NaN(), Timestamp: now}
+	infinite := Reading{Metric: "temperature", Value: math.Inf(1), Timestamp: now}
+	noTimestamp := Reading{Metric: "temperature", Value: 21.5}
+
+	assert.True(t, validReading.IsValid(), "Expected validReading to be valid")
+	assert.False(t, noMetric.IsValid(), "Expected noMetric to be invalid")
+	assert.False(t, notANumber.IsValid(), "Expected notANumber to be invalid")
+	assert.False(t, infinite.IsValid(), "Expected infinite to be invalid")
+	assert.False(t, noTimestamp.IsValid(), "Expected noTimestamp to be invalid")
+}
@@ -0,0 +1,18 @@
+package model
+
+import (
+	"math"
+	"time"
+)
+
+// Reading is a single measurement taken by a sensor.
+type Reading struct {
+	Metric    string    `json:"metric"`
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// IsValid reports whether the reading names a metric, has a finite value and is timestamped.
+func (r *Reading) IsValid() bool {
+	return r.Metric != "" && !math.IsNaN(r.Value) && !math.IsInf(r.Value, 0) && !r.Timestamp.IsZero()
+}
@@ -5,3 +5,10 @@ type Sensor struct {
 	Location Location `json:"location"`
 	Tags     []string `json:"tags"`
 }
+
+// SensorDistance is a sensor paired with its distance in meters and initial bearing in degrees from a queried location.
+type SensorDistance struct {
+	Sensor
+	Distance float64 `json:"distance"`
+	Bearing  float64 `json:"bearing"`
+}
@@ -1,6 +1,305 @@
 package quadtree
 
-// Implement me!
-// A quadtree could be used to store a set of points in a 2D space and query for sensors near a given location efficiently
-// In this API, we use a rtree package to store the sensors in a 2D space and query for the nearest sensor efficiently, but a quadtree
-// could be a good candidate for this as well.
+import "container/heap"
+
+// A quadtree stores a set of points in a 2D space and answers box and nearest neighbour queries efficiently.
+// Each node covers a quarter of its parent's region and holds up to capacity points before splitting,
+// so densely populated areas are subdivided more finely than sparse ones.
+// Points are [latitude, longitude] pairs and must lie within [-90, 90] x [-180, 180].
+
+const (
+	// capacity is the number of points a leaf holds before it splits into four children.
+	capacity = 8
+	// maxDepth stops runaway splitting when many points share the same location.
+	maxDepth = 32
+)
+
+// Tree is a point-region quadtree mapping locations to sensor names.
+// It is not safe for concurrent use.
+type Tree struct {
+	root *node
+}
+
+// New creates an empty Tree covering every latitude and longitude.
+func New() *Tree {
+	return &Tree{
+		root: &node{
+			min: [2]float64{-90, -180},
+			max: [2]float64{90, 180},
+		},
+	}
+}
+
+type item struct {
+	point [2]float64
+	name  string
+}
+
+type node struct {
+	// region covered by this node
+	min, max [2]float64
+	depth    int
+	// tight bounds of the points below this node, valid while size > 0
+	extentMin, extentMax [2]float64
+	size                 int
+	// points held by a leaf
+	items []item
+	// four quadrants of an inner node, nil for a leaf
+	children []*node
+}
+
+// Insert adds a point to the tree.
+func (t *Tree) Insert(point [2]float64, name string) {
+	t.root.insert(item{point: point, name: name})
+}
+
+// Delete removes a point from the tree.
+func (t *Tree) Delete(point [2]float64, name string) {
+	t.root.delete(item{point: point, name: name})
+}
+
+// Replace moves a point to a new location and name.
+// If the old point does not exist then the new point is not inserted.
+func (t *Tree) Replace(oldPoint [2]float64, oldName string, newPoint [2]float64, newName string) {
+	if t.root.delete(item{point: oldPoint, name: oldName}) {
+		t.root.insert(item{point: newPoint, name: newName})
+	}
+}
+
+// Len returns the number of points in the tree.
+func (t *Tree) Len() int {
+	return t.root.size
+}
+
+// Bounds returns the minimum bounding rectangle of every point in the tree.
+func (t *Tree) Bounds() (min, max [2]float64) {
+	if t.root.size == 0 {
+		return [2]float64{}, [2]float64{}
+	}
+	return t.root.extentMin, t.root.extentMax
+}
+
+// Search calls iter for every point inside the box, edges included, until iter returns false.
+func (t *Tree) Search(min, max [2]float64, iter func(point [2]float64, name string) bool) {
+	t.root.search(min, max, iter)
+}
+
+// Nearby calls iter for every point in increasing order of distance until iter returns false.
+// dist is called with item set to false for the bounds of a node, and must then return a lower bound of
+// the distance to anything inside them, or with item set to true for a single point.
+func (t *Tree) Nearby(
+	dist func(min, max [2]float64, name string, item bool) float64,
+	iter func(point [2]float64, name string, dist float64) bool,
+) {
+	if t.root.size == 0 {
+		return
+	}
+
+	q := &queue{{node: t.root}}
+	for q.Len() > 0 {
+		e := heap.Pop(q).(entry)
+		switch {
+		case e.node == nil:
+			if !iter(e.item.point, e.item.name, e.dist) {
+				return
+			}
+		case e.node.children == nil:
+			for _, it := range e.node.items {
+				heap.Push(q, entry{dist: dist(it.point, it.point, it.name, true), item: it})
+			}
+		default:
+			for _, child := range e.node.children {
+				if child.size > 0 {
+					heap.Push(q, entry{dist: dist(child.extentMin, child.extentMax, "", false), node: child})
+				}
+			}
+		}
+	}
+}
+
+func (n *node) insert(it item) {
+	n.expand(it.point)
+	n.size++
+	if n.children != nil {
+		n.children[n.quadrant(it.point)].insert(it)
+		return
+	}
+
+	n.items = append(n.items, it)
+	if len(n.items) > capacity && n.depth < maxDepth {
+		n.split()
+	}
+}
+
+func (n *node) delete(it item) bool {
+	if n.size == 0 || !n.mayContain(it.point) {
+		return false
+	}
+
+	if n.children == nil {
+		for i := range n.items {
+			if n.items[i] == it {
+				n.items = append(n.items[:i], n.items[i+1:]...)
+				n.size--
+				n.recompute()
+				return true
+			}
+		}
+		return false
+	}
+
+	if !n.children[n.quadrant(it.point)].delete(it) {
+		return false
+	}
+	n.size--
+	if n.size <= capacity {
+		n.collapse()
+	} else {
+		n.recompute()
+	}
+	return true
+}
+
+func (n *node) search(min, max [2]float64, iter func(point [2]float64, name string) bool) bool {
+	if n.size == 0 || !intersects(n.extentMin, n.extentMax, min, max) {
+		return true
+	}
+
+	if n.children == nil {
+		for _, it := range n.items {
+			if intersects(it.point, it.point, min, max) && !iter(it.point, it.name) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, child := range n.children {
+		if !child.search(min, max, iter) {
+			return false
+		}
+	}
+	return true
+}
+
+// split moves the items of a full leaf into four new children.
+func (n *node) split() {
+	mid := n.mid()
+	n.children = []*node{
+		{min: n.min, max: mid},
+		{min: [2]float64{n.min[0], mid[1]}, max: [2]float64{mid[0], n.max[1]}},
+		{min: [2]float64{mid[0], n.min[1]}, max: [2]float64{n.max[0], mid[1]}},
+		{min: mid, max: n.max},
+	}
+	for _, child := range n.children {
+		child.depth = n.depth + 1
+	}
+
+	for _, it := range n.items {
+		n.children[n.quadrant(it.point)].insert(it)
+	}
+	n.items = nil
+}
+
+// collapse turns an inner node that has become sparse back into a leaf.
+func (n *node) collapse() {
+	items := make([]item, 0, n.size)
+	n.collect(&items)
+	n.items = items
+	n.children = nil
+	n.recompute()
+}
+
+func (n *node) collect(items *[]item) {
+	*items = append(*items, n.items...)
+	for _, child := range n.children {
+		child.collect(items)
+	}
+}
+
+// quadrant returns the index of the child covering the point.
+func (n *node) quadrant(point [2]float64) int {
+	mid := n.mid()
+	q := 0
+	if point[0] >= mid[0] {
+		q |= 2
+	}
+	if point[1] >= mid[1] {
+		q |= 1
+	}
+	return q
+}
+
+func (n *node) mid() [2]float64 {
+	return [2]float64{(n.min[0] + n.max[0]) / 2, (n.min[1] + n.max[1]) / 2}
+}
+
+func (n *node) mayContain(point [2]float64) bool {
+	return intersects(point, point, n.extentMin, n.extentMax)
+}
+
+func (n *node) expand(point [2]float64) {
+	if n.size == 0 {
+		n.extentMin, n.extentMax = point, point
+		return
+	}
+	n.grow(point, point)
+}
+
+// grow widens the tight bounds of a node to cover the given box.
+func (n *node) grow(min, max [2]float64) {
+	for axis := 0; axis < 2; axis++ {
+		if min[axis] < n.extentMin[axis] {
+			n.extentMin[axis] = min[axis]
+		}
+		if max[axis] > n.extentMax[axis] {
+			n.extentMax[axis] = max[axis]
+		}
+	}
+}
+
+// recompute rebuilds the tight bounds of a non-empty node from its items or children.
+func (n *node) recompute() {
+	empty := true
+	include := func(min, max [2]float64) {
+		if empty {
+			n.extentMin, n.extentMax = min, max
+			empty = false
+			return
+		}
+		n.grow(min, max)
+	}
+
+	for _, it := range n.items {
+		include(it.point, it.point)
+	}
+	for _, child := range n.children {
+		if child.size > 0 {
+			include(child.extentMin, child.extentMax)
+		}
+	}
+}
+
+func intersects(aMin, aMax, bMin, bMax [2]float64) bool {
+	return aMin[0] <= bMax[0] && aMax[0] >= bMin[0] && aMin[1] <= bMax[1] && aMax[1] >= bMin[1]
+}
+
+// entry is a node or a single item waiting in the Nearby priority queue.
+type entry struct {
+	dist float64
+	node *node
+	item item
+}
+
+type queue []entry
+
+func (q queue) Len() int            { return len(q) }
+func (q queue) Less(i, j int) bool  { return q[i].dist < q[j].dist }
+func (q queue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *queue) Push(x interface{}) { *q = append(*q, x.(entry)) }
+func (q *queue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
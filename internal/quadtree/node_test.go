@@ -0,0 +1,51 @@
+package quadtree
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitAndCollapse(t *testing.T) {
+	tree := New()
+	for i := 0; i < capacity+1; i++ {
+		tree.Insert([2]float64{float64(i), float64(i)}, fmt.Sprint(i))
+	}
+
+	// a full leaf splits into four quadrants
+	assert.Len(t, tree.root.children, 4)
+	assert.Nil(t, tree.root.items)
+	assert.Equal(t, capacity+1, tree.Len())
+
+	// deleting back down to capacity collapses the quadrants into a leaf
+	tree.Delete([2]float64{0, 0}, "0")
+	assert.Nil(t, tree.root.children)
+	assert.Len(t, tree.root.items, capacity)
+
+	min, max := tree.Bounds()
+	assert.Equal(t, [2]float64{1, 1}, min)
+	assert.Equal(t, [2]float64{capacity, capacity}, max)
+}
+
+func TestDuplicatePoints(t *testing.T) {
+	// many sensors at one location stop splitting at maxDepth instead of recursing forever
+	tree := New()
+	for i := 0; i < capacity*4; i++ {
+		tree.Insert([2]float64{37.7749, -122.4194}, fmt.Sprint(i))
+	}
+	assert.Equal(t, capacity*4, tree.Len())
+
+	count := 0
+	tree.Search([2]float64{37.7749, -122.4194}, [2]float64{37.7749, -122.4194}, func(point [2]float64, name string) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, capacity*4, count)
+
+	for i := 0; i < capacity*4; i++ {
+		tree.Delete([2]float64{37.7749, -122.4194}, fmt.Sprint(i))
+	}
+	assert.Equal(t, 0, tree.Len())
+	assert.Nil(t, tree.root.children)
+}
@@ -0,0 +1,134 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sensor-api/internal/boolexpr"
+	"sensor-api/internal/model"
+	"strconv"
+	"strings"
+)
+
+// SyntaxError describes a malformed query.
+type SyntaxError = boolexpr.SyntaxError
+
+// language is the syntax of queries, whose terms are built from words, double or back quoted strings,
+// and the symbols ":", "~" and ",":
+//
+//	term  = "tag" ":" value | "name" ":" value | "name" "~" string
+//	      | "within" "(" number "," number "," number "," number ")"
+//	      | "near" "(" number "," number "," number ")"
+//	value = word | string
+var language = &boolexpr.Language{Name: "query", Symbols: ":~,", Quotes: "\"`", StringName: "string"}
+
+type parser = boolexpr.Parser[Expr]
+
+// Parse parses a query. Errors are of type *SyntaxError.
+func Parse(s string) (Expr, error) {
+	p := &parser{
+		Term: parseTerm,
+		And:  func(operands []Expr) Expr { return And(operands) },
+		Or:   func(operands []Expr) Expr { return Or(operands) },
+		Not:  func(operand Expr) Expr { return Not{X: operand} },
+	}
+	return p.Parse(language, s)
+}
+
+func parseTerm(p *parser) (Expr, error) {
+	field := p.Tok()
+	if field.Kind != boolexpr.Word {
+		return nil, p.Errorf("expected term, found %s", field)
+	}
+	p.Next()
+
+	switch strings.ToLower(field.Value) {
+	case "tag", "name":
+		if strings.EqualFold(field.Value, "name") && p.Tok().Is("~") {
+			p.Next()
+			if p.Tok().Kind != boolexpr.String {
+				return nil, p.Errorf("expected quoted regular expression, found %s", p.Tok())
+			}
+			re, err := regexp.Compile(p.Tok().Value)
+			if err != nil {
+				return nil, p.Errorf("invalid regular expression: %s", err)
+			}
+			p.Next()
+			return NameMatch{Regexp: re}, nil
+		}
+		if !p.Tok().Is(":") {
+			return nil, p.Errorf(`expected ":" after %s, found %s`, field.Value, p.Tok())
+		}
+		p.Next()
+		if p.Tok().Kind != boolexpr.Word && p.Tok().Kind != boolexpr.String {
+			return nil, p.Errorf("expected %s, found %s", strings.ToLower(field.Value), p.Tok())
+		}
+		value := p.Tok().Value
+		p.Next()
+		if strings.EqualFold(field.Value, "tag") {
+			return Tag(value), nil
+		}
+		return Name(value), nil
+	case "within":
+		args, err := parseArgs(p, field, 4)
+		if err != nil {
+			return nil, err
+		}
+		box := model.BoundingBox{
+			Min: model.Location{Latitude: args[0], Longitude: args[1]},
+			Max: model.Location{Latitude: args[2], Longitude: args[3]},
+		}
+		if !box.IsValid() {
+			return nil, &SyntaxError{Pos: field.Pos, Msg: "within corners must be valid locations with minLat <= maxLat and minLng <= maxLng"}
+		}
+		return Within{Box: box}, nil
+	case "near":
+		args, err := parseArgs(p, field, 3)
+		if err != nil {
+			return nil, err
+		}
+		center := model.Location{Latitude: args[0], Longitude: args[1]}
+		if !center.IsValid() {
+			return nil, &SyntaxError{Pos: field.Pos, Msg: "near center must be a valid location"}
+		}
+		if args[2] <= 0 || math.IsInf(args[2], 0) {
+			return nil, &SyntaxError{Pos: field.Pos, Msg: "near radius must be positive"}
+		}
+		return Near{Center: center, Radius: args[2]}, nil
+	}
+	return nil, &SyntaxError{Pos: field.Pos, Msg: fmt.Sprintf("unknown field %q, expected tag, name, within or near", field.Value)}
+}
+
+// parseArgs parses the parenthesised list of n numbers following a function name.
+func parseArgs(p *parser, function boolexpr.Token, n int) ([]float64, error) {
+	if p.Tok().Kind != boolexpr.LeftParen {
+		return nil, p.Errorf(`expected "(" after %s, found %s`, function.Value, p.Tok())
+	}
+	p.Next()
+
+	var args []float64
+	for {
+		if p.Tok().Kind != boolexpr.Word {
+			return nil, p.Errorf("expected number, found %s", p.Tok())
+		}
+		arg, err := strconv.ParseFloat(p.Tok().Value, 64)
+		if err != nil || math.IsNaN(arg) {
+			return nil, p.Errorf("expected number, found %s", p.Tok())
+		}
+		args = append(args, arg)
+		p.Next()
+
+		if p.Tok().Kind == boolexpr.RightParen {
+			break
+		}
+		if !p.Tok().Is(",") {
+			return nil, p.Errorf(`expected "," or ")", found %s`, p.Tok())
+		}
+		p.Next()
+	}
+	if len(args) != n {
+		return nil, p.Errorf("%s takes %d arguments, found %d", strings.ToLower(function.Value), n, len(args))
+	}
+	p.Next()
+	return args, nil
+}
@@ -0,0 +1,227 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/model"
+	"sensor-api/internal/tagexpr"
+	"strings"
+)
+
+// Stats describes the sensors held by a store, so that NewPlan can estimate how many sensors each
+// access path would read.
+type Stats interface {
+	// Count returns the number of sensors.
+	Count() int
+	// TagCount returns the number of sensors with the tag.
+	TagCount(tag string) int
+	// Bounds returns the smallest box containing every sensor.
+	Bounds() model.BoundingBox
+}
+
+// Access is the way a plan finds its candidate sensors.
+type Access int
+
+const (
+	// Scan reads every sensor.
+	Scan Access = iota
+	// TagIndex reads the sensors matching Plan.Tags from the inverted tag index.
+	TagIndex
+	// SpatialIndex reads the sensors inside Plan.Boxes from the spatial index.
+	SpatialIndex
+)
+
+func (a Access) String() string {
+	switch a {
+	case TagIndex:
+		return "tag index"
+	case SpatialIndex:
+		return "spatial index"
+	}
+	return "scan"
+}
+
+// Plan describes how to execute a query. A store reads the candidates given by Access, then keeps
+// those matching Filter.
+type Plan struct {
+	Access Access
+	// Tags selects the candidates when Access is TagIndex.
+	Tags tagexpr.Expr
+	// Boxes select the candidates when Access is SpatialIndex. They never overlap.
+	Boxes []model.BoundingBox
+	// Filter is the part of the query the access path does not answer exactly, or nil if every
+	// candidate matches.
+	Filter Expr
+	// Estimate is the expected number of candidates.
+	Estimate int
+}
+
+func (p Plan) String() string {
+	var b strings.Builder
+	b.WriteString(p.Access.String())
+	switch p.Access {
+	case TagIndex:
+		fmt.Fprintf(&b, " [%s]", p.Tags)
+	case SpatialIndex:
+		for _, box := range p.Boxes {
+			fmt.Fprintf(&b, " [%s]", Within{Box: box}.String())
+		}
+	}
+	fmt.Fprintf(&b, " ~%d sensors", p.Estimate)
+	if p.Filter != nil {
+		fmt.Fprintf(&b, ", filter %s", p.Filter)
+	}
+	return b.String()
+}
+
+// NewPlan chooses how to execute a query, starting from whichever of the tag index, the spatial index
+// or a full scan is expected to read the fewest sensors. Only terms that every match must satisfy,
+// those joined to the rest of the query by AND, can select an index. A nil query matches every sensor.
+//
+// Estimates assume sensors are spread evenly over stats.Bounds and that tags are independent.
+func NewPlan(x Expr, stats Stats) Plan {
+	count := stats.Count()
+	plan := Plan{Access: Scan, Filter: x, Estimate: count}
+	if x == nil {
+		return plan
+	}
+
+	terms := conjuncts(x)
+
+	// the tag terms combine into a single lookup, answered exactly by the index
+	var tags []tagexpr.Expr
+	var rest []Expr
+	for _, term := range terms {
+		if tag, ok := toTagExpr(term); ok {
+			tags = append(tags, tag)
+		} else {
+			rest = append(rest, term)
+		}
+	}
+	if len(tags) > 0 {
+		var lookup tagexpr.Expr = tagexpr.And(tags)
+		if len(tags) == 1 {
+			lookup = tags[0]
+		}
+		if estimate := estimateTags(lookup, stats); estimate < plan.Estimate {
+			plan = Plan{Access: TagIndex, Tags: lookup, Filter: conjunction(rest), Estimate: estimate}
+		}
+	}
+
+	for i, term := range terms {
+		var (
+			boxes []model.BoundingBox
+			exact bool
+		)
+		switch term := term.(type) {
+		case Within:
+			boxes, exact = []model.BoundingBox{term.Box}, true
+		case Near:
+			// widen the circle so its boxes still enclose it when distances are measured on the ellipsoid
+			boxes = geo.CircleBounds(term.Center, term.Radius/geo.EllipsoidLowerBound)
+		default:
+			continue
+		}
+
+		if estimate := estimateBoxes(boxes, stats); estimate < plan.Estimate {
+			filter := terms
+			if exact {
+				filter = append(append([]Expr{}, terms[:i]...), terms[i+1:]...)
+			}
+			plan = Plan{Access: SpatialIndex, Boxes: boxes, Filter: conjunction(filter), Estimate: estimate}
+		}
+	}
+
+	return plan
+}
+
+// toTagExpr converts a query made only of tags into a tag expression the tag index can evaluate.
+func toTagExpr(x Expr) (tagexpr.Expr, bool) {
+	switch x := x.(type) {
+	case Tag:
+		return tagexpr.Tag(x), true
+	case Not:
+		y, ok := toTagExpr(x.X)
+		return tagexpr.Not{X: y}, ok
+	case And:
+		and := make(tagexpr.And, len(x))
+		for i, y := range x {
+			var ok bool
+			if and[i], ok = toTagExpr(y); !ok {
+				return nil, false
+			}
+		}
+		return and, true
+	case Or:
+		or := make(tagexpr.Or, len(x))
+		for i, y := range x {
+			var ok bool
+			if or[i], ok = toTagExpr(y); !ok {
+				return nil, false
+			}
+		}
+		return or, true
+	}
+	return nil, false
+}
+
+// estimateTags estimates the number of sensors matching a tag expression.
+func estimateTags(x tagexpr.Expr, stats Stats) int {
+	count := stats.Count()
+	switch x := x.(type) {
+	case tagexpr.Tag:
+		return stats.TagCount(string(x))
+	case tagexpr.Not:
+		return count - estimateTags(x.X, stats)
+	case tagexpr.And:
+		estimate := count
+		for _, y := range x {
+			if e := estimateTags(y, stats); e < estimate {
+				estimate = e
+			}
+		}
+		return estimate
+	case tagexpr.Or:
+		estimate := 0
+		for _, y := range x {
+			estimate += estimateTags(y, stats)
+		}
+		if estimate > count {
+			return count
+		}
+		return estimate
+	}
+	return count
+}
+
+// estimateBoxes estimates the number of sensors inside the boxes from the fraction of stats.Bounds they cover.
+func estimateBoxes(boxes []model.BoundingBox, stats Stats) int {
+	count := stats.Count()
+	if count == 0 {
+		return 0
+	}
+	bounds := stats.Bounds()
+
+	fraction := 0.0
+	for _, box := range boxes {
+		fraction += overlap(box.Min.Latitude, box.Max.Latitude, bounds.Min.Latitude, bounds.Max.Latitude) *
+			overlap(box.Min.Longitude, box.Max.Longitude, bounds.Min.Longitude, bounds.Max.Longitude)
+	}
+	estimate := int(math.Round(fraction * float64(count)))
+	if estimate > count {
+		return count
+	}
+	return estimate
+}
+
+// overlap returns the fraction of [boundsMin, boundsMax] covered by [min, max].
+func overlap(min, max, boundsMin, boundsMax float64) float64 {
+	if max < boundsMin || min > boundsMax {
+		return 0
+	}
+	if boundsMax == boundsMin {
+		return 1
+	}
+	return (math.Min(max, boundsMax) - math.Max(min, boundsMin)) / (boundsMax - boundsMin)
+}
@@ -0,0 +1,227 @@
+package query
+
+import (
+	"regexp"
+	"sensor-api/internal/boolexpr"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/model"
+	"sensor-api/internal/tagexpr"
+	"strconv"
+	"strings"
+)
+
+// A query filters sensors by tag, name and location, for example:
+//
+//	tag:indoor AND within(37.7, -122.5, 37.8, -122.3) AND name~"^bldg-"
+//
+// The terms are:
+//
+//	tag:value                             the sensor has the tag
+//	name:value                            the sensor has exactly this name
+//	name~"regexp"                         the sensor name matches the regular expression
+//	within(minLat, minLng, maxLat, maxLng) the sensor lies inside the bounding box, edges included
+//	near(lat, lng, radius)                the sensor lies within radius meters of the point
+//
+// Terms combine with AND, OR, NOT and parentheses, with the same precedence as tag expressions.
+// Values that contain spaces or punctuation, or that are spelled like a keyword, can be double quoted.
+// Regular expressions can also be written between backquotes to avoid escaping backslashes.
+
+// Expr is a parsed query.
+type Expr interface {
+	// Match reports whether the sensor satisfies the query, measuring distances with the given function.
+	Match(sensor model.Sensor, distance geo.DistanceFunc) bool
+	// String returns the query in a form that parses back to the same query.
+	String() string
+}
+
+// Tag matches sensors with the tag.
+type Tag string
+
+// Name matches the sensor with exactly this name.
+type Name string
+
+// NameMatch matches sensors whose name matches the regular expression.
+type NameMatch struct {
+	Regexp *regexp.Regexp
+}
+
+// Within matches sensors inside the bounding box, edges included.
+type Within struct {
+	Box model.BoundingBox
+}
+
+// Near matches sensors within Radius meters of Center.
+type Near struct {
+	Center model.Location
+	Radius float64
+}
+
+// Not matches sensors that do not match X.
+type Not struct {
+	X Expr
+}
+
+// And matches sensors that match every one of its operands.
+type And []Expr
+
+// Or matches sensors that match any of its operands.
+type Or []Expr
+
+func (t Tag) Match(sensor model.Sensor, distance geo.DistanceFunc) bool {
+	for _, tag := range sensor.Tags {
+		if tag == string(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t Tag) String() string {
+	return "tag:" + quote(string(t))
+}
+
+func (n Name) Match(sensor model.Sensor, distance geo.DistanceFunc) bool {
+	return sensor.Name == string(n)
+}
+
+func (n Name) String() string {
+	return "name:" + quote(string(n))
+}
+
+func (n NameMatch) Match(sensor model.Sensor, distance geo.DistanceFunc) bool {
+	return n.Regexp.MatchString(sensor.Name)
+}
+
+func (n NameMatch) String() string {
+	return "name~" + strconv.Quote(n.Regexp.String())
+}
+
+func (w Within) Match(sensor model.Sensor, distance geo.DistanceFunc) bool {
+	return w.Box.Contains(sensor.Location)
+}
+
+func (w Within) String() string {
+	return "within(" + formatArgs(w.Box.Min.Latitude, w.Box.Min.Longitude, w.Box.Max.Latitude, w.Box.Max.Longitude) + ")"
+}
+
+func (n Near) Match(sensor model.Sensor, distance geo.DistanceFunc) bool {
+	return distance(n.Center.Latitude, n.Center.Longitude, sensor.Location.Latitude, sensor.Location.Longitude) <= n.Radius
+}
+
+func (n Near) String() string {
+	return "near(" + formatArgs(n.Center.Latitude, n.Center.Longitude, n.Radius) + ")"
+}
+
+func (n Not) Match(sensor model.Sensor, distance geo.DistanceFunc) bool {
+	return !n.X.Match(sensor, distance)
+}
+
+func (n Not) String() string {
+	return "NOT " + wrap(n.X)
+}
+
+func (a And) Match(sensor model.Sensor, distance geo.DistanceFunc) bool {
+	for _, x := range a {
+		if !x.Match(sensor, distance) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a And) String() string {
+	return join(a, " AND ")
+}
+
+func (o Or) Match(sensor model.Sensor, distance geo.DistanceFunc) bool {
+	for _, x := range o {
+		if x.Match(sensor, distance) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o Or) String() string {
+	return join(o, " OR ")
+}
+
+// FromTagExpr converts a tag expression into the equivalent query. A nil expression gives a nil query,
+// which matches every sensor.
+func FromTagExpr(x tagexpr.Expr) Expr {
+	switch x := x.(type) {
+	case tagexpr.Tag:
+		return Tag(x)
+	case tagexpr.Not:
+		return Not{X: FromTagExpr(x.X)}
+	case tagexpr.And:
+		and := make(And, len(x))
+		for i, y := range x {
+			and[i] = FromTagExpr(y)
+		}
+		return and
+	case tagexpr.Or:
+		or := make(Or, len(x))
+		for i, y := range x {
+			or[i] = FromTagExpr(y)
+		}
+		return or
+	}
+	return nil
+}
+
+// conjuncts flattens nested ANDs into the list of terms that must all hold.
+func conjuncts(x Expr) []Expr {
+	and, ok := x.(And)
+	if !ok {
+		return []Expr{x}
+	}
+	var terms []Expr
+	for _, y := range and {
+		terms = append(terms, conjuncts(y)...)
+	}
+	return terms
+}
+
+// conjunction is the inverse of conjuncts, returning nil for no terms.
+func conjunction(terms []Expr) Expr {
+	switch len(terms) {
+	case 0:
+		return nil
+	case 1:
+		return terms[0]
+	}
+	return And(terms)
+}
+
+func join(xs []Expr, sep string) string {
+	parts := make([]string, len(xs))
+	for i, x := range xs {
+		parts[i] = wrap(x)
+	}
+	return strings.Join(parts, sep)
+}
+
+// wrap parenthesises compound operands so that String round-trips through Parse.
+func wrap(x Expr) string {
+	switch x.(type) {
+	case And, Or:
+		return "(" + x.String() + ")"
+	}
+	return x.String()
+}
+
+func formatArgs(args ...float64) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		parts[i] = strconv.FormatFloat(arg, 'g', -1, 64)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func quote(value string) string {
+	if value == "" || boolexpr.IsKeyword(value) || strings.ContainsAny(value, " \t\r\n():~,\"`") {
+		return strconv.Quote(value)
+	}
+	return value
+}
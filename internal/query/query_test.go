@@ -0,0 +1,180 @@
+package query
+
+import (
+	"regexp"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/model"
+	"sensor-api/internal/tagexpr"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	sf := model.BoundingBox{
+		Min: model.Location{Latitude: 37.7, Longitude: -122.5},
+		Max: model.Location{Latitude: 37.8, Longitude: -122.3},
+	}
+	for input, expected := range map[string]Expr{
+		"tag:indoor":                      Tag("indoor"),
+		`TAG:"floor 1"`:                   Tag("floor 1"),
+		`tag:"and"`:                       Tag("and"),
+		"name:bldg-1":                     Name("bldg-1"),
+		`name~"^bldg-"`:                   NameMatch{Regexp: regexp.MustCompile("^bldg-")},
+		"name~`^bldg-\\d+$`":              NameMatch{Regexp: regexp.MustCompile(`^bldg-\d+$`)},
+		"within(37.7,-122.5,37.8,-122.3)": Within{Box: sf},
+		"near( 37.775 , -122.42 , 500 )":  Near{Center: model.Location{Latitude: 37.775, Longitude: -122.42}, Radius: 500},
+		`tag:indoor AND within(37.7,-122.5,37.8,-122.3) AND name~"^bldg-"`: And{
+			Tag("indoor"), Within{Box: sf}, NameMatch{Regexp: regexp.MustCompile("^bldg-")},
+		},
+		"tag:a OR tag:b and not tag:c":    Or{Tag("a"), And{Tag("b"), Not{X: Tag("c")}}},
+		"(tag:a OR tag:b) AND NOT name:x": And{Or{Tag("a"), Tag("b")}, Not{X: Name("x")}},
+	} {
+		x, err := Parse(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, x, input)
+
+		// String round-trips through Parse
+		roundTrip, err := Parse(x.String())
+		assert.NoError(t, err, x.String())
+		assert.Equal(t, x, roundTrip, x.String())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for input, pos := range map[string]int{
+		"":                             0,
+		"indoor":                       0,
+		"tag indoor":                   4,
+		"tag:":                         4,
+		"tag:a AND":                    9,
+		"tag:a tag:b":                  6,
+		"(tag:a":                       0,
+		`name~bldg`:                    5,
+		`name~"("`:                     5,
+		`name:"unclosed`:               5,
+		"within(1, 2, 3)":              14,
+		"within(1, 2, 3, x)":           16,
+		"within(1 2)":                  9,
+		"within(38, -122, 37, -121)":   0,
+		"tag:a AND near(37, -122, -5)": 10,
+		"tag:a AND near(91, -122, 5)":  10,
+		"near 37":                      5,
+	} {
+		_, err := Parse(input)
+		if assert.Error(t, err, input) {
+			syntaxErr, ok := err.(*SyntaxError)
+			assert.True(t, ok, input)
+			assert.Equal(t, pos, syntaxErr.Pos, "%s: %s", input, err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	sensor := model.Sensor{
+		Name:     "bldg-7",
+		Location: model.Location{Latitude: 37.7749, Longitude: -122.4194},
+		Tags:     []string{"indoor", "temperature"},
+	}
+	for input, expected := range map[string]bool{
+		"tag:indoor":                      true,
+		"tag:outdoor":                     false,
+		"name:bldg-7":                     true,
+		`name~"^bldg-\\d$"`:               true,
+		`name~"^site-"`:                   false,
+		"within(37.7,-122.5,37.8,-122.3)": true,
+		"within(37.8,-122.5,37.9,-122.3)": false,
+		"near(37.7833, -122.4167, 1000)":  true,
+		"near(37.7833, -122.4167, 900)":   false,
+		"tag:indoor AND NOT tag:outdoor":  true,
+		"tag:outdoor OR name~\"7$\"":      true,
+		"NOT (tag:indoor OR tag:outdoor)": false,
+	} {
+		x, err := Parse(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, x.Match(sensor, geo.HaversineDistance), input)
+	}
+}
+
+func TestFromTagExpr(t *testing.T) {
+	assert.Nil(t, FromTagExpr(nil))
+
+	x, err := tagexpr.Parse("(temperature OR humidity) AND NOT decommissioned")
+	assert.NoError(t, err)
+	assert.Equal(t, And{Or{Tag("temperature"), Tag("humidity")}, Not{X: Tag("decommissioned")}}, FromTagExpr(x))
+}
+
+// testStats describes 1000 sensors spread over a 10 by 10 degree box.
+type testStats map[string]int
+
+func (stats testStats) Count() int {
+	return 1000
+}
+
+func (stats testStats) TagCount(tag string) int {
+	return stats[tag]
+}
+
+func (stats testStats) Bounds() model.BoundingBox {
+	return model.BoundingBox{
+		Min: model.Location{Latitude: 30, Longitude: -130},
+		Max: model.Location{Latitude: 40, Longitude: -120},
+	}
+}
+
+func TestNewPlan(t *testing.T) {
+	stats := testStats{"rare": 5, "common": 800}
+
+	// Test a nil query scans everything
+	plan := NewPlan(nil, stats)
+	assert.Equal(t, Scan, plan.Access)
+	assert.Nil(t, plan.Filter)
+	assert.Equal(t, 1000, plan.Estimate)
+
+	// Test a selective tag starts from the tag index and leaves the rest as a filter
+	x, err := Parse(`tag:rare AND within(30, -130, 35, -125) AND name~"^bldg-"`)
+	assert.NoError(t, err)
+	plan = NewPlan(x, stats)
+	assert.Equal(t, TagIndex, plan.Access)
+	assert.Equal(t, tagexpr.Tag("rare"), plan.Tags)
+	assert.Equal(t, And{x.(And)[1], x.(And)[2]}, plan.Filter)
+	assert.Equal(t, 5, plan.Estimate)
+
+	// Test a small box starts from the spatial index, which answers the within term exactly
+	x, err = Parse("tag:common AND within(30, -130, 31, -129)")
+	assert.NoError(t, err)
+	plan = NewPlan(x, stats)
+	assert.Equal(t, SpatialIndex, plan.Access)
+	assert.Equal(t, []model.BoundingBox{x.(And)[1].(Within).Box}, plan.Boxes)
+	assert.Equal(t, Tag("common"), plan.Filter)
+	assert.Equal(t, 10, plan.Estimate)
+
+	// Test every tag term is combined into a single lookup
+	x, err = Parse("tag:common AND NOT tag:rare AND (tag:rare OR tag:other)")
+	assert.NoError(t, err)
+	plan = NewPlan(x, stats)
+	assert.Equal(t, TagIndex, plan.Access)
+	assert.Equal(t, tagexpr.And{tagexpr.Tag("common"), tagexpr.Not{X: tagexpr.Tag("rare")}, tagexpr.Or{tagexpr.Tag("rare"), tagexpr.Tag("other")}}, plan.Tags)
+	assert.Nil(t, plan.Filter)
+	assert.Equal(t, 5, plan.Estimate)
+
+	// Test a near term keeps itself as a filter, since its boxes only enclose the circle
+	x, err = Parse("near(35, -125, 10000)")
+	assert.NoError(t, err)
+	plan = NewPlan(x, stats)
+	assert.Equal(t, SpatialIndex, plan.Access)
+	assert.Len(t, plan.Boxes, 1)
+	assert.Equal(t, x, plan.Filter)
+
+	// Test terms under OR or NOT cannot select an index
+	x, err = Parse("within(30, -130, 31, -129) OR name:x")
+	assert.NoError(t, err)
+	plan = NewPlan(x, stats)
+	assert.Equal(t, Scan, plan.Access)
+	assert.Equal(t, x, plan.Filter)
+
+	// Test a tag every sensor has falls back to a scan
+	x, err = Parse("tag:common OR tag:rare")
+	assert.NoError(t, err)
+	assert.Equal(t, Scan, NewPlan(x, testStats{"common": 1000}).Access)
+}
@@ -0,0 +1,259 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Limiter limits the requests each client makes with a token bucket for reads and another for
+// writes, and optionally a quota of requests per UTC day. A bucket holds up to Burst tokens and refills
+// at Rate tokens a second; each request takes a token, and is refused when there is none.
+//
+// Clients are named by the caller, by API key or address. Their state is kept in memory, and forgotten
+// once their buckets have refilled and, if they are under a quota, the day they last made a request has
+// passed. The limits can be replaced with SetConfig while the limiter is in use; buckets keep their
+// tokens, up to the new burst.
+
+// sweepInterval is how often idle clients are forgotten.
+const sweepInterval = time.Minute
+
+// Limit is the rate and burst of a token bucket. A zero limit does not limit.
+type Limit struct {
+	// Rate is the number of requests a second.
+	Rate float64 `json:"rate"`
+	// Burst is the number of requests that can be made at once.
+	Burst int `json:"burst"`
+}
+
+// unlimited reports whether the limit does not limit.
+func (l Limit) unlimited() bool {
+	return l.Rate == 0 && l.Burst == 0
+}
+
+// Limits are the limits of a client.
+type Limits struct {
+	Read  Limit `json:"read"`
+	Write Limit `json:"write"`
+	// DailyQuota is the number of requests a client can make per UTC day, unlimited if zero.
+	DailyQuota int `json:"daily_quota"`
+}
+
+// Config is the configuration of a Limiter, read from a JSON file. The default limits apply to every
+// client, save those given their own limits in Clients.
+type Config struct {
+	Limits
+	Clients map[string]Limits `json:"clients,omitempty"`
+}
+
+// LoadConfig reads the config file at path.
+func LoadConfig(path string) (Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer file.Close()
+
+	var config Config
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return Config{}, fmt.Errorf("invalid rate limit config: %w", err)
+	}
+	return config, config.Validate()
+}
+
+// Validate returns an error if any limit does not refill, or limits requests without allowing any.
+func (c Config) Validate() error {
+	check := func(name string, limits Limits) error {
+		for class, limit := range map[string]Limit{"read": limits.Read, "write": limits.Write} {
+			if limit.unlimited() {
+				continue
+			}
+			if !(limit.Rate > 0) || math.IsInf(limit.Rate, 0) || limit.Burst < 1 {
+				return fmt.Errorf("%s: invalid %s limit: rate must be positive and burst at least 1", name, class)
+			}
+		}
+		if limits.DailyQuota < 0 {
+			return fmt.Errorf("%s: invalid daily quota %d", name, limits.DailyQuota)
+		}
+		return nil
+	}
+	if err := check("default", c.Limits); err != nil {
+		return err
+	}
+	for client, limits := range c.Clients {
+		if err := check(fmt.Sprintf("client %q", client), limits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decision is the outcome of a request.
+type Decision struct {
+	Allowed bool
+	// QuotaExceeded is true if the request was refused because the client has used its daily quota.
+	QuotaExceeded bool
+	// Limit and Remaining are the requests that can be made at once and are left: those of the bucket,
+	// or of the quota if it is used up. They are zero if the request is not limited.
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again, or until the quota resets if it is used up.
+	Reset time.Duration
+	// RetryAfter is the time until the request could be allowed, if it was refused.
+	RetryAfter time.Duration
+	// Window is the time the bucket takes to refill from empty, or a day for the quota.
+	Window time.Duration
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last refill, up to the burst.
+func (b *bucket) refill(limit Limit, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * limit.Rate
+	}
+	b.tokens = math.Min(b.tokens, float64(limit.Burst))
+	b.last = now
+}
+
+// client is the state of a client.
+type client struct {
+	read, write bucket
+	// day is the start of the UTC day in which used requests were made
+	day  time.Time
+	used int
+}
+
+// Limiter limits the requests of clients.
+type Limiter struct {
+	mu        sync.Mutex
+	config    Config
+	clients   map[string]*client
+	lastSweep time.Time
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// NewLimiter creates a Limiter with config.
+func NewLimiter(config Config) *Limiter {
+	return &Limiter{config: config, clients: make(map[string]*client), now: time.Now}
+}
+
+// SetConfig replaces the limits.
+func (l *Limiter) SetConfig(config Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.config = config
+}
+
+// limits returns the limits of a client. The caller must hold l.mu.
+func (l *Limiter) limits(name string) Limits {
+	if limits, ok := l.config.Clients[name]; ok {
+		return limits
+	}
+	return l.config.Limits
+}
+
+// Allow takes a token for a read or a write by a client and counts it against its quota, if the
+// request is allowed.
+func (l *Limiter) Allow(name string, write bool) Decision {
+	return l.decide(name, write, true)
+}
+
+// Check returns the decision Allow would make for a read or a write by a client, without taking a token
+// or counting it against the quota.
+func (l *Limiter) Check(name string, write bool) Decision {
+	return l.decide(name, write, false)
+}
+
+// decide decides whether a client can make a request, taking a token for it if take is set and it is
+// allowed.
+func (l *Limiter) decide(name string, write, take bool) Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	limits := l.limits(name)
+	limit := limits.Read
+	if write {
+		limit = limits.Write
+	}
+	c, ok := l.clients[name]
+	if !ok {
+		c = &client{}
+		l.clients[name] = c
+	}
+
+	day := now.UTC().Truncate(24 * time.Hour)
+	if !c.day.Equal(day) {
+		c.day, c.used = day, 0
+	}
+	if limits.DailyQuota > 0 && c.used >= limits.DailyQuota {
+		untilReset := day.Add(24 * time.Hour).Sub(now)
+		return Decision{QuotaExceeded: true, Limit: limits.DailyQuota, Reset: untilReset, RetryAfter: untilReset, Window: 24 * time.Hour}
+	}
+	if limit.unlimited() {
+		if take {
+			c.used++
+		}
+		return Decision{Allowed: true}
+	}
+
+	b := &c.read
+	if write {
+		b = &c.write
+	}
+	b.refill(limit, now)
+	decision := Decision{Limit: limit.Burst, Window: duration(float64(limit.Burst), limit.Rate)}
+	if b.tokens >= 1 {
+		if take {
+			b.tokens--
+			c.used++
+		}
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = duration(1-b.tokens, limit.Rate)
+	}
+	decision.Remaining = int(b.tokens)
+	decision.Reset = duration(float64(limit.Burst)-b.tokens, limit.Rate)
+	return decision
+}
+
+// duration returns the time a bucket takes to earn tokens at rate.
+func duration(tokens, rate float64) time.Duration {
+	return time.Duration(tokens / rate * float64(time.Second))
+}
+
+// sweep forgets the clients whose buckets have refilled and who are not using a quota today. The
+// caller must hold l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	today := now.UTC().Truncate(24 * time.Hour)
+	for name, c := range l.clients {
+		limits := l.limits(name)
+		if limits.DailyQuota > 0 && c.day.Equal(today) {
+			continue
+		}
+		c.read.refill(limits.Read, now)
+		c.write.refill(limits.Write, now)
+		if c.read.tokens >= float64(limits.Read.Burst) && c.write.tokens >= float64(limits.Write.Burst) {
+			delete(l.clients, name)
+		}
+	}
+}
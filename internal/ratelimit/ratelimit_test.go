@@ -0,0 +1,132 @@
+package ratelimit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestLimiter creates a limiter whose clock is advanced by the returned function.
+func newTestLimiter(config Config) (*Limiter, func(time.Duration)) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewLimiter(config)
+	limiter.now = func() time.Time { return now }
+	return limiter, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestBuckets(t *testing.T) {
+	limiter, advance := newTestLimiter(Config{Limits: Limits{
+		Read:  Limit{Rate: 10, Burst: 5},
+		Write: Limit{Rate: 1, Burst: 2},
+	}})
+
+	// Test a client can burst, and is then refused until a token is earned
+	for i := 0; i < 5; i++ {
+		decision := limiter.Allow("dashboard", false)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, 5, decision.Limit)
+		assert.Equal(t, 4-i, decision.Remaining)
+	}
+	decision := limiter.Allow("dashboard", false)
+	assert.False(t, decision.Allowed)
+	assert.False(t, decision.QuotaExceeded)
+	assert.Equal(t, 100*time.Millisecond, decision.RetryAfter)
+	assert.Equal(t, 500*time.Millisecond, decision.Reset)
+	assert.Equal(t, 500*time.Millisecond, decision.Window)
+	advance(100 * time.Millisecond)
+
+	// Check checking a client takes no token
+	assert.True(t, limiter.Check("dashboard", false).Allowed)
+	assert.True(t, limiter.Allow("dashboard", false).Allowed)
+	assert.False(t, limiter.Check("dashboard", false).Allowed)
+
+	// Check reads and writes, and clients, have separate buckets
+	assert.True(t, limiter.Allow("dashboard", true).Allowed)
+	assert.True(t, limiter.Allow("dashboard", true).Allowed)
+	decision = limiter.Allow("dashboard", true)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Second, decision.RetryAfter)
+	assert.True(t, limiter.Allow("ingest", true).Allowed)
+
+	// Check a bucket refills no further than its burst
+	advance(time.Hour)
+	decision = limiter.Allow("dashboard", true)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 1, decision.Remaining)
+}
+
+func TestQuotas(t *testing.T) {
+	limiter, advance := newTestLimiter(Config{
+		Limits: Limits{DailyQuota: 3},
+		Clients: map[string]Limits{
+			"ingest": {Write: Limit{Rate: 100, Burst: 100}},
+		},
+	})
+
+	// Test a client is refused once its quota is used, until the next UTC day
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow("10.0.0.1", i%2 == 0).Allowed)
+	}
+	decision := limiter.Allow("10.0.0.1", false)
+	assert.False(t, decision.Allowed)
+	assert.True(t, decision.QuotaExceeded)
+	assert.Equal(t, 3, decision.Limit)
+	assert.Equal(t, 0, decision.Remaining)
+	assert.Equal(t, 12*time.Hour, decision.RetryAfter)
+	advance(12 * time.Hour)
+	assert.True(t, limiter.Allow("10.0.0.1", false).Allowed)
+
+	// Check a client with its own limits has no quota, and unlimited reads
+	for i := 0; i < 10; i++ {
+		assert.True(t, limiter.Allow("ingest", false).Allowed)
+	}
+	assert.Equal(t, 99, limiter.Allow("ingest", true).Remaining)
+}
+
+func TestSetConfig(t *testing.T) {
+	limiter, advance := newTestLimiter(Config{Limits: Limits{Read: Limit{Rate: 1, Burst: 10}}})
+	for i := 0; i < 5; i++ {
+		assert.True(t, limiter.Allow("dashboard", false).Allowed)
+	}
+
+	// Test new limits apply at once, buckets keeping their tokens up to the new burst
+	limiter.SetConfig(Config{Limits: Limits{Read: Limit{Rate: 1, Burst: 2}}})
+	decision := limiter.Allow("dashboard", false)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 2, decision.Limit)
+	assert.Equal(t, 1, decision.Remaining)
+
+	// Check idle clients are forgotten once their buckets refill
+	advance(time.Hour)
+	limiter.Allow("other", false)
+	assert.Len(t, limiter.clients, 1)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ratelimit.json")
+
+	// Test a config is read with its clients
+	assert.NoError(t, os.WriteFile(path, []byte(`{"read": {"rate": 50, "burst": 100}, "write": {"rate": 5, "burst": 10}, "daily_quota": 100000, "clients": {"ingest": {"write": {"rate": 100, "burst": 200}}}}`), 0o600))
+	config, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, Limit{Rate: 50, Burst: 100}, config.Read)
+	assert.Equal(t, 100000, config.DailyQuota)
+	assert.Equal(t, Limit{Rate: 100, Burst: 200}, config.Clients["ingest"].Write)
+
+	// Check invalid configs are rejected
+	for _, data := range []string{
+		`{"read": {"rate": 0, "burst": 10}}`,
+		`{"write": {"rate": 10, "burst": 0}}`,
+		`{"daily_quota": -1}`,
+		`{"clients": {"ingest": {"read": {"rate": -1, "burst": 1}}}}`,
+		`{"unknown": 1}`,
+	} {
+		assert.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+		_, err := LoadConfig(path)
+		assert.Error(t, err, data)
+	}
+}
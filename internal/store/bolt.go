@@ -0,0 +1,872 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sensor-api/internal/events"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/geohash"
+	"sensor-api/internal/model"
+	"sensor-api/internal/query"
+	"sensor-api/internal/tagexpr"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The bolt store keeps each sensor and its index entries in one database file, in the buckets
+//
+//	sensors  name                          -> JSON encoded model.Sensor
+//	tags     tag 0x00 name                 -> empty
+//	geo      geohash 0x00 name             -> latitude, longitude as big-endian float64 bits
+//	versions name                          -> version as a big-endian uint64
+//	meta     "count"                       -> number of sensors as a big-endian uint64
+//	         "revision"                    -> last version given out as a big-endian uint64
+//
+// The geohash is always geohash.MaxPrecision characters long, so a spatial query scans the keys
+// starting with each cell covering its box and checks the exact location held in the value, only
+// reading the sensors that are inside.
+
+var (
+	sensorsBucket  = []byte("sensors")
+	tagsBucket     = []byte("tags")
+	geoBucket      = []byte("geo")
+	versionsBucket = []byte("versions")
+	metaBucket     = []byte("meta")
+
+	countKey    = []byte("count")
+	revisionKey = []byte("revision")
+)
+
+const (
+	// coverCells is the most geohash cells scanned for each box of a spatial query.
+	coverCells = 16
+	// nearestStartRadius is the first radius in meters searched by GetNearestSensors, which grows
+	// fourfold until enough sensors are found.
+	nearestStartRadius = 1000
+	// nearestMaxRadius is further than any two points on the Earth are apart.
+	nearestMaxRadius = 2.1e7
+)
+
+// BoltSensorStore is a SensorStore kept in a bbolt database file. Sensors are read from disk as queries
+// need them, found through on-disk indexes of their tags and of the geohashes of their locations.
+// It does not store readings.
+type BoltSensorStore struct {
+	*boltState
+	// logger logs the store's failures, scoped to a request by WithLogger
+	logger *log.Entry
+}
+
+// boltState is the database of a BoltSensorStore, shared by the views WithLogger returns.
+type boltState struct {
+	db *bolt.DB
+	// distance between two points in meters, used to rank and filter spatial queries
+	distance geo.DistanceFunc
+	// mu serializes changes with publishing their events, which bolt would otherwise let commit in
+	// one order and publish in another
+	mu sync.Mutex
+	// sink receives each change made to sensors once it has been committed, if set
+	sink EventSink
+}
+
+// NewBoltSensorStore opens the store in the database file at path, creating it if needed. Distances are
+// measured with distance, or geo.HaversineDistance if it is nil.
+func NewBoltSensorStore(path string, distance geo.DistanceFunc) (*BoltSensorStore, error) {
+	if distance == nil {
+		distance = geo.HaversineDistance
+	}
+
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{sensorsBucket, tagsBucket, geoBucket, versionsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Info("Opened bolt store in ", path)
+	return &BoltSensorStore{
+		boltState: &boltState{db: db, distance: distance},
+		logger:    log.NewEntry(log.StandardLogger()),
+	}, nil
+}
+
+// WithLogger returns a view of the store sharing its database, which logs with logger.
+func (store *BoltSensorStore) WithLogger(logger *log.Entry) SensorStore {
+	return &BoltSensorStore{boltState: store.boltState, logger: logger}
+}
+
+// Close closes the database file.
+func (store *BoltSensorStore) Close() error {
+	return store.db.Close()
+}
+
+// SetEventSink sets the sink changes to sensors are published to.
+func (store *BoltSensorStore) SetEventSink(sink EventSink) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.sink = sink
+}
+
+// update runs fn in a write transaction, and once the transaction has committed publishes the events
+// fn passed to publish.
+func (store *BoltSensorStore) update(fn func(tx *bolt.Tx, publish func(events.Event)) error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var changes []events.Event
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		// the transaction may still fail after fn, so events are held until it commits
+		return fn(tx, func(event events.Event) { changes = append(changes, event) })
+	})
+	if err != nil || store.sink == nil {
+		return err
+	}
+	for _, event := range changes {
+		store.sink.Publish(event)
+	}
+	return nil
+}
+
+// AddSensor adds a sensor to the store.
+func (store *BoltSensorStore) AddSensor(sensor model.Sensor) (int, error) {
+	if code, err := checkText(store.logger, sensor); err != nil {
+		return code, err
+	}
+	if !sensor.Location.IsValid() {
+		store.logger.Error("Invalid location: ", sensor.Location)
+		return http.StatusBadRequest, fmt.Errorf("invalid location")
+	}
+
+	code := http.StatusCreated
+	err := store.update(func(tx *bolt.Tx, publish func(events.Event)) error {
+		if tx.Bucket(sensorsBucket).Get([]byte(sensor.Name)) != nil {
+			store.logger.Error("Sensor already exists: ", sensor.Name)
+			code = http.StatusBadRequest
+			return fmt.Errorf("sensor already exists")
+		}
+		if err := putSensor(tx, sensor); err != nil {
+			return err
+		}
+		publish(events.Created(sensor))
+		return addCount(tx, 1)
+	})
+	return storeResult(store.logger, code, err)
+}
+
+// AddSensors adds a batch of sensors to the store in one transaction. An atomic batch that fails is
+// rolled back.
+func (store *BoltSensorStore) AddSensors(sensors []model.Sensor, atomic bool) ([]AddResult, int, error) {
+	results := make([]AddResult, len(sensors))
+	code := http.StatusOK
+	err := store.update(func(tx *bolt.Tx, publish func(events.Event)) error {
+		added := 0
+		for i, sensor := range sensors {
+			if code, err := checkText(store.logger, sensor); err != nil {
+				results[i] = AddResult{Code: code, Err: err}
+				continue
+			}
+			if !sensor.Location.IsValid() {
+				store.logger.Error("Invalid location: ", sensor.Location)
+				results[i] = AddResult{Code: http.StatusBadRequest, Err: fmt.Errorf("invalid location")}
+				continue
+			}
+			if tx.Bucket(sensorsBucket).Get([]byte(sensor.Name)) != nil {
+				store.logger.Error("Sensor already exists: ", sensor.Name)
+				results[i] = AddResult{Code: http.StatusBadRequest, Err: fmt.Errorf("sensor already exists")}
+				continue
+			}
+			if err := putSensor(tx, sensor); err != nil {
+				return err
+			}
+			results[i] = AddResult{Code: http.StatusCreated}
+			publish(events.Created(sensor))
+			added++
+		}
+		if atomic {
+			if err := failBatch(store.logger, results); err != nil {
+				code = http.StatusBadRequest
+				return err
+			}
+		}
+		return addCount(tx, added)
+	})
+	code, err = storeResult(store.logger, code, err)
+	if code == http.StatusInternalServerError {
+		return nil, code, err
+	}
+	return results, code, err
+}
+
+// GetSensor returns a sensor from the store.
+func (store *BoltSensorStore) GetSensor(name string) (model.Sensor, int, error) {
+	var sensor model.Sensor
+	code := http.StatusOK
+	err := store.db.View(func(tx *bolt.Tx) error {
+		found, ok, err := getSensor(tx, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			store.logger.Error("Sensor not found: ", name)
+			code = http.StatusNotFound
+			return fmt.Errorf("sensor not found")
+		}
+		sensor = found
+		return nil
+	})
+	code, err = storeResult(store.logger, code, err)
+	return sensor, code, err
+}
+
+// GetSensorVersion returns a sensor from the store and its version.
+func (store *BoltSensorStore) GetSensorVersion(name string) (model.Sensor, uint64, int, error) {
+	var (
+		sensor  model.Sensor
+		version uint64
+	)
+	code := http.StatusOK
+	err := store.db.View(func(tx *bolt.Tx) error {
+		found, ok, err := getSensor(tx, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			store.logger.Error("Sensor not found: ", name)
+			code = http.StatusNotFound
+			return fmt.Errorf("sensor not found")
+		}
+		sensor, version = found, getUint(tx.Bucket(versionsBucket), []byte(name))
+		return nil
+	})
+	code, err = storeResult(store.logger, code, err)
+	return sensor, version, code, err
+}
+
+// GetSensorsByTags returns all sensors with every one of the given tags, or every sensor if there are none.
+func (store *BoltSensorStore) GetSensorsByTags(tags []string) ([]model.Sensor, int, error) {
+	store.logger.Debug("Getting sensors by tags: ", tags)
+	return store.GetSensorsByTagExpr(tagexpr.AllOf(tags))
+}
+
+// GetSensorsByTagExpr returns all sensors matching the tag expression, evaluated against the tag index.
+// A nil expression returns all sensors.
+func (store *BoltSensorStore) GetSensorsByTagExpr(filter tagexpr.Expr) ([]model.Sensor, int, error) {
+	store.logger.Debug("Getting sensors by tag expression: ", filter)
+
+	var sensors []model.Sensor
+	code, err := store.view(func(tx *bolt.Tx) error {
+		var names map[string]struct{}
+		if filter == nil {
+			names = boltTagIndex{tx}.All()
+		} else {
+			names = filter.Eval(boltTagIndex{tx})
+		}
+
+		sensors = make([]model.Sensor, 0, len(names))
+		for name := range names {
+			sensor, _, err := getSensor(tx, name)
+			if err != nil {
+				return err
+			}
+			sensors = append(sensors, sensor)
+		}
+		return nil
+	})
+	return sensors, code, err
+}
+
+// UpdateSensor updates a sensor in the store. A sensor cannot be renamed to the name of another.
+func (store *BoltSensorStore) UpdateSensor(name string, updatedSensor *model.Sensor) (int, error) {
+	return store.UpdateSensorIfMatch(name, updatedSensor, 0)
+}
+
+// UpdateSensorIfMatch updates a sensor in the store if its version matches.
+func (store *BoltSensorStore) UpdateSensorIfMatch(name string, updatedSensor *model.Sensor, version uint64) (int, error) {
+	if updatedSensor == nil {
+		store.logger.Error("Sensor is nil")
+		return http.StatusBadRequest, fmt.Errorf("sensor is nil")
+	}
+	if code, err := checkUpdate(store.logger, *updatedSensor); err != nil {
+		return code, err
+	}
+
+	return store.PatchSensor(name, func(model.Sensor) (model.Sensor, error) { return *updatedSensor, nil }, version)
+}
+
+// PatchSensor replaces a sensor in the store with the result of patch, if its version matches. The
+// patch runs inside the update transaction.
+func (store *BoltSensorStore) PatchSensor(name string, patch Patch, version uint64) (int, error) {
+	code := http.StatusNoContent
+	err := store.update(func(tx *bolt.Tx, publish func(events.Event)) error {
+		sensor, ok, err := getSensor(tx, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			store.logger.Error("Sensor not found: ", name)
+			code = http.StatusNotFound
+			return fmt.Errorf("sensor not found")
+		}
+		if err := checkVersion(store.logger, tx, name, version); err != nil {
+			code = http.StatusPreconditionFailed
+			return err
+		}
+		updatedSensor, err := patch(sensor)
+		if err != nil {
+			store.logger.Error("Failed to patch sensor: ", err)
+			code = http.StatusConflict
+			return err
+		}
+		if status, err := checkUpdate(store.logger, updatedSensor); err != nil {
+			code = status
+			return err
+		}
+		if updatedSensor.Name != name && tx.Bucket(sensorsBucket).Get([]byte(updatedSensor.Name)) != nil {
+			store.logger.Error("Sensor already exists: ", updatedSensor.Name)
+			code = http.StatusBadRequest
+			return fmt.Errorf("sensor already exists")
+		}
+		if err := deleteSensor(tx, sensor); err != nil {
+			return err
+		}
+		publish(events.Updated(sensor, updatedSensor))
+		return putSensor(tx, updatedSensor)
+	})
+	return storeResult(store.logger, code, err)
+}
+
+// RemoveSensor removes a sensor and its index entries from the store.
+func (store *BoltSensorStore) RemoveSensor(name string) (int, error) {
+	return store.RemoveSensorIfMatch(name, 0)
+}
+
+// RemoveSensorIfMatch removes a sensor and its index entries from the store if its version matches.
+func (store *BoltSensorStore) RemoveSensorIfMatch(name string, version uint64) (int, error) {
+	code := http.StatusNoContent
+	err := store.update(func(tx *bolt.Tx, publish func(events.Event)) error {
+		sensor, ok, err := getSensor(tx, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			store.logger.Error("Sensor not found: ", name)
+			code = http.StatusNotFound
+			return fmt.Errorf("sensor not found")
+		}
+		if err := checkVersion(store.logger, tx, name, version); err != nil {
+			code = http.StatusPreconditionFailed
+			return err
+		}
+		if err := deleteSensor(tx, sensor); err != nil {
+			return err
+		}
+		publish(events.Deleted(sensor))
+		return addCount(tx, -1)
+	})
+	return storeResult(store.logger, code, err)
+}
+
+// GetNearestSensor returns the nearest sensor to the given location.
+func (store *BoltSensorStore) GetNearestSensor(location model.Location) (*model.Sensor, int, error) {
+	return store.GetNearestSensorByTag(location, nil)
+}
+
+// GetNearestSensorByTag returns the nearest sensor to the given location with the given set of tags.
+func (store *BoltSensorStore) GetNearestSensorByTag(location model.Location, tags []string) (*model.Sensor, int, error) {
+	store.logger.Debug("Getting nearest sensor by tag: ", tags)
+	sensors, code, err := store.GetNearestSensors(location, 1, 0, tagexpr.AllOf(tags))
+	if err != nil {
+		return nil, code, err
+	}
+	if len(sensors) == 0 {
+		store.logger.Error("No sensors with given tag(s)")
+		return nil, http.StatusNotFound, fmt.Errorf("no sensors with given tag(s)")
+	}
+
+	return &sensors[0].Sensor, http.StatusOK, nil
+}
+
+// GetNearestSensors returns up to k sensors matching the tag filter closest to the given location, closest first.
+// A positive maxDistance excludes sensors more than maxDistance meters away.
+//
+// The geohash index cannot be walked in order of distance, so the search looks within a small radius
+// and widens it until k sensors are found or it reaches maxDistance.
+func (store *BoltSensorStore) GetNearestSensors(location model.Location, k int, maxDistance float64, filter tagexpr.Expr) ([]model.SensorDistance, int, error) {
+	store.logger.Debug("Getting nearest sensors: ", location, k, maxDistance, filter)
+
+	if !location.IsValid() {
+		store.logger.Error("Invalid location: ", location)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid location")
+	}
+	if k <= 0 {
+		store.logger.Error("Invalid number of sensors: ", k)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid number of sensors")
+	}
+	if maxDistance < 0 || math.IsNaN(maxDistance) {
+		store.logger.Error("Invalid max distance: ", maxDistance)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid max distance")
+	}
+
+	limit := nearestMaxRadius
+	if maxDistance > 0 && maxDistance < limit {
+		limit = maxDistance
+	}
+
+	var sensors []model.SensorDistance
+	code, err := store.view(func(tx *bolt.Tx) error {
+		for radius := math.Min(nearestStartRadius, limit); ; radius = math.Min(radius*4, limit) {
+			var err error
+			sensors, err = store.withinRadius(tx, filter, location, radius)
+			if err != nil {
+				return err
+			}
+			// every sensor within the radius has been found, so the k closest are among them
+			if len(sensors) >= k || radius >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, code, err
+	}
+
+	if len(sensors) > k {
+		sensors = sensors[:k]
+	}
+	return sensors, http.StatusOK, nil
+}
+
+// GetSensorsWithinBoundingBox returns all sensors located inside the given bounding box.
+func (store *BoltSensorStore) GetSensorsWithinBoundingBox(minLat, minLong, maxLat, maxLong float64) ([]model.Sensor, int, error) {
+	return store.GetSensorsByTagWithinBoundingBox(nil, minLat, minLong, maxLat, maxLong)
+}
+
+// GetSensorsByTagWithinBoundingBox returns all sensors located inside the given bounding box that match the tag filter.
+func (store *BoltSensorStore) GetSensorsByTagWithinBoundingBox(filter tagexpr.Expr, minLat, minLong, maxLat, maxLong float64) ([]model.Sensor, int, error) {
+	store.logger.Debug("Getting sensors within bounding box: ", minLat, minLong, maxLat, maxLong, filter)
+
+	box := model.BoundingBox{
+		Min: model.Location{Latitude: minLat, Longitude: minLong},
+		Max: model.Location{Latitude: maxLat, Longitude: maxLong},
+	}
+	if !box.IsValid() {
+		store.logger.Error("Invalid bounding box: ", box)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid bounding box")
+	}
+
+	sensors := []model.Sensor{}
+	code, err := store.view(func(tx *bolt.Tx) error {
+		return searchBoxes(tx, []model.BoundingBox{box}, func(location model.Location, sensor model.Sensor) {
+			if tagexpr.Match(filter, sensor.Tags) {
+				sensors = append(sensors, sensor)
+			}
+		})
+	})
+	return sensors, code, err
+}
+
+// GetSensorsWithinRadius returns all sensors within radius meters of the given location, closest first.
+func (store *BoltSensorStore) GetSensorsWithinRadius(location model.Location, radius float64) ([]model.SensorDistance, int, error) {
+	return store.GetSensorsByTagWithinRadius(nil, location, radius)
+}
+
+// GetSensorsByTagWithinRadius returns all sensors within radius meters of the given location that match the tag filter, closest first.
+func (store *BoltSensorStore) GetSensorsByTagWithinRadius(filter tagexpr.Expr, location model.Location, radius float64) ([]model.SensorDistance, int, error) {
+	store.logger.Debug("Getting sensors within radius: ", location, radius, filter)
+
+	if !location.IsValid() {
+		store.logger.Error("Invalid location: ", location)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid location")
+	}
+	if radius <= 0 || math.IsInf(radius, 0) || math.IsNaN(radius) {
+		store.logger.Error("Invalid radius: ", radius)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid radius")
+	}
+
+	var sensors []model.SensorDistance
+	code, err := store.view(func(tx *bolt.Tx) error {
+		var err error
+		sensors, err = store.withinRadius(tx, filter, location, radius)
+		return err
+	})
+	return sensors, code, err
+}
+
+// withinRadius returns the sensors within radius meters of location that match the filter, closest first.
+func (store *BoltSensorStore) withinRadius(tx *bolt.Tx, filter tagexpr.Expr, location model.Location, radius float64) ([]model.SensorDistance, error) {
+	// widen the circle so its boxes still enclose it when distances are measured on the ellipsoid
+	sensors := []model.SensorDistance{}
+	err := searchBoxes(tx, geo.CircleBounds(location, radius/geo.EllipsoidLowerBound), func(point model.Location, sensor model.Sensor) {
+		if !tagexpr.Match(filter, sensor.Tags) {
+			return
+		}
+		distance := store.distance(location.Latitude, location.Longitude, point.Latitude, point.Longitude)
+		if distance <= radius {
+			sensors = append(sensors, model.SensorDistance{
+				Sensor:   sensor,
+				Distance: distance,
+				Bearing:  geo.InitialBearing(location.Latitude, location.Longitude, point.Latitude, point.Longitude),
+			})
+		}
+	})
+	sortByDistance(sensors)
+	return sensors, err
+}
+
+// GetSensorsWithinPolygon returns all sensors located inside the given polygons.
+func (store *BoltSensorStore) GetSensorsWithinPolygon(polygon geo.MultiPolygon) ([]model.Sensor, int, error) {
+	return store.GetSensorsByTagWithinPolygon(nil, polygon)
+}
+
+// GetSensorsByTagWithinPolygon returns all sensors located inside the given polygons that match the tag filter.
+func (store *BoltSensorStore) GetSensorsByTagWithinPolygon(filter tagexpr.Expr, polygon geo.MultiPolygon) ([]model.Sensor, int, error) {
+	store.logger.Debug("Getting sensors within polygon: ", len(polygon), filter)
+
+	if err := polygon.Validate(); err != nil {
+		store.logger.Error("Invalid polygon: ", err)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid polygon: %w", err)
+	}
+
+	// prune to each polygon's bounding box, then test the exact shape
+	boxes := make([]model.BoundingBox, len(polygon))
+	for i, part := range polygon {
+		boxes[i] = part.Bounds()
+	}
+	sensors := []model.Sensor{}
+	code, err := store.view(func(tx *bolt.Tx) error {
+		return searchBoxes(tx, boxes, func(location model.Location, sensor model.Sensor) {
+			if tagexpr.Match(filter, sensor.Tags) && polygon.Contains(location) {
+				sensors = append(sensors, sensor)
+			}
+		})
+	})
+	return sensors, code, err
+}
+
+// QuerySensors returns the sensors matching the query, reading candidates from whichever index
+// query.NewPlan expects to be most selective. A nil query returns every sensor.
+func (store *BoltSensorStore) QuerySensors(q query.Expr) ([]model.Sensor, int, error) {
+	sensors := []model.Sensor{}
+	code, err := store.view(func(tx *bolt.Tx) error {
+		plan := query.NewPlan(q, boltStats{tx})
+		store.logger.Debug("Query plan for ", q, ": ", plan)
+
+		add := func(sensor model.Sensor) {
+			if plan.Filter == nil || plan.Filter.Match(sensor, store.distance) {
+				sensors = append(sensors, sensor)
+			}
+		}
+
+		switch plan.Access {
+		case query.TagIndex:
+			for name := range plan.Tags.Eval(boltTagIndex{tx}) {
+				sensor, _, err := getSensor(tx, name)
+				if err != nil {
+					return err
+				}
+				add(sensor)
+			}
+			return nil
+		case query.SpatialIndex:
+			return searchBoxes(tx, plan.Boxes, func(location model.Location, sensor model.Sensor) {
+				add(sensor)
+			})
+		}
+		return tx.Bucket(sensorsBucket).ForEach(func(k, v []byte) error {
+			var sensor model.Sensor
+			if err := json.Unmarshal(v, &sensor); err != nil {
+				return err
+			}
+			add(sensor)
+			return nil
+		})
+	})
+	return sensors, code, err
+}
+
+// GetUniqueTags returns all unique tags in the store.
+func (store *BoltSensorStore) GetUniqueTags() ([]string, int, error) {
+	tags := []string{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		// keys are sorted, so the entries of each tag are adjacent
+		return tx.Bucket(tagsBucket).ForEach(func(k, v []byte) error {
+			tag := string(k[:bytes.IndexByte(k, 0)])
+			if len(tags) == 0 || tags[len(tags)-1] != tag {
+				tags = append(tags, tag)
+			}
+			return nil
+		})
+	})
+	code, err := storeResult(store.logger, http.StatusOK, err)
+	return tags, code, err
+}
+
+// GetUniqueLocations returns all unique locations in the store.
+func (store *BoltSensorStore) GetUniqueLocations() ([]model.Location, int, error) {
+	locations := []model.Location{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		seen := make(map[model.Location]struct{})
+		return tx.Bucket(geoBucket).ForEach(func(k, v []byte) error {
+			location := decodeLocation(v)
+			if _, ok := seen[location]; !ok {
+				seen[location] = struct{}{}
+				locations = append(locations, location)
+			}
+			return nil
+		})
+	})
+	code, err := storeResult(store.logger, http.StatusOK, err)
+	return locations, code, err
+}
+
+// GetSensorCount returns the total number of sensors in the store.
+func (store *BoltSensorStore) GetSensorCount() (int, int, error) {
+	var count int
+	err := store.db.View(func(tx *bolt.Tx) error {
+		count = getCount(tx)
+		return nil
+	})
+	code, err := storeResult(store.logger, http.StatusOK, err)
+	return count, code, err
+}
+
+// view runs a read-only transaction over a store holding at least one sensor, returning the status code
+// to report.
+func (store *BoltSensorStore) view(fn func(tx *bolt.Tx) error) (int, error) {
+	code := http.StatusOK
+	err := store.db.View(func(tx *bolt.Tx) error {
+		if getCount(tx) == 0 {
+			store.logger.Error("No sensors in store")
+			code = http.StatusNotFound
+			return fmt.Errorf("no sensors in store")
+		}
+		return fn(tx)
+	})
+	return storeResult(store.logger, code, err)
+}
+
+// storeResult returns the status code for the outcome of a transaction. Errors the transaction
+// reported with a status code of their own keep it; any other error is a database failure.
+func storeResult(logger *log.Entry, code int, err error) (int, error) {
+	if err == nil || code >= 400 {
+		return code, err
+	}
+	logger.Error("Bolt store failure: ", err)
+	return http.StatusInternalServerError, err
+}
+
+// getSensor reads a sensor, reporting whether it exists.
+func getSensor(tx *bolt.Tx, name string) (model.Sensor, bool, error) {
+	var sensor model.Sensor
+	v := tx.Bucket(sensorsBucket).Get([]byte(name))
+	if v == nil {
+		return sensor, false, nil
+	}
+	if err := json.Unmarshal(v, &sensor); err != nil {
+		return sensor, false, fmt.Errorf("sensor %q: %w", name, err)
+	}
+	return sensor, true, nil
+}
+
+// putSensor writes a sensor and its index entries, giving it a new version.
+func putSensor(tx *bolt.Tx, sensor model.Sensor) error {
+	v, err := json.Marshal(sensor)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(sensorsBucket).Put([]byte(sensor.Name), v); err != nil {
+		return err
+	}
+	for _, tag := range sensor.Tags {
+		if err := tx.Bucket(tagsBucket).Put(indexKey(tag, sensor.Name), nil); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(geoBucket).Put(geoKey(sensor), encodeLocation(sensor.Location)); err != nil {
+		return err
+	}
+
+	// every change gives the sensor the next revision as its version
+	revision := getUint(tx.Bucket(metaBucket), revisionKey) + 1
+	if err := putUint(tx.Bucket(metaBucket), revisionKey, revision); err != nil {
+		return err
+	}
+	return putUint(tx.Bucket(versionsBucket), []byte(sensor.Name), revision)
+}
+
+// deleteSensor deletes a sensor and its index entries.
+func deleteSensor(tx *bolt.Tx, sensor model.Sensor) error {
+	if err := tx.Bucket(sensorsBucket).Delete([]byte(sensor.Name)); err != nil {
+		return err
+	}
+	for _, tag := range sensor.Tags {
+		if err := tx.Bucket(tagsBucket).Delete(indexKey(tag, sensor.Name)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(versionsBucket).Delete([]byte(sensor.Name)); err != nil {
+		return err
+	}
+	return tx.Bucket(geoBucket).Delete(geoKey(sensor))
+}
+
+// checkVersion returns an error if version is not 0 and the named sensor has a different version.
+func checkVersion(logger *log.Entry, tx *bolt.Tx, name string, version uint64) error {
+	current := getUint(tx.Bucket(versionsBucket), []byte(name))
+	if version != 0 && current != version {
+		logger.Error("Sensor version mismatch: ", name, " is at ", current, ", not ", version)
+		return fmt.Errorf("sensor has been modified")
+	}
+	return nil
+}
+
+// searchBoxes calls fn with each sensor inside the boxes, and its location. A sensor inside more than
+// one box is passed once.
+func searchBoxes(tx *bolt.Tx, boxes []model.BoundingBox, fn func(location model.Location, sensor model.Sensor)) error {
+	seen := make(map[string]struct{})
+	c := tx.Bucket(geoBucket).Cursor()
+	for _, box := range boxes {
+		for _, cell := range geohash.Cover(box, coverCells) {
+			prefix := []byte(cell)
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				location := decodeLocation(v)
+				if !box.Contains(location) {
+					continue
+				}
+				name := string(k[geohash.MaxPrecision+1:])
+				if _, ok := seen[name]; ok {
+					continue
+				}
+				seen[name] = struct{}{}
+
+				sensor, _, err := getSensor(tx, name)
+				if err != nil {
+					return err
+				}
+				fn(location, sensor)
+			}
+		}
+	}
+	return nil
+}
+
+// indexKey returns the key of an index entry for the named sensor.
+func indexKey(prefix, name string) []byte {
+	key := make([]byte, 0, len(prefix)+1+len(name))
+	key = append(key, prefix...)
+	key = append(key, 0)
+	return append(key, name...)
+}
+
+// geoKey returns the key of a sensor's entry in the geohash index.
+func geoKey(sensor model.Sensor) []byte {
+	return indexKey(geohash.Encode(sensor.Location, geohash.MaxPrecision), sensor.Name)
+}
+
+func encodeLocation(location model.Location) []byte {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v, math.Float64bits(location.Latitude))
+	binary.BigEndian.PutUint64(v[8:], math.Float64bits(location.Longitude))
+	return v
+}
+
+func decodeLocation(v []byte) model.Location {
+	return model.Location{
+		Latitude:  math.Float64frombits(binary.BigEndian.Uint64(v)),
+		Longitude: math.Float64frombits(binary.BigEndian.Uint64(v[8:])),
+	}
+}
+
+func getCount(tx *bolt.Tx) int {
+	return int(getUint(tx.Bucket(metaBucket), countKey))
+}
+
+func addCount(tx *bolt.Tx, delta int) error {
+	return putUint(tx.Bucket(metaBucket), countKey, uint64(getCount(tx)+delta))
+}
+
+// getUint reads a big-endian uint64, or 0 if the key is missing.
+func getUint(b *bolt.Bucket, key []byte) uint64 {
+	v := b.Get(key)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func putUint(b *bolt.Bucket, key []byte, n uint64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, n)
+	return b.Put(key, v)
+}
+
+// boltTagIndex exposes the tag index to tagexpr within a transaction.
+type boltTagIndex struct {
+	tx *bolt.Tx
+}
+
+func (index boltTagIndex) Lookup(tag string) map[string]struct{} {
+	names := make(map[string]struct{})
+	prefix := indexKey(tag, "")
+	c := index.tx.Bucket(tagsBucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		names[string(k[len(prefix):])] = struct{}{}
+	}
+	return names
+}
+
+func (index boltTagIndex) All() map[string]struct{} {
+	names := make(map[string]struct{})
+	c := index.tx.Bucket(sensorsBucket).Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		names[string(k)] = struct{}{}
+	}
+	return names
+}
+
+// boltStats describes the store to the query planner within a transaction.
+type boltStats struct {
+	tx *bolt.Tx
+}
+
+func (stats boltStats) Count() int {
+	return getCount(stats.tx)
+}
+
+func (stats boltStats) TagCount(tag string) int {
+	count := 0
+	prefix := indexKey(tag, "")
+	c := stats.tx.Bucket(tagsBucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		count++
+	}
+	return count
+}
+
+// Bounds returns the whole globe, since finding the extent of the sensors would mean reading every
+// entry of the geohash index. Spatial terms are estimated as a fraction of the globe's area, which
+// favours the spatial index.
+func (stats boltStats) Bounds() model.BoundingBox {
+	return model.BoundingBox{
+		Min: model.Location{Latitude: -90, Longitude: -180},
+		Max: model.Location{Latitude: 90, Longitude: 180},
+	}
+}
@@ -0,0 +1,284 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/model"
+	"sensor-api/internal/query"
+	"sensor-api/internal/tagexpr"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newBoltStore opens a bolt store in a temporary directory, closed when the test ends.
+func newBoltStore(t *testing.T) *BoltSensorStore {
+	store, err := NewBoltSensorStore(filepath.Join(t.TempDir(), "sensors.db"), nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestBoltStore(t *testing.T) {
+	store := newBoltStore(t)
+
+	// Test querying an empty store
+	_, code, err := store.GetSensorsByTags(nil)
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+	_, code, err = store.GetNearestSensor(model.Location{Latitude: 1, Longitude: 1})
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+
+	sensor1 := model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor", "temperature"}}
+	sensor2 := model.Sensor{Name: "Sensor2", Location: model.Location{Latitude: 37.7833, Longitude: -122.4167}, Tags: []string{"outdoor", "temperature"}}
+
+	// Test AddSensor and GetSensor
+	for _, sensor := range []model.Sensor{sensor1, sensor2} {
+		code, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+		assert.Equal(t, 201, code)
+	}
+	retrievedSensor, code, err := store.GetSensor("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, sensor1, retrievedSensor)
+
+	// Test duplicate sensor addition
+	code, err = store.AddSensor(sensor1)
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+
+	// Test invalid locations are rejected
+	code, err = store.AddSensor(model.Sensor{Name: "Sensor3", Location: model.Location{Latitude: 91, Longitude: 0}})
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+	invalid := sensor1
+	invalid.Location.Longitude = -181
+	code, err = store.UpdateSensor("Sensor1", &invalid)
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+
+	// Test getting, updating and removing a sensor that doesn't exist
+	_, code, err = store.GetSensor("Sensor3")
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+	code, err = store.UpdateSensor("Sensor3", &sensor1)
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+	code, err = store.RemoveSensor("Sensor3")
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+
+	// Test renaming and moving a sensor updates every index
+	moved := model.Sensor{Name: "Sensor4", Location: model.Location{Latitude: 40, Longitude: -120}, Tags: []string{"indoor", "humidity"}}
+	code, err = store.UpdateSensor("Sensor1", &moved)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	_, _, err = store.GetSensor("Sensor1")
+	assert.Error(t, err)
+	sensors, _, err := store.GetSensorsByTags([]string{"temperature"})
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Sensor{sensor2}, sensors)
+	sensors, _, err = store.GetSensorsWithinBoundingBox(39, -121, 41, -119)
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Sensor{moved}, sensors)
+	sensors, _, err = store.GetSensorsWithinBoundingBox(37, -123, 38, -122)
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Sensor{sensor2}, sensors)
+
+	tags, _, err := store.GetUniqueTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"humidity", "indoor", "outdoor", "temperature"}, tags)
+
+	// Test removing a sensor cleans up its tags and location
+	code, err = store.RemoveSensor("Sensor2")
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	tags, _, err = store.GetUniqueTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"humidity", "indoor"}, tags)
+	locations, _, err := store.GetUniqueLocations()
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Location{moved.Location}, locations)
+	count, _, err := store.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Check no index entries are left behind once the store is empty
+	_, err = store.RemoveSensor("Sensor4")
+	assert.NoError(t, err)
+	assert.NoError(t, store.db.View(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{sensorsBucket, tagsBucket, geoBucket, versionsBucket} {
+			k, _ := tx.Bucket(bucket).Cursor().First()
+			assert.Nil(t, k, string(bucket))
+		}
+		return nil
+	}))
+	count, _, err = store.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestBoltStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sensors.db")
+	store, err := NewBoltSensorStore(path, nil)
+	assert.NoError(t, err)
+
+	sensor := model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor"}}
+	_, err = store.AddSensor(sensor)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+
+	// Test the sensor and its indexes are read back after reopening
+	store, err = NewBoltSensorStore(path, nil)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	sensors, _, err := store.GetSensorsByTags([]string{"indoor"})
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Sensor{sensor}, sensors)
+	nearest, _, err := store.GetNearestSensor(model.Location{Latitude: 37, Longitude: -122})
+	assert.NoError(t, err)
+	assert.Equal(t, sensor, *nearest)
+}
+
+func TestBoltStoreMatchesInMemory(t *testing.T) {
+	// compare every query against the in-memory store holding the same scattered set of sensors,
+	// including sensors either side of the antimeridian
+	disk := newBoltStore(t)
+	memory := NewInMemorySensorStore()
+	rng := rand.New(rand.NewSource(1))
+	tags := []string{"indoor", "outdoor", "temperature", "humidity"}
+	for i := 0; i < 500; i++ {
+		sensor := model.Sensor{
+			Name: fmt.Sprintf("Sensor%d", i),
+			Location: model.Location{
+				Latitude:  rng.Float64()*20 + 30,
+				Longitude: rng.Float64()*20 - 130,
+			},
+		}
+		if i%10 == 0 {
+			sensor.Location.Longitude = rng.Float64()*4 + 178
+			if sensor.Location.Longitude > 180 {
+				sensor.Location.Longitude -= 360
+			}
+		}
+		for _, tag := range tags {
+			if rng.Intn(2) == 0 {
+				sensor.Tags = append(sensor.Tags, tag)
+			}
+		}
+		_, err := disk.AddSensor(sensor)
+		assert.NoError(t, err)
+		_, err = memory.AddSensor(sensor)
+		assert.NoError(t, err)
+	}
+
+	indoor := tagexpr.Tag("indoor")
+	for _, filter := range []tagexpr.Expr{nil, indoor} {
+		expected, _, err := memory.GetSensorsByTagExpr(filter)
+		assert.NoError(t, err)
+		actual, _, err := disk.GetSensorsByTagExpr(filter)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, expected, actual, filter)
+
+		expected, _, err = memory.GetSensorsByTagWithinBoundingBox(filter, 35, -125, 38, -122)
+		assert.NoError(t, err)
+		actual, _, err = disk.GetSensorsByTagWithinBoundingBox(filter, 35, -125, 38, -122)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, actual)
+		assert.ElementsMatch(t, expected, actual, filter)
+
+		polygon := geo.MultiPolygon{{{
+			{Latitude: 35, Longitude: -125}, {Latitude: 35, Longitude: -120},
+			{Latitude: 40, Longitude: -125}, {Latitude: 35, Longitude: -125},
+		}}}
+		expected, _, err = memory.GetSensorsByTagWithinPolygon(filter, polygon)
+		assert.NoError(t, err)
+		actual, _, err = disk.GetSensorsByTagWithinPolygon(filter, polygon)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, actual)
+		assert.ElementsMatch(t, expected, actual, filter)
+
+		for _, center := range []model.Location{{Latitude: 40, Longitude: -120}, {Latitude: 40, Longitude: 179.9}} {
+			expectedDistances, _, err := memory.GetSensorsByTagWithinRadius(filter, center, 300000)
+			assert.NoError(t, err)
+			actualDistances, _, err := disk.GetSensorsByTagWithinRadius(filter, center, 300000)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, actualDistances)
+			assert.Equal(t, expectedDistances, actualDistances, center)
+
+			for _, maxDistance := range []float64{0, 500000} {
+				expectedDistances, _, err = memory.GetNearestSensors(center, 10, maxDistance, filter)
+				assert.NoError(t, err)
+				actualDistances, _, err = disk.GetNearestSensors(center, 10, maxDistance, filter)
+				assert.NoError(t, err)
+				assert.Len(t, actualDistances, 10)
+				assert.Equal(t, expectedDistances, actualDistances, center)
+			}
+		}
+	}
+
+	// Test a nearest query that runs out of sensors returns all of them
+	nearest, _, err := disk.GetNearestSensors(model.Location{Latitude: -40, Longitude: 20}, 1000, 0, indoor)
+	assert.NoError(t, err)
+	expected, _, err := memory.GetSensorsByTagExpr(indoor)
+	assert.NoError(t, err)
+	assert.Len(t, nearest, len(expected))
+
+	for _, input := range []string{
+		"tag:indoor OR name:Sensor3",
+		"tag:indoor AND NOT tag:outdoor AND (tag:temperature OR tag:humidity)",
+		`tag:indoor AND within(35, -125, 38, -122) AND name~"[02468]$"`,
+		"tag:temperature AND near(40, -120, 150000)",
+	} {
+		q, err := query.Parse(input)
+		assert.NoError(t, err, input)
+		expected, _, err := memory.QuerySensors(q)
+		assert.NoError(t, err, input)
+		actual, code, err := disk.QuerySensors(q)
+		assert.NoError(t, err, input)
+		assert.Equal(t, 200, code, input)
+		assert.ElementsMatch(t, expected, actual, input)
+	}
+
+	locations, _, err := disk.GetUniqueLocations()
+	assert.NoError(t, err)
+	assert.Len(t, locations, 500)
+}
+
+func TestBoltIndexKeys(t *testing.T) {
+	// Test tag entries of one tag are not confused with those of a tag it is a prefix of
+	store := newBoltStore(t)
+	for _, sensor := range []model.Sensor{
+		{Name: "A", Location: model.Location{Latitude: 1, Longitude: 1}, Tags: []string{"in"}},
+		{Name: "B", Location: model.Location{Latitude: 1, Longitude: 1}, Tags: []string{"indoor"}},
+	} {
+		_, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+	}
+	sensors, _, err := store.GetSensorsByTags([]string{"in"})
+	assert.NoError(t, err)
+	assert.Len(t, sensors, 1)
+	assert.Equal(t, "A", sensors[0].Name)
+
+	assert.True(t, bytes.HasPrefix(geoKey(sensors[0]), []byte("s00")))
+
+	// Test a NUL byte, which separates the parts of index keys, is rejected in tags and names
+	_, err = store.AddSensor(model.Sensor{Name: "C", Location: model.Location{Latitude: 1, Longitude: 1}, Tags: []string{"in\x00C"}})
+	assert.Error(t, err)
+	results, _, err := store.AddSensors([]model.Sensor{{Name: "C\x00in", Location: model.Location{Latitude: 1, Longitude: 1}}}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, results[0].Code)
+	tags, _, err := store.GetUniqueTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"in", "indoor"}, tags)
+	sensors, _, err = store.GetSensorsByTags([]string{"in"})
+	assert.NoError(t, err)
+	assert.Len(t, sensors, 1)
+}
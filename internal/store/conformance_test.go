@@ -0,0 +1,41 @@
+package store_test
+
+import (
+	"path/filepath"
+	"sensor-api/internal/store"
+	"sensor-api/internal/store/storetest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemoryConformance(t *testing.T) {
+	for name, newIndex := range map[string]func() store.SpatialIndex{
+		"rtree":    store.NewRTreeIndex,
+		"quadtree": store.NewQuadtreeIndex,
+	} {
+		t.Run(name, func(t *testing.T) {
+			storetest.RunConformance(t, func(t *testing.T) store.SensorStore {
+				return store.NewInMemorySensorStore(store.WithSpatialIndex(newIndex()))
+			})
+		})
+	}
+}
+
+func TestFileConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) store.SensorStore {
+		s, err := store.NewFileSensorStore(t.TempDir(), 0)
+		assert.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestBoltConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) store.SensorStore {
+		s, err := store.NewBoltSensorStore(filepath.Join(t.TempDir(), "sensors.db"), nil)
+		assert.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
@@ -0,0 +1,402 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sensor-api/internal/model"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+
+	// DefaultSnapshotInterval is the number of logged changes between snapshots.
+	DefaultSnapshotInterval = 1000
+)
+
+// FileSensorStore is a SensorStore persisted to a directory. It serves every query from an embedded
+// InMemorySensorStore, and makes each change durable by appending it to a write-ahead log before
+// returning. Every so often it writes the whole store to a snapshot and empties the log, and on
+// startup it rebuilds the store from the snapshot followed by the log.
+//
+// Each change is checked by the in-memory store, appended to the log and only then made in memory, so a
+// change that cannot be logged is never seen. If the log cannot be written, the store refuses any
+// further changes, as the log may hold part of the failed record.
+type FileSensorStore struct {
+	*InMemorySensorStore
+	*fileState
+}
+
+// fileState is the log of a FileSensorStore, shared by the views WithLogger returns.
+type fileState struct {
+	// mu serializes changes with snapshots, so that a snapshot holds every change logged before it
+	mu  sync.Mutex
+	dir string
+	wal *os.File
+	// seq is the sequence number of the last logged change
+	seq uint64
+	// logged counts the changes logged since the last snapshot
+	logged           int
+	snapshotInterval int
+	// err is the write failure that stopped the store accepting changes
+	err error
+}
+
+// snapshot is the on-disk form of the whole store.
+type snapshot struct {
+	// Seq is the sequence number of the last change included in the snapshot.
+	Seq      uint64                     `json:"seq"`
+	Sensors  []model.Sensor             `json:"sensors"`
+	Readings map[string][]model.Reading `json:"readings"`
+	// Versions and Revision restore the sensors' versions. Snapshots written before sensors had
+	// versions leave them empty, and the sensors are given new ones.
+	Versions map[string]uint64 `json:"versions,omitempty"`
+	Revision uint64            `json:"revision,omitempty"`
+}
+
+// NewFileSensorStore opens the store persisted in dir, creating it if needed. A snapshot is written
+// after every snapshotInterval changes, or DefaultSnapshotInterval if it is not positive. The options
+// configure the in-memory store serving queries.
+func NewFileSensorStore(dir string, snapshotInterval int, opts ...Option) (*FileSensorStore, error) {
+	if snapshotInterval <= 0 {
+		snapshotInterval = DefaultSnapshotInterval
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	fs := &FileSensorStore{
+		InMemorySensorStore: NewInMemorySensorStore(opts...),
+		fileState:           &fileState{dir: dir, snapshotInterval: snapshotInterval},
+	}
+	if err := fs.loadSnapshot(); err != nil {
+		return nil, fmt.Errorf("failed to load snapshot: %w", err)
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.replay(wal); err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("failed to replay log: %w", err)
+	}
+	fs.wal = wal
+	// the snapshot and the log are restored without logging them again
+	fs.InMemorySensorStore.logChange = fs.logChange
+
+	log.Info("Opened file store in ", dir, " at sequence ", fs.seq)
+	return fs, nil
+}
+
+// loadSnapshot restores the store from the snapshot, if there is one.
+func (fs *FileSensorStore) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(fs.dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var snap snapshot
+	if err := json.NewDecoder(f).Decode(&snap); err != nil {
+		return err
+	}
+	for _, sensor := range snap.Sensors {
+		if _, err := fs.InMemorySensorStore.AddSensor(sensor); err != nil {
+			return fmt.Errorf("sensor %q: %w", sensor.Name, err)
+		}
+	}
+	for name, readings := range snap.Readings {
+		if _, err := fs.InMemorySensorStore.AddReadings(name, readings); err != nil {
+			return fmt.Errorf("readings of sensor %q: %w", name, err)
+		}
+	}
+	if snap.Revision > 0 {
+		fs.InMemorySensorStore.restoreVersions(snap.Versions, snap.Revision)
+	}
+	fs.seq = snap.Seq
+	return nil
+}
+
+// replay applies the changes logged after the snapshot, and cuts off a final record torn by a crash
+// so that new records are appended after the last intact one.
+func (fs *FileSensorStore) replay(wal *os.File) error {
+	valid, err := readRecords(wal, func(record walRecord) {
+		// the log may still hold changes already in the snapshot if a crash came between writing
+		// the snapshot and emptying the log
+		if record.Seq <= fs.seq {
+			return
+		}
+		if _, err := fs.apply(record); err != nil {
+			// only successful changes are logged, so replaying them should succeed too
+			fs.logger.Error("Failed to replay change ", record.Seq, ": ", err)
+		}
+		fs.seq = record.Seq
+		fs.logged++
+	})
+	if err != nil {
+		return err
+	}
+
+	size, err := wal.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if valid < size {
+		fs.logger.Warn("Discarding ", size-valid, " bytes of incomplete log record at offset ", valid)
+		if err := wal.Truncate(valid); err != nil {
+			return err
+		}
+		if err := wal.Sync(); err != nil {
+			return err
+		}
+	}
+	_, err = wal.Seek(valid, io.SeekStart)
+	return err
+}
+
+// apply makes a logged change to the in-memory store.
+func (fs *FileSensorStore) apply(record walRecord) (int, error) {
+	switch record.Op {
+	case opAddSensor:
+		return fs.InMemorySensorStore.AddSensor(*record.Sensor)
+	case opAddSensors:
+		_, code, err := fs.InMemorySensorStore.AddSensors(record.Sensors, true)
+		return code, err
+	case opUpdateSensor:
+		return fs.InMemorySensorStore.UpdateSensorIfMatch(record.Name, record.Sensor, record.Version)
+	case opRemoveSensor:
+		return fs.InMemorySensorStore.RemoveSensorIfMatch(record.Name, record.Version)
+	case opAddReadings:
+		return fs.InMemorySensorStore.AddReadings(record.Name, record.Readings)
+	}
+	return http.StatusInternalServerError, fmt.Errorf("unknown log operation %q", record.Op)
+}
+
+// WithLogger returns a view of the store sharing its data and log, which logs with logger.
+func (fs *FileSensorStore) WithLogger(logger *log.Entry) SensorStore {
+	return &FileSensorStore{InMemorySensorStore: fs.InMemorySensorStore.withLogger(logger), fileState: fs.fileState}
+}
+
+// logChange appends a change checked by the in-memory store to the log, before the change is made. It
+// is called with fs.mu held, by way of change.
+func (fs *FileSensorStore) logChange(logger *log.Entry, record walRecord) (int, error) {
+	record.Seq = fs.seq + 1
+	if err := appendRecord(fs.wal, record); err != nil {
+		logger.Error("Failed to write log: ", err)
+		fs.err = err
+		return http.StatusInternalServerError, fmt.Errorf("failed to write log: %w", err)
+	}
+	fs.seq = record.Seq
+	fs.logged++
+	return http.StatusOK, nil
+}
+
+// change makes a change to the in-memory store with do, which logs it through logChange. A snapshot is
+// taken when enough changes have been logged.
+func (fs *FileSensorStore) change(do func() (int, error)) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.err != nil {
+		fs.logger.Error("Store is read-only after a write failure: ", fs.err)
+		return http.StatusInternalServerError, fmt.Errorf("store is read-only after a write failure: %w", fs.err)
+	}
+
+	code, err := do()
+	if err != nil {
+		return code, err
+	}
+
+	if fs.logged >= fs.snapshotInterval {
+		// the change is already durable in the log, so a failed snapshot is retried later
+		if err := fs.snapshot(); err != nil {
+			fs.logger.Error("Failed to write snapshot: ", err)
+		}
+	}
+	return code, nil
+}
+
+// AddSensor adds a sensor to the store and logs it.
+func (fs *FileSensorStore) AddSensor(sensor model.Sensor) (int, error) {
+	return fs.change(func() (int, error) {
+		return fs.InMemorySensorStore.AddSensor(sensor)
+	})
+}
+
+// AddSensors adds a batch of sensors to the store, logging those added as one record, so that after a
+// crash either all of them or none are restored.
+func (fs *FileSensorStore) AddSensors(sensors []model.Sensor, atomic bool) ([]AddResult, int, error) {
+	var results []AddResult
+	code, err := fs.change(func() (int, error) {
+		var code int
+		var err error
+		results, code, err = fs.InMemorySensorStore.AddSensors(sensors, atomic)
+		return code, err
+	})
+	return results, code, err
+}
+
+// UpdateSensor updates a sensor in the store and logs it.
+func (fs *FileSensorStore) UpdateSensor(name string, updatedSensor *model.Sensor) (int, error) {
+	return fs.UpdateSensorIfMatch(name, updatedSensor, 0)
+}
+
+// UpdateSensorIfMatch updates a sensor in the store if its version matches, and logs it.
+func (fs *FileSensorStore) UpdateSensorIfMatch(name string, updatedSensor *model.Sensor, version uint64) (int, error) {
+	return fs.change(func() (int, error) {
+		return fs.InMemorySensorStore.UpdateSensorIfMatch(name, updatedSensor, version)
+	})
+}
+
+// PatchSensor replaces a sensor in the store with the result of patch, if its version matches, and
+// logs the patched sensor as an update.
+func (fs *FileSensorStore) PatchSensor(name string, patch Patch, version uint64) (int, error) {
+	return fs.change(func() (int, error) {
+		return fs.InMemorySensorStore.PatchSensor(name, patch, version)
+	})
+}
+
+// RemoveSensor removes a sensor from the store and logs it.
+func (fs *FileSensorStore) RemoveSensor(name string) (int, error) {
+	return fs.RemoveSensorIfMatch(name, 0)
+}
+
+// RemoveSensorIfMatch removes a sensor from the store if its version matches, and logs it.
+func (fs *FileSensorStore) RemoveSensorIfMatch(name string, version uint64) (int, error) {
+	return fs.change(func() (int, error) {
+		return fs.InMemorySensorStore.RemoveSensorIfMatch(name, version)
+	})
+}
+
+// AddReadings adds readings to a sensor in the store and logs them.
+func (fs *FileSensorStore) AddReadings(name string, readings []model.Reading) (int, error) {
+	return fs.change(func() (int, error) {
+		return fs.InMemorySensorStore.AddReadings(name, readings)
+	})
+}
+
+// Snapshot writes the whole store to a snapshot and empties the log.
+func (fs *FileSensorStore) Snapshot() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.snapshot()
+}
+
+// snapshot writes the snapshot to a temporary file and renames it into place, so that a crash leaves
+// either the old or the new snapshot. The caller must hold mu.
+func (fs *FileSensorStore) snapshot() error {
+	snap := fs.InMemorySensorStore.dump()
+	snap.Seq = fs.seq
+
+	tmp, err := os.CreateTemp(fs.dir, snapshotFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(snap); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(fs.dir, snapshotFileName)); err != nil {
+		return err
+	}
+	if err := syncDir(fs.dir); err != nil {
+		return err
+	}
+
+	// everything in the log is now in the snapshot
+	if err := fs.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := fs.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := fs.wal.Sync(); err != nil {
+		return err
+	}
+	fs.logged = 0
+
+	fs.logger.Debug("Wrote snapshot at sequence ", fs.seq)
+	return nil
+}
+
+// Close writes a final snapshot and closes the log.
+func (fs *FileSensorStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.err == nil && fs.logged > 0 {
+		if err := fs.snapshot(); err != nil {
+			fs.logger.Error("Failed to write snapshot: ", err)
+		}
+	}
+	return fs.wal.Close()
+}
+
+// syncDir flushes a directory, making a file renamed into it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// dump returns a snapshot holding a copy of every sensor, ordered by name, with their versions and
+// readings. The caller sets its sequence number.
+func (store *InMemorySensorStore) dump() snapshot {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	sensors := make([]model.Sensor, 0, len(store.sensors))
+	versions := make(map[string]uint64, len(store.sensors))
+	for name, sensor := range store.sensors {
+		sensors = append(sensors, sensor)
+		versions[name] = store.versions[name]
+	}
+	sort.Slice(sensors, func(i, j int) bool { return sensors[i].Name < sensors[j].Name })
+
+	store.readings.mu.Lock()
+	defer store.readings.mu.Unlock()
+
+	readings := make(map[string][]model.Reading, len(store.readings.readings))
+	for name, r := range store.readings.readings {
+		readings[name] = append([]model.Reading(nil), r...)
+	}
+	return snapshot{Sensors: sensors, Readings: readings, Versions: versions, Revision: store.revision}
+}
+
+// restoreVersions sets the versions of the sensors and the revision the next change follows.
+func (store *InMemorySensorStore) restoreVersions(versions map[string]uint64, revision uint64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for name, version := range versions {
+		if _, ok := store.sensors[name]; ok {
+			store.versions[name] = version
+		}
+	}
+	store.revision = revision
+}
@@ -0,0 +1,351 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sensor-api/internal/events"
+	"sensor-api/internal/model"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStorePersists(t *testing.T) {
+	dir := t.TempDir()
+	timestamp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	store, err := NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+
+	// make a change of every kind
+	for _, sensor := range []model.Sensor{
+		{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor"}},
+		{Name: "Sensor2", Location: model.Location{Latitude: 37.7833, Longitude: -122.4167}, Tags: []string{"outdoor"}},
+		{Name: "Sensor3", Location: model.Location{Latitude: 39.0921, Longitude: -123.5222}},
+	} {
+		code, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+		assert.Equal(t, 201, code)
+	}
+	code, err := store.AddReadings("Sensor1", []model.Reading{{Metric: "temperature", Value: 21.5, Timestamp: timestamp}})
+	assert.NoError(t, err)
+	assert.Equal(t, 201, code)
+	code, err = store.UpdateSensor("Sensor1", &model.Sensor{Name: "Sensor4", Location: model.Location{Latitude: 38, Longitude: -122}, Tags: []string{"indoor", "moved"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	code, err = store.RemoveSensor("Sensor2")
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+
+	// Test failed changes are not logged
+	code, err = store.AddSensor(model.Sensor{Name: "Sensor3", Location: model.Location{Latitude: 1, Longitude: 1}})
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+
+	// reopen without closing, as after a crash, so the store is rebuilt from the log alone
+	reopened, err := NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+	checkFileStore(t, reopened, timestamp)
+
+	// Test the store is rebuilt from the snapshot written on close
+	assert.NoError(t, reopened.Close())
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	assert.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	reopened, err = NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+	checkFileStore(t, reopened, timestamp)
+	assert.NoError(t, reopened.Close())
+}
+
+// checkFileStore checks the store holds the sensors left by TestFileStorePersists, with working indexes.
+func checkFileStore(t *testing.T, store *FileSensorStore, timestamp time.Time) {
+	count, _, err := store.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	_, code, err := store.GetSensor("Sensor2")
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+
+	sensors, _, err := store.GetSensorsByTags([]string{"moved"})
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Sensor{{Name: "Sensor4", Location: model.Location{Latitude: 38, Longitude: -122}, Tags: []string{"indoor", "moved"}}}, sensors)
+
+	nearest, _, err := store.GetNearestSensor(model.Location{Latitude: 39, Longitude: -123.5})
+	assert.NoError(t, err)
+	assert.Equal(t, "Sensor3", nearest.Name)
+
+	readings, _, err := store.GetReadings("Sensor4", time.Time{}, time.Time{}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Reading{{Metric: "temperature", Value: 21.5, Timestamp: timestamp}}, readings)
+}
+
+func TestFileStoreSnapshots(t *testing.T) {
+	dir := t.TempDir()
+
+	// Test a snapshot is written every few changes, emptying the log
+	store, err := NewFileSensorStore(dir, 3)
+	assert.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := store.AddSensor(model.Sensor{Name: string(rune('A' + i)), Location: model.Location{Latitude: float64(i + 1), Longitude: 1}})
+		assert.NoError(t, err)
+	}
+	_, err = os.Stat(filepath.Join(dir, snapshotFileName))
+	assert.NoError(t, err)
+	wal, err := os.ReadFile(filepath.Join(dir, walFileName))
+	assert.NoError(t, err)
+	var seqs []uint64
+	_, err = readRecords(bytes.NewReader(wal), func(record walRecord) { seqs = append(seqs, record.Seq) })
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{4}, seqs)
+
+	// Test changes already in the snapshot are skipped if a crash left them in the log: put back the
+	// log from before the next snapshot
+	_, err = store.AddSensor(model.Sensor{Name: "E", Location: model.Location{Latitude: 5, Longitude: 1}})
+	assert.NoError(t, err)
+	wal, err = os.ReadFile(filepath.Join(dir, walFileName))
+	assert.NoError(t, err)
+	assert.NoError(t, store.Snapshot())
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, walFileName), wal, 0o644))
+
+	reopened, err := NewFileSensorStore(dir, 3)
+	assert.NoError(t, err)
+	count, _, err := reopened.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	// Test sequence numbers carry on after the snapshot
+	_, err = reopened.AddSensor(model.Sensor{Name: "F", Location: model.Location{Latitude: 6, Longitude: 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), reopened.seq)
+}
+
+func TestFileStoreTruncatedLog(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := store.AddSensor(model.Sensor{Name: string(rune('A' + i)), Location: model.Location{Latitude: float64(i + 1), Longitude: 1}})
+		assert.NoError(t, err)
+	}
+
+	// Test a final record torn part way through, in the payload or in the header, is discarded
+	path := filepath.Join(dir, walFileName)
+	wal, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	for _, cut := range []int{1, len(wal)/3 - 4} {
+		assert.NoError(t, os.WriteFile(path, wal[:len(wal)-cut], 0o644))
+
+		reopened, err := NewFileSensorStore(dir, 0)
+		assert.NoError(t, err, cut)
+		count, _, err := reopened.GetSensorCount()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count, cut)
+		_, _, err = reopened.GetSensor("C")
+		assert.Error(t, err, cut)
+
+		// new changes are appended after the last intact record, and survive another restart
+		_, err = reopened.AddSensor(model.Sensor{Name: "D", Location: model.Location{Latitude: 4, Longitude: 1}})
+		assert.NoError(t, err)
+		reopened, err = NewFileSensorStore(dir, 0)
+		assert.NoError(t, err)
+		count, _, err = reopened.GetSensorCount()
+		assert.NoError(t, err)
+		assert.Equal(t, 3, count, cut)
+	}
+
+	// Test damage before the final record is reported rather than silently dropping changes
+	damaged := append([]byte(nil), wal...)
+	damaged[walHeaderSize+2] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, damaged, 0o644))
+	_, err = NewFileSensorStore(dir, 0)
+	assert.Error(t, err)
+
+	// Test a length running past the end of the log is corruption, not a torn append, if intact
+	// records follow it
+	damaged = append([]byte(nil), wal...)
+	damaged[2] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, damaged, 0o644))
+	_, err = NewFileSensorStore(dir, 0)
+	assert.Error(t, err)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(wal)), info.Size())
+}
+
+func TestFileStoreVersions(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+
+	sensor := model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}}
+	_, err = store.AddSensor(sensor)
+	assert.NoError(t, err)
+	_, err = store.AddSensor(model.Sensor{Name: "Sensor2", Location: model.Location{Latitude: 38, Longitude: -122}})
+	assert.NoError(t, err)
+	_, err = store.UpdateSensor("Sensor1", &sensor)
+	assert.NoError(t, err)
+	_, version, _, err := store.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+
+	// Test a failed conditional change is not logged, and versions are rebuilt from the log
+	code, err := store.RemoveSensorIfMatch("Sensor1", version-1)
+	assert.Error(t, err)
+	assert.Equal(t, 412, code)
+
+	reopened, err := NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+	_, replayed, _, err := reopened.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, version, replayed)
+
+	// Test versions and the revision they are drawn from survive a snapshot
+	assert.NoError(t, reopened.Close())
+	reopened, err = NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+	_, restored, _, err := reopened.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, version, restored)
+	_, restored, _, err = reopened.GetSensorVersion("Sensor2")
+	assert.NoError(t, err)
+	assert.Less(t, restored, version)
+
+	code, err = reopened.UpdateSensorIfMatch("Sensor1", &sensor, version)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	_, updated, _, err := reopened.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, version+1, updated)
+	assert.NoError(t, reopened.Close())
+}
+
+func TestFileStorePatch(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+
+	_, err = store.AddSensor(model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}})
+	assert.NoError(t, err)
+
+	// Test a patch is logged as the sensor it produced, and a failed patch is not logged
+	code, err := store.PatchSensor("Sensor1", func(sensor model.Sensor) (model.Sensor, error) {
+		sensor.Tags = append(sensor.Tags, "indoor")
+		return sensor, nil
+	}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	code, err = store.PatchSensor("Sensor1", func(sensor model.Sensor) (model.Sensor, error) {
+		return sensor, fmt.Errorf("test failed")
+	}, 0)
+	assert.Error(t, err)
+	assert.Equal(t, 409, code)
+	patched, version, _, err := store.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+
+	reopened, err := NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+	replayed, replayedVersion, _, err := reopened.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, patched, replayed)
+	assert.Equal(t, []string{"indoor"}, replayed.Tags)
+	assert.Equal(t, version, replayedVersion)
+	assert.NoError(t, reopened.Close())
+}
+
+func TestFileStoreAddSensors(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+
+	// Test a batch is logged as one record holding only the sensors added
+	sensors := []model.Sensor{
+		{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}},
+		{Name: "Sensor2", Location: model.Location{Latitude: 95}},
+		{Name: "Sensor3", Location: model.Location{Latitude: 38, Longitude: -122}, Tags: []string{"indoor"}},
+	}
+	_, _, err = store.AddSensors(sensors, false)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), store.seq)
+
+	// Check batches that add nothing are not logged
+	_, _, err = store.AddSensors(sensors[:2], false)
+	assert.NoError(t, err)
+	_, _, err = store.AddSensors([]model.Sensor{{Name: "Sensor4", Location: model.Location{Latitude: 38, Longitude: -121}}, sensors[1]}, true)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(1), store.seq)
+
+	reopened, err := NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+	count, _, err := reopened.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	sensor, _, err := reopened.GetSensor("Sensor3")
+	assert.NoError(t, err)
+	assert.Equal(t, sensors[2], sensor)
+	assert.NoError(t, reopened.Close())
+}
+
+func TestFileStoreWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+	sensor := model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}}
+	_, err = store.AddSensor(sensor)
+	assert.NoError(t, err)
+
+	// close the log under the store, so the next append fails
+	assert.NoError(t, store.wal.Close())
+
+	// Test a change that cannot be logged is refused and not made in memory
+	code, err := store.UpdateSensor("Sensor1", &model.Sensor{Name: "Sensor2", Location: model.Location{Latitude: 38, Longitude: -122}})
+	assert.Error(t, err)
+	assert.Equal(t, 500, code)
+	retrieved, _, err := store.GetSensor("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, sensor, retrieved)
+	_, code, _ = store.GetSensor("Sensor2")
+	assert.Equal(t, 404, code)
+
+	// Check the store then refuses every change, leaving memory as it was
+	results, code, err := store.AddSensors([]model.Sensor{{Name: "Sensor3", Location: model.Location{Latitude: 38, Longitude: -121}}}, false)
+	assert.Error(t, err)
+	assert.Equal(t, 500, code)
+	assert.Nil(t, results)
+	code, err = store.AddReadings("Sensor1", []model.Reading{{Metric: "temperature", Value: 21.5, Timestamp: time.Now()}})
+	assert.Error(t, err)
+	assert.Equal(t, 500, code)
+	count, _, err := store.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Check only the change logged before the failure is restored
+	reopened, err := NewFileSensorStore(dir, 0)
+	assert.NoError(t, err)
+	retrieved, _, err = reopened.GetSensor("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, sensor, retrieved)
+	assert.NoError(t, reopened.Close())
+}
+
+func TestFileStoreWriteFailureEvents(t *testing.T) {
+	store, err := NewFileSensorStore(t.TempDir(), 0)
+	assert.NoError(t, err)
+	broker := events.NewBroker(100, 100)
+	store.SetEventSink(broker)
+	_, err = store.AddSensor(model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), broker.LastID())
+
+	// Test a change that cannot be logged publishes no event
+	assert.NoError(t, store.wal.Close())
+	_, err = store.AddSensor(model.Sensor{Name: "Sensor2", Location: model.Location{Latitude: 38, Longitude: -122}})
+	assert.Error(t, err)
+	_, err = store.RemoveSensor("Sensor1")
+	assert.Error(t, err)
+	assert.Equal(t, uint64(1), broker.LastID())
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"sensor-api/internal/quadtree"
+
+	"github.com/tidwall/rtree"
+)
+
+// SpatialIndex stores sensor names by location and answers box and nearest neighbour queries.
+// Points are [latitude, longitude] pairs. Implementations need not be safe for concurrent use;
+// InMemorySensorStore guards its index with its own mutex.
+type SpatialIndex interface {
+	// Insert adds a sensor at the given point.
+	Insert(point [2]float64, name string)
+	// Delete removes a sensor from the given point.
+	Delete(point [2]float64, name string)
+	// Replace moves a sensor to a new point and name. Nothing is inserted if the old sensor does not exist.
+	Replace(oldPoint [2]float64, oldName string, newPoint [2]float64, newName string)
+	// Search calls iter for every sensor inside the box until iter returns false.
+	Search(min, max [2]float64, iter func(point [2]float64, name string) bool)
+	// Nearby calls iter for every sensor in increasing order of distance until iter returns false.
+	// dist must return a lower bound of the distance to anything inside a box when item is false.
+	Nearby(dist func(min, max [2]float64, name string, item bool) float64, iter func(point [2]float64, name string, dist float64) bool)
+	// Len returns the number of sensors in the index.
+	Len() int
+	// Bounds returns the minimum bounding rectangle of every sensor in the index.
+	Bounds() (min, max [2]float64)
+}
+
+// NewRTreeIndex creates a SpatialIndex backed by an R-tree.
+func NewRTreeIndex() SpatialIndex {
+	return &rtreeIndex{}
+}
+
+// NewQuadtreeIndex creates a SpatialIndex backed by a point quadtree.
+func NewQuadtreeIndex() SpatialIndex {
+	return quadtree.New()
+}
+
+// rtreeIndex adapts UC Berkeley's RTree implementation to SpatialIndex.
+type rtreeIndex struct {
+	tr rtree.RTreeGN[float64, string]
+}
+
+func (index *rtreeIndex) Insert(point [2]float64, name string) {
+	index.tr.Insert(point, point, name)
+}
+
+func (index *rtreeIndex) Delete(point [2]float64, name string) {
+	index.tr.Delete(point, point, name)
+}
+
+func (index *rtreeIndex) Replace(oldPoint [2]float64, oldName string, newPoint [2]float64, newName string) {
+	index.tr.Replace(oldPoint, oldPoint, oldName, newPoint, newPoint, newName)
+}
+
+func (index *rtreeIndex) Search(min, max [2]float64, iter func(point [2]float64, name string) bool) {
+	index.tr.Search(min, max, func(min, max [2]float64, data string) bool {
+		return iter(min, data)
+	})
+}
+
+func (index *rtreeIndex) Nearby(
+	dist func(min, max [2]float64, name string, item bool) float64,
+	iter func(point [2]float64, name string, dist float64) bool,
+) {
+	index.tr.Nearby(dist, func(min, max [2]float64, data string, dist float64) bool {
+		return iter(min, data, dist)
+	})
+}
+
+func (index *rtreeIndex) Len() int {
+	return index.tr.Len()
+}
+
+func (index *rtreeIndex) Bounds() (min, max [2]float64) {
+	return index.tr.Bounds()
+}
@@ -0,0 +1,272 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/model"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// spatialIndexes lists every SpatialIndex implementation run through the shared conformance suite.
+var spatialIndexes = map[string]func() SpatialIndex{
+	"RTree":    NewRTreeIndex,
+	"Quadtree": NewQuadtreeIndex,
+}
+
+func TestSpatialIndex(t *testing.T) {
+	for name, newIndex := range spatialIndexes {
+		t.Run(name, func(t *testing.T) {
+			testSpatialIndex(t, newIndex)
+		})
+	}
+}
+
+func testSpatialIndex(t *testing.T, newIndex func() SpatialIndex) {
+	t.Run("Insert and delete", func(t *testing.T) {
+		index := newIndex()
+		assert.Equal(t, 0, index.Len())
+
+		index.Insert([2]float64{37.7749, -122.4194}, "Sensor1")
+		index.Insert([2]float64{39.0921, -123.5222}, "Sensor2")
+		// two sensors may share a location
+		index.Insert([2]float64{37.7749, -122.4194}, "Sensor3")
+		assert.Equal(t, 3, index.Len())
+
+		min, max := index.Bounds()
+		assert.Equal(t, [2]float64{37.7749, -123.5222}, min)
+		assert.Equal(t, [2]float64{39.0921, -122.4194}, max)
+
+		// deleting a sensor that isn't at the given point does nothing
+		index.Delete([2]float64{39.0921, -123.5222}, "Sensor1")
+		assert.Equal(t, 3, index.Len())
+
+		index.Delete([2]float64{37.7749, -122.4194}, "Sensor1")
+		assert.Equal(t, 2, index.Len())
+		assert.Equal(t, []string{"Sensor3"}, searchNames(index, [2]float64{37, -123}, [2]float64{38, -122}))
+
+		index.Delete([2]float64{37.7749, -122.4194}, "Sensor3")
+		index.Delete([2]float64{39.0921, -123.5222}, "Sensor2")
+		assert.Equal(t, 0, index.Len())
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		index := newIndex()
+		index.Insert([2]float64{37.7749, -122.4194}, "Sensor1")
+
+		index.Replace([2]float64{37.7749, -122.4194}, "Sensor1", [2]float64{37.7833, -122.4167}, "Sensor2")
+		assert.Equal(t, 1, index.Len())
+		min, _ := index.Bounds()
+		assert.Equal(t, [2]float64{37.7833, -122.4167}, min)
+		assert.Equal(t, []string{"Sensor2"}, searchNames(index, [2]float64{-90, -180}, [2]float64{90, 180}))
+
+		// replacing a sensor that doesn't exist inserts nothing
+		index.Replace([2]float64{37.7749, -122.4194}, "Sensor1", [2]float64{10, 10}, "Sensor3")
+		assert.Equal(t, 1, index.Len())
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		index := newIndex()
+		index.Insert([2]float64{37.7749, -122.4194}, "Sensor1")
+		index.Insert([2]float64{37.7833, -122.4167}, "Sensor2")
+		index.Insert([2]float64{39.0921, -123.5222}, "Sensor3")
+
+		assert.Equal(t, []string{"Sensor1", "Sensor2"}, searchNames(index, [2]float64{37.7, -122.5}, [2]float64{37.8, -122.3}))
+		// edges are included
+		assert.Equal(t, []string{"Sensor3"}, searchNames(index, [2]float64{39.0921, -123.5222}, [2]float64{39.0921, -123.5222}))
+		assert.Empty(t, searchNames(index, [2]float64{10, 10}, [2]float64{20, 20}))
+
+		// returning false stops the search
+		count := 0
+		index.Search([2]float64{-90, -180}, [2]float64{90, 180}, func(point [2]float64, name string) bool {
+			count++
+			return false
+		})
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("Nearby", func(t *testing.T) {
+		index := newIndex()
+		assert.NotPanics(t, func() {
+			index.Nearby(pointDist([2]float64{0, 0}), func(point [2]float64, name string, dist float64) bool {
+				return true
+			})
+		})
+
+		for i := 0; i < 20; i++ {
+			index.Insert([2]float64{39, -110 - float64(i)*.9}, fmt.Sprintf("Sensor%d", i))
+		}
+
+		var names []string
+		var dists []float64
+		index.Nearby(pointDist([2]float64{39.0920, -123.5221}), func(point [2]float64, name string, dist float64) bool {
+			names = append(names, name)
+			dists = append(dists, dist)
+			return len(names) < 3
+		})
+		assert.Equal(t, []string{"Sensor15", "Sensor16", "Sensor14"}, names)
+		assert.True(t, sort.Float64sAreSorted(dists))
+	})
+
+	t.Run("Randomized", func(t *testing.T) {
+		// apply random inserts, moves and deletes to the index and a plain map, then compare their answers
+		index := newIndex()
+		reference := map[string][2]float64{}
+		rng := rand.New(rand.NewSource(1))
+		randomPoint := func() [2]float64 {
+			// round so that some sensors share locations
+			return [2]float64{float64(rng.Intn(180) - 90), float64(rng.Intn(360) - 180)}
+		}
+
+		for i := 0; i < 2000; i++ {
+			name := fmt.Sprintf("Sensor%d", rng.Intn(300))
+			point, exists := reference[name]
+			switch {
+			case !exists:
+				point = randomPoint()
+				index.Insert(point, name)
+				reference[name] = point
+			case rng.Intn(2) == 0:
+				newPoint := randomPoint()
+				index.Replace(point, name, newPoint, name)
+				reference[name] = newPoint
+			default:
+				index.Delete(point, name)
+				delete(reference, name)
+			}
+		}
+		assert.Equal(t, len(reference), index.Len())
+
+		for i := 0; i < 20; i++ {
+			a, b := randomPoint(), randomPoint()
+			min := [2]float64{minFloat(a[0], b[0]), minFloat(a[1], b[1])}
+			max := [2]float64{maxFloat(a[0], b[0]), maxFloat(a[1], b[1])}
+
+			var expected []string
+			for name, point := range reference {
+				if point[0] >= min[0] && point[0] <= max[0] && point[1] >= min[1] && point[1] <= max[1] {
+					expected = append(expected, name)
+				}
+			}
+			sort.Strings(expected)
+			assert.Equal(t, expected, searchNames(index, min, max))
+
+			target := randomPoint()
+			var nearest []float64
+			index.Nearby(pointDist(target), func(point [2]float64, name string, dist float64) bool {
+				assert.Equal(t, reference[name], point)
+				nearest = append(nearest, dist)
+				return true
+			})
+			assert.Len(t, nearest, len(reference))
+			assert.True(t, sort.Float64sAreSorted(nearest))
+		}
+	})
+}
+
+// pointDist ranks boxes by their great-circle distance from target.
+func pointDist(target [2]float64) func(min, max [2]float64, name string, item bool) float64 {
+	return func(min, max [2]float64, name string, item bool) float64 {
+		return geo.BoxDistance(target[0], target[1], min[0], min[1], max[0], max[1])
+	}
+}
+
+func searchNames(index SpatialIndex, min, max [2]float64) []string {
+	var names []string
+	index.Search(min, max, func(point [2]float64, name string) bool {
+		names = append(names, name)
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func TestInMemoryStoreSpatialIndexes(t *testing.T) {
+	// the store answers the same whichever index it is built on
+	for name, newIndex := range spatialIndexes {
+		t.Run(name, func(t *testing.T) {
+			store := NewInMemorySensorStore(WithSpatialIndex(newIndex()))
+			for i := 0; i < 20; i++ {
+				sensor := model.Sensor{
+					Name:     fmt.Sprintf("Sensor%d", i),
+					Location: model.Location{Latitude: 39, Longitude: -110 + float64(i)*.9*-1},
+				}
+				_, err := store.AddSensor(sensor)
+				assert.NoError(t, err)
+			}
+
+			nearest, _, err := store.GetNearestSensors(model.Location{Latitude: 39.0920, Longitude: -123.5221}, 3, 0, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, "Sensor15", nearest[0].Name)
+			assert.Equal(t, "Sensor16", nearest[1].Name)
+			assert.Equal(t, "Sensor14", nearest[2].Name)
+
+			within, _, err := store.GetSensorsWithinBoundingBox(38, -112, 40, -110)
+			assert.NoError(t, err)
+			assert.Len(t, within, 3)
+
+			_, err = store.UpdateSensor("Sensor0", &model.Sensor{Name: "Moved", Location: model.Location{Latitude: 10, Longitude: 10}})
+			assert.NoError(t, err)
+			_, err = store.RemoveSensor("Sensor1")
+			assert.NoError(t, err)
+			assert.Equal(t, 19, store.index.Len())
+
+			within, _, err = store.GetSensorsWithinBoundingBox(38, -112, 40, -110)
+			assert.NoError(t, err)
+			assert.Len(t, within, 1)
+		})
+	}
+}
+
+func BenchmarkSpatialIndex(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	points := make([][2]float64, 100000)
+	for i := range points {
+		points[i] = [2]float64{rng.Float64()*180 - 90, rng.Float64()*360 - 180}
+	}
+
+	for name, newIndex := range spatialIndexes {
+		index := newIndex()
+		b.Run(name+"/Insert", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				index.Insert(points[i%len(points)], fmt.Sprint(i))
+			}
+		})
+
+		b.Run(name+"/Search", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				point := points[i%len(points)]
+				index.Search(point, [2]float64{point[0] + 1, point[1] + 1}, func(point [2]float64, name string) bool {
+					return true
+				})
+			}
+		})
+
+		b.Run(name+"/Nearby", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				count := 0
+				index.Nearby(pointDist(points[i%len(points)]), func(point [2]float64, name string, dist float64) bool {
+					count++
+					return count < 10
+				})
+			}
+		})
+	}
+}
@@ -4,29 +4,120 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"sensor-api/internal/events"
+	"sensor-api/internal/geo"
 	"sensor-api/internal/model"
+	"sensor-api/internal/query"
+	"sensor-api/internal/tagexpr"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"unicode"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/tidwall/rtree"
 )
 
 // InMemorySensorStore is an in-memory implementation of SensorStore.
 type InMemorySensorStore struct {
+	*inMemoryState
+	// logger logs the store's failures, scoped to a request by WithLogger
+	logger *log.Entry
+}
+
+// inMemoryState is the data of an InMemorySensorStore, shared by the views WithLogger returns.
+type inMemoryState struct {
 	mu      sync.Mutex
 	sensors map[string]model.Sensor
 	// mapping of tag name to sensor names
 	tags map[string]map[string]struct{}
-	// UC Berkeley's RTree implementation
-	rt *rtree.RTreeGN[float64, string]
+	// spatial index of sensor locations, an R-tree unless configured otherwise
+	index SpatialIndex
+	// distance between two points in meters, used to rank and filter spatial queries
+	distance geo.DistanceFunc
+	// time-series readings of each sensor, locked after mu when both are held
+	readings *InMemoryReadingStore
+	// version of each sensor, set from revision whenever the sensor changes
+	versions map[string]uint64
+	// revision counts the changes made to sensors
+	revision uint64
+	// sink receives each change made to sensors, if set
+	sink EventSink
+	// logChange, if set, is called with each change once it has been checked and before it is made, with
+	// mu held. If it fails the change is not made. The file store sets it to append the change to its
+	// write-ahead log, so a change is never seen before it is durable.
+	logChange func(logger *log.Entry, record walRecord) (int, error)
+}
+
+// Option configures an InMemorySensorStore.
+type Option func(*InMemorySensorStore)
+
+// WithDistanceFunc sets the function used to measure distances between sensors and queried locations.
+// The default is geo.HaversineDistance; geo.VincentyDistance is more accurate over long distances.
+func WithDistanceFunc(distance geo.DistanceFunc) Option {
+	return func(store *InMemorySensorStore) {
+		store.distance = distance
+	}
+}
+
+// WithSpatialIndex sets the index used to store sensor locations, such as NewRTreeIndex or NewQuadtreeIndex.
+// The index must be empty.
+func WithSpatialIndex(index SpatialIndex) Option {
+	return func(store *InMemorySensorStore) {
+		store.index = index
+	}
 }
 
 // NewInMemorySensorStore creates a new InMemorySensorStore.
-func NewInMemorySensorStore() *InMemorySensorStore {
-	return &InMemorySensorStore{
-		sensors: make(map[string]model.Sensor),
-		rt:      &rtree.RTreeGN[float64, string]{},
-		tags:    make(map[string]map[string]struct{}),
+func NewInMemorySensorStore(opts ...Option) *InMemorySensorStore {
+	store := &InMemorySensorStore{
+		inMemoryState: &inMemoryState{
+			sensors:  make(map[string]model.Sensor),
+			index:    NewRTreeIndex(),
+			tags:     make(map[string]map[string]struct{}),
+			distance: geo.HaversineDistance,
+			readings: NewInMemoryReadingStore(),
+			versions: make(map[string]uint64),
+		},
+		logger: log.NewEntry(log.StandardLogger()),
+	}
+	for _, opt := range opts {
+		opt(store)
+	}
+	return store
+}
+
+// WithLogger returns a view of the store sharing its data, which logs with logger.
+func (store *InMemorySensorStore) WithLogger(logger *log.Entry) SensorStore {
+	return store.withLogger(logger)
+}
+
+func (store *InMemorySensorStore) withLogger(logger *log.Entry) *InMemorySensorStore {
+	return &InMemorySensorStore{inMemoryState: store.inMemoryState, logger: logger}
+}
+
+// SetEventSink sets the sink changes to sensors are published to.
+func (store *InMemorySensorStore) SetEventSink(sink EventSink) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.sink = sink
+}
+
+// log passes a checked change to logChange, if set.
+func (store *InMemorySensorStore) log(record walRecord) (int, error) {
+	if store.logChange == nil {
+		return http.StatusOK, nil
+	}
+	return store.logChange(store.logger, record)
+}
+
+// publish sends an event to the sink, if there is one. The caller must hold store.mu, so events are
+// published in the order the changes were made, and must have made the change, so an event is never
+// published for a change logChange refused.
+func (store *InMemorySensorStore) publish(event events.Event) {
+	if store.sink != nil {
+		store.sink.Publish(event)
 	}
 }
 
@@ -35,23 +126,97 @@ func (store *InMemorySensorStore) AddSensor(sensor model.Sensor) (int, error) {
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
+	return store.addSensor(sensor)
+}
+
+// AddSensors adds a batch of sensors to the store.
+func (store *InMemorySensorStore) AddSensors(sensors []model.Sensor, atomic bool) ([]AddResult, int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// check every sensor can be added, including after the ones before it, before adding any
+	results := make([]AddResult, len(sensors))
+	names := make(map[string]struct{}, len(sensors))
+	var added []model.Sensor
+	for i, sensor := range sensors {
+		code, err := store.checkAdd(sensor)
+		if _, exists := names[sensor.Name]; exists && err == nil {
+			store.logger.Error("Sensor already exists: ", sensor.Name)
+			code, err = http.StatusBadRequest, fmt.Errorf("sensor already exists")
+		}
+		if err == nil {
+			names[sensor.Name] = struct{}{}
+			added = append(added, sensor)
+		}
+		results[i] = AddResult{Code: code, Err: err}
+	}
+	if atomic {
+		if err := failBatch(store.logger, results); err != nil {
+			return results, http.StatusBadRequest, err
+		}
+	}
+	if len(added) == 0 {
+		return results, http.StatusOK, nil
+	}
+
+	// the sensors added are logged as one change, so that after a crash either all of them or none are
+	// restored
+	if code, err := store.log(walRecord{Op: opAddSensors, Sensors: added}); err != nil {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i] = AddResult{Code: code, Err: err}
+			}
+		}
+		return results, code, err
+	}
+	for _, sensor := range added {
+		store.insertSensor(sensor)
+	}
+	return results, http.StatusOK, nil
+}
+
+// checkAdd checks a sensor can be added to the store.
+func (store *InMemorySensorStore) checkAdd(sensor model.Sensor) (int, error) {
+	if code, err := checkText(store.logger, sensor); err != nil {
+		return code, err
+	}
 	if !sensor.Location.IsValid() {
-		log.Error("Invalid location: ", sensor.Location)
+		store.logger.Error("Invalid location: ", sensor.Location)
 		return http.StatusBadRequest, fmt.Errorf("invalid location")
 	}
 
 	_, exists := store.sensors[sensor.Name]
 	if exists {
-		log.Error("Sensor already exists: ", sensor.Name)
+		store.logger.Error("Sensor already exists: ", sensor.Name)
 		return http.StatusBadRequest, fmt.Errorf("sensor already exists")
 	}
 
+	return http.StatusCreated, nil
+}
+
+// addSensor adds a sensor to the store, which must be locked.
+func (store *InMemorySensorStore) addSensor(sensor model.Sensor) (int, error) {
+	if code, err := store.checkAdd(sensor); err != nil {
+		return code, err
+	}
+	if code, err := store.log(walRecord{Op: opAddSensor, Sensor: &sensor}); err != nil {
+		return code, err
+	}
+
+	store.insertSensor(sensor)
+	return http.StatusCreated, nil
+}
+
+// insertSensor adds a checked sensor to the store, which must be locked.
+func (store *InMemorySensorStore) insertSensor(sensor model.Sensor) {
 	// add sensor to store
 	store.sensors[sensor.Name] = sensor
+	store.revision++
+	store.versions[sensor.Name] = store.revision
 
-	// insert the sensor into the rtree
+	// insert the sensor into the spatial index
 	point := [2]float64{sensor.Location.Latitude, sensor.Location.Longitude}
-	store.rt.Insert(point, point, sensor.Name)
+	store.index.Insert(point, sensor.Name)
 
 	// add sensor name to tags
 	for _, tag := range sensor.Tags {
@@ -61,7 +226,7 @@ func (store *InMemorySensorStore) AddSensor(sensor model.Sensor) (int, error) {
 		store.tags[tag][sensor.Name] = struct{}{}
 	}
 
-	return http.StatusCreated, nil
+	store.publish(events.Created(sensor))
 }
 
 // GetSensor returns a sensor from the store.
@@ -71,13 +236,27 @@ func (store *InMemorySensorStore) GetSensor(name string) (model.Sensor, int, err
 
 	sensor, ok := store.sensors[name]
 	if !ok {
-		log.Error("Sensor not found: ", name)
+		store.logger.Error("Sensor not found: ", name)
 		return model.Sensor{}, http.StatusNotFound, fmt.Errorf("sensor not found")
 	}
 
 	return sensor, http.StatusOK, nil
 }
 
+// GetSensorVersion returns a sensor from the store and its version.
+func (store *InMemorySensorStore) GetSensorVersion(name string) (model.Sensor, uint64, int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	sensor, ok := store.sensors[name]
+	if !ok {
+		store.logger.Error("Sensor not found: ", name)
+		return model.Sensor{}, 0, http.StatusNotFound, fmt.Errorf("sensor not found")
+	}
+
+	return sensor, store.versions[name], http.StatusOK, nil
+}
+
 // GetSensors returns all sensors in the store.
 func (store *InMemorySensorStore) GetSensors() ([]model.Sensor, int, error) {
 	return store.GetSensorsByTags(nil)
@@ -88,10 +267,10 @@ func (store *InMemorySensorStore) GetSensorsByTags(tags []string) ([]model.Senso
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
-	log.Debug("Getting sensors by tags: ", tags)
+	store.logger.Debug("Getting sensors by tags: ", tags)
 
 	if len(store.sensors) == 0 {
-		log.Error("No sensors in store")
+		store.logger.Error("No sensors in store")
 		return nil, http.StatusNotFound, fmt.Errorf("no sensors in store")
 	}
 
@@ -108,7 +287,7 @@ func (store *InMemorySensorStore) GetSensorsByTags(tags []string) ([]model.Senso
 		for _, sensor := range store.sensors {
 			sensors = append(sensors, sensor)
 		}
-		log.Debug("Returning all sensors", sensors)
+		store.logger.Debug("Returning all sensors", sensors)
 		return sensors, http.StatusOK, nil
 	}
 
@@ -143,43 +322,106 @@ func (store *InMemorySensorStore) GetSensorsByTags(tags []string) ([]model.Senso
 	return sensors, http.StatusOK, nil
 }
 
-// UpdateSensor updates a sensor in the store.
-func (store *InMemorySensorStore) UpdateSensor(name string, updatedSensor *model.Sensor) (int, error) {
+// GetSensorsByTagExpr returns all sensors matching the tag expression, evaluated against the tag index.
+// A nil expression returns all sensors.
+func (store *InMemorySensorStore) GetSensorsByTagExpr(filter tagexpr.Expr) ([]model.Sensor, int, error) {
+	if filter == nil {
+		return store.GetSensorsByTags(nil)
+	}
+
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
-	if updatedSensor == nil {
-		log.Error("Sensor is nil")
-		return http.StatusBadRequest, fmt.Errorf("sensor is nil")
+	store.logger.Debug("Getting sensors by tag expression: ", filter)
+
+	if len(store.sensors) == 0 {
+		store.logger.Error("No sensors in store")
+		return nil, http.StatusNotFound, fmt.Errorf("no sensors in store")
 	}
 
-	if updatedSensor.Name == "" {
-		log.Error("Sensor name is empty")
-		return http.StatusBadRequest, fmt.Errorf("sensor name is empty")
+	names := filter.Eval(tagIndex{store})
+	sensors := make([]model.Sensor, 0, len(names))
+	for name := range names {
+		sensors = append(sensors, store.sensors[name])
 	}
 
-	if !updatedSensor.Location.IsValid() {
-		log.Error("Invalid location: ", updatedSensor.Location)
-		return http.StatusBadRequest, fmt.Errorf("invalid location")
+	return sensors, http.StatusOK, nil
+}
+
+// UpdateSensor updates a sensor in the store. A sensor cannot be renamed to the name of another.
+func (store *InMemorySensorStore) UpdateSensor(name string, updatedSensor *model.Sensor) (int, error) {
+	return store.UpdateSensorIfMatch(name, updatedSensor, 0)
+}
+
+// UpdateSensorIfMatch updates a sensor in the store if its version matches.
+func (store *InMemorySensorStore) UpdateSensorIfMatch(name string, updatedSensor *model.Sensor, version uint64) (int, error) {
+	if updatedSensor == nil {
+		store.logger.Error("Sensor is nil")
+		return http.StatusBadRequest, fmt.Errorf("sensor is nil")
+	}
+	if code, err := checkUpdate(store.logger, *updatedSensor); err != nil {
+		return code, err
 	}
 
+	return store.PatchSensor(name, func(model.Sensor) (model.Sensor, error) { return *updatedSensor, nil }, version)
+}
+
+// PatchSensor replaces a sensor in the store with the result of patch, if its version matches.
+func (store *InMemorySensorStore) PatchSensor(name string, patch Patch, version uint64) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
 	sensor, ok := store.sensors[name]
 	if !ok {
-		log.Error("Sensor not found: ", name)
+		store.logger.Error("Sensor not found: ", name)
 		return http.StatusNotFound, fmt.Errorf("sensor not found")
 	}
 
-	// if the name changed, update the sensor name in the rtree
+	if version != 0 && store.versions[name] != version {
+		store.logger.Error("Sensor version mismatch: ", name, " is at ", store.versions[name], ", not ", version)
+		return http.StatusPreconditionFailed, fmt.Errorf("sensor has been modified")
+	}
+
+	// the patch gets its own copy of the tags, so it cannot change the stored sensor
+	current := sensor
+	current.Tags = append([]string(nil), sensor.Tags...)
+	patched, err := patch(current)
+	if err != nil {
+		store.logger.Error("Failed to patch sensor: ", err)
+		return http.StatusConflict, err
+	}
+	updatedSensor := &patched
+	if code, err := checkUpdate(store.logger, patched); err != nil {
+		return code, err
+	}
+
+	if _, exists := store.sensors[updatedSensor.Name]; exists && updatedSensor.Name != name {
+		store.logger.Error("Sensor already exists: ", updatedSensor.Name)
+		return http.StatusBadRequest, fmt.Errorf("sensor already exists")
+	}
+	// the patched sensor is logged as an update, so replaying the log does not need the patch
+	if code, err := store.log(walRecord{Op: opUpdateSensor, Name: name, Sensor: updatedSensor, Version: version}); err != nil {
+		return code, err
+	}
+
+	// if the name changed, update the sensor name in the spatial index
 	oldPoint := [2]float64{sensor.Location.Latitude, sensor.Location.Longitude}
 	newPoint := [2]float64{updatedSensor.Location.Latitude, updatedSensor.Location.Longitude}
 	if oldPoint != newPoint || sensor.Name != updatedSensor.Name {
-		// only update the rtree if name or location data has been updated
-		store.rt.Replace(oldPoint, oldPoint, sensor.Name, newPoint, newPoint, updatedSensor.Name)
+		// only update the spatial index if name or location data has been updated
+		store.index.Replace(oldPoint, sensor.Name, newPoint, updatedSensor.Name)
+	}
+	// carry the readings over to the new name
+	if sensor.Name != updatedSensor.Name {
+		store.readings.rename(sensor.Name, updatedSensor.Name)
 	}
 	// remove old sensor from store
 	delete(store.sensors, sensor.Name)
+	delete(store.versions, sensor.Name)
 	// add updated sensor to store
 	store.sensors[updatedSensor.Name] = *updatedSensor
+	store.revision++
+	store.versions[updatedSensor.Name] = store.revision
 
 	// update sensor name in tags
 	for _, tag := range sensor.Tags {
@@ -195,23 +437,99 @@ func (store *InMemorySensorStore) UpdateSensor(name string, updatedSensor *model
 		store.tags[tag][updatedSensor.Name] = struct{}{}
 	}
 
+	store.publish(events.Updated(sensor, *updatedSensor))
 	return http.StatusNoContent, nil
 }
 
+// failBatch fails every sensor of an atomic batch if any has failed, returning the batch's error.
+func failBatch(logger *log.Entry, results []AddResult) error {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+
+	for i, result := range results {
+		if result.Err == nil {
+			results[i] = AddResult{Code: http.StatusFailedDependency, Err: fmt.Errorf("sensor not added: another sensor in the batch failed")}
+		}
+	}
+	logger.Error("Failed to add batch: ", failed, " of ", len(results), " sensors cannot be added")
+	return fmt.Errorf("%d of %d sensors cannot be added", failed, len(results))
+}
+
+// checkUpdate checks the sensor replacing a stored one has a name and a valid location.
+func checkUpdate(logger *log.Entry, sensor model.Sensor) (int, error) {
+	if sensor.Name == "" {
+		logger.Error("Sensor name is empty")
+		return http.StatusBadRequest, fmt.Errorf("sensor name is empty")
+	}
+	if code, err := checkText(logger, sensor); err != nil {
+		return code, err
+	}
+
+	if !sensor.Location.IsValid() {
+		logger.Error("Invalid location: ", sensor.Location)
+		return http.StatusBadRequest, fmt.Errorf("invalid location")
+	}
+
+	return http.StatusOK, nil
+}
+
+// checkText checks a sensor's name and tags have no control characters, so that every store can hold
+// them: the bolt store separates them with NUL bytes in its index keys.
+func checkText(logger *log.Entry, sensor model.Sensor) (int, error) {
+	if hasControl(sensor.Name) {
+		logger.Error("Invalid sensor name: ", strconv.Quote(sensor.Name))
+		return http.StatusBadRequest, fmt.Errorf("sensor name has control characters")
+	}
+	for _, tag := range sensor.Tags {
+		if hasControl(tag) {
+			logger.Error("Invalid tag: ", strconv.Quote(tag))
+			return http.StatusBadRequest, fmt.Errorf("tag has control characters")
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// hasControl reports whether s has a control character.
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
 // RemoveSensor removes a sensor from the store.
 func (store *InMemorySensorStore) RemoveSensor(name string) (int, error) {
+	return store.RemoveSensorIfMatch(name, 0)
+}
+
+// RemoveSensorIfMatch removes a sensor from the store if its version matches.
+func (store *InMemorySensorStore) RemoveSensorIfMatch(name string, version uint64) (int, error) {
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
 	sensor, ok := store.sensors[name]
 	if !ok {
-		log.Error("Sensor not found: ", name)
+		store.logger.Error("Sensor not found: ", name)
 		return http.StatusNotFound, fmt.Errorf("sensor not found")
 	}
 
+	if version != 0 && store.versions[name] != version {
+		store.logger.Error("Sensor version mismatch: ", name, " is at ", store.versions[name], ", not ", version)
+		return http.StatusPreconditionFailed, fmt.Errorf("sensor has been modified")
+	}
+	if code, err := store.log(walRecord{Op: opRemoveSensor, Name: name, Version: version}); err != nil {
+		return code, err
+	}
+
 	point := [2]float64{sensor.Location.Latitude, sensor.Location.Longitude}
-	store.rt.Delete(point, point, sensor.Name)
+	store.index.Delete(point, sensor.Name)
 	delete(store.sensors, name)
+	delete(store.versions, name)
+	store.readings.drop(name)
 
 	// remove sensor name from tags
 	for _, tag := range sensor.Tags {
@@ -222,6 +540,7 @@ func (store *InMemorySensorStore) RemoveSensor(name string) (int, error) {
 		}
 	}
 
+	store.publish(events.Deleted(sensor))
 	return http.StatusNoContent, nil
 }
 
@@ -232,59 +551,336 @@ func (store *InMemorySensorStore) GetNearestSensor(location model.Location) (*mo
 
 // GetNearestSensorByTag returns the nearest sensor to the given location with the given set of tags.
 func (store *InMemorySensorStore) GetNearestSensorByTag(location model.Location, tags []string) (*model.Sensor, int, error) {
-	log.Debug("Getting nearest sensor by tag: ", tags)
-	if !location.IsValid() {
-		log.Error("Invalid location: ", location)
-		return nil, http.StatusBadRequest, fmt.Errorf("invalid location")
-	}
-	if len(store.sensors) == 0 {
-		log.Error("No sensors in store")
-		return nil, http.StatusNotFound, fmt.Errorf("no sensors in store")
-	}
-
-	sensors, code, err := store.GetSensorsByTags(tags)
+	store.logger.Debug("Getting nearest sensor by tag: ", tags)
+	sensors, code, err := store.GetNearestSensors(location, 1, 0, tagexpr.AllOf(tags))
 	if err != nil {
 		return nil, code, err
 	}
 	if len(sensors) == 0 {
-		log.Error("No sensors with given tag(s)")
+		store.logger.Error("No sensors with given tag(s)")
 		return nil, http.StatusNotFound, fmt.Errorf("no sensors with given tag(s)")
 	}
 
+	return &sensors[0].Sensor, http.StatusOK, nil
+}
+
+// GetNearestSensors returns up to k sensors matching the tag filter closest to the given location, closest first.
+// A positive maxDistance excludes sensors more than maxDistance meters away.
+func (store *InMemorySensorStore) GetNearestSensors(location model.Location, k int, maxDistance float64, filter tagexpr.Expr) ([]model.SensorDistance, int, error) {
 	store.mu.Lock()
 	defer store.mu.Unlock()
-	// make a mapping of sensor name to sensor
-	sensorMap := make(map[string]model.Sensor)
-	for _, sensor := range sensors {
-		sensorMap[sensor.Name] = sensor
+
+	store.logger.Debug("Getting nearest sensors: ", location, k, maxDistance, filter)
+
+	if !location.IsValid() {
+		store.logger.Error("Invalid location: ", location)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid location")
+	}
+	if k <= 0 {
+		store.logger.Error("Invalid number of sensors: ", k)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid number of sensors")
+	}
+	if maxDistance < 0 || math.IsNaN(maxDistance) {
+		store.logger.Error("Invalid max distance: ", maxDistance)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid max distance")
+	}
+	if len(store.sensors) == 0 {
+		store.logger.Error("No sensors in store")
+		return nil, http.StatusNotFound, fmt.Errorf("no sensors in store")
 	}
 
-	var (
-		closestSensor   *model.Sensor
-		closestDistance float64 = math.MaxFloat64
+	sensors := []model.SensorDistance{}
+	store.logger.Debug("Starting location: ", location)
+	store.index.Nearby(
+		store.geodesicDist(location),
+		func(point [2]float64, data string, distance float64) bool {
+			// items arrive closest first, so nothing further away can be within range
+			if maxDistance > 0 && distance > maxDistance {
+				return false
+			}
+			if !store.matches(data, filter) {
+				return true
+			}
+			store.logger.Debug("Nearby Sensor: ", data, point, distance)
+			sensors = append(sensors, model.SensorDistance{
+				Sensor:   store.sensors[data],
+				Distance: distance,
+				Bearing:  geo.InitialBearing(location.Latitude, location.Longitude, point[0], point[1]),
+			})
+			// stop walking the tree once k matches are found
+			return len(sensors) < k
+		},
 	)
 
-	point := [2]float64{location.Latitude, location.Longitude}
-	log.Debug("Starting location: ", point)
-	store.rt.Nearby(
-		/* func(min, max [2]float64, data string, item bool) float64 {
-			return haversineDistance(min[1], min[0], point[1], point[0])
-		}, */
-		rtree.BoxDist[float64, string](point, point, nil),
-		func(min, max [2]float64, data string, dist float64) bool {
-			if sensor, ok := sensorMap[data]; ok {
-				log.Debug("Nearby Sensor: ", data, sensor.Location, dist)
-				if closestSensor == nil || dist < closestDistance {
-					closestSensor = &sensor
-					closestDistance = dist
-				}
-			}
+	sortByDistance(sensors)
+
+	return sensors, http.StatusOK, nil
+}
+
+// GetSensorsWithinBoundingBox returns all sensors located inside the given bounding box.
+func (store *InMemorySensorStore) GetSensorsWithinBoundingBox(minLat, minLong, maxLat, maxLong float64) ([]model.Sensor, int, error) {
+	return store.GetSensorsByTagWithinBoundingBox(nil, minLat, minLong, maxLat, maxLong)
+}
+
+// GetSensorsByTagWithinBoundingBox returns all sensors located inside the given bounding box that match the tag filter.
+func (store *InMemorySensorStore) GetSensorsByTagWithinBoundingBox(filter tagexpr.Expr, minLat, minLong, maxLat, maxLong float64) ([]model.Sensor, int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.logger.Debug("Getting sensors within bounding box: ", minLat, minLong, maxLat, maxLong, filter)
+
+	box := model.BoundingBox{
+		Min: model.Location{Latitude: minLat, Longitude: minLong},
+		Max: model.Location{Latitude: maxLat, Longitude: maxLong},
+	}
+	if !box.IsValid() {
+		store.logger.Error("Invalid bounding box: ", box)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid bounding box")
+	}
+
+	if len(store.sensors) == 0 {
+		store.logger.Error("No sensors in store")
+		return nil, http.StatusNotFound, fmt.Errorf("no sensors in store")
+	}
 
+	sensors := []model.Sensor{}
+	store.index.Search(
+		[2]float64{minLat, minLong},
+		[2]float64{maxLat, maxLong},
+		func(point [2]float64, data string) bool {
+			if store.matches(data, filter) {
+				sensors = append(sensors, store.sensors[data])
+			}
 			return true
 		},
 	)
 
-	return closestSensor, http.StatusOK, nil
+	return sensors, http.StatusOK, nil
+}
+
+// GetSensorsWithinRadius returns all sensors within radius meters of the given location, closest first.
+func (store *InMemorySensorStore) GetSensorsWithinRadius(location model.Location, radius float64) ([]model.SensorDistance, int, error) {
+	return store.GetSensorsByTagWithinRadius(nil, location, radius)
+}
+
+// GetSensorsByTagWithinRadius returns all sensors within radius meters of the given location that match the tag filter, closest first.
+func (store *InMemorySensorStore) GetSensorsByTagWithinRadius(filter tagexpr.Expr, location model.Location, radius float64) ([]model.SensorDistance, int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.logger.Debug("Getting sensors within radius: ", location, radius, filter)
+
+	if !location.IsValid() {
+		store.logger.Error("Invalid location: ", location)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid location")
+	}
+	if radius <= 0 || math.IsInf(radius, 0) || math.IsNaN(radius) {
+		store.logger.Error("Invalid radius: ", radius)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid radius")
+	}
+
+	if len(store.sensors) == 0 {
+		store.logger.Error("No sensors in store")
+		return nil, http.StatusNotFound, fmt.Errorf("no sensors in store")
+	}
+
+	// prune to the boxes enclosing the circle, then filter by great-circle distance. The boxes are
+	// widened so that they still enclose the circle when distances are measured on the ellipsoid.
+	sensors := []model.SensorDistance{}
+	for _, box := range geo.CircleBounds(location, radius/geo.EllipsoidLowerBound) {
+		store.index.Search(
+			[2]float64{box.Min.Latitude, box.Min.Longitude},
+			[2]float64{box.Max.Latitude, box.Max.Longitude},
+			func(point [2]float64, data string) bool {
+				if !store.matches(data, filter) {
+					return true
+				}
+				distance := store.distance(location.Latitude, location.Longitude, point[0], point[1])
+				if distance <= radius {
+					sensors = append(sensors, model.SensorDistance{
+						Sensor:   store.sensors[data],
+						Distance: distance,
+						Bearing:  geo.InitialBearing(location.Latitude, location.Longitude, point[0], point[1]),
+					})
+				}
+				return true
+			},
+		)
+	}
+
+	sortByDistance(sensors)
+
+	return sensors, http.StatusOK, nil
+}
+
+// GetSensorsWithinPolygon returns all sensors located inside the given polygons.
+func (store *InMemorySensorStore) GetSensorsWithinPolygon(polygon geo.MultiPolygon) ([]model.Sensor, int, error) {
+	return store.GetSensorsByTagWithinPolygon(nil, polygon)
+}
+
+// GetSensorsByTagWithinPolygon returns all sensors located inside the given polygons that match the tag filter.
+func (store *InMemorySensorStore) GetSensorsByTagWithinPolygon(filter tagexpr.Expr, polygon geo.MultiPolygon) ([]model.Sensor, int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.logger.Debug("Getting sensors within polygon: ", len(polygon), filter)
+
+	if err := polygon.Validate(); err != nil {
+		store.logger.Error("Invalid polygon: ", err)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid polygon: %w", err)
+	}
+
+	if len(store.sensors) == 0 {
+		store.logger.Error("No sensors in store")
+		return nil, http.StatusNotFound, fmt.Errorf("no sensors in store")
+	}
+
+	// prune to each polygon's bounding box, then test the exact shape
+	sensors := []model.Sensor{}
+	seen := make(map[string]struct{})
+	for _, part := range polygon {
+		box := part.Bounds()
+		store.index.Search(
+			[2]float64{box.Min.Latitude, box.Min.Longitude},
+			[2]float64{box.Max.Latitude, box.Max.Longitude},
+			func(point [2]float64, data string) bool {
+				if _, ok := seen[data]; ok || !store.matches(data, filter) {
+					return true
+				}
+				if part.Contains(model.Location{Latitude: point[0], Longitude: point[1]}) {
+					seen[data] = struct{}{}
+					sensors = append(sensors, store.sensors[data])
+				}
+				return true
+			},
+		)
+	}
+
+	return sensors, http.StatusOK, nil
+}
+
+// QuerySensors returns the sensors matching the query, reading candidates from whichever index
+// query.NewPlan expects to be most selective. A nil query returns every sensor.
+func (store *InMemorySensorStore) QuerySensors(q query.Expr) ([]model.Sensor, int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if len(store.sensors) == 0 {
+		store.logger.Error("No sensors in store")
+		return nil, http.StatusNotFound, fmt.Errorf("no sensors in store")
+	}
+
+	return store.query(q), http.StatusOK, nil
+}
+
+// query executes a query, returning the matching sensors. The caller must hold the lock.
+func (store *InMemorySensorStore) query(q query.Expr) []model.Sensor {
+	plan := query.NewPlan(q, storeStats{store})
+	store.logger.Debug("Query plan for ", q, ": ", plan)
+
+	sensors := []model.Sensor{}
+	add := func(name string) {
+		sensor := store.sensors[name]
+		if plan.Filter == nil || plan.Filter.Match(sensor, store.distance) {
+			sensors = append(sensors, sensor)
+		}
+	}
+
+	switch plan.Access {
+	case query.TagIndex:
+		for name := range plan.Tags.Eval(tagIndex{store}) {
+			add(name)
+		}
+	case query.SpatialIndex:
+		for _, box := range plan.Boxes {
+			store.index.Search(
+				[2]float64{box.Min.Latitude, box.Min.Longitude},
+				[2]float64{box.Max.Latitude, box.Max.Longitude},
+				func(point [2]float64, data string) bool {
+					add(data)
+					return true
+				},
+			)
+		}
+	default:
+		for name := range store.sensors {
+			add(name)
+		}
+	}
+
+	return sensors
+}
+
+// matches reports whether the named sensor satisfies the tag filter, looking its tags up in the tag index.
+// A nil filter matches every sensor. The caller must hold store.mu.
+func (store *InMemorySensorStore) matches(name string, filter tagexpr.Expr) bool {
+	if filter == nil {
+		return true
+	}
+	return filter.Match(func(tag string) bool {
+		_, ok := store.tags[tag][name]
+		return ok
+	})
+}
+
+// tagIndex exposes the store's tag index to tagexpr. The caller must hold store.mu.
+type tagIndex struct {
+	store *InMemorySensorStore
+}
+
+func (index tagIndex) Lookup(tag string) map[string]struct{} {
+	return index.store.tags[tag]
+}
+
+func (index tagIndex) All() map[string]struct{} {
+	names := make(map[string]struct{}, len(index.store.sensors))
+	for name := range index.store.sensors {
+		names[name] = struct{}{}
+	}
+	return names
+}
+
+// storeStats describes the store to the query planner.
+type storeStats struct {
+	store *InMemorySensorStore
+}
+
+func (stats storeStats) Count() int {
+	return len(stats.store.sensors)
+}
+
+func (stats storeStats) TagCount(tag string) int {
+	return len(stats.store.tags[tag])
+}
+
+func (stats storeStats) Bounds() model.BoundingBox {
+	min, max := stats.store.index.Bounds()
+	return model.BoundingBox{
+		Min: model.Location{Latitude: min[0], Longitude: min[1]},
+		Max: model.Location{Latitude: max[0], Longitude: max[1]},
+	}
+}
+
+// geodesicDist returns a SpatialIndex.Nearby distance function ranking items by their distance from location.
+// Nodes are ranked by a lower bound on the distance to anything inside them, scaled down so it also
+// holds on the ellipsoid, which lets the search visit only the nodes that could hold closer items.
+func (store *InMemorySensorStore) geodesicDist(location model.Location) func(min, max [2]float64, data string, item bool) float64 {
+	return func(min, max [2]float64, data string, item bool) float64 {
+		if item {
+			return store.distance(location.Latitude, location.Longitude, min[0], min[1])
+		}
+		return geo.BoxDistance(location.Latitude, location.Longitude, min[0], min[1], max[0], max[1]) * geo.EllipsoidLowerBound
+	}
+}
+
+// sortByDistance orders sensors closest first, breaking ties by name.
+func sortByDistance(sensors []model.SensorDistance) {
+	sort.Slice(sensors, func(i, j int) bool {
+		if sensors[i].Distance != sensors[j].Distance {
+			return sensors[i].Distance < sensors[j].Distance
+		}
+		return sensors[i].Name < sensors[j].Name
+	})
 }
 
 // GetUniqueTags returns all unique tags in the store.
@@ -324,27 +920,3 @@ func (store *InMemorySensorStore) GetSensorCount() (int, int, error) {
 
 	return len(store.sensors), http.StatusOK, nil
 }
-
-/*
-// haversineDistance calculates the distance between two points on Earth using the Haversine formula.
-// https://en.wikipedia.org/wiki/Haversine_formula
-// Good for short distances, less accurate for larger distances.
-func haversineDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	const earthRadius = 6371 // Radius of Earth in kilometers
-
-	// Convert degrees to radians
-	lat1Rad := lat1 * math.Pi / 180
-	lon1Rad := lon1 * math.Pi / 180
-	lat2Rad := lat2 * math.Pi / 180
-	lon2Rad := lon2 * math.Pi / 180
-
-	latDiff := lat2Rad - lat1Rad
-	lonDiff := lon2Rad - lon1Rad
-
-	a := math.Pow(math.Sin(latDiff / 2), 2) + math.Cos(lat1Rad) * math.Cos(lat2Rad) * math.Pow(math.Sin(lonDiff / 2), 2)
-	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1 - a))
-
-	distance := earthRadius * c
-	return distance
-}
-*/
@@ -2,7 +2,11 @@ package store
 
 import (
 	"fmt"
+	"math/rand"
+	"sensor-api/internal/geo"
 	"sensor-api/internal/model"
+	"sensor-api/internal/query"
+	"sensor-api/internal/tagexpr"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -82,8 +86,8 @@ func TestUpdate(t *testing.T) {
 	assert.Equal(t, 37.7833, updatedSensor.Location.Latitude)
 
 	assert.Equal(t, 1, len(store.sensors))
-	assert.Equal(t, 1, store.rt.Len())
-	min, _ := store.rt.Bounds()
+	assert.Equal(t, 1, store.index.Len())
+	min, _ := store.index.Bounds()
 	assert.Equal(t, 37.7833, min[0])
 	assert.Equal(t, -122.4194, min[1])
 
@@ -140,13 +144,13 @@ func TestRemove(t *testing.T) {
 	assert.Error(t, err)
 
 	assert.Equal(t, 1, len(store.sensors))
-	assert.Equal(t, 1, store.rt.Len())
+	assert.Equal(t, 1, store.index.Len())
 
 	_, err = store.RemoveSensor("Sensor2")
 	assert.NoError(t, err)
 
 	assert.Equal(t, 0, len(store.sensors))
-	assert.Equal(t, 0, store.rt.Len())
+	assert.Equal(t, 0, store.index.Len())
 }
 
 func TestNearby(t *testing.T) {
@@ -322,3 +326,418 @@ func TestNearby(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestWithinBoundingBox(t *testing.T) {
+	store := NewInMemorySensorStore()
+	sensors := []model.Sensor{
+		{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor", "temperature"}},
+		{Name: "Sensor2", Location: model.Location{Latitude: 37.7833, Longitude: -122.4167}, Tags: []string{"outdoor", "temperature"}},
+		{Name: "Sensor3", Location: model.Location{Latitude: 39.0921, Longitude: -123.5222}, Tags: []string{"indoor", "temperature"}},
+	}
+
+	// Test querying an empty store
+	_, code, err := store.GetSensorsWithinBoundingBox(37.7, -122.5, 37.8, -122.3)
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+
+	for _, sensor := range sensors {
+		_, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+	}
+
+	within, code, err := store.GetSensorsWithinBoundingBox(37.7, -122.5, 37.8, -122.3)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.ElementsMatch(t, sensors[:2], within)
+
+	// Test ANDing tags within the bounding box
+	within, _, err = store.GetSensorsByTagWithinBoundingBox(tagexpr.AllOf([]string{"indoor", "temperature"}), 37.7, -122.5, 37.8, -122.3)
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Sensor{sensors[0]}, within)
+
+	// Test a bounding box with no sensors
+	within, code, err = store.GetSensorsWithinBoundingBox(10, 10, 20, 20)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Empty(t, within)
+
+	// Test an inverted bounding box
+	_, code, err = store.GetSensorsWithinBoundingBox(37.8, -122.3, 37.7, -122.5)
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+
+	// Test an out of range bounding box
+	_, code, err = store.GetSensorsWithinBoundingBox(-91, -122.5, 37.8, -122.3)
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+}
+
+func TestWithinRadius(t *testing.T) {
+	store := NewInMemorySensorStore()
+	sensors := []model.Sensor{
+		{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor"}},
+		{Name: "Sensor2", Location: model.Location{Latitude: 37.7833, Longitude: -122.4167}, Tags: []string{"outdoor"}},
+		{Name: "Sensor3", Location: model.Location{Latitude: 39.0921, Longitude: -123.5222}, Tags: []string{"indoor"}},
+		{Name: "Sensor4", Location: model.Location{Latitude: 10, Longitude: -179.99}},
+	}
+
+	// Test querying an empty store
+	_, code, err := store.GetSensorsWithinRadius(model.Location{Latitude: 37.775, Longitude: -122.42}, 5000)
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+
+	for _, sensor := range sensors {
+		_, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+	}
+
+	// Test that results are sorted closest first
+	within, code, err := store.GetSensorsWithinRadius(model.Location{Latitude: 37.775, Longitude: -122.42}, 5000)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Len(t, within, 2)
+	assert.Equal(t, "Sensor1", within[0].Name)
+	assert.Equal(t, "Sensor2", within[1].Name)
+	assert.Less(t, within[0].Distance, within[1].Distance)
+	assert.InDelta(t, 1000, within[1].Distance, 50)
+
+	// Test that the corners of the enclosing box are excluded
+	within, _, err = store.GetSensorsWithinRadius(model.Location{Latitude: 37.775, Longitude: -122.42}, 900)
+	assert.NoError(t, err)
+	assert.Len(t, within, 1)
+
+	// Test filtering by tags
+	within, _, err = store.GetSensorsByTagWithinRadius(tagexpr.Tag("outdoor"), model.Location{Latitude: 37.775, Longitude: -122.42}, 5000)
+	assert.NoError(t, err)
+	assert.Len(t, within, 1)
+	assert.Equal(t, "Sensor2", within[0].Name)
+
+	// Test a circle crossing the antimeridian
+	within, _, err = store.GetSensorsWithinRadius(model.Location{Latitude: 10, Longitude: 179.99}, 5000)
+	assert.NoError(t, err)
+	assert.Len(t, within, 1)
+	assert.Equal(t, "Sensor4", within[0].Name)
+
+	// Test bad input
+	_, code, err = store.GetSensorsWithinRadius(model.Location{Latitude: 91, Longitude: -122.42}, 5000)
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+	_, code, err = store.GetSensorsWithinRadius(model.Location{Latitude: 37.775, Longitude: -122.42}, -1)
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+}
+
+func TestNearestK(t *testing.T) {
+	store := NewInMemorySensorStore()
+	for i := 0; i < 20; i++ {
+		tags := []string{"even"}
+		if i%2 == 1 {
+			tags = []string{"odd"}
+		}
+		sensor := model.Sensor{
+			Name: fmt.Sprintf("Sensor%d", i),
+			Location: model.Location{
+				Latitude:  39,
+				Longitude: -110 + float64(i)*.9*-1,
+			},
+			Tags: tags,
+		}
+		_, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+	}
+	location := model.Location{Latitude: 39.0920, Longitude: -123.5221}
+
+	// Test getting the three nearest sensors, closest first
+	nearest, code, err := store.GetNearestSensors(location, 3, 0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Len(t, nearest, 3)
+	assert.Equal(t, "Sensor15", nearest[0].Name)
+	assert.Equal(t, "Sensor16", nearest[1].Name)
+	assert.Equal(t, "Sensor14", nearest[2].Name)
+	assert.Less(t, nearest[0].Distance, nearest[1].Distance)
+	assert.Less(t, nearest[1].Distance, nearest[2].Distance)
+	// Sensor16 lies to the west and Sensor14 to the east of the query point
+	assert.InDelta(t, 270, nearest[1].Bearing, 10)
+	assert.InDelta(t, 90, nearest[2].Bearing, 10)
+
+	// Test filtering by tags
+	nearest, _, err = store.GetNearestSensors(location, 2, 0, tagexpr.Tag("odd"))
+	assert.NoError(t, err)
+	assert.Len(t, nearest, 2)
+	assert.Equal(t, "Sensor15", nearest[0].Name)
+	assert.Equal(t, "Sensor17", nearest[1].Name)
+
+	// Test capping by max distance
+	nearest, _, err = store.GetNearestSensors(location, 5, 50000, nil)
+	assert.NoError(t, err)
+	assert.Len(t, nearest, 1)
+	assert.Equal(t, "Sensor15", nearest[0].Name)
+
+	// Test asking for more sensors than exist
+	nearest, _, err = store.GetNearestSensors(location, 50, 0, nil)
+	assert.NoError(t, err)
+	assert.Len(t, nearest, 20)
+
+	// Test bad input
+	_, code, err = store.GetNearestSensors(location, 0, 0, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+	_, code, err = store.GetNearestSensors(location, 1, -1, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+
+	// Test the nearest sensor by tag
+	nearestSensor, _, err := store.GetNearestSensorByTag(location, []string{"even"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Sensor16", nearestSensor.Name)
+	_, code, err = store.GetNearestSensorByTag(location, []string{"missing"})
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+}
+
+func TestNearbyGeodesic(t *testing.T) {
+	t.Run("Across the antimeridian", func(t *testing.T) {
+		store := NewInMemorySensorStore()
+		west := model.Sensor{Name: "West", Location: model.Location{Latitude: 10, Longitude: 179.9}}
+		east := model.Sensor{Name: "East", Location: model.Location{Latitude: 10, Longitude: -179}}
+		_, err := store.AddSensor(west)
+		assert.NoError(t, err)
+		_, err = store.AddSensor(east)
+		assert.NoError(t, err)
+
+		nearestSensor, _, err := store.GetNearestSensor(model.Location{Latitude: 10, Longitude: -179.9})
+		assert.NoError(t, err)
+		assert.Equal(t, west, *nearestSensor)
+	})
+
+	t.Run("Over the pole", func(t *testing.T) {
+		store := NewInMemorySensorStore()
+		across := model.Sensor{Name: "Across", Location: model.Location{Latitude: 89.9, Longitude: 180}}
+		below := model.Sensor{Name: "Below", Location: model.Location{Latitude: 89, Longitude: 1}}
+		_, err := store.AddSensor(across)
+		assert.NoError(t, err)
+		_, err = store.AddSensor(below)
+		assert.NoError(t, err)
+
+		nearest, _, err := store.GetNearestSensors(model.Location{Latitude: 89.9, Longitude: 1}, 2, 0, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Across", nearest[0].Name)
+		assert.InDelta(t, 22239, nearest[0].Distance, 10)
+		assert.Equal(t, "Below", nearest[1].Name)
+	})
+
+	// compare against a brute force search over a scattered set of sensors with both distance functions
+	for name, distance := range map[string]geo.DistanceFunc{
+		"Haversine": geo.HaversineDistance,
+		"Vincenty":  geo.VincentyDistance,
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := NewInMemorySensorStore(WithDistanceFunc(distance))
+			rng := rand.New(rand.NewSource(1))
+			sensors := make([]model.Sensor, 500)
+			for i := range sensors {
+				sensors[i] = model.Sensor{
+					Name: fmt.Sprintf("Sensor%d", i),
+					Location: model.Location{
+						Latitude:  rng.Float64()*180 - 90,
+						Longitude: rng.Float64()*360 - 180,
+					},
+				}
+				_, err := store.AddSensor(sensors[i])
+				assert.NoError(t, err)
+			}
+
+			for _, location := range []model.Location{
+				{Latitude: 12.34, Longitude: 179.99},
+				{Latitude: -89.5, Longitude: 45},
+				{Latitude: 37.7749, Longitude: -122.4194},
+			} {
+				expected := make([]model.SensorDistance, len(sensors))
+				for i, sensor := range sensors {
+					expected[i] = model.SensorDistance{
+						Sensor:   sensor,
+						Distance: distance(location.Latitude, location.Longitude, sensor.Location.Latitude, sensor.Location.Longitude),
+					}
+				}
+				sortByDistance(expected)
+
+				nearest, _, err := store.GetNearestSensors(location, 10, 0, nil)
+				assert.NoError(t, err)
+				assert.Len(t, nearest, 10)
+				for i := range nearest {
+					assert.Equal(t, expected[i].Name, nearest[i].Name)
+					assert.InDelta(t, expected[i].Distance, nearest[i].Distance, 1e-6)
+				}
+
+				// the radius search agrees on the same set
+				within, _, err := store.GetSensorsWithinRadius(location, expected[9].Distance)
+				assert.NoError(t, err)
+				assert.Len(t, within, 10)
+			}
+		})
+	}
+}
+
+func TestWithinPolygon(t *testing.T) {
+	store := NewInMemorySensorStore()
+	sensors := []model.Sensor{
+		{Name: "Sensor1", Location: model.Location{Latitude: 2, Longitude: 2}, Tags: []string{"indoor"}},
+		{Name: "Sensor2", Location: model.Location{Latitude: 5, Longitude: 5}, Tags: []string{"indoor"}},
+		{Name: "Sensor3", Location: model.Location{Latitude: 8, Longitude: 2}, Tags: []string{"outdoor"}},
+		{Name: "Sensor4", Location: model.Location{Latitude: 10.5, Longitude: 10.5}, Tags: []string{"indoor"}},
+		{Name: "Sensor5", Location: model.Location{Latitude: 20, Longitude: 20}, Tags: []string{"indoor"}},
+	}
+	ring := func(minLat, minLon, maxLat, maxLon float64) []model.Location {
+		return []model.Location{
+			{Latitude: minLat, Longitude: minLon},
+			{Latitude: minLat, Longitude: maxLon},
+			{Latitude: maxLat, Longitude: maxLon},
+			{Latitude: maxLat, Longitude: minLon},
+			{Latitude: minLat, Longitude: minLon},
+		}
+	}
+	// a square with a hole in the middle, and a second small square
+	polygon := geo.MultiPolygon{
+		{ring(0, 0, 10, 10), ring(4, 4, 6, 6)},
+		{ring(10, 10, 11, 11)},
+	}
+
+	// Test querying an empty store
+	_, code, err := store.GetSensorsWithinPolygon(polygon)
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+
+	for _, sensor := range sensors {
+		_, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+	}
+
+	within, code, err := store.GetSensorsWithinPolygon(polygon)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.ElementsMatch(t, []model.Sensor{sensors[0], sensors[2], sensors[3]}, within)
+
+	// Test filtering by tags
+	within, _, err = store.GetSensorsByTagWithinPolygon(tagexpr.Tag("indoor"), polygon)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []model.Sensor{sensors[0], sensors[3]}, within)
+
+	// Test overlapping polygons return each sensor once
+	within, _, err = store.GetSensorsWithinPolygon(geo.MultiPolygon{{ring(0, 0, 3, 3)}, {ring(1, 1, 3, 3)}})
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Sensor{sensors[0]}, within)
+
+	// Test an invalid polygon
+	_, code, err = store.GetSensorsWithinPolygon(geo.MultiPolygon{{ring(0, 0, 3, 3)[:4]}})
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+}
+
+func TestGetSensorsByTagExpr(t *testing.T) {
+	store := NewInMemorySensorStore()
+
+	// Test querying an empty store
+	_, code, err := store.GetSensorsByTagExpr(tagexpr.Tag("temperature"))
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+
+	sensors := []model.Sensor{
+		{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"temperature", "indoor"}},
+		{Name: "Sensor2", Location: model.Location{Latitude: 37.7833, Longitude: -122.4167}, Tags: []string{"humidity"}},
+		{Name: "Sensor3", Location: model.Location{Latitude: 39.0921, Longitude: -123.5222}, Tags: []string{"temperature", "decommissioned"}},
+		{Name: "Sensor4", Location: model.Location{Latitude: 39.0921, Longitude: -123.5222}, Tags: []string{"pressure"}},
+	}
+	for _, sensor := range sensors {
+		_, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+	}
+
+	expr, err := tagexpr.Parse("(temperature OR humidity) AND NOT decommissioned")
+	assert.NoError(t, err)
+	matched, code, err := store.GetSensorsByTagExpr(expr)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.ElementsMatch(t, sensors[:2], matched)
+
+	// Test a nil expression returns every sensor
+	matched, _, err = store.GetSensorsByTagExpr(nil)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, sensors, matched)
+
+	// Test the expression also filters spatial queries
+	within, _, err := store.GetSensorsByTagWithinBoundingBox(tagexpr.Not{X: tagexpr.Tag("decommissioned")}, 39, -124, 40, -123)
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Sensor{sensors[3]}, within)
+
+	nearest, _, err := store.GetNearestSensors(model.Location{Latitude: 39, Longitude: -123}, 1, 0, expr)
+	assert.NoError(t, err)
+	assert.Equal(t, "Sensor2", nearest[0].Name)
+}
+
+func TestQuerySensors(t *testing.T) {
+	// Test querying an empty store
+	_, code, err := NewInMemorySensorStore().QuerySensors(nil)
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+
+	// compare against a brute force match over a scattered set of sensors, for queries that start from
+	// every access path
+	for name, newIndex := range spatialIndexes {
+		t.Run(name, func(t *testing.T) {
+			store := NewInMemorySensorStore(WithSpatialIndex(newIndex()))
+			rng := rand.New(rand.NewSource(1))
+			tags := []string{"indoor", "outdoor", "temperature", "humidity", "rare"}
+			sensors := make([]model.Sensor, 500)
+			for i := range sensors {
+				sensors[i] = model.Sensor{
+					Name: fmt.Sprintf("Sensor%d", i),
+					Location: model.Location{
+						Latitude:  rng.Float64()*20 + 30,
+						Longitude: rng.Float64()*20 - 130,
+					},
+				}
+				for _, tag := range tags[:4] {
+					if rng.Intn(2) == 0 {
+						sensors[i].Tags = append(sensors[i].Tags, tag)
+					}
+				}
+				if i%100 == 0 {
+					sensors[i].Tags = append(sensors[i].Tags, "rare")
+				}
+				_, err := store.AddSensor(sensors[i])
+				assert.NoError(t, err)
+			}
+
+			for input, access := range map[string]query.Access{
+				"tag:indoor OR name:Sensor3":                                           query.Scan,
+				"tag:rare AND within(30, -130, 40, -120)":                              query.TagIndex,
+				"tag:indoor AND NOT tag:outdoor AND (tag:temperature OR tag:humidity)": query.TagIndex,
+				`tag:indoor AND within(35, -125, 38, -122) AND name~"[02468]$"`:        query.SpatialIndex,
+				"tag:temperature AND near(40, -120, 150000)":                           query.SpatialIndex,
+			} {
+				q, err := query.Parse(input)
+				assert.NoError(t, err, input)
+				assert.Equal(t, access, query.NewPlan(q, storeStats{store}).Access, input)
+
+				expected := []model.Sensor{}
+				for _, sensor := range sensors {
+					if q.Match(sensor, geo.HaversineDistance) {
+						expected = append(expected, sensor)
+					}
+				}
+
+				matched, code, err := store.QuerySensors(q)
+				assert.NoError(t, err, input)
+				assert.Equal(t, 200, code, input)
+				assert.NotEmpty(t, matched, input)
+				assert.ElementsMatch(t, expected, matched, input)
+			}
+
+			// Test a nil query returns every sensor
+			matched, _, err := store.QuerySensors(nil)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, sensors, matched)
+		})
+	}
+}
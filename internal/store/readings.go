@@ -0,0 +1,187 @@
+package store
+
+import (
+	"fmt"
+	"net/http"
+	"sensor-api/internal/model"
+	"sensor-api/internal/query"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReadingStore stores time-series readings per sensor. Stores that support readings implement it
+// alongside SensorStore.
+type ReadingStore interface {
+	// AddReadings stores readings for an existing sensor. Either every reading is stored or none are.
+	AddReadings(name string, readings []model.Reading) (int, error)
+	// GetReadings returns a sensor's readings in time order, from inclusive and to exclusive.
+	// A zero from or to leaves that end of the range open, and an empty metric matches every metric.
+	GetReadings(name string, from, to time.Time, metric string) ([]model.Reading, int, error)
+	// QueryReadings returns the readings of every sensor matching the query, with the same range and
+	// metric filters as GetReadings. The readings are not in any particular order.
+	QueryReadings(q query.Expr, from, to time.Time, metric string) ([]model.Reading, int, error)
+}
+
+// InMemoryReadingStore holds readings in memory, keyed by sensor name and kept in time order.
+// It does not know which sensors exist; InMemorySensorStore checks that before storing readings and
+// moves or drops them as sensors are renamed or removed.
+type InMemoryReadingStore struct {
+	mu       sync.Mutex
+	readings map[string][]model.Reading
+}
+
+// NewInMemoryReadingStore creates a new InMemoryReadingStore.
+func NewInMemoryReadingStore() *InMemoryReadingStore {
+	return &InMemoryReadingStore{
+		readings: make(map[string][]model.Reading),
+	}
+}
+
+// add inserts readings for a sensor, keeping them in time order. Readings with equal timestamps keep
+// the order they were added in.
+func (rs *InMemoryReadingStore) add(name string, readings []model.Reading) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	existing := rs.readings[name]
+	inOrder := len(existing) == 0 || !readings[0].Timestamp.Before(existing[len(existing)-1].Timestamp)
+	for i := 1; i < len(readings) && inOrder; i++ {
+		inOrder = !readings[i].Timestamp.Before(readings[i-1].Timestamp)
+	}
+
+	existing = append(existing, readings...)
+	if !inOrder {
+		// readings usually arrive in order, so only sort when they do not
+		sort.SliceStable(existing, func(i, j int) bool {
+			return existing[i].Timestamp.Before(existing[j].Timestamp)
+		})
+	}
+	rs.readings[name] = existing
+}
+
+// get returns a copy of a sensor's readings in [from, to) for the metric.
+func (rs *InMemoryReadingStore) get(name string, from, to time.Time, metric string) []model.Reading {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	readings := rs.readings[name]
+	start := 0
+	if !from.IsZero() {
+		start = sort.Search(len(readings), func(i int) bool {
+			return !readings[i].Timestamp.Before(from)
+		})
+	}
+	end := len(readings)
+	if !to.IsZero() {
+		end = sort.Search(len(readings), func(i int) bool {
+			return !readings[i].Timestamp.Before(to)
+		})
+	}
+
+	if end < start {
+		end = start
+	}
+
+	result := []model.Reading{}
+	for _, reading := range readings[start:end] {
+		if metric == "" || reading.Metric == metric {
+			result = append(result, reading)
+		}
+	}
+	return result
+}
+
+// rename moves a sensor's readings to a new name, replacing any readings already held under it.
+func (rs *InMemoryReadingStore) rename(oldName, newName string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	readings, ok := rs.readings[oldName]
+	delete(rs.readings, oldName)
+	delete(rs.readings, newName)
+	if ok {
+		rs.readings[newName] = readings
+	}
+}
+
+// drop removes every reading of a sensor.
+func (rs *InMemoryReadingStore) drop(name string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	delete(rs.readings, name)
+}
+
+// AddReadings stores readings for a sensor in the store.
+func (store *InMemorySensorStore) AddReadings(name string, readings []model.Reading) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.sensors[name]; !ok {
+		store.logger.Error("Sensor not found: ", name)
+		return http.StatusNotFound, fmt.Errorf("sensor not found")
+	}
+
+	if len(readings) == 0 {
+		store.logger.Error("No readings given")
+		return http.StatusBadRequest, fmt.Errorf("no readings given")
+	}
+	for i := range readings {
+		if !readings[i].IsValid() {
+			store.logger.Error("Invalid reading: ", readings[i])
+			return http.StatusBadRequest, fmt.Errorf("invalid reading at index %d: a metric, finite value and timestamp are required", i)
+		}
+	}
+
+	if code, err := store.log(walRecord{Op: opAddReadings, Name: name, Readings: readings}); err != nil {
+		return code, err
+	}
+
+	// the store lock is held while adding so that the sensor cannot be removed or renamed in between
+	store.readings.add(name, readings)
+
+	return http.StatusCreated, nil
+}
+
+// GetReadings returns the readings of a sensor in the store.
+func (store *InMemorySensorStore) GetReadings(name string, from, to time.Time, metric string) ([]model.Reading, int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.sensors[name]; !ok {
+		store.logger.Error("Sensor not found: ", name)
+		return nil, http.StatusNotFound, fmt.Errorf("sensor not found")
+	}
+
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		store.logger.Error("Invalid time range: ", from, to)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid time range: to is before from")
+	}
+
+	return store.readings.get(name, from, to, metric), http.StatusOK, nil
+}
+
+// QueryReadings returns the readings of the sensors in the store matching the query.
+func (store *InMemorySensorStore) QueryReadings(q query.Expr, from, to time.Time, metric string) ([]model.Reading, int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		store.logger.Error("Invalid time range: ", from, to)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid time range: to is before from")
+	}
+
+	if len(store.sensors) == 0 {
+		store.logger.Error("No sensors in store")
+		return nil, http.StatusNotFound, fmt.Errorf("no sensors in store")
+	}
+
+	// pick the sensors through the tag and spatial indexes, then gather their readings
+	readings := []model.Reading{}
+	for _, sensor := range store.query(q) {
+		readings = append(readings, store.readings.get(sensor.Name, from, to, metric)...)
+	}
+
+	return readings, http.StatusOK, nil
+}
@@ -0,0 +1,148 @@
+package store
+
+import (
+	"sensor-api/internal/model"
+	"sensor-api/internal/query"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadings(t *testing.T) {
+	store := NewInMemorySensorStore()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+
+	// Test adding readings to a missing sensor
+	code, err := store.AddReadings("Sensor1", []model.Reading{{Metric: "temperature", Value: 20, Timestamp: at(0)}})
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+
+	_, code, err = store.GetReadings("Sensor1", time.Time{}, time.Time{}, "")
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+
+	_, err = store.AddSensor(model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}})
+	assert.NoError(t, err)
+
+	// Test a sensor without readings has an empty list
+	readings, code, err := store.GetReadings("Sensor1", time.Time{}, time.Time{}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Empty(t, readings)
+
+	// Test a batch is rejected as a whole if any reading is invalid
+	code, err = store.AddReadings("Sensor1", []model.Reading{
+		{Metric: "temperature", Value: 20, Timestamp: at(0)},
+		{Metric: "", Value: 20, Timestamp: at(1)},
+	})
+	assert.EqualError(t, err, "invalid reading at index 1: a metric, finite value and timestamp are required")
+	assert.Equal(t, 400, code)
+	code, err = store.AddReadings("Sensor1", nil)
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+
+	// Test readings are kept in time order however they arrive
+	code, err = store.AddReadings("Sensor1", []model.Reading{
+		{Metric: "temperature", Value: 20, Timestamp: at(0)},
+		{Metric: "humidity", Value: 40, Timestamp: at(0)},
+		{Metric: "temperature", Value: 22, Timestamp: at(10)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 201, code)
+	_, err = store.AddReadings("Sensor1", []model.Reading{
+		{Metric: "temperature", Value: 21, Timestamp: at(5)},
+		{Metric: "temperature", Value: 23, Timestamp: at(15)},
+	})
+	assert.NoError(t, err)
+
+	readings, _, err = store.GetReadings("Sensor1", time.Time{}, time.Time{}, "temperature")
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Reading{
+		{Metric: "temperature", Value: 20, Timestamp: at(0)},
+		{Metric: "temperature", Value: 21, Timestamp: at(5)},
+		{Metric: "temperature", Value: 22, Timestamp: at(10)},
+		{Metric: "temperature", Value: 23, Timestamp: at(15)},
+	}, readings)
+
+	// Test the time range includes from and excludes to
+	readings, _, err = store.GetReadings("Sensor1", at(5), at(15), "")
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Reading{
+		{Metric: "temperature", Value: 21, Timestamp: at(5)},
+		{Metric: "temperature", Value: 22, Timestamp: at(10)},
+	}, readings)
+
+	readings, _, err = store.GetReadings("Sensor1", time.Time{}, at(1), "")
+	assert.NoError(t, err)
+	assert.Len(t, readings, 2)
+
+	_, code, err = store.GetReadings("Sensor1", at(15), at(5), "")
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+
+	// Test renaming a sensor carries its readings over
+	code, err = store.UpdateSensor("Sensor1", &model.Sensor{Name: "Sensor2", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}})
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	readings, _, err = store.GetReadings("Sensor2", time.Time{}, time.Time{}, "")
+	assert.NoError(t, err)
+	assert.Len(t, readings, 5)
+
+	// Test removing a sensor drops its readings, so a new sensor with the same name starts empty
+	_, err = store.RemoveSensor("Sensor2")
+	assert.NoError(t, err)
+	_, err = store.AddSensor(model.Sensor{Name: "Sensor2", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}})
+	assert.NoError(t, err)
+	readings, _, err = store.GetReadings("Sensor2", time.Time{}, time.Time{}, "")
+	assert.NoError(t, err)
+	assert.Empty(t, readings)
+}
+
+func TestQueryReadings(t *testing.T) {
+	store := NewInMemorySensorStore()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Test querying an empty store
+	_, code, err := store.QueryReadings(nil, time.Time{}, time.Time{}, "")
+	assert.Error(t, err)
+	assert.Equal(t, 404, code)
+
+	for i, sensor := range []model.Sensor{
+		{Name: "Sensor1", Location: model.Location{Latitude: 37.7749, Longitude: -122.4194}, Tags: []string{"indoor"}},
+		{Name: "Sensor2", Location: model.Location{Latitude: 37.7833, Longitude: -122.4167}, Tags: []string{"indoor"}},
+		{Name: "Sensor3", Location: model.Location{Latitude: 39.0921, Longitude: -123.5222}, Tags: []string{"outdoor"}},
+	} {
+		_, err := store.AddSensor(sensor)
+		assert.NoError(t, err)
+		_, err = store.AddReadings(sensor.Name, []model.Reading{
+			{Metric: "temperature", Value: float64(i), Timestamp: start},
+			{Metric: "humidity", Value: float64(i), Timestamp: start},
+			{Metric: "temperature", Value: float64(i), Timestamp: start.Add(time.Hour)},
+		})
+		assert.NoError(t, err)
+	}
+
+	// Test the readings of every matching sensor are gathered
+	q, err := query.Parse("tag:indoor")
+	assert.NoError(t, err)
+	readings, code, err := store.QueryReadings(q, time.Time{}, start.Add(time.Hour), "temperature")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.ElementsMatch(t, []model.Reading{
+		{Metric: "temperature", Value: 0, Timestamp: start},
+		{Metric: "temperature", Value: 1, Timestamp: start},
+	}, readings)
+
+	// Test a nil query gathers the readings of every sensor
+	readings, _, err = store.QueryReadings(nil, time.Time{}, time.Time{}, "")
+	assert.NoError(t, err)
+	assert.Len(t, readings, 9)
+
+	_, code, err = store.QueryReadings(nil, start.Add(time.Hour), start, "")
+	assert.Error(t, err)
+	assert.Equal(t, 400, code)
+}
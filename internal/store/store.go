@@ -1,23 +1,96 @@
 package store
 
-import "sensor-api/internal/model"
+import (
+	"sensor-api/internal/events"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/model"
+	"sensor-api/internal/query"
+	"sensor-api/internal/tagexpr"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Patch computes the new state of a sensor from its current state.
+type Patch func(sensor model.Sensor) (model.Sensor, error)
+
+// AddResult is the outcome of adding one sensor of a batch: the status code and error AddSensor
+// would have returned for it.
+type AddResult struct {
+	Code int
+	Err  error
+}
+
+// EventSink receives the changes a store makes to sensors. Stores publish while holding their locks,
+// in the order the changes were made, so Publish must not block.
+type EventSink interface {
+	Publish(event events.Event)
+}
+
+// EventSource is implemented by stores that publish each successful change to an EventSink. Stores
+// that persist changes publish them only once they are durable.
+type EventSource interface {
+	// SetEventSink sets the sink changes are published to from now on, or stops publishing if nil.
+	SetEventSink(sink EventSink)
+}
+
+// ScopedStore is implemented by stores that can log with the logger of a request, so that their
+// failures carry its fields, such as its request ID.
+type ScopedStore interface {
+	// WithLogger returns a view of the store sharing its data, which logs with logger.
+	WithLogger(logger *log.Entry) SensorStore
+}
+
+// WithLogger returns a view of s logging with logger, or s if it cannot log with another logger.
+func WithLogger(s SensorStore, logger *log.Entry) SensorStore {
+	if scoped, ok := s.(ScopedStore); ok {
+		return scoped.WithLogger(logger)
+	}
+	return s
+}
 
 type SensorStore interface {
 	AddSensor(sensor model.Sensor) (int, error)
+	// AddSensors adds a batch of sensors, in order, locking the store once for the whole batch. It
+	// returns the result of adding each sensor. If atomic is set and any sensor cannot be added, none
+	// are: the others fail with 424 Failed Dependency, and the batch with 400 Bad Request.
+	AddSensors(sensors []model.Sensor, atomic bool) ([]AddResult, int, error)
 	GetSensor(name string) (model.Sensor, int, error)
 	GetSensorsByTags(tags []string) ([]model.Sensor, int, error)
+	GetSensorsByTagExpr(filter tagexpr.Expr) ([]model.Sensor, int, error)
 	UpdateSensor(name string, updatedSensor *model.Sensor) (int, error)
 	RemoveSensor(name string) (int, error)
+	// GetSensorVersion returns a sensor and its version. Versions are drawn from a counter shared by
+	// the whole store, so a sensor's version increases with every change to it and is never reused,
+	// even by a sensor later added under the same name.
+	GetSensorVersion(name string) (model.Sensor, uint64, int, error)
+	// UpdateSensorIfMatch updates a sensor only if its version is still version, failing with 412
+	// Precondition Failed otherwise. A version of 0 matches any.
+	UpdateSensorIfMatch(name string, updatedSensor *model.Sensor, version uint64) (int, error)
+	// PatchSensor replaces a sensor with the result of patch, which is called with a copy of the
+	// sensor while the store is locked, so the change is atomic with respect to other writers. The
+	// patched sensor is validated like an update, and if patch fails the store is unchanged and it
+	// returns 409 Conflict. A version other than 0 must match as in UpdateSensorIfMatch.
+	PatchSensor(name string, patch Patch, version uint64) (int, error)
+	// RemoveSensorIfMatch removes a sensor only if its version is still version, failing with 412
+	// Precondition Failed otherwise. A version of 0 matches any.
+	RemoveSensorIfMatch(name string, version uint64) (int, error)
 	GetNearestSensor(location model.Location) (*model.Sensor, int, error)
 	GetNearestSensorByTag(location model.Location, tags []string) (*model.Sensor, int, error)
+	GetNearestSensors(location model.Location, k int, maxDistance float64, filter tagexpr.Expr) ([]model.SensorDistance, int, error)
 	GetSensorCount() (int, int, error)
 	GetUniqueTags() ([]string, int, error)
 	GetUniqueLocations() ([]model.Location, int, error)
+	GetSensorsWithinBoundingBox(minLat, minLong, maxLat, maxLong float64) ([]model.Sensor, int, error)
+	GetSensorsByTagWithinBoundingBox(filter tagexpr.Expr, minLat, minLong, maxLat, maxLong float64) ([]model.Sensor, int, error)
+	GetSensorsWithinRadius(location model.Location, radius float64) ([]model.SensorDistance, int, error)
+	GetSensorsByTagWithinRadius(filter tagexpr.Expr, location model.Location, radius float64) ([]model.SensorDistance, int, error)
+	GetSensorsWithinPolygon(polygon geo.MultiPolygon) ([]model.Sensor, int, error)
+	GetSensorsByTagWithinPolygon(filter tagexpr.Expr, polygon geo.MultiPolygon) ([]model.Sensor, int, error)
+	// QuerySensors returns the sensors matching a query. Each backend executes the query against its own
+	// indexes; query.NewPlan chooses an access path and leaves a residual filter for backends that
+	// cannot evaluate every term natively.
+	QuerySensors(q query.Expr) ([]model.Sensor, int, error)
 	/*
 		GetSensorCardinality(tags []string) (int, int, error) ?
-		GetSensorsWithinBoundingBox(minLat, minLong, maxLat, maxLong float64) ([]model.Sensor, int, error)
-		GetSensorsWithinRadius(location model.Location, radius float64) ([]model.Sensor, int, error)
-		GetSensorsByTagWithinBoundingBox(tags []string, minLat, minLong, maxLat, maxLong float64) ([]model.Sensor, int, error)
-		GetSensorsByTagWithinRadius(tags []string, location model.Location, radius float64) ([]model.Sensor, int, error)
 	*/
 }
@@ -0,0 +1,265 @@
+package storetest
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/model"
+	"sensor-api/internal/query"
+	"sensor-api/internal/store"
+	"sensor-api/internal/tagexpr"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reference is the simplest store that could work: a map of sensors, answering every query by
+// checking each of them. It is the model randomized changes and queries are checked against.
+type reference map[string]model.Sensor
+
+func (ref reference) add(sensor model.Sensor) int {
+	if !sensor.Location.IsValid() {
+		return http.StatusBadRequest
+	}
+	if _, ok := ref[sensor.Name]; ok {
+		return http.StatusBadRequest
+	}
+	ref[sensor.Name] = sensor
+	return http.StatusCreated
+}
+
+func (ref reference) update(name string, sensor model.Sensor) int {
+	if sensor.Name == "" || !sensor.Location.IsValid() {
+		return http.StatusBadRequest
+	}
+	if _, ok := ref[name]; !ok {
+		return http.StatusNotFound
+	}
+	if _, ok := ref[sensor.Name]; ok && sensor.Name != name {
+		return http.StatusBadRequest
+	}
+	delete(ref, name)
+	ref[sensor.Name] = sensor
+	return http.StatusNoContent
+}
+
+func (ref reference) remove(name string) int {
+	if _, ok := ref[name]; !ok {
+		return http.StatusNotFound
+	}
+	delete(ref, name)
+	return http.StatusNoContent
+}
+
+// filter returns the sensors for which keep is true.
+func (ref reference) filter(keep func(sensor model.Sensor) bool) []model.Sensor {
+	sensors := []model.Sensor{}
+	for _, sensor := range ref {
+		if keep(sensor) {
+			sensors = append(sensors, sensor)
+		}
+	}
+	return sensors
+}
+
+// near returns the sensors matching the filter within radius meters of location, closest first,
+// breaking ties by name. A radius of zero has no limit.
+func (ref reference) near(location model.Location, radius float64, filter tagexpr.Expr) []model.SensorDistance {
+	sensors := []model.SensorDistance{}
+	for _, sensor := range ref {
+		distance := geo.HaversineDistance(location.Latitude, location.Longitude, sensor.Location.Latitude, sensor.Location.Longitude)
+		if (radius == 0 || distance <= radius) && tagexpr.Match(filter, sensor.Tags) {
+			sensors = append(sensors, model.SensorDistance{
+				Sensor:   sensor,
+				Distance: distance,
+				Bearing:  geo.InitialBearing(location.Latitude, location.Longitude, sensor.Location.Latitude, sensor.Location.Longitude),
+			})
+		}
+	}
+	sort.Slice(sensors, func(i, j int) bool {
+		if sensors[i].Distance != sensors[j].Distance {
+			return sensors[i].Distance < sensors[j].Distance
+		}
+		return sensors[i].Name < sensors[j].Name
+	})
+	return sensors
+}
+
+// modelTags and modelNames are drawn from small pools, so that random changes often collide with
+// existing sensors and tags.
+var (
+	modelTags  = []string{"indoor", "outdoor", "temperature", "humidity", "rare"}
+	modelNames = 60
+)
+
+// testModel makes random changes to the store and to the reference, checking each change has the same
+// outcome, and every so often checks a batch of random queries give the same results.
+func testModel(t *testing.T, s store.SensorStore) {
+	rng := rand.New(rand.NewSource(1))
+	ref := reference{}
+
+	// a few fixed locations, so that some sensors share a location
+	shared := []model.Location{randomLocation(rng), randomLocation(rng), randomLocation(rng)}
+	randomSensor := func() model.Sensor {
+		sensor := model.Sensor{Name: fmt.Sprint("Sensor", rng.Intn(modelNames)), Location: randomLocation(rng)}
+		switch rng.Intn(20) {
+		case 0:
+			sensor.Location = model.Location{Latitude: 95, Longitude: 0}
+		case 1, 2:
+			sensor.Location = shared[rng.Intn(len(shared))]
+		}
+		for _, tag := range modelTags {
+			if rng.Intn(3) == 0 {
+				sensor.Tags = append(sensor.Tags, tag)
+			}
+		}
+		return sensor
+	}
+
+	for step := 1; step <= 600; step++ {
+		switch op := rng.Intn(10); {
+		case op < 5:
+			sensor := randomSensor()
+			code, _ := s.AddSensor(sensor)
+			assert.Equal(t, ref.add(sensor), code, "step %d: add %v", step, sensor)
+		case op < 8:
+			name := fmt.Sprint("Sensor", rng.Intn(modelNames))
+			sensor := randomSensor()
+			if rng.Intn(2) == 0 {
+				// mostly update in place, as renames onto a taken name fail
+				sensor.Name = name
+			}
+			code, _ := s.UpdateSensor(name, &sensor)
+			assert.Equal(t, ref.update(name, sensor), code, "step %d: update %s to %v", step, name, sensor)
+		default:
+			name := fmt.Sprint("Sensor", rng.Intn(modelNames))
+			code, _ := s.RemoveSensor(name)
+			assert.Equal(t, ref.remove(name), code, "step %d: remove %s", step, name)
+		}
+
+		if step%50 == 0 {
+			checkModel(t, s, ref, rng)
+		}
+	}
+}
+
+// checkModel checks random queries against the store give the same results as the reference.
+func checkModel(t *testing.T, s store.SensorStore, ref reference, rng *rand.Rand) {
+	t.Helper()
+
+	count, _, err := s.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, len(ref), count)
+
+	for name, expected := range ref {
+		sensor, _, err := s.GetSensor(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, sensor)
+	}
+
+	uniqueTags := map[string]struct{}{}
+	uniqueLocations := map[model.Location]struct{}{}
+	for _, sensor := range ref {
+		for _, tag := range sensor.Tags {
+			uniqueTags[tag] = struct{}{}
+		}
+		uniqueLocations[sensor.Location] = struct{}{}
+	}
+	tags, _, err := s.GetUniqueTags()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keys(uniqueTags), tags)
+	locations, _, err := s.GetUniqueLocations()
+	assert.NoError(t, err)
+	assert.Len(t, locations, len(uniqueLocations))
+	for _, location := range locations {
+		assert.Contains(t, uniqueLocations, location)
+	}
+
+	if len(ref) == 0 {
+		return
+	}
+
+	for i := 0; i < 5; i++ {
+		filter := randomFilter(rng)
+		center := randomLocation(rng)
+
+		sensors, _, err := s.GetSensorsByTagExpr(filter)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, ref.filter(func(sensor model.Sensor) bool { return tagexpr.Match(filter, sensor.Tags) }), sensors, filter)
+
+		box := model.BoundingBox{Min: center, Max: model.Location{Latitude: center.Latitude + rng.Float64()*5, Longitude: center.Longitude + rng.Float64()*5}}
+		sensors, _, err = s.GetSensorsByTagWithinBoundingBox(filter, box.Min.Latitude, box.Min.Longitude, box.Max.Latitude, box.Max.Longitude)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, ref.filter(func(sensor model.Sensor) bool {
+			return box.Contains(sensor.Location) && tagexpr.Match(filter, sensor.Tags)
+		}), sensors, "%v %v", box, filter)
+
+		radius := rng.Float64() * 500000
+		distances, _, err := s.GetSensorsByTagWithinRadius(filter, center, radius)
+		assert.NoError(t, err)
+		checkDistances(t, ref.near(center, radius, filter), distances)
+
+		// sensors tied at the cut-off distance may be returned in any order, so only the distances
+		// of the nearest sensors are compared exactly
+		k := rng.Intn(10) + 1
+		expected := ref.near(center, 0, filter)
+		if len(expected) > k {
+			expected = expected[:k]
+		}
+		distances, _, err = s.GetNearestSensors(center, k, 0, filter)
+		assert.NoError(t, err)
+		checkDistances(t, expected, distances)
+
+		q := query.And{query.Near{Center: center, Radius: radius}, query.FromTagExpr(filter)}
+		if filter == nil {
+			q = query.And{query.Within{Box: box}, query.Not{X: query.Tag("rare")}}
+		}
+		sensors, _, err = s.QuerySensors(q)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, ref.filter(func(sensor model.Sensor) bool { return q.Match(sensor, geo.HaversineDistance) }), sensors, q)
+	}
+}
+
+// checkDistances checks sensors returned closest first have the expected distances, and that each is
+// the sensor the reference holds at that distance.
+func checkDistances(t *testing.T, expected, actual []model.SensorDistance) {
+	t.Helper()
+	if !assert.Len(t, actual, len(expected)) {
+		return
+	}
+	for i := range expected {
+		assert.Equal(t, expected[i].Distance, actual[i].Distance)
+		if expected[i].Name == actual[i].Name {
+			assert.Equal(t, expected[i], actual[i])
+		}
+	}
+}
+
+// randomLocation returns a location in an area small enough that random queries find sensors.
+func randomLocation(rng *rand.Rand) model.Location {
+	return model.Location{Latitude: rng.Float64()*20 + 30, Longitude: rng.Float64()*20 - 130}
+}
+
+// randomFilter returns nil, a tag, or a combination of tags.
+func randomFilter(rng *rand.Rand) tagexpr.Expr {
+	tag := func() tagexpr.Expr { return tagexpr.Tag(modelTags[rng.Intn(len(modelTags))]) }
+	switch rng.Intn(4) {
+	case 0:
+		return nil
+	case 1:
+		return tag()
+	case 2:
+		return tagexpr.And{tag(), tagexpr.Not{X: tag()}}
+	}
+	return tagexpr.Or{tag(), tag()}
+}
+
+func keys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,808 @@
+// Package storetest checks that a store.SensorStore implementation honours the contract the API
+// relies on. A backend's tests call RunConformance with a function creating empty stores:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.RunConformance(t, func(t *testing.T) store.SensorStore {
+//			return NewMyStore(t.TempDir())
+//		})
+//	}
+package storetest
+
+import (
+	"fmt"
+	"sensor-api/internal/events"
+	"sensor-api/internal/geo"
+	"sensor-api/internal/model"
+	"sensor-api/internal/store"
+	"sensor-api/internal/tagexpr"
+	"sort"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// Factory returns a new, empty store measuring distances with geo.HaversineDistance. Stores holding
+// resources should release them with t.Cleanup.
+type Factory func(t *testing.T) store.SensorStore
+
+// RunConformance runs the conformance tests as subtests of t, each against a store from newStore.
+func RunConformance(t *testing.T, newStore Factory) {
+	for _, test := range []struct {
+		name string
+		fn   func(t *testing.T, s store.SensorStore)
+	}{
+		{"EmptyStore", testEmptyStore},
+		{"AddAndGet", testAddAndGet},
+		{"AddBatch", testAddBatch},
+		{"Update", testUpdate},
+		{"Remove", testRemove},
+		{"Versions", testVersions},
+		{"Patch", testPatch},
+		{"Nearest", testNearest},
+		{"Spatial", testSpatial},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"Events", testEvents},
+		{"Logger", testLogger},
+		{"Model", testModel},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, newStore(t))
+		})
+	}
+}
+
+var (
+	sanFrancisco = model.Location{Latitude: 37.7749, Longitude: -122.4194}
+	oakland      = model.Location{Latitude: 37.8044, Longitude: -122.2712}
+	sanJose      = model.Location{Latitude: 37.3382, Longitude: -121.8863}
+	square       = geo.MultiPolygon{{{
+		{Latitude: 37, Longitude: -123}, {Latitude: 37, Longitude: -121},
+		{Latitude: 38, Longitude: -121}, {Latitude: 38, Longitude: -123},
+		{Latitude: 37, Longitude: -123},
+	}}}
+)
+
+func testEmptyStore(t *testing.T, s store.SensorStore) {
+	// Test every query that lists sensors reports an empty store as not found
+	_, code, err := s.GetSensorsByTags(nil)
+	checkError(t, 404, code, err)
+	_, code, err = s.GetSensorsByTagExpr(tagexpr.Tag("indoor"))
+	checkError(t, 404, code, err)
+	_, code, err = s.GetSensor("Sensor1")
+	checkError(t, 404, code, err)
+	_, code, err = s.GetNearestSensor(sanFrancisco)
+	checkError(t, 404, code, err)
+	_, code, err = s.GetNearestSensors(sanFrancisco, 3, 0, nil)
+	checkError(t, 404, code, err)
+	_, code, err = s.GetSensorsWithinBoundingBox(37, -123, 38, -122)
+	checkError(t, 404, code, err)
+	_, code, err = s.GetSensorsWithinRadius(sanFrancisco, 1000)
+	checkError(t, 404, code, err)
+	_, code, err = s.GetSensorsWithinPolygon(square)
+	checkError(t, 404, code, err)
+	_, code, err = s.QuerySensors(nil)
+	checkError(t, 404, code, err)
+	code, err = s.UpdateSensor("Sensor1", &model.Sensor{Name: "Sensor1", Location: sanFrancisco})
+	checkError(t, 404, code, err)
+	code, err = s.RemoveSensor("Sensor1")
+	checkError(t, 404, code, err)
+
+	// Check the summaries of an empty store are empty rather than errors
+	count, code, err := s.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Zero(t, count)
+	tags, code, err := s.GetUniqueTags()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Empty(t, tags)
+	locations, code, err := s.GetUniqueLocations()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Empty(t, locations)
+}
+
+func testAddAndGet(t *testing.T, s store.SensorStore) {
+	sensor := model.Sensor{Name: "Sensor1", Location: sanFrancisco, Tags: []string{"indoor", "temperature"}}
+	code, err := s.AddSensor(sensor)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, code)
+
+	retrieved, code, err := s.GetSensor("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, sensor, retrieved)
+
+	// Test duplicate names are rejected, leaving the first sensor in place
+	code, err = s.AddSensor(model.Sensor{Name: "Sensor1", Location: oakland})
+	checkError(t, 400, code, err)
+	retrieved, _, err = s.GetSensor("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, sensor, retrieved)
+
+	// Test invalid locations are rejected
+	for _, location := range []model.Location{{Latitude: 91, Longitude: 0}, {Latitude: 0, Longitude: -181}} {
+		code, err = s.AddSensor(model.Sensor{Name: "Sensor2", Location: location})
+		checkError(t, 400, code, err)
+	}
+	_, code, err = s.GetSensor("Sensor2")
+	checkError(t, 404, code, err)
+
+	// Test names and tags with control characters are rejected
+	for _, sensor := range []model.Sensor{
+		{Name: "Sensor\x002", Location: oakland},
+		{Name: "Sensor2", Location: oakland, Tags: []string{"in\ndoor"}},
+	} {
+		code, err = s.AddSensor(sensor)
+		checkError(t, 400, code, err)
+	}
+	code, err = s.UpdateSensor("Sensor1", &model.Sensor{Name: "Sensor1", Location: sanFrancisco, Tags: []string{"a\x00b"}})
+	checkError(t, 400, code, err)
+
+	count, _, err := s.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Test listing by tags ANDs them, and no tags lists every sensor
+	_, err = s.AddSensor(model.Sensor{Name: "Sensor2", Location: oakland, Tags: []string{"indoor"}})
+	assert.NoError(t, err)
+	checkNames(t, s, nil, "Sensor1", "Sensor2")
+	checkNames(t, s, []string{"indoor"}, "Sensor1", "Sensor2")
+	checkNames(t, s, []string{"indoor", "temperature"}, "Sensor1")
+	checkNames(t, s, []string{"indoor", "outdoor"})
+
+	sensors, code, err := s.GetSensorsByTagExpr(tagexpr.And{tagexpr.Tag("indoor"), tagexpr.Not{X: tagexpr.Tag("temperature")}})
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []string{"Sensor2"}, names(sensors))
+}
+
+func testAddBatch(t *testing.T, s store.SensorStore) {
+	_, err := s.AddSensor(model.Sensor{Name: "Sensor1", Location: sanFrancisco})
+	assert.NoError(t, err)
+	codes := func(results []store.AddResult) []int {
+		codes := make([]int, len(results))
+		for i, result := range results {
+			codes[i] = result.Code
+			assert.Equal(t, result.Code >= 400, result.Err != nil, "result %d", i)
+		}
+		return codes
+	}
+
+	// Test an atomic batch with a sensor that exists, an invalid location and a repeated name adds nothing
+	results, code, err := s.AddSensors([]model.Sensor{
+		{Name: "Sensor2", Location: oakland, Tags: []string{"outdoor"}},
+		{Name: "Sensor1", Location: sanJose},
+		{Name: "Sensor3", Location: model.Location{Latitude: 95}},
+		{Name: "Sensor4", Location: sanJose},
+		{Name: "Sensor4", Location: oakland},
+	}, true)
+	checkError(t, 400, code, err)
+	assert.Equal(t, []int{424, 400, 400, 424, 400}, codes(results))
+	count, _, err := s.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	_, _, err = s.GetSensor("Sensor2")
+	assert.Error(t, err)
+
+	// Test the same batch without atomic adds every sensor it can
+	results, code, err = s.AddSensors([]model.Sensor{
+		{Name: "Sensor2", Location: oakland, Tags: []string{"outdoor"}},
+		{Name: "Sensor1", Location: sanJose},
+		{Name: "Sensor3", Location: model.Location{Latitude: 95}},
+		{Name: "Sensor4", Location: sanJose},
+		{Name: "Sensor4", Location: oakland},
+	}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []int{201, 400, 400, 201, 400}, codes(results))
+	count, _, err = s.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	sensor, _, err := s.GetSensor("Sensor4")
+	assert.NoError(t, err)
+	assert.Equal(t, sanJose, sensor.Location)
+	checkNames(t, s, []string{"outdoor"}, "Sensor2")
+	sensors, _, err := s.GetSensorsWithinBoundingBox(37.3, -121.9, 37.4, -121.8)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Sensor4"}, names(sensors))
+
+	// Test an atomic batch that succeeds, and an empty batch
+	results, code, err = s.AddSensors([]model.Sensor{{Name: "Sensor5", Location: oakland}, {Name: "Sensor6", Location: sanJose}}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []int{201, 201}, codes(results))
+	results, _, err = s.AddSensors(nil, true)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+	count, _, err = s.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+}
+
+func testUpdate(t *testing.T, s store.SensorStore) {
+	sensor1 := model.Sensor{Name: "Sensor1", Location: sanFrancisco, Tags: []string{"indoor", "temperature"}}
+	sensor2 := model.Sensor{Name: "Sensor2", Location: oakland, Tags: []string{"outdoor"}}
+	for _, sensor := range []model.Sensor{sensor1, sensor2} {
+		_, err := s.AddSensor(sensor)
+		assert.NoError(t, err)
+	}
+
+	// Test invalid updates are rejected, leaving the sensor unchanged
+	code, err := s.UpdateSensor("Sensor1", nil)
+	checkError(t, 400, code, err)
+	code, err = s.UpdateSensor("Sensor1", &model.Sensor{Location: sanJose})
+	checkError(t, 400, code, err)
+	code, err = s.UpdateSensor("Sensor1", &model.Sensor{Name: "Sensor1", Location: model.Location{Latitude: -91}})
+	checkError(t, 400, code, err)
+	code, err = s.UpdateSensor("Sensor3", &model.Sensor{Name: "Sensor3", Location: sanJose})
+	checkError(t, 404, code, err)
+
+	// Test a sensor cannot be renamed to the name of another
+	code, err = s.UpdateSensor("Sensor1", &model.Sensor{Name: "Sensor2", Location: sanJose})
+	checkError(t, 400, code, err)
+
+	retrieved, _, err := s.GetSensor("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, sensor1, retrieved)
+	retrieved, _, err = s.GetSensor("Sensor2")
+	assert.NoError(t, err)
+	assert.Equal(t, sensor2, retrieved)
+
+	// Test updating in place
+	sensor1.Tags = []string{"indoor", "humidity"}
+	code, err = s.UpdateSensor("Sensor1", &sensor1)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	checkNames(t, s, []string{"humidity"}, "Sensor1")
+	checkNames(t, s, []string{"temperature"})
+
+	// Test renaming and moving a sensor moves its tag index and spatial index entries
+	renamed := model.Sensor{Name: "Sensor3", Location: sanJose, Tags: []string{"outdoor", "moved"}}
+	code, err = s.UpdateSensor("Sensor1", &renamed)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+
+	_, code, err = s.GetSensor("Sensor1")
+	checkError(t, 404, code, err)
+	retrieved, _, err = s.GetSensor("Sensor3")
+	assert.NoError(t, err)
+	assert.Equal(t, renamed, retrieved)
+
+	checkNames(t, s, []string{"indoor"})
+	checkNames(t, s, []string{"humidity"})
+	checkNames(t, s, []string{"outdoor"}, "Sensor2", "Sensor3")
+	checkNames(t, s, []string{"moved"}, "Sensor3")
+
+	tags, _, err := s.GetUniqueTags()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"outdoor", "moved"}, tags)
+	locations, _, err := s.GetUniqueLocations()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []model.Location{oakland, sanJose}, locations)
+
+	sensors, _, err := s.GetSensorsWithinBoundingBox(37.7, -122.5, 37.9, -122.3)
+	assert.NoError(t, err)
+	assert.Empty(t, sensors)
+	nearest, _, err := s.GetNearestSensor(sanJose)
+	assert.NoError(t, err)
+	assert.Equal(t, "Sensor3", nearest.Name)
+
+	count, _, err := s.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func testRemove(t *testing.T, s store.SensorStore) {
+	for _, sensor := range []model.Sensor{
+		{Name: "Sensor1", Location: sanFrancisco, Tags: []string{"indoor", "temperature"}},
+		{Name: "Sensor2", Location: sanFrancisco, Tags: []string{"indoor"}},
+	} {
+		_, err := s.AddSensor(sensor)
+		assert.NoError(t, err)
+	}
+
+	code, err := s.RemoveSensor("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	_, code, err = s.GetSensor("Sensor1")
+	checkError(t, 404, code, err)
+
+	// Test removing a sensor that doesn't exist
+	code, err = s.RemoveSensor("Sensor1")
+	checkError(t, 404, code, err)
+
+	// Test tags are cleaned up once no sensor has them, and shared locations are kept
+	tags, _, err := s.GetUniqueTags()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"indoor"}, tags)
+	checkNames(t, s, []string{"temperature"})
+	locations, _, err := s.GetUniqueLocations()
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Location{sanFrancisco}, locations)
+	nearest, _, err := s.GetNearestSensor(sanFrancisco)
+	assert.NoError(t, err)
+	assert.Equal(t, "Sensor2", nearest.Name)
+
+	// Test the name can be reused, without inheriting the old tags
+	_, err = s.AddSensor(model.Sensor{Name: "Sensor1", Location: oakland})
+	assert.NoError(t, err)
+	checkNames(t, s, []string{"indoor"}, "Sensor2")
+
+	for _, name := range []string{"Sensor1", "Sensor2"} {
+		_, err = s.RemoveSensor(name)
+		assert.NoError(t, err)
+	}
+	tags, _, err = s.GetUniqueTags()
+	assert.NoError(t, err)
+	assert.Empty(t, tags)
+	locations, _, err = s.GetUniqueLocations()
+	assert.NoError(t, err)
+	assert.Empty(t, locations)
+	_, code, err = s.GetSensorsByTags(nil)
+	checkError(t, 404, code, err)
+}
+
+func testVersions(t *testing.T, s store.SensorStore) {
+	sensor := model.Sensor{Name: "Sensor1", Location: sanFrancisco, Tags: []string{"indoor"}}
+	_, err := s.AddSensor(sensor)
+	assert.NoError(t, err)
+	_, err = s.AddSensor(model.Sensor{Name: "Sensor2", Location: oakland})
+	assert.NoError(t, err)
+
+	retrieved, v1, code, err := s.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, sensor, retrieved)
+	assert.NotZero(t, v1)
+	_, _, code, err = s.GetSensorVersion("Sensor3")
+	checkError(t, 404, code, err)
+
+	// Test every update gives a new, higher version, conditional or not
+	sensor.Tags = []string{"outdoor"}
+	code, err = s.UpdateSensorIfMatch("Sensor1", &sensor, v1)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	_, v2, _, err := s.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+	assert.Greater(t, v2, v1)
+	_, err = s.UpdateSensor("Sensor1", &sensor)
+	assert.NoError(t, err)
+	_, v3, _, err := s.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+	assert.Greater(t, v3, v2)
+
+	// Test changes conditional on an old version fail, leaving the sensor unchanged
+	code, err = s.UpdateSensorIfMatch("Sensor1", &model.Sensor{Name: "Sensor1", Location: sanJose}, v2)
+	checkError(t, 412, code, err)
+	code, err = s.RemoveSensorIfMatch("Sensor1", v1)
+	checkError(t, 412, code, err)
+	retrieved, version, _, err := s.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, sensor, retrieved)
+	assert.Equal(t, v3, version)
+	checkNames(t, s, []string{"outdoor"}, "Sensor1")
+
+	// Check a sensor that doesn't exist is not found rather than modified
+	code, err = s.UpdateSensorIfMatch("Sensor3", &model.Sensor{Name: "Sensor3", Location: sanJose}, v3)
+	checkError(t, 404, code, err)
+	code, err = s.RemoveSensorIfMatch("Sensor3", v3)
+	checkError(t, 404, code, err)
+
+	// Test renaming carries the sensor to a new version under its new name
+	renamed := model.Sensor{Name: "Sensor3", Location: sanJose}
+	code, err = s.UpdateSensorIfMatch("Sensor1", &renamed, v3)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	_, v4, _, err := s.GetSensorVersion("Sensor3")
+	assert.NoError(t, err)
+	assert.Greater(t, v4, v3)
+
+	// Test a conditional removal, then that a new sensor with the same name never reuses a version
+	code, err = s.RemoveSensorIfMatch("Sensor3", v4)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	_, err = s.AddSensor(renamed)
+	assert.NoError(t, err)
+	_, v5, _, err := s.GetSensorVersion("Sensor3")
+	assert.NoError(t, err)
+	assert.Greater(t, v5, v4)
+	code, err = s.RemoveSensorIfMatch("Sensor3", v4)
+	checkError(t, 412, code, err)
+
+	// Check other sensors keep their versions
+	_, version, _, err = s.GetSensorVersion("Sensor2")
+	assert.NoError(t, err)
+	assert.Less(t, version, v2)
+}
+
+func testPatch(t *testing.T, s store.SensorStore) {
+	_, err := s.AddSensor(model.Sensor{Name: "Sensor1", Location: sanFrancisco, Tags: []string{"indoor"}})
+	assert.NoError(t, err)
+	_, err = s.AddSensor(model.Sensor{Name: "Sensor2", Location: oakland})
+	assert.NoError(t, err)
+	addTag := func(tag string) store.Patch {
+		return func(sensor model.Sensor) (model.Sensor, error) {
+			sensor.Tags = append(sensor.Tags, tag)
+			return sensor, nil
+		}
+	}
+
+	// Test a patch is applied to the current sensor and kept in the tag and spatial indexes
+	code, err := s.PatchSensor("Sensor1", func(sensor model.Sensor) (model.Sensor, error) {
+		assert.Equal(t, model.Sensor{Name: "Sensor1", Location: sanFrancisco, Tags: []string{"indoor"}}, sensor)
+		sensor.Location = sanJose
+		sensor.Tags = append(sensor.Tags, "outdoor")
+		return sensor, nil
+	}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	sensor, v1, _, err := s.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Sensor{Name: "Sensor1", Location: sanJose, Tags: []string{"indoor", "outdoor"}}, sensor)
+	checkNames(t, s, []string{"outdoor"}, "Sensor1")
+	sensors, _, err := s.GetSensorsWithinBoundingBox(37.3, -121.9, 37.4, -121.8)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Sensor1"}, names(sensors))
+
+	// Test a failed or invalid patch leaves the sensor unchanged
+	code, err = s.PatchSensor("Sensor1", func(sensor model.Sensor) (model.Sensor, error) {
+		sensor.Tags = nil
+		return sensor, fmt.Errorf("test failed")
+	}, 0)
+	checkError(t, 409, code, err)
+	code, err = s.PatchSensor("Sensor1", func(sensor model.Sensor) (model.Sensor, error) {
+		sensor.Location = model.Location{Latitude: 95}
+		return sensor, nil
+	}, 0)
+	checkError(t, 400, code, err)
+	code, err = s.PatchSensor("Sensor1", func(sensor model.Sensor) (model.Sensor, error) {
+		sensor.Name = "Sensor2"
+		return sensor, nil
+	}, 0)
+	checkError(t, 400, code, err)
+	retrieved, version, _, err := s.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+	assert.Equal(t, sensor, retrieved)
+	assert.Equal(t, v1, version)
+
+	// Check a patch is conditional on the version, and is not called for a missing sensor
+	code, err = s.PatchSensor("Sensor1", addTag("stale"), v1-1)
+	checkError(t, 412, code, err)
+	code, err = s.PatchSensor("Sensor3", func(sensor model.Sensor) (model.Sensor, error) {
+		t.Error("patch called for a missing sensor")
+		return sensor, nil
+	}, 0)
+	checkError(t, 404, code, err)
+	code, err = s.PatchSensor("Sensor1", addTag("current"), v1)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, code)
+	_, version, _, err = s.GetSensorVersion("Sensor1")
+	assert.NoError(t, err)
+	assert.Greater(t, version, v1)
+
+	// Test concurrent patches to one sensor are applied one at a time, so none is lost
+	const writers = 20
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			_, err := s.PatchSensor("Sensor2", addTag(fmt.Sprint("tag", w)), 0)
+			assert.NoError(t, err)
+		}(w)
+	}
+	wg.Wait()
+	sensor, _, err = s.GetSensor("Sensor2")
+	assert.NoError(t, err)
+	assert.Len(t, sensor.Tags, writers)
+}
+
+func testNearest(t *testing.T, s store.SensorStore) {
+	for _, sensor := range []model.Sensor{
+		{Name: "SanFrancisco", Location: sanFrancisco, Tags: []string{"indoor"}},
+		{Name: "Oakland", Location: oakland, Tags: []string{"outdoor"}},
+		{Name: "SanJose", Location: sanJose, Tags: []string{"indoor", "temperature"}},
+	} {
+		_, err := s.AddSensor(sensor)
+		assert.NoError(t, err)
+	}
+
+	nearest, code, err := s.GetNearestSensor(model.Location{Latitude: 37.8, Longitude: -122.3})
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "Oakland", nearest.Name)
+
+	// Test nearest with tags skips closer sensors without them
+	nearest, _, err = s.GetNearestSensorByTag(model.Location{Latitude: 37.8, Longitude: -122.3}, []string{"indoor"})
+	assert.NoError(t, err)
+	assert.Equal(t, "SanFrancisco", nearest.Name)
+	nearest, _, err = s.GetNearestSensorByTag(model.Location{Latitude: 37.8, Longitude: -122.3}, []string{"indoor", "temperature"})
+	assert.NoError(t, err)
+	assert.Equal(t, "SanJose", nearest.Name)
+	_, code, err = s.GetNearestSensorByTag(sanFrancisco, []string{"humidity"})
+	checkError(t, 404, code, err)
+
+	// Test k nearest are ordered closest first, with distances and bearings, and limited by maxDistance
+	sensors, code, err := s.GetNearestSensors(sanFrancisco, 5, 0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []string{"SanFrancisco", "Oakland", "SanJose"}, distanceNames(sensors))
+	assert.Zero(t, sensors[0].Distance)
+	assert.Equal(t, geo.HaversineDistance(sanFrancisco.Latitude, sanFrancisco.Longitude, oakland.Latitude, oakland.Longitude), sensors[1].Distance)
+	assert.Equal(t, geo.InitialBearing(sanFrancisco.Latitude, sanFrancisco.Longitude, oakland.Latitude, oakland.Longitude), sensors[1].Bearing)
+
+	sensors, _, err = s.GetNearestSensors(sanFrancisco, 2, 0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SanFrancisco", "Oakland"}, distanceNames(sensors))
+	sensors, _, err = s.GetNearestSensors(sanFrancisco, 5, 20000, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SanFrancisco", "Oakland"}, distanceNames(sensors))
+	sensors, _, err = s.GetNearestSensors(oakland, 5, 0, tagexpr.Tag("indoor"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SanFrancisco", "SanJose"}, distanceNames(sensors))
+	sensors, code, err = s.GetNearestSensors(oakland, 5, 0, tagexpr.Tag("humidity"))
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Empty(t, sensors)
+
+	// Test invalid arguments
+	_, code, err = s.GetNearestSensor(model.Location{Latitude: 100})
+	checkError(t, 400, code, err)
+	_, code, err = s.GetNearestSensors(sanFrancisco, 0, 0, nil)
+	checkError(t, 400, code, err)
+	_, code, err = s.GetNearestSensors(sanFrancisco, 1, -1, nil)
+	checkError(t, 400, code, err)
+}
+
+func testSpatial(t *testing.T, s store.SensorStore) {
+	for _, sensor := range []model.Sensor{
+		{Name: "SanFrancisco", Location: sanFrancisco, Tags: []string{"indoor"}},
+		{Name: "Oakland", Location: oakland, Tags: []string{"outdoor"}},
+		{Name: "SanJose", Location: sanJose, Tags: []string{"indoor"}},
+		{Name: "Fiji", Location: model.Location{Latitude: -17.7, Longitude: 179.9}, Tags: []string{"outdoor"}},
+		{Name: "Samoa", Location: model.Location{Latitude: -17.7, Longitude: -179.9}, Tags: []string{"outdoor"}},
+	} {
+		_, err := s.AddSensor(sensor)
+		assert.NoError(t, err)
+	}
+
+	sensors, code, err := s.GetSensorsWithinBoundingBox(37.7, -122.5, 37.9, -122.2)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.ElementsMatch(t, []string{"SanFrancisco", "Oakland"}, names(sensors))
+	sensors, _, err = s.GetSensorsByTagWithinBoundingBox(tagexpr.Tag("indoor"), 37, -123, 38, -121)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"SanFrancisco", "SanJose"}, names(sensors))
+	sensors, _, err = s.GetSensorsWithinBoundingBox(1, 1, 2, 2)
+	assert.NoError(t, err)
+	assert.Empty(t, sensors)
+
+	// Test radius searches are ordered closest first, and reach across the antimeridian
+	distances, code, err := s.GetSensorsWithinRadius(sanFrancisco, 20000)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []string{"SanFrancisco", "Oakland"}, distanceNames(distances))
+	distances, _, err = s.GetSensorsByTagWithinRadius(tagexpr.Tag("indoor"), oakland, 100000)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SanFrancisco", "SanJose"}, distanceNames(distances))
+	distances, _, err = s.GetSensorsWithinRadius(model.Location{Latitude: -17.7, Longitude: 179.95}, 20000)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Fiji", "Samoa"}, distanceNames(distances))
+
+	sensors, code, err = s.GetSensorsWithinPolygon(square)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.ElementsMatch(t, []string{"SanFrancisco", "Oakland", "SanJose"}, names(sensors))
+	sensors, _, err = s.GetSensorsByTagWithinPolygon(tagexpr.Tag("outdoor"), square)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Oakland"}, names(sensors))
+
+	// Test invalid arguments
+	_, code, err = s.GetSensorsWithinBoundingBox(38, -122, 37, -123)
+	checkError(t, 400, code, err)
+	_, code, err = s.GetSensorsWithinRadius(sanFrancisco, 0)
+	checkError(t, 400, code, err)
+	_, code, err = s.GetSensorsWithinRadius(model.Location{Latitude: 91}, 10)
+	checkError(t, 400, code, err)
+	_, code, err = s.GetSensorsWithinPolygon(geo.MultiPolygon{{{sanFrancisco, oakland, sanFrancisco}}})
+	checkError(t, 400, code, err)
+}
+
+func testConcurrentWriters(t *testing.T, s store.SensorStore) {
+	const writers, sensorsPerWriter = 8, 25
+
+	// each writer adds, moves and removes its own sensors while readers query the store
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < sensorsPerWriter; i++ {
+				name := fmt.Sprintf("Writer%d-%d", w, i)
+				location := model.Location{Latitude: float64(w + 1), Longitude: float64(i)}
+				if _, err := s.AddSensor(model.Sensor{Name: name, Location: location, Tags: []string{"new"}}); err != nil {
+					t.Error(err)
+				}
+				location.Latitude += 0.5
+				if _, err := s.UpdateSensor(name, &model.Sensor{Name: name, Location: location, Tags: []string{fmt.Sprint("writer", w)}}); err != nil {
+					t.Error(err)
+				}
+				if i%5 == 0 {
+					if _, err := s.RemoveSensor(name); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < sensorsPerWriter; i++ {
+				s.GetNearestSensors(model.Location{Latitude: float64(w + 1), Longitude: float64(i)}, 3, 0, nil)
+				s.GetSensorsByTags([]string{fmt.Sprint("writer", w)})
+				s.GetUniqueTags()
+				s.GetSensorCount()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Check every writer's changes landed, and the indexes agree with them
+	count, _, err := s.GetSensorCount()
+	assert.NoError(t, err)
+	assert.Equal(t, writers*sensorsPerWriter*4/5, count)
+	checkNames(t, s, []string{"new"})
+	for w := 0; w < writers; w++ {
+		sensors, _, err := s.GetSensorsByTags([]string{fmt.Sprint("writer", w)})
+		assert.NoError(t, err)
+		assert.Len(t, sensors, sensorsPerWriter*4/5)
+		sensors, _, err = s.GetSensorsWithinBoundingBox(float64(w)+1.25, 0, float64(w)+1.75, sensorsPerWriter)
+		assert.NoError(t, err)
+		assert.Len(t, sensors, sensorsPerWriter*4/5)
+	}
+}
+
+func testEvents(t *testing.T, s store.SensorStore) {
+	source, ok := s.(store.EventSource)
+	if !ok {
+		t.Skip("store does not publish events")
+	}
+	broker := events.NewBroker(100, 100)
+	source.SetEventSink(broker)
+	sub := broker.Subscribe()
+	defer sub.Close()
+	sensor1 := model.Sensor{Name: "Sensor1", Location: sanFrancisco, Tags: []string{"indoor"}}
+	moved := model.Sensor{Name: "Sensor1", Location: oakland, Tags: []string{"outdoor"}}
+
+	// Test each successful change publishes an event with the sensor before and after it
+	_, err := s.AddSensor(sensor1)
+	assert.NoError(t, err)
+	_, err = s.AddSensor(sensor1)
+	assert.Error(t, err)
+	_, err = s.UpdateSensor("Sensor1", &moved)
+	assert.NoError(t, err)
+	_, err = s.UpdateSensorIfMatch("Sensor1", &sensor1, 1<<60)
+	assert.Error(t, err)
+	_, err = s.RemoveSensor("Sensor1")
+	assert.NoError(t, err)
+	_, err = s.RemoveSensor("Sensor1")
+	assert.Error(t, err)
+	assert.Equal(t, uint64(3), broker.LastID())
+	event := <-sub.Events
+	assert.Equal(t, events.TypeCreated, event.Type)
+	assert.Equal(t, "Sensor1", event.Name)
+	assert.Equal(t, &sensor1, event.Sensor)
+	assert.Nil(t, event.Previous)
+	event = <-sub.Events
+	assert.Equal(t, events.TypeUpdated, event.Type)
+	assert.Equal(t, "Sensor1", event.Name)
+	assert.Equal(t, &sensor1, event.Previous)
+	assert.Equal(t, &moved, event.Sensor)
+	event = <-sub.Events
+	assert.Equal(t, events.TypeDeleted, event.Type)
+	assert.Equal(t, &moved, event.Previous)
+	assert.Nil(t, event.Sensor)
+
+	// Check a failed atomic batch publishes nothing, and any other batch publishes the sensors added
+	_, _, err = s.AddSensors([]model.Sensor{{Name: "Sensor2", Location: oakland}, {Name: "Sensor3"}}, true)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(3), broker.LastID())
+	_, _, err = s.AddSensors([]model.Sensor{{Name: "Sensor2", Location: oakland}, {Name: "Sensor3"}}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), broker.LastID())
+	event = <-sub.Events
+	assert.Equal(t, events.TypeCreated, event.Type)
+	assert.Equal(t, "Sensor2", event.Name)
+
+	// Test concurrent changes to one sensor are published in the order they were made
+	const writers = 20
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			_, err := s.PatchSensor("Sensor2", func(sensor model.Sensor) (model.Sensor, error) {
+				sensor.Tags = append(sensor.Tags, fmt.Sprint("tag", w))
+				return sensor, nil
+			}, 0)
+			assert.NoError(t, err)
+		}(w)
+	}
+	wg.Wait()
+	for i := 0; i < writers; i++ {
+		event := <-sub.Events
+		assert.Len(t, event.Previous.Tags, i)
+		assert.Len(t, event.Sensor.Tags, i+1)
+	}
+
+	// Check no more events are published once the sink is removed
+	source.SetEventSink(nil)
+	_, err = s.RemoveSensor("Sensor2")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4+writers), broker.LastID())
+}
+
+// checkError checks a call failed with the given status code.
+func testLogger(t *testing.T, s store.SensorStore) {
+	if _, ok := s.(store.ScopedStore); !ok {
+		t.Skip("store does not log with other loggers")
+	}
+	logger, hook := test.NewNullLogger()
+	scoped := store.WithLogger(s, logger.WithField("request_id", "req-1"))
+
+	// Test a view of the store logs its failures with the fields of its logger
+	_, code, err := scoped.GetSensor("Sensor1")
+	checkError(t, 404, code, err)
+	if assert.NotNil(t, hook.LastEntry()) {
+		assert.Equal(t, log.ErrorLevel, hook.LastEntry().Level)
+		assert.Equal(t, "req-1", hook.LastEntry().Data["request_id"])
+	}
+
+	// Check the view shares the store's data, and the store keeps its own logger
+	_, err = scoped.AddSensor(model.Sensor{Name: "Sensor1", Location: sanFrancisco})
+	assert.NoError(t, err)
+	_, _, err = s.GetSensor("Sensor1")
+	assert.NoError(t, err)
+	hook.Reset()
+	_, _, err = s.GetSensor("Sensor2")
+	assert.Error(t, err)
+	assert.Nil(t, hook.LastEntry())
+}
+
+func checkError(t *testing.T, expected, code int, err error) {
+	t.Helper()
+	assert.Error(t, err)
+	assert.Equal(t, expected, code)
+}
+
+// checkNames checks the sensors with every one of the tags have the given names.
+func checkNames(t *testing.T, s store.SensorStore, tags []string, expected ...string) {
+	t.Helper()
+	sensors, code, err := s.GetSensorsByTags(tags)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	if expected == nil {
+		expected = []string{}
+	}
+	assert.ElementsMatch(t, expected, names(sensors), tags)
+}
+
+func names(sensors []model.Sensor) []string {
+	names := make([]string, len(sensors))
+	for i, sensor := range sensors {
+		names[i] = sensor.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+func distanceNames(sensors []model.SensorDistance) []string {
+	names := make([]string, len(sensors))
+	for i, sensor := range sensors {
+		names[i] = sensor.Name
+	}
+	return names
+}
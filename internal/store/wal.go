@@ -0,0 +1,120 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sensor-api/internal/model"
+)
+
+// The write-ahead log is a sequence of records, each framed as
+//
+//	length uint32 | checksum uint32 | payload
+//
+// in little-endian byte order, where payload is a JSON encoded walRecord of the given length and
+// checksum is its CRC-32C. A crash part way through an append leaves a final record that is short or
+// fails its checksum, which is discarded when the log is read back.
+
+const (
+	walHeaderSize = 8
+
+	opAddSensor    = "add"
+	opAddSensors   = "add_batch"
+	opUpdateSensor = "update"
+	opRemoveSensor = "remove"
+	opAddReadings  = "readings"
+)
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walRecord is a single change to the store.
+type walRecord struct {
+	// Seq numbers records in the order they were applied, continuing across snapshots.
+	Seq    uint64        `json:"seq"`
+	Op     string        `json:"op"`
+	Name   string        `json:"name,omitempty"`
+	Sensor *model.Sensor `json:"sensor,omitempty"`
+	// Sensors are the sensors of a batch that were added.
+	Sensors  []model.Sensor  `json:"sensors,omitempty"`
+	Readings []model.Reading `json:"readings,omitempty"`
+	// Version is the version an update or removal was conditional on, or 0 if it was unconditional.
+	Version uint64 `json:"version,omitempty"`
+}
+
+// appendRecord writes a record to the end of the log and waits for it to reach the disk.
+func appendRecord(f *os.File, record walRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.Checksum(payload, walTable))
+	copy(frame[walHeaderSize:], payload)
+
+	if _, err := f.Write(frame); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// readRecords calls fn for every intact record in the log. It returns the offset just past the last
+// intact record, which is short of the end of the log if the final record was torn by a crash.
+// A damaged record followed by more data, or whose length runs past the end of the log over an
+// intact record, is reported as an error, since that is corruption rather than an interrupted append.
+func readRecords(r io.Reader, fn func(walRecord)) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	var offset int64
+	for offset < int64(len(data)) {
+		if int64(len(data))-offset < walHeaderSize {
+			return offset, nil
+		}
+		length := int64(binary.LittleEndian.Uint32(data[offset:]))
+		checksum := binary.LittleEndian.Uint32(data[offset+4:])
+		end := offset + walHeaderSize + length
+		if end > int64(len(data)) {
+			if intactAfter(data, offset+walHeaderSize) {
+				return offset, fmt.Errorf("corrupt log record length at offset %d", offset)
+			}
+			return offset, nil
+		}
+
+		payload := data[offset+walHeaderSize : end]
+		var record walRecord
+		if crc32.Checksum(payload, walTable) != checksum || json.Unmarshal(payload, &record) != nil {
+			if end == int64(len(data)) {
+				return offset, nil
+			}
+			return offset, fmt.Errorf("corrupt log record at offset %d", offset)
+		}
+
+		fn(record)
+		offset = end
+	}
+	return offset, nil
+}
+
+// intactAfter reports whether an intact record starts anywhere in the log from offset on. A torn
+// append leaves only part of one record after the last intact one, so an intact record past a
+// record that runs off the end of the log means that record's length is corrupt.
+func intactAfter(data []byte, offset int64) bool {
+	for ; offset+walHeaderSize <= int64(len(data)); offset++ {
+		length := int64(binary.LittleEndian.Uint32(data[offset:]))
+		end := offset + walHeaderSize + length
+		if end > int64(len(data)) {
+			continue
+		}
+		if crc32.Checksum(data[offset+walHeaderSize:end], walTable) == binary.LittleEndian.Uint32(data[offset+4:]) {
+			return true
+		}
+	}
+	return false
+}
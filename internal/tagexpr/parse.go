@@ -0,0 +1,31 @@
+package tagexpr
+
+import (
+	"sensor-api/internal/boolexpr"
+)
+
+// SyntaxError describes a malformed tag expression.
+type SyntaxError = boolexpr.SyntaxError
+
+// language is the syntax of tag expressions, whose terms are tags, bare or double quoted.
+var language = &boolexpr.Language{Name: "expression", Quotes: `"`, WordName: "tag", StringName: "tag"}
+
+// Parse parses a tag expression. Errors are of type *SyntaxError.
+func Parse(s string) (Expr, error) {
+	p := &boolexpr.Parser[Expr]{
+		Term: parseTag,
+		And:  func(operands []Expr) Expr { return And(operands) },
+		Or:   func(operands []Expr) Expr { return Or(operands) },
+		Not:  func(operand Expr) Expr { return Not{X: operand} },
+	}
+	return p.Parse(language, s)
+}
+
+func parseTag(p *boolexpr.Parser[Expr]) (Expr, error) {
+	tok := p.Tok()
+	if tok.Kind != boolexpr.Word && tok.Kind != boolexpr.String {
+		return nil, p.Errorf("expected tag, found %s", tok)
+	}
+	p.Next()
+	return Tag(tok.Value), nil
+}
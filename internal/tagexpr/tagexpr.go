@@ -0,0 +1,234 @@
+package tagexpr
+
+import (
+	"fmt"
+	"sensor-api/internal/boolexpr"
+	"sort"
+	"strings"
+)
+
+// A tag expression combines tags with AND, OR, NOT and parentheses, for example:
+//
+//	(temperature OR humidity) AND NOT decommissioned
+//
+// NOT binds tighter than AND, which binds tighter than OR. Keywords are case-insensitive. Tags that
+// contain spaces or parentheses, or that are spelled like a keyword, can be double quoted.
+
+// Expr is a parsed tag expression.
+type Expr interface {
+	// Match reports whether a sensor satisfies the expression, given a function reporting whether the
+	// sensor has a tag.
+	Match(has func(tag string) bool) bool
+	// Eval returns the names of every sensor in the index satisfying the expression.
+	// The returned set must not be modified, as it may be shared with the index.
+	Eval(index Index) map[string]struct{}
+	// String returns the expression in a form that parses back to the same expression.
+	String() string
+}
+
+// Index is an inverted index of tags, such as the one kept by store.InMemorySensorStore.
+type Index interface {
+	// Lookup returns the names of the sensors with the tag. The caller must not modify the set.
+	Lookup(tag string) map[string]struct{}
+	// All returns the names of every sensor. The caller must not modify the set.
+	All() map[string]struct{}
+}
+
+// Tag matches sensors with the tag.
+type Tag string
+
+// Not matches sensors that do not match X.
+type Not struct {
+	X Expr
+}
+
+// And matches sensors that match every one of its operands.
+type And []Expr
+
+// Or matches sensors that match any of its operands.
+type Or []Expr
+
+// AllOf returns an expression matching sensors with every one of the tags, or nil if there are none.
+// It is equivalent to the tags query parameter.
+func AllOf(tags []string) Expr {
+	switch len(tags) {
+	case 0:
+		return nil
+	case 1:
+		return Tag(tags[0])
+	}
+	and := make(And, len(tags))
+	for i, tag := range tags {
+		and[i] = Tag(tag)
+	}
+	return and
+}
+
+// Both returns an expression matching sensors that match both a and b. Either may be nil, meaning
+// every sensor matches.
+func Both(a, b Expr) Expr {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+	return And{a, b}
+}
+
+// Match reports whether x matches a sensor with the given tags. A nil expression matches every sensor.
+func Match(x Expr, tags []string) bool {
+	if x == nil {
+		return true
+	}
+	return x.Match(func(tag string) bool {
+		for _, t := range tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (t Tag) Match(has func(tag string) bool) bool {
+	return has(string(t))
+}
+
+func (t Tag) Eval(index Index) map[string]struct{} {
+	names := index.Lookup(string(t))
+	if names == nil {
+		return map[string]struct{}{}
+	}
+	return names
+}
+
+func (t Tag) String() string {
+	if needsQuotes(string(t)) {
+		return fmt.Sprintf("%q", string(t))
+	}
+	return string(t)
+}
+
+func (n Not) Match(has func(tag string) bool) bool {
+	return !n.X.Match(has)
+}
+
+func (n Not) Eval(index Index) map[string]struct{} {
+	return difference(index.All(), n.X.Eval(index))
+}
+
+func (n Not) String() string {
+	return "NOT " + wrap(n.X)
+}
+
+func (a And) Match(has func(tag string) bool) bool {
+	for _, x := range a {
+		if !x.Match(has) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a And) Eval(index Index) map[string]struct{} {
+	// intersect the positive operands first, so negated ones only have to be subtracted rather
+	// than complemented against every sensor
+	var positive, negative []Expr
+	for _, x := range a {
+		if not, ok := x.(Not); ok {
+			negative = append(negative, not.X)
+		} else {
+			positive = append(positive, x)
+		}
+	}
+
+	result := index.All()
+	if len(positive) > 0 {
+		sets := make([]map[string]struct{}, len(positive))
+		for i, x := range positive {
+			sets[i] = x.Eval(index)
+		}
+		// start from the smallest set to keep the intersection cheap
+		sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+		result = sets[0]
+		for _, set := range sets[1:] {
+			result = intersection(result, set)
+		}
+	}
+	for _, x := range negative {
+		result = difference(result, x.Eval(index))
+	}
+	return result
+}
+
+func (a And) String() string {
+	return join(a, " AND ")
+}
+
+func (o Or) Match(has func(tag string) bool) bool {
+	for _, x := range o {
+		if x.Match(has) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o Or) Eval(index Index) map[string]struct{} {
+	result := make(map[string]struct{})
+	for _, x := range o {
+		for name := range x.Eval(index) {
+			result[name] = struct{}{}
+		}
+	}
+	return result
+}
+
+func (o Or) String() string {
+	return join(o, " OR ")
+}
+
+func intersection(a, b map[string]struct{}) map[string]struct{} {
+	result := make(map[string]struct{})
+	for name := range a {
+		if _, ok := b[name]; ok {
+			result[name] = struct{}{}
+		}
+	}
+	return result
+}
+
+func difference(a, b map[string]struct{}) map[string]struct{} {
+	result := make(map[string]struct{})
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			result[name] = struct{}{}
+		}
+	}
+	return result
+}
+
+func join(xs []Expr, sep string) string {
+	parts := make([]string, len(xs))
+	for i, x := range xs {
+		parts[i] = wrap(x)
+	}
+	return strings.Join(parts, sep)
+}
+
+// wrap parenthesises compound operands so that String round-trips through Parse.
+func wrap(x Expr) string {
+	switch x.(type) {
+	case And, Or:
+		return "(" + x.String() + ")"
+	}
+	return x.String()
+}
+
+func needsQuotes(tag string) bool {
+	if tag == "" || boolexpr.IsKeyword(tag) {
+		return true
+	}
+	return strings.ContainsAny(tag, " \t\r\n()\"")
+}
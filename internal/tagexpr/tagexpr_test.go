@@ -0,0 +1,130 @@
+package tagexpr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testIndex is an inverted index over a fixed set of sensors.
+type testIndex map[string][]string
+
+func (index testIndex) Lookup(tag string) map[string]struct{} {
+	var names map[string]struct{}
+	for name, tags := range index {
+		for _, t := range tags {
+			if t == tag {
+				if names == nil {
+					names = make(map[string]struct{})
+				}
+				names[name] = struct{}{}
+			}
+		}
+	}
+	return names
+}
+
+func (index testIndex) All() map[string]struct{} {
+	names := make(map[string]struct{})
+	for name := range index {
+		names[name] = struct{}{}
+	}
+	return names
+}
+
+func TestParse(t *testing.T) {
+	for input, expected := range map[string]Expr{
+		"temperature":  Tag("temperature"),
+		"a AND b":      And{Tag("a"), Tag("b")},
+		"a and b or c": Or{And{Tag("a"), Tag("b")}, Tag("c")},
+		"a OR b AND c": Or{Tag("a"), And{Tag("b"), Tag("c")}},
+		"NOT a AND b":  And{Not{X: Tag("a")}, Tag("b")},
+		"NOT NOT a":    Not{X: Not{X: Tag("a")}},
+		"(temperature OR humidity) AND NOT decommissioned": And{Or{Tag("temperature"), Tag("humidity")}, Not{X: Tag("decommissioned")}},
+		`"floor 1" OR "and"`: Or{Tag("floor 1"), Tag("and")},
+		"  ( ( a ) )  ":      Tag("a"),
+		"site:sf-01":         Tag("site:sf-01"),
+	} {
+		x, err := Parse(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, x, input)
+
+		// String round-trips through Parse
+		roundTrip, err := Parse(x.String())
+		assert.NoError(t, err, x.String())
+		assert.Equal(t, x, roundTrip, x.String())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for input, pos := range map[string]int{
+		"":                0,
+		"a AND":           5,
+		"a b":             2,
+		"(a OR b":         0,
+		"(a OR b c)":      8,
+		"a OR )":          5,
+		"NOT":             3,
+		`a AND "unclosed`: 6,
+		"a AND (b OR ())": 13,
+		"a ) b":           2,
+	} {
+		_, err := Parse(input)
+		if assert.Error(t, err, input) {
+			syntaxErr, ok := err.(*SyntaxError)
+			assert.True(t, ok, input)
+			assert.Equal(t, pos, syntaxErr.Pos, "%s: %s", input, err)
+		}
+	}
+}
+
+func TestEvalAndMatch(t *testing.T) {
+	index := testIndex{
+		"Sensor1": {"temperature", "indoor"},
+		"Sensor2": {"humidity", "outdoor"},
+		"Sensor3": {"temperature", "decommissioned"},
+		"Sensor4": {"pressure"},
+	}
+
+	for input, expected := range map[string][]string{
+		"temperature":                  {"Sensor1", "Sensor3"},
+		"temperature AND indoor":       {"Sensor1"},
+		"temperature OR humidity":      {"Sensor1", "Sensor2", "Sensor3"},
+		"NOT temperature":              {"Sensor2", "Sensor4"},
+		"missing":                      {},
+		"NOT missing AND NOT pressure": {"Sensor1", "Sensor2", "Sensor3"},
+		"(temperature OR humidity) AND NOT decommissioned": {"Sensor1", "Sensor2"},
+	} {
+		x, err := Parse(input)
+		assert.NoError(t, err, input)
+
+		var evaluated []string
+		for name := range x.Eval(index) {
+			evaluated = append(evaluated, name)
+		}
+		assert.ElementsMatch(t, expected, evaluated, input)
+
+		// matching sensors one at a time agrees with evaluating against the index
+		var matched []string
+		for name, tags := range index {
+			if Match(x, tags) {
+				matched = append(matched, name)
+			}
+		}
+		assert.ElementsMatch(t, expected, matched, input)
+	}
+}
+
+func TestAllOfAndBoth(t *testing.T) {
+	assert.Nil(t, AllOf(nil))
+	assert.Equal(t, Tag("a"), AllOf([]string{"a"}))
+	assert.Equal(t, And{Tag("a"), Tag("b")}, AllOf([]string{"a", "b"}))
+
+	assert.Nil(t, Both(nil, nil))
+	assert.Equal(t, Tag("a"), Both(Tag("a"), nil))
+	assert.Equal(t, Tag("b"), Both(nil, Tag("b")))
+	assert.Equal(t, And{Tag("a"), Tag("b")}, Both(Tag("a"), Tag("b")))
+
+	// a nil expression matches everything
+	assert.True(t, Match(nil, nil))
+}
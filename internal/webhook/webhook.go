@@ -0,0 +1,448 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sensor-api/internal/events"
+	"sensor-api/internal/ids"
+	"sensor-api/internal/model"
+	"sensor-api/internal/tagexpr"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A Dispatcher delivers the changes published to a broker to the webhooks subscribed to them. Each
+// delivery is a POST of the event as JSON, signed with the webhook's secret, and is made in the
+// background, independently of the request that changed the sensor. Failed deliveries are retried with
+// exponential backoff, and those that still fail are kept as dead letters to be inspected and replayed.
+//
+// Webhooks and dead letters are held in memory, and lost on restart.
+
+// Headers sent with each delivery
+const (
+	HeaderEvent     = "X-Sensor-Event"
+	HeaderDelivery  = "X-Sensor-Delivery"
+	HeaderSignature = "X-Sensor-Signature"
+)
+
+// Options configures a Dispatcher. Zero values are replaced by the defaults.
+type Options struct {
+	// MaxAttempts is the number of times a delivery is attempted before it is dead-lettered.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubled for each retry after it up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Timeout limits each attempt.
+	Timeout time.Duration
+	// MaxDeadLetters is the number of dead letters kept, dropping the oldest beyond it.
+	MaxDeadLetters int
+	// Client makes the deliveries.
+	Client *http.Client
+}
+
+// DefaultOptions are the options used in place of zero values.
+var DefaultOptions = Options{
+	MaxAttempts:    5,
+	Backoff:        time.Second,
+	MaxBackoff:     time.Minute,
+	Timeout:        10 * time.Second,
+	MaxDeadLetters: 1000,
+	Client:         http.DefaultClient,
+}
+
+// maxInFlight is the most deliveries attempted at once.
+const maxInFlight = 16
+
+// Webhook is a subscription to the changes made to sensors.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Events are the event types delivered, or every type if empty.
+	Events []string `json:"events,omitempty"`
+	// Tags and TagExpr select the sensors whose changes are delivered, as the tags and tag_expr query
+	// parameters do. A change is delivered if the sensor matches before or after it.
+	Tags    []string `json:"tags,omitempty"`
+	TagExpr string   `json:"tag_expr,omitempty"`
+	// Secret signs the deliveries. It is only returned when the webhook is created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	filter tagexpr.Expr
+}
+
+// matches reports whether the webhook is subscribed to the event.
+func (hook *Webhook) matches(event events.Event) bool {
+	if len(hook.Events) > 0 {
+		subscribed := false
+		for _, t := range hook.Events {
+			subscribed = subscribed || t == event.Type
+		}
+		if !subscribed {
+			return false
+		}
+	}
+	for _, sensor := range []*model.Sensor{event.Sensor, event.Previous} {
+		if sensor != nil && tagexpr.Match(hook.filter, sensor.Tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery is an event sent to a webhook.
+type Delivery struct {
+	ID        string       `json:"id"`
+	WebhookID string       `json:"webhook_id"`
+	Event     events.Event `json:"event"`
+	// Attempts is the number of attempts made, and Error the reason the last one failed.
+	Attempts      int       `json:"attempts"`
+	Error         string    `json:"error,omitempty"`
+	LastAttemptAt time.Time `json:"last_attempt_at"`
+}
+
+// Dispatcher delivers events to webhooks.
+type Dispatcher struct {
+	broker *events.Broker
+	opts   Options
+
+	mu    sync.Mutex
+	hooks map[string]*Webhook
+	// deadLetters holds the deliveries that failed every attempt, oldest first
+	deadLetters []Delivery
+
+	inFlight chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewDispatcher creates a Dispatcher delivering the events published to broker. It starts delivering
+// once Start is called.
+func NewDispatcher(broker *events.Broker, opts Options) *Dispatcher {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultOptions.MaxAttempts
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultOptions.Backoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultOptions.MaxBackoff
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultOptions.Timeout
+	}
+	if opts.MaxDeadLetters <= 0 {
+		opts.MaxDeadLetters = DefaultOptions.MaxDeadLetters
+	}
+	if opts.Client == nil {
+		opts.Client = DefaultOptions.Client
+	}
+	return &Dispatcher{
+		broker:   broker,
+		opts:     opts,
+		hooks:    make(map[string]*Webhook),
+		inFlight: make(chan struct{}, maxInFlight),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start subscribes to the broker and delivers the events published from now on.
+func (d *Dispatcher) Start() {
+	sub := d.broker.Subscribe()
+	d.wg.Add(1)
+	go d.run(sub)
+}
+
+// Close stops delivering and waits for the attempts in progress. Deliveries waiting to be retried are
+// abandoned.
+func (d *Dispatcher) Close() {
+	close(d.done)
+	d.wg.Wait()
+}
+
+// run reads events from the subscription until the dispatcher is closed.
+func (d *Dispatcher) run(sub *events.Subscription) {
+	defer d.wg.Done()
+	var lastID uint64
+	for {
+		select {
+		case <-d.done:
+			sub.Close()
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				// the dispatcher only falls behind if it is starved, so it catches up from the broker's buffer
+				var (
+					backlog []events.Event
+					missed  bool
+				)
+				sub, backlog, missed = d.broker.Resume(lastID)
+				if missed {
+					log.Error("Webhook deliveries missed: events after ", lastID, " have left the buffer")
+				}
+				for _, event := range backlog {
+					d.dispatch(event)
+					lastID = event.ID
+				}
+				continue
+			}
+			if event.ID > lastID {
+				d.dispatch(event)
+				lastID = event.ID
+			}
+		}
+	}
+}
+
+// dispatch starts delivering an event to every webhook subscribed to it.
+func (d *Dispatcher) dispatch(event events.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, hook := range d.hooks {
+		if hook.matches(event) {
+			d.deliver(Delivery{ID: ids.New(), WebhookID: hook.ID, Event: event})
+		}
+	}
+}
+
+// deliver attempts a delivery in the background until it succeeds, or dead-letters it once every
+// attempt has failed.
+func (d *Dispatcher) deliver(delivery Delivery) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		backoff := d.opts.Backoff
+		for {
+			err := d.attempt(&delivery)
+			if err == nil {
+				log.Debug("Delivered ", delivery.Event.Type, " event ", delivery.Event.ID, " to webhook ", delivery.WebhookID)
+				return
+			}
+			log.Error("Failed to deliver event ", delivery.Event.ID, " to webhook ", delivery.WebhookID, ": ", err)
+			if delivery.Attempts >= d.opts.MaxAttempts {
+				d.deadLetter(delivery)
+				return
+			}
+
+			select {
+			case <-d.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > d.opts.MaxBackoff {
+				backoff = d.opts.MaxBackoff
+			}
+		}
+	}()
+}
+
+// attempt makes one attempt at a delivery, recording it.
+func (d *Dispatcher) attempt(delivery *Delivery) error {
+	select {
+	case d.inFlight <- struct{}{}:
+		defer func() { <-d.inFlight }()
+	case <-d.done:
+		return fmt.Errorf("dispatcher closed")
+	}
+
+	d.mu.Lock()
+	hook, ok := d.hooks[delivery.WebhookID]
+	d.mu.Unlock()
+	if !ok {
+		// the webhook was removed since the event, so there is no one left to deliver to
+		return nil
+	}
+
+	delivery.Attempts++
+	delivery.LastAttemptAt = time.Now().UTC()
+	err := d.post(hook, delivery)
+	delivery.Error = ""
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	return err
+}
+
+// post sends a delivery to its webhook, failing unless the webhook responds with a 2xx status.
+func (d *Dispatcher) post(hook *Webhook, delivery *Delivery) error {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.Event.Type)
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderSignature, Sign(hook.Secret, body))
+
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// deadLetter keeps a delivery that failed every attempt.
+func (d *Dispatcher) deadLetter(delivery Delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	log.Error("Dead-lettering delivery ", delivery.ID, " to webhook ", delivery.WebhookID, " after ", delivery.Attempts, " attempts")
+	d.deadLetters = append(d.deadLetters, delivery)
+	if len(d.deadLetters) > d.opts.MaxDeadLetters {
+		d.deadLetters = append([]Delivery(nil), d.deadLetters[len(d.deadLetters)-d.opts.MaxDeadLetters:]...)
+	}
+}
+
+// Sign returns the signature of a delivery body: the hex encoded HMAC-SHA256 of the body keyed with the
+// webhook's secret, prefixed with "sha256=". Receivers should compute it themselves and compare the
+// two with hmac.Equal.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// AddWebhook validates and adds a webhook, giving it an ID and, if it has none, a secret. The webhook
+// returned includes the secret.
+func (d *Dispatcher) AddWebhook(hook Webhook) (Webhook, int, error) {
+	target, err := url.Parse(hook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		log.Error("Invalid webhook URL: ", hook.URL)
+		return Webhook{}, http.StatusBadRequest, fmt.Errorf("url must be an absolute http or https URL")
+	}
+	for _, t := range hook.Events {
+		switch t {
+		case events.TypeCreated, events.TypeUpdated, events.TypeDeleted, events.TypeGeofenceEnter, events.TypeGeofenceExit:
+		default:
+			log.Error("Invalid webhook event type: ", t)
+			return Webhook{}, http.StatusBadRequest, fmt.Errorf("unknown event type %q", t)
+		}
+	}
+	hook.filter = tagexpr.AllOf(hook.Tags)
+	if hook.TagExpr != "" {
+		expr, err := tagexpr.Parse(hook.TagExpr)
+		if err != nil {
+			log.Error("Invalid webhook tag expression: ", err)
+			return Webhook{}, http.StatusBadRequest, fmt.Errorf("invalid tag_expr: %w", err)
+		}
+		hook.filter = tagexpr.Both(hook.filter, expr)
+	}
+	if hook.Secret == "" {
+		hook.Secret = ids.New() + ids.New()
+	}
+	hook.ID = ids.New()
+	hook.CreatedAt = time.Now().UTC()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.hooks[hook.ID] = &hook
+	log.Info("Added webhook ", hook.ID, " for ", hook.URL)
+	return hook, http.StatusCreated, nil
+}
+
+// GetWebhook returns a webhook, without its secret.
+func (d *Dispatcher) GetWebhook(id string) (Webhook, int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hook, ok := d.hooks[id]
+	if !ok {
+		log.Error("Webhook not found: ", id)
+		return Webhook{}, http.StatusNotFound, fmt.Errorf("webhook not found")
+	}
+	return hook.redacted(), http.StatusOK, nil
+}
+
+// GetWebhooks returns every webhook, without their secrets, oldest first.
+func (d *Dispatcher) GetWebhooks() ([]Webhook, int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hooks := make([]Webhook, 0, len(d.hooks))
+	for _, hook := range d.hooks {
+		hooks = append(hooks, hook.redacted())
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		if !hooks[i].CreatedAt.Equal(hooks[j].CreatedAt) {
+			return hooks[i].CreatedAt.Before(hooks[j].CreatedAt)
+		}
+		return hooks[i].ID < hooks[j].ID
+	})
+	return hooks, http.StatusOK, nil
+}
+
+// RemoveWebhook removes a webhook. Deliveries to it still waiting to be retried are dropped.
+func (d *Dispatcher) RemoveWebhook(id string) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.hooks[id]; !ok {
+		log.Error("Webhook not found: ", id)
+		return http.StatusNotFound, fmt.Errorf("webhook not found")
+	}
+	delete(d.hooks, id)
+	log.Info("Removed webhook ", id)
+	return http.StatusNoContent, nil
+}
+
+// GetDeadLetters returns the deliveries that failed every attempt, oldest first.
+func (d *Dispatcher) GetDeadLetters() ([]Delivery, int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]Delivery{}, d.deadLetters...), http.StatusOK, nil
+}
+
+// ReplayDeadLetter removes a dead letter and delivers it again, with a fresh set of attempts.
+func (d *Dispatcher) ReplayDeadLetter(id string) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, delivery := range d.deadLetters {
+		if delivery.ID != id {
+			continue
+		}
+		if _, ok := d.hooks[delivery.WebhookID]; !ok {
+			log.Error("Webhook not found: ", delivery.WebhookID)
+			return http.StatusConflict, fmt.Errorf("webhook %s has been removed", delivery.WebhookID)
+		}
+		d.deadLetters = append(d.deadLetters[:i:i], d.deadLetters[i+1:]...)
+		delivery.Attempts, delivery.Error = 0, ""
+		d.deliver(delivery)
+		log.Info("Replaying delivery ", id, " to webhook ", delivery.WebhookID)
+		return http.StatusAccepted, nil
+	}
+	log.Error("Dead letter not found: ", id)
+	return http.StatusNotFound, fmt.Errorf("dead letter not found")
+}
+
+// redacted returns a copy of the webhook without its secret.
+func (hook *Webhook) redacted() Webhook {
+	redacted := *hook
+	redacted.Secret = ""
+	return redacted
+}
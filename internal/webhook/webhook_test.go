@@ -0,0 +1,200 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sensor-api/internal/events"
+	"sensor-api/internal/model"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// receiver is a local webhook endpoint recording the deliveries it accepts. It fails the first
+// failures requests it is sent.
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+	received chan struct{}
+}
+
+func newReceiver(t *testing.T, failures int) (*receiver, *httptest.Server) {
+	rec := &receiver{failures: failures, received: make(chan struct{}, 100)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		if rec.failures > 0 {
+			rec.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rec.requests = append(rec.requests, r)
+		rec.bodies = append(rec.bodies, body)
+		rec.received <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return rec, server
+}
+
+// wait waits for the receiver to accept a delivery.
+func (rec *receiver) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-rec.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a delivery")
+	}
+}
+
+func newTestDispatcher(t *testing.T) (*Dispatcher, *events.Broker) {
+	broker := events.NewBroker(0, 0)
+	d := NewDispatcher(broker, Options{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+	d.Start()
+	t.Cleanup(d.Close)
+	return d, broker
+}
+
+func sensor(name string, tags ...string) model.Sensor {
+	return model.Sensor{Name: name, Location: model.Location{Latitude: 1, Longitude: 1}, Tags: tags}
+}
+
+func TestDelivery(t *testing.T) {
+	d, broker := newTestDispatcher(t)
+	rec, server := newReceiver(t, 0)
+	hook, code, err := d.AddWebhook(Webhook{URL: server.URL, Secret: "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, code)
+
+	// Test an event is posted as JSON with its type, a delivery ID and a signature of the body
+	broker.Publish(events.Created(sensor("Sensor1")))
+	rec.wait(t)
+	req, body := rec.requests[0], rec.bodies[0]
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, events.TypeCreated, req.Header.Get(HeaderEvent))
+	assert.NotEmpty(t, req.Header.Get(HeaderDelivery))
+	assert.Equal(t, Sign("secret", body), req.Header.Get(HeaderSignature))
+	assert.Equal(t, "sha256=", Sign("secret", body)[:7])
+	var event events.Event
+	assert.NoError(t, json.Unmarshal(body, &event))
+	assert.Equal(t, uint64(1), event.ID)
+	assert.Equal(t, "Sensor1", event.Sensor.Name)
+
+	// Check nothing is delivered once the webhook is removed
+	code, err = d.RemoveWebhook(hook.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, code)
+	code, err = d.RemoveWebhook(hook.ID)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestFilters(t *testing.T) {
+	d, broker := newTestDispatcher(t)
+	rec, server := newReceiver(t, 0)
+	_, _, err := d.AddWebhook(Webhook{URL: server.URL, Events: []string{events.TypeUpdated, events.TypeDeleted}, Tags: []string{"outdoor"}})
+	assert.NoError(t, err)
+
+	// Test only the subscribed event types are delivered, for sensors matching before or after the change
+	broker.Publish(events.Created(sensor("Sensor1", "outdoor")))
+	broker.Publish(events.Updated(sensor("Sensor2", "indoor"), sensor("Sensor2", "indoor")))
+	broker.Publish(events.Updated(sensor("Sensor1", "outdoor"), sensor("Sensor1")))
+	broker.Publish(events.Deleted(sensor("Sensor1")))
+	broker.Publish(events.Deleted(sensor("Sensor3", "outdoor")))
+	rec.wait(t)
+	rec.wait(t)
+	time.Sleep(20 * time.Millisecond)
+	var ids []uint64
+	for _, body := range rec.bodies {
+		var event events.Event
+		assert.NoError(t, json.Unmarshal(body, &event))
+		ids = append(ids, event.ID)
+	}
+	assert.ElementsMatch(t, []uint64{3, 5}, ids)
+}
+
+func TestRetryAndDeadLetters(t *testing.T) {
+	d, broker := newTestDispatcher(t)
+
+	// Test a delivery is retried until it succeeds
+	rec, server := newReceiver(t, 2)
+	_, _, err := d.AddWebhook(Webhook{URL: server.URL})
+	assert.NoError(t, err)
+	broker.Publish(events.Created(sensor("Sensor1")))
+	rec.wait(t)
+	deadLetters, _, err := d.GetDeadLetters()
+	assert.NoError(t, err)
+	assert.Empty(t, deadLetters)
+
+	// Test a delivery that fails every attempt is dead-lettered
+	rec.mu.Lock()
+	rec.failures = 3
+	rec.mu.Unlock()
+	broker.Publish(events.Deleted(sensor("Sensor1")))
+	assert.Eventually(t, func() bool {
+		deadLetters, _, _ = d.GetDeadLetters()
+		return len(deadLetters) == 1
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, 3, deadLetters[0].Attempts)
+	assert.Equal(t, "webhook responded with 503 Service Unavailable", deadLetters[0].Error)
+	assert.Equal(t, uint64(2), deadLetters[0].Event.ID)
+
+	// Test replaying a dead letter delivers it again
+	code, err := d.ReplayDeadLetter(deadLetters[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, code)
+	rec.wait(t)
+	assert.Equal(t, deadLetters[0].ID, rec.requests[1].Header.Get(HeaderDelivery))
+	deadLetters, _, err = d.GetDeadLetters()
+	assert.NoError(t, err)
+	assert.Empty(t, deadLetters)
+	code, err = d.ReplayDeadLetter("missing")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestWebhooks(t *testing.T) {
+	d, _ := newTestDispatcher(t)
+
+	// Test invalid webhooks are rejected
+	for _, hook := range []Webhook{
+		{URL: "not a url"},
+		{URL: "ftp://example.com"},
+		{URL: "/relative"},
+		{URL: "http://example.com", Events: []string{"renamed"}},
+		{URL: "http://example.com", TagExpr: "("},
+	} {
+		_, code, err := d.AddWebhook(hook)
+		assert.Error(t, err, hook)
+		assert.Equal(t, http.StatusBadRequest, code)
+	}
+
+	// Test a secret is generated if none is given, and only returned when the webhook is added
+	hook, _, err := d.AddWebhook(Webhook{URL: "http://example.com/hook", TagExpr: "outdoor and not indoor"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, hook.ID)
+	assert.Len(t, hook.Secret, 64)
+	retrieved, code, err := d.GetWebhook(hook.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, retrieved.Secret)
+	assert.Equal(t, hook.URL, retrieved.URL)
+	_, code, err = d.GetWebhook("missing")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	second, _, err := d.AddWebhook(Webhook{URL: "https://example.com/other"})
+	assert.NoError(t, err)
+	hooks, _, err := d.GetWebhooks()
+	assert.NoError(t, err)
+	assert.Len(t, hooks, 2)
+	assert.Equal(t, hook.ID, hooks[0].ID)
+	assert.Equal(t, second.ID, hooks[1].ID)
+	assert.Empty(t, hooks[0].Secret)
+}